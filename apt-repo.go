@@ -0,0 +1,338 @@
+// SPDX-License-Identifier: BSD-3-Clause
+// Copyright (c) 2020-2021, Ctrl IQ, Inc. All rights reserved
+
+package gobuild
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/clearsign"
+)
+
+// AptRepoOptions configures the repository written by CreateAptRepo.
+type AptRepoOptions struct {
+	Suite       string // suite, or distribution, of the packages (for example, stable or jammy)
+	Origin      string // if set, the Origin field of the Release file
+	Label       string // if set, the Label field of the Release file
+	Description string // if set, the Description field of the Release file
+
+	// SigningKey, if set, is used to sign the Release file, in InRelease and Release.gpg. Its
+	// private key must already be decrypted.
+	SigningKey *openpgp.Entity
+}
+
+// CreateAptRepo writes the indexes of an APT repository of the Debian packages in dir and its
+// subdirectories to dir/dists/<suite>, replacing any indexes of the suite already there. The suite
+// defaults to stable. Packages in dir/pool/<component> belong to that component, and other packages
+// belong to main, so that dir can use the pool layout of Debian archives. Packages for all
+// architectures are listed in the index of each architecture. If the SOURCE_DATE_EPOCH environment
+// variable is set, it is used as the date of the Release file.
+func CreateAptRepo(dir string, opts AptRepoOptions) error {
+	suite := opts.Suite
+	if suite == "" {
+		suite = "stable"
+	}
+
+	now, ok, err := sourceDateEpoch()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		now = time.Now()
+	}
+
+	// Read the control file of each package, grouped by component.
+	components := make(map[string][]*aptPackage)
+	err = filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() && p == filepath.Join(dir, "dists") {
+			return filepath.SkipDir
+		}
+		if !fi.Mode().IsRegular() || !strings.HasSuffix(p, ".deb") {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		pkg, err := readAptPackage(p, rel)
+		if err != nil {
+			return fmt.Errorf("while reading %s: %s", p, err)
+		}
+
+		component := "main"
+		if parts := strings.Split(rel, "/"); len(parts) > 2 && parts[0] == "pool" {
+			component = parts[1]
+		}
+		components[component] = append(components[component], pkg)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var names []string
+	archSet := make(map[string]bool)
+	for name, pkgs := range components {
+		names = append(names, name)
+		sort.Slice(pkgs, func(i, j int) bool { return pkgs[i].filename < pkgs[j].filename })
+		for _, pkg := range pkgs {
+			if pkg.arch != "all" {
+				archSet[pkg.arch] = true
+			}
+		}
+	}
+	sort.Strings(names)
+
+	var archs []string
+	for a := range archSet {
+		archs = append(archs, a)
+	}
+	sort.Strings(archs)
+	if len(archs) == 0 {
+		archs = []string{"all"}
+	}
+
+	// Write the indexes to a new directory, and then replace the old one with it, so that the
+	// repository is never left with partial indexes.
+	suiteDir := filepath.Join(dir, "dists", suite)
+	tmp := filepath.Join(dir, "dists", "."+suite)
+	if err := os.RemoveAll(tmp); err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	var indexes []memSource
+	for _, name := range names {
+		for _, arch := range archs {
+			var b bytes.Buffer
+			for _, pkg := range components[name] {
+				if pkg.arch == arch || pkg.arch == "all" {
+					b.Write(pkg.paragraph)
+					b.WriteByte('\n')
+				}
+			}
+
+			var gz bytes.Buffer
+			w := gzip.NewWriter(&gz)
+			w.Write(b.Bytes())
+			if err := w.Close(); err != nil {
+				return fmt.Errorf("while compressing index: %s", err)
+			}
+
+			p := path.Join(name, "binary-"+arch, "Packages")
+			indexes = append(indexes,
+				memSource{name: p, content: b.Bytes()},
+				memSource{name: p + ".gz", content: gz.Bytes()})
+		}
+	}
+
+	release := aptRelease(suite, names, archs, indexes, now, opts)
+	files := append(indexes, memSource{name: "Release", content: release})
+
+	if opts.SigningKey != nil {
+		if opts.SigningKey.PrivateKey == nil || opts.SigningKey.PrivateKey.Encrypted {
+			return fmt.Errorf("private key must be decrypted for signing")
+		}
+
+		var inRelease bytes.Buffer
+		w, err := clearsign.Encode(&inRelease, opts.SigningKey.PrivateKey, nil)
+		if err != nil {
+			return fmt.Errorf("while signing Release: %s", err)
+		}
+		w.Write(release)
+		if err := w.Close(); err != nil {
+			return fmt.Errorf("while signing Release: %s", err)
+		}
+
+		var sig bytes.Buffer
+		ds, err := newDetachedSigner(opts.SigningKey)
+		if err != nil {
+			return err
+		}
+		ds.Write(release)
+		if err := ds.writeSignature(&sig); err != nil {
+			return err
+		}
+
+		files = append(files,
+			memSource{name: "InRelease", content: inRelease.Bytes()},
+			memSource{name: "Release.gpg", content: sig.Bytes()})
+	}
+
+	for _, f := range files {
+		p := filepath.Join(tmp, filepath.FromSlash(f.name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			return fmt.Errorf("while creating %s: %s", filepath.Dir(p), err)
+		}
+		if err := ioutil.WriteFile(p, f.content, 0644); err != nil {
+			return fmt.Errorf("while writing %s: %s", p, err)
+		}
+	}
+
+	if err := os.RemoveAll(suiteDir); err != nil {
+		return fmt.Errorf("while removing %s: %s", suiteDir, err)
+	}
+	if err := os.Rename(tmp, suiteDir); err != nil {
+		return fmt.Errorf("while renaming %s: %s", tmp, err)
+	}
+	return nil
+}
+
+// aptRelease returns the Release file of suite, listing the checksums of indexes.
+func aptRelease(suite string, components, archs []string, indexes []memSource, date time.Time, opts AptRepoOptions) []byte {
+	var b bytes.Buffer
+	for _, f := range []struct{ name, value string }{
+		{"Origin", opts.Origin},
+		{"Label", opts.Label},
+		{"Suite", suite},
+		{"Codename", suite},
+		{"Date", date.UTC().Format("Mon, 02 Jan 2006 15:04:05 UTC")},
+		{"Architectures", strings.Join(archs, " ")},
+		{"Components", strings.Join(components, " ")},
+		{"Description", opts.Description},
+	} {
+		if f.value != "" {
+			fmt.Fprintf(&b, "%s: %s\n", f.name, f.value)
+		}
+	}
+
+	fmt.Fprintf(&b, "MD5Sum:\n")
+	for _, f := range indexes {
+		fmt.Fprintf(&b, " %x %d %s\n", md5.Sum(f.content), len(f.content), f.name)
+	}
+	fmt.Fprintf(&b, "SHA1:\n")
+	for _, f := range indexes {
+		fmt.Fprintf(&b, " %x %d %s\n", sha1.Sum(f.content), len(f.content), f.name)
+	}
+	fmt.Fprintf(&b, "SHA256:\n")
+	for _, f := range indexes {
+		fmt.Fprintf(&b, " %x %d %s\n", sha256.Sum256(f.content), len(f.content), f.name)
+	}
+	return b.Bytes()
+}
+
+// aptPackage is a package in an APT repository.
+type aptPackage struct {
+	filename  string // path of the package, relative to the root of the repository
+	arch      string // architecture of the package
+	paragraph []byte // paragraph of the package in Packages indexes
+}
+
+// readAptPackage returns the package at p, whose path relative to the root of the repository is
+// filename.
+func readAptPackage(p, filename string) (*aptPackage, error) {
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+
+	control, err := debControl(b)
+	if err != nil {
+		return nil, err
+	}
+	paragraphs, err := parseDeb822(control)
+	if err != nil {
+		return nil, fmt.Errorf("while parsing control file: %s", err)
+	}
+	if len(paragraphs) != 1 || paragraphs[0]["package"] == "" || paragraphs[0]["architecture"] == "" {
+		return nil, fmt.Errorf("control file must have one paragraph with Package and Architecture")
+	}
+
+	var paragraph bytes.Buffer
+	paragraph.Write(bytes.TrimRight(control, "\n"))
+	fmt.Fprintf(&paragraph, "\nFilename: %s\nSize: %d\nMD5sum: %x\nSHA1: %x\nSHA256: %x\n",
+		filename, len(b), md5.Sum(b), sha1.Sum(b), sha256.Sum256(b))
+
+	return &aptPackage{
+		filename:  filename,
+		arch:      paragraphs[0]["architecture"],
+		paragraph: paragraph.Bytes(),
+	}, nil
+}
+
+// debControl returns the control file of the Debian package b.
+func debControl(b []byte) ([]byte, error) {
+	const magic = "!<arch>\n"
+	if !bytes.HasPrefix(b, []byte(magic)) {
+		return nil, fmt.Errorf("not a Debian package")
+	}
+
+	// The package is an ar archive, in which each member has a 60 byte header and is padded to an
+	// even size.
+	for off := len(magic); off+60 <= len(b); {
+		hdr := b[off : off+60]
+		name := strings.TrimSuffix(strings.TrimSpace(string(hdr[:16])), "/")
+		size, err := strconv.Atoi(strings.TrimSpace(string(hdr[48:58])))
+		if err != nil || size < 0 || off+60+size > len(b) {
+			return nil, fmt.Errorf("bad ar member header")
+		}
+		data := b[off+60 : off+60+size]
+		off += 60 + size + size%2
+
+		if !strings.HasPrefix(name, "control.tar") {
+			continue
+		}
+
+		var r io.Reader = bytes.NewReader(data)
+		switch path.Ext(name) {
+		case ".gz":
+			if r, err = gzip.NewReader(r); err != nil {
+				return nil, err
+			}
+		case ".xz":
+			if r, err = xz.NewReader(r); err != nil {
+				return nil, err
+			}
+		case ".zst":
+			d, err := zstd.NewReader(r)
+			if err != nil {
+				return nil, err
+			}
+			defer d.Close()
+			r = d
+		case ".tar":
+		default:
+			return nil, fmt.Errorf("unsupported compression of %s", name)
+		}
+
+		tr := tar.NewReader(bufio.NewReader(r))
+		for {
+			h, err := tr.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return nil, fmt.Errorf("while reading %s: %s", name, err)
+			}
+			if path.Clean(h.Name) == "control" {
+				return ioutil.ReadAll(tr)
+			}
+		}
+		return nil, fmt.Errorf("%s has no control file", name)
+	}
+	return nil, fmt.Errorf("no control archive")
+}
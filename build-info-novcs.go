@@ -0,0 +1,23 @@
+// SPDX-License-Identifier: BSD-3-Clause
+// Copyright (c) 2020-2021, Ctrl IQ, Inc. All rights reserved
+
+//go:build !go1.18
+// +build !go1.18
+
+package gobuild
+
+import (
+	"errors"
+	"runtime/debug"
+)
+
+// vcsSettings returns no settings, as VCS information is only recorded by Go 1.18 and later.
+func vcsSettings(bi *debug.BuildInfo) map[string]string {
+	return nil
+}
+
+// readBuildInfoFile returns an error, as the build information of binaries can only be read by Go
+// 1.18 and later.
+func readBuildInfoFile(path string) (*debug.BuildInfo, error) {
+	return nil, errors.New("reading build information requires Go 1.18 or later")
+}
@@ -0,0 +1,29 @@
+// SPDX-License-Identifier: BSD-3-Clause
+// Copyright (c) 2020-2021, Ctrl IQ, Inc. All rights reserved
+
+//go:build go1.18
+// +build go1.18
+
+package gobuild
+
+import (
+	"debug/buildinfo"
+	"runtime/debug"
+	"strings"
+)
+
+// vcsSettings returns the VCS settings of bi, such as vcs.revision, by key.
+func vcsSettings(bi *debug.BuildInfo) map[string]string {
+	settings := make(map[string]string)
+	for _, s := range bi.Settings {
+		if s.Key == "vcs" || strings.HasPrefix(s.Key, "vcs.") {
+			settings[s.Key] = s.Value
+		}
+	}
+	return settings
+}
+
+// readBuildInfoFile returns the build information embedded in the binary at path.
+func readBuildInfoFile(path string) (*debug.BuildInfo, error) {
+	return buildinfo.ReadFile(path)
+}
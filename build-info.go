@@ -0,0 +1,93 @@
+// SPDX-License-Identifier: BSD-3-Clause
+// Copyright (c) 2020-2021, Ctrl IQ, Inc. All rights reserved
+
+package gobuild
+
+import (
+	"fmt"
+	"os/user"
+	"runtime/debug"
+	"strings"
+
+	"github.com/blang/semver"
+)
+
+// BuildInfoBinary, if set, is the path of a binary built by the go command, such as an earlier
+// build of the artifact, whose embedded build information is used by CurrentVersion,
+// RunBuildVersioned and NewVersionInfo when there is no git repository to describe, such as in a
+// tree exported without its .git directory. It is not used by default. Reading the build
+// information of a binary requires Go 1.18 or later.
+var BuildInfoBinary string
+
+// BuildInfoVersion returns a VersionInfo read from the build information embedded in the running
+// binary by the go command, such as for a program to report its own version when it was built
+// without a VersionInfo. It describes the running binary, not the tree it is run in, so it is not
+// a substitute for NewVersionInfo. If the binary has no build information, or neither a module
+// version nor a VCS revision, ok is false.
+//
+// The version is that of the main module, if it is a semantic version, such as when the binary
+// was installed with go install <package>@<version>. Otherwise, it is UntaggedVersion with the
+// abbreviated VCS revision as build metadata, such as 0.0.0-devel+g1a2b3c4. The VCS revision,
+// time and tree state are only recorded by Go 1.18 and later.
+func BuildInfoVersion() (vi *VersionInfo, ok bool) {
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return nil, false
+	}
+	return buildInfoVersion(bi)
+}
+
+// BinaryVersionInfo returns a VersionInfo read from the build information embedded in the binary
+// at path by the go command, in the same way as BuildInfoVersion. An error is returned if the
+// binary has no build information, or neither a module version nor a VCS revision.
+func BinaryVersionInfo(path string) (*VersionInfo, error) {
+	bi, err := readBuildInfoFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("while reading build information of %s: %s", path, err)
+	}
+	vi, ok := buildInfoVersion(bi)
+	if !ok {
+		return nil, fmt.Errorf("build information of %s has no version or VCS revision", path)
+	}
+	return vi, nil
+}
+
+// buildInfoVersion returns a VersionInfo read from bi, as described by BuildInfoVersion.
+func buildInfoVersion(bi *debug.BuildInfo) (vi *VersionInfo, ok bool) {
+	vcs := vcsSettings(bi)
+	vi = &VersionInfo{
+		Commit: vcs["vcs.revision"],
+		Date:   vcs["vcs.time"],
+	}
+	switch vcs["vcs.modified"] {
+	case "true":
+		vi.TreeState = "dirty"
+	case "false":
+		vi.TreeState = "clean"
+	}
+
+	if v, err := semver.Parse(strings.TrimPrefix(bi.Main.Version, "v")); err == nil {
+		vi.Version = v.String()
+	} else if v, err := semver.Parse(UntaggedVersion); err == nil && vi.Commit != "" {
+		v.Build = append(v.Build, "g"+abbrevHash(vi.Commit))
+		if vi.TreeState == "dirty" {
+			v.Build = append(v.Build, "dirty")
+		}
+		vi.Version = v.String()
+	} else {
+		return nil, false
+	}
+
+	if u, err := user.Current(); err == nil {
+		vi.Builder = u.Username
+	}
+	return vi, true
+}
+
+// abbrevHash returns the first 7 characters of the commit hash h.
+func abbrevHash(h string) string {
+	if len(h) > 7 {
+		return h[:7]
+	}
+	return h
+}
@@ -0,0 +1,62 @@
+// SPDX-License-Identifier: BSD-3-Clause
+// Copyright (c) 2020-2021, Ctrl IQ, Inc. All rights reserved
+
+package gobuild
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-git/go-git/v5"
+)
+
+func TestBuildInfoBinary(t *testing.T) {
+	if os.Getenv(VersionEnv) != "" || VersionOverride != "" {
+		t.Skip("the version is overridden")
+	}
+	dir := initMainModule(t)
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	runGit(t, dir, "init", "--quiet")
+	runGit(t, dir, "add", ".")
+	runGit(t, dir, "commit", "--quiet", "-m", "hello")
+	runGit(t, dir, "tag", "v1.2.3")
+	head := runGit(t, dir, "rev-parse", "HEAD")
+
+	bin := filepath.Join(tempDir(t), "hello")
+	if err := RunBuild("-buildvcs=true", "-o", bin, "."); err != nil {
+		t.Fatal(err)
+	}
+
+	// Outside of a git repository, the version is only read from the binary if it is set.
+	chdir(t, tempDir(t))
+	ResetGitDescribeCache()
+	if _, err := NewVersionInfo(); err != git.ErrRepositoryNotExists {
+		t.Fatalf("got error %v, want %v", err, git.ErrRepositoryNotExists)
+	}
+
+	BuildInfoBinary = bin
+	t.Cleanup(func() { BuildInfoBinary = "" })
+	vi, err := NewVersionInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The go command records the tag as the version of the main module since Go 1.24.
+	if vi.Version != "1.2.3" && vi.Version != "0.0.0-devel+g"+head[:7] {
+		t.Errorf("got version %s", vi.Version)
+	}
+	if vi.Commit != head || vi.TreeState != "clean" || vi.Date == "" {
+		t.Errorf("got commit %s, tree state %s and date %q, want %s, clean and the commit date", vi.Commit, vi.TreeState, vi.Date, head)
+	}
+	if v, err := CurrentVersion(); err != nil || v != vi.Version {
+		t.Errorf("got current version %s (%v), want %s", v, err, vi.Version)
+	}
+
+	BuildInfoBinary = filepath.Join(tempDir(t), "absent")
+	if _, err := CurrentVersion(); err == nil {
+		t.Error("absent binary: no error")
+	}
+}
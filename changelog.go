@@ -0,0 +1,288 @@
+// SPDX-License-Identifier: BSD-3-Clause
+// Copyright (c) 2020-2021, Ctrl IQ, Inc. All rights reserved
+
+package gobuild
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing/object/commitgraph"
+	"github.com/goreleaser/chglog"
+	"gopkg.in/yaml.v2"
+)
+
+// ChangelogEntry is an entry in the changelog of a package.
+type ChangelogEntry struct {
+	Version  string    // version the entry describes
+	Date     time.Time // date of the release
+	Packager string    // name and email address of the packager (defaults to the maintainer)
+	Changes  []string  // descriptions of each change
+}
+
+// writeChangelog writes entries to a temporary file in the changelog format read by nfpm, and
+// returns its path. The caller is responsible for removing the file.
+func writeChangelog(entries []ChangelogEntry, maintainer string) (string, error) {
+	cl := make(chglog.ChangeLogEntries, 0, len(entries))
+	for _, e := range entries {
+		c := &chglog.ChangeLog{
+			ChangeLogOverridables: chglog.ChangeLogOverridables{
+				Deb: &chglog.ChangelogDeb{Urgency: "low", Distributions: []string{"stable"}},
+			},
+			Semver:   e.Version,
+			Date:     e.Date,
+			Packager: e.Packager,
+		}
+		if c.Packager == "" {
+			c.Packager = maintainer
+		}
+		for _, note := range e.Changes {
+			c.Changes = append(c.Changes, &chglog.ChangeLogChange{Note: note})
+		}
+		cl = append(cl, c)
+	}
+
+	b, err := yaml.Marshal(cl)
+	if err != nil {
+		return "", fmt.Errorf("while encoding changelog: %s", err)
+	}
+
+	f, err := ioutil.TempFile("", "changelog-*.yaml")
+	if err != nil {
+		return "", fmt.Errorf("while creating changelog: %s", err)
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", fmt.Errorf("while writing changelog: %s", err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return "", fmt.Errorf("while writing changelog: %s", err)
+	}
+	return f.Name(), nil
+}
+
+// Changelog is the history of a release: the commits between the previous semver tag and the
+// described commit.
+type Changelog struct {
+	Version     string            // version of the release
+	PreviousTag string            // name of the previous semver tag, or empty if there is none
+	Date        time.Time         // committer date of the release commit
+	Commits     []ChangelogCommit // commits since the previous tag, newest first
+}
+
+// ChangelogCommit is a commit in a Changelog. If the commit message follows the conventional
+// commits specification (for example, "feat(api)!: remove v1 endpoints"), its type, scope and
+// breaking marker are parsed from the subject.
+type ChangelogCommit struct {
+	Hash     string // commit hash
+	Author   string // name of the author
+	Type     string // conventional commit type (for example, feat or fix), or empty
+	Scope    string // conventional commit scope, or empty
+	Breaking bool   // if true, the commit is marked as a breaking change
+	Subject  string // first line of the commit message, without the type and scope
+}
+
+// conventionalCommitRE matches the subject of a conventional commit.
+var conventionalCommitRE = regexp.MustCompile(`^(\w+)(?:\(([^)]*)\))?(!)?: +(.+)$`)
+
+// newChangelogCommit returns a ChangelogCommit for the commit with the given hash, author and
+// message.
+func newChangelogCommit(hash, author, message string) ChangelogCommit {
+	lines := strings.SplitN(strings.TrimSpace(message), "\n", 2)
+	c := ChangelogCommit{Hash: hash, Author: author, Subject: strings.TrimSpace(lines[0])}
+
+	if m := conventionalCommitRE.FindStringSubmatch(c.Subject); m != nil {
+		c.Type = strings.ToLower(m[1])
+		c.Scope = m[2]
+		c.Breaking = m[3] == "!"
+		c.Subject = m[4]
+	}
+	if len(lines) > 1 && strings.Contains(lines[1], "BREAKING CHANGE:") {
+		c.Breaking = true
+	}
+	return c
+}
+
+// String returns a one-line description of c, such as "api: remove v1 endpoints".
+func (c ChangelogCommit) String() string {
+	if c.Scope != "" {
+		return c.Scope + ": " + c.Subject
+	}
+	return c.Subject
+}
+
+// changelogGroups lists the sections of a Markdown changelog, in order, and the conventional
+// commit types in each. Commits with other types are listed under Other Changes.
+var changelogGroups = []struct {
+	title string
+	types []string
+}{
+	{"Features", []string{"feat"}},
+	{"Bug Fixes", []string{"fix"}},
+	{"Performance Improvements", []string{"perf"}},
+}
+
+// GenerateChangelog returns the Changelog of HEAD in the git repository containing the current
+// working directory.
+func GenerateChangelog() (*Changelog, error) {
+	return GenerateChangelogAt(".", DescribeOptions{TagPrefix: DefaultTagPrefix})
+}
+
+// GenerateChangelogAt returns the Changelog of HEAD in the git repository containing path, using
+// opts to select tags. If HEAD is tagged, the changelog covers the commits since the tag before
+// it, so that it describes that release. Merge commits are omitted.
+func GenerateChangelogAt(path string, opts DescribeOptions) (*Changelog, error) {
+	gd, err := GitDescribeWithOptions(path, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	v, err := describedVersion(gd)
+	if err != nil {
+		return nil, err
+	}
+
+	repo, err := openRepo(path)
+	if err != nil {
+		return nil, err
+	}
+
+	tags, err := getVersionTags(repo, opts.TagPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("version tag: %s", err)
+	}
+
+	head, err := repo.CommitObject(gd.Ref())
+	if err != nil {
+		return nil, fmt.Errorf("while reading commit %s: %s", gd.Ref(), err)
+	}
+
+	cl := &Changelog{Version: v, Date: head.Committer.When}
+	prev, err := walkToTag(repo, gd.Ref(), tags, true, func(n commitgraph.CommitNode) error {
+		if n.NumParents() > 1 {
+			return nil
+		}
+		c, err := n.Commit()
+		if err != nil {
+			return fmt.Errorf("while reading commit %s: %s", n.ID(), err)
+		}
+		cl.Commits = append(cl.Commits, newChangelogCommit(c.Hash.String(), c.Author.Name, c.Message))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if prev != nil {
+		cl.PreviousTag = prev.name
+	}
+
+	return cl, nil
+}
+
+// Changes returns a one-line description of each commit in cl, with breaking changes first, for
+// use in package changelogs.
+func (cl *Changelog) Changes() []string {
+	var breaking, other []string
+	for _, c := range cl.Commits {
+		if c.Breaking {
+			breaking = append(breaking, "BREAKING: "+c.String())
+		} else {
+			other = append(other, c.String())
+		}
+	}
+	return append(breaking, other...)
+}
+
+// Entry returns cl as a ChangelogEntry, for use in PackageOptions.ChangelogEntries or
+// Package.SetChangelog.
+func (cl *Changelog) Entry() ChangelogEntry {
+	return ChangelogEntry{Version: cl.Version, Date: cl.Date, Changes: cl.Changes()}
+}
+
+// WriteMarkdown writes cl to w as Markdown, grouping conventional commits by type.
+func (cl *Changelog) WriteMarkdown(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "## %s (%s)\n", cl.Version, cl.Date.Format("2006-01-02"))
+
+	section := func(title string, commits []ChangelogCommit) {
+		if len(commits) == 0 {
+			return
+		}
+		fmt.Fprintf(bw, "\n### %s\n\n", title)
+		for _, c := range commits {
+			if c.Scope != "" {
+				fmt.Fprintf(bw, "- **%s:** %s (%s)\n", c.Scope, c.Subject, c.Hash[:7])
+			} else {
+				fmt.Fprintf(bw, "- %s (%s)\n", c.Subject, c.Hash[:7])
+			}
+		}
+	}
+
+	var breaking []ChangelogCommit
+	grouped := make([][]ChangelogCommit, len(changelogGroups)+1)
+	for _, c := range cl.Commits {
+		if c.Breaking {
+			breaking = append(breaking, c)
+			continue
+		}
+		i := len(changelogGroups)
+		for j, g := range changelogGroups {
+			for _, t := range g.types {
+				if c.Type == t {
+					i = j
+				}
+			}
+		}
+		grouped[i] = append(grouped[i], c)
+	}
+
+	section("Breaking Changes", breaking)
+	for i, g := range changelogGroups {
+		section(g.title, grouped[i])
+	}
+	section("Other Changes", grouped[len(changelogGroups)])
+
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("while writing changelog: %s", err)
+	}
+	return nil
+}
+
+// WriteDebian writes cl to w as an entry in the format of debian/changelog, for the source package
+// named pkg. The maintainer must be a name and email address, such as "Jane Doe <jane@example.com>".
+func (cl *Changelog) WriteDebian(w io.Writer, pkg, maintainer string) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "%s (%s) stable; urgency=low\n\n", pkg, cl.Version)
+	for _, c := range cl.Changes() {
+		fmt.Fprintf(bw, "  * %s\n", c)
+	}
+	fmt.Fprintf(bw, "\n -- %s  %s\n", maintainer, cl.Date.Format("Mon, 02 Jan 2006 15:04:05 -0700"))
+
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("while writing changelog: %s", err)
+	}
+	return nil
+}
+
+// WriteRPM writes cl to w as an entry in the %changelog section of an RPM spec file. The
+// maintainer must be a name and email address, such as "Jane Doe <jane@example.com>".
+func (cl *Changelog) WriteRPM(w io.Writer, maintainer string) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "* %s %s - %s\n", cl.Date.Format("Mon Jan 02 2006"), maintainer, cl.Version)
+	for _, c := range cl.Changes() {
+		fmt.Fprintf(bw, "- %s\n", c)
+	}
+
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("while writing changelog: %s", err)
+	}
+	return nil
+}
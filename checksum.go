@@ -0,0 +1,132 @@
+// SPDX-License-Identifier: BSD-3-Clause
+// Copyright (c) 2020-2021, Ctrl IQ, Inc. All rights reserved
+
+package gobuild
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ChecksumAlgorithm is a hash algorithm used for checksum files.
+type ChecksumAlgorithm uint8
+
+const (
+	SHA256 ChecksumAlgorithm = iota // SHA-256, as written by sha256sum
+	SHA512                          // SHA-512, as written by sha512sum
+)
+
+// newHash returns a new hash.Hash for alg.
+func (alg ChecksumAlgorithm) newHash() (hash.Hash, error) {
+	switch alg {
+	case SHA256:
+		return sha256.New(), nil
+	case SHA512:
+		return sha512.New(), nil
+	}
+	return nil, fmt.Errorf("unknown checksum algorithm: %d", alg)
+}
+
+// WriteChecksums writes the SHA-256 checksum of each of files to w, in the format used by
+// sha256sum (a SHA256SUMS file). Lines are sorted by file name, and only the base name of each
+// file is written.
+func WriteChecksums(w io.Writer, files []string) error {
+	return WriteChecksumsWith(w, SHA256, files)
+}
+
+// WriteChecksumsWith writes the checksum of each of files to w using alg, in the same way as
+// WriteChecksums.
+func WriteChecksumsWith(w io.Writer, alg ChecksumAlgorithm, files []string) error {
+	sorted := make([]string, len(files))
+	copy(sorted, files)
+	sort.Slice(sorted, func(i, j int) bool {
+		return filepath.Base(sorted[i]) < filepath.Base(sorted[j])
+	})
+
+	for _, path := range sorted {
+		sum, err := fileChecksum(path, alg)
+		if err != nil {
+			return err
+		}
+
+		if _, err := fmt.Fprintf(w, "%s  %s\n", sum, filepath.Base(path)); err != nil {
+			return fmt.Errorf("while writing checksum for %s: %s", path, err)
+		}
+	}
+
+	return nil
+}
+
+// WriteChecksumsFor writes the SHA-256 checksums of the files in dir matching glob to w, in the
+// same way as WriteChecksums.
+func WriteChecksumsFor(w io.Writer, dir string, glob string) error {
+	files, err := filepath.Glob(filepath.Join(dir, glob))
+	if err != nil {
+		return fmt.Errorf("while matching %s in %s: %s", glob, dir, err)
+	}
+	return WriteChecksums(w, files)
+}
+
+// VerifyChecksums reads a checksum file written by WriteChecksumsWith (or sha256sum or sha512sum)
+// from r, and checks the checksum of each file it lists, relative to dir, using alg. The returned
+// error names each file that is missing or does not match.
+func VerifyChecksums(r io.Reader, dir string, alg ChecksumAlgorithm) error {
+	var failed []string
+
+	s := bufio.NewScanner(r)
+	for line := 1; s.Scan(); line++ {
+		text := s.Text()
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+
+		// Each line is the checksum, a space, and the file name, preceded by '*' in binary mode.
+		i := strings.IndexByte(text, ' ')
+		if i < 0 || i+2 > len(text) || (text[i+1] != ' ' && text[i+1] != '*') {
+			return fmt.Errorf("while parsing checksums: malformed line %d", line)
+		}
+		want, name := strings.ToLower(text[:i]), text[i+2:]
+
+		got, err := fileChecksum(filepath.Join(dir, name), alg)
+		if err != nil || got != want {
+			failed = append(failed, name)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return fmt.Errorf("while reading checksums: %s", err)
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("checksum verification failed for: %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// fileChecksum returns the hex-encoded checksum of the file at path using alg.
+func fileChecksum(path string, alg ChecksumAlgorithm) (string, error) {
+	h, err := alg.newHash()
+	if err != nil {
+		return "", err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("while opening file %s: %s", path, err)
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("while reading file %s: %s", path, err)
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,54 @@
+// SPDX-License-Identifier: BSD-3-Clause
+// Copyright (c) 2020-2021, Ctrl IQ, Inc. All rights reserved
+
+package gobuild
+
+import (
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWriteChecksums(t *testing.T) {
+	dir := tempDir(t)
+	for name, content := range map[string]string{"tool.tar.gz": "hello\n", "tool.zip": ""} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var b strings.Builder
+	if err := WriteChecksumsFor(&b, dir, "tool.*"); err != nil {
+		t.Fatal(err)
+	}
+	// Each line is the hash, two spaces and the base name, sorted by name.
+	want := "5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03  tool.tar.gz\n" +
+		"e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855  tool.zip\n"
+	if b.String() != want {
+		t.Errorf("got checksums:\n%s\nwant:\n%s", b.String(), want)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "SHA256SUMS"), []byte(b.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := VerifyChecksums(strings.NewReader(b.String()), dir, SHA256); err != nil {
+		t.Error(err)
+	}
+	if _, err := exec.LookPath("sha256sum"); err == nil {
+		cmd := exec.Command("sha256sum", "--check", "--quiet", "SHA256SUMS")
+		cmd.Dir = dir
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Errorf("sha256sum: %s: %s", err, out)
+		}
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "tool.zip"), []byte("changed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err := VerifyChecksums(strings.NewReader(b.String()), dir, SHA256)
+	if err == nil || !strings.HasSuffix(err.Error(), ": tool.zip") {
+		t.Errorf("got error %v, want failure of tool.zip", err)
+	}
+}
@@ -0,0 +1,303 @@
+// SPDX-License-Identifier: BSD-3-Clause
+// Copyright (c) 2020-2021, Ctrl IQ, Inc. All rights reserved
+
+package gobuild
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/blang/semver"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// ImageOptions configures images built by BuildImage.
+type ImageOptions struct {
+	// Base is the reference of the base image, such as gcr.io/distroless/static. If it is a
+	// multi-platform image, the image for the target is used. If Base is empty, the image is built
+	// from scratch.
+	Base string
+
+	Path   string            // path of the binary in the image; defaults to /<name of the binary>
+	Args   []string          // arguments passed to the binary after the entrypoint
+	Env    []string          // environment variables, in the form key=value
+	Labels map[string]string // labels added to the image configuration
+}
+
+// BuildImage returns an image for target, with the binary at binPath added as a layer and set as
+// the entrypoint. Base images are pulled using the credentials of the Docker configuration. If the
+// SOURCE_DATE_EPOCH environment variable is set, it is used as the creation time of the image and
+// the modification time of the binary; otherwise, the Unix epoch is used, so that the image is
+// reproducible.
+func BuildImage(binPath string, target Target, opts ImageOptions) (v1.Image, error) {
+	dst := opts.Path
+	if dst == "" {
+		dst = "/" + strings.TrimSuffix(path.Base(binPath), "_"+target.String())
+	}
+	if !path.IsAbs(dst) {
+		return nil, fmt.Errorf("image path %s must be absolute", dst)
+	}
+
+	platform := v1.Platform{OS: target.GOOS, Architecture: target.GOARCH}
+	if target.GOARM != "" {
+		platform.Variant = "v" + target.GOARM
+	}
+
+	img := empty.Image
+	if opts.Base != "" {
+		ref, err := name.ParseReference(opts.Base)
+		if err != nil {
+			return nil, fmt.Errorf("while parsing base image %s: %s", opts.Base, err)
+		}
+		img, err = remote.Image(ref, remote.WithPlatform(platform), remote.WithAuthFromKeychain(authn.DefaultKeychain))
+		if err != nil {
+			return nil, fmt.Errorf("while pulling base image %s: %s", opts.Base, err)
+		}
+	}
+
+	modTime, ok, err := sourceDateEpoch()
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		modTime = time.Unix(0, 0).UTC()
+	}
+
+	layer, err := binaryLayer(binPath, dst, modTime)
+	if err != nil {
+		return nil, err
+	}
+	img, err = mutate.AppendLayers(img, layer)
+	if err != nil {
+		return nil, fmt.Errorf("while adding binary layer: %s", err)
+	}
+
+	cf, err := img.ConfigFile()
+	if err != nil {
+		return nil, fmt.Errorf("while reading image config: %s", err)
+	}
+	cf = cf.DeepCopy()
+	cf.OS, cf.Architecture = platform.OS, platform.Architecture
+	cf.Created = v1.Time{Time: modTime}
+	cf.Config.Entrypoint = []string{dst}
+	cf.Config.Cmd = opts.Args
+	cf.Config.Env = append(cf.Config.Env, opts.Env...)
+	if len(opts.Labels) > 0 && cf.Config.Labels == nil {
+		cf.Config.Labels = make(map[string]string)
+	}
+	for k, v := range opts.Labels {
+		cf.Config.Labels[k] = v
+	}
+
+	img, err = mutate.ConfigFile(img, cf)
+	if err != nil {
+		return nil, fmt.Errorf("while setting image config: %s", err)
+	}
+	if img, err = mutate.CreatedAt(img, cf.Created); err != nil {
+		return nil, err
+	}
+	return platformImage{img, platform}, nil
+}
+
+// platformImage is an image built by BuildImage, which records its platform, as the configuration
+// of an image has no field for the variant of its architecture.
+type platformImage struct {
+	v1.Image
+	platform v1.Platform
+}
+
+// imagePlatform returns the platform of img.
+func imagePlatform(img v1.Image) (*v1.Platform, error) {
+	if pi, ok := img.(platformImage); ok {
+		return &pi.platform, nil
+	}
+
+	cf, err := img.ConfigFile()
+	if err != nil {
+		return nil, fmt.Errorf("while reading image config: %s", err)
+	}
+	return &v1.Platform{OS: cf.OS, Architecture: cf.Architecture}, nil
+}
+
+// binaryLayer returns a layer containing the binary at binPath as dst, owned by root and with the
+// given modification time.
+func binaryLayer(binPath, dst string, modTime time.Time) (v1.Layer, error) {
+	b, err := ioutil.ReadFile(binPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+
+	// Add parent directories, so that the binary does not depend on them being in the base image.
+	dirs := strings.Split(strings.Trim(path.Dir(dst), "/"), "/")
+	for i := range dirs {
+		if dirs[i] == "" {
+			continue
+		}
+		hdr := &tar.Header{
+			Typeflag: tar.TypeDir,
+			Name:     strings.Join(dirs[:i+1], "/") + "/",
+			Mode:     0755,
+			ModTime:  modTime,
+			Format:   tar.FormatPAX,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return nil, err
+		}
+	}
+
+	hdr := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     strings.TrimPrefix(dst, "/"),
+		Mode:     0755,
+		Size:     int64(len(b)),
+		ModTime:  modTime,
+		Format:   tar.FormatPAX,
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return nil, err
+	}
+	if _, err := tw.Write(b); err != nil {
+		return nil, err
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+
+	layer, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(buf.Bytes())), nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("while creating binary layer: %s", err)
+	}
+	return layer, nil
+}
+
+// ImageTags returns the tags of an image of version v: the version itself, with any build metadata
+// separated by '_' rather than '+', which tags cannot contain. For releases, which have neither a
+// pre-release nor build metadata, such as +dirty, the tags also include <major>.<minor>, <major>
+// and latest.
+func ImageTags(v semver.Version) []string {
+	tags := []string{strings.Replace(v.String(), "+", "_", 1)}
+	if len(v.Pre) == 0 && len(v.Build) == 0 {
+		tags = append(tags, fmt.Sprintf("%d.%d", v.Major, v.Minor), fmt.Sprintf("%d", v.Major), "latest")
+	}
+	return tags
+}
+
+// PushImageOptions configures images pushed by PushImageWithOptions.
+type PushImageOptions struct {
+	// Force pushes images even if HEAD is not tagged or the working tree is dirty. They are then
+	// only tagged with their version, as returned by ImageTags.
+	Force bool
+}
+
+// PushImage pushes imgs to repo (for example, ghcr.io/ctrliq/foo), tagged with ImageTags for the
+// current version, and returns the tags, in the same way as PushImageWithOptions with no options.
+func PushImage(repo string, imgs ...v1.Image) ([]string, error) {
+	return PushImageWithOptions(repo, PushImageOptions{}, imgs...)
+}
+
+// PushImageWithOptions pushes imgs to repo, tagged with ImageTags for the version set by
+// VersionOverride or VersionEnv, if any, or otherwise that of HEAD in the git repository
+// containing the current working directory, and returns the tags. See PushImageWithTags.
+//
+// If the version is not overridden, and HEAD is not tagged or the working tree is dirty, an error
+// wrapping ErrUnreleasedVersion is returned, unless opts.Force is set.
+func PushImageWithOptions(repo string, opts PushImageOptions, imgs ...v1.Image) ([]string, error) {
+	version, ok, err := versionOverride()
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		// Describe the repository afresh, so that changes since it was described are seen.
+		gd, err := GitDescribeFresh(".", DescribeOptions{TagPrefix: DefaultTagPrefix})
+		if err != nil {
+			return nil, err
+		}
+		if version, err = describedVersion(gd); err != nil {
+			return nil, err
+		}
+		if _, tagged := gd.TagName(); !opts.Force && (!tagged || gd.CommitsSinceTag() != 0 || !gd.IsClean()) {
+			return nil, fmt.Errorf("while pushing %s: %w", version, ErrUnreleasedVersion)
+		}
+	}
+	v, err := semver.Parse(version)
+	if err != nil {
+		return nil, err
+	}
+
+	tags := ImageTags(v)
+	if err := PushImageWithTags(repo, tags, imgs...); err != nil {
+		return nil, err
+	}
+	return tags, nil
+}
+
+// PushImageWithTags pushes imgs to repo with each of tags, using the credentials of the Docker
+// configuration. If more than one image is given, they are pushed as a multi-platform image index,
+// using the platform of each image.
+func PushImageWithTags(repo string, tags []string, imgs ...v1.Image) error {
+	if len(imgs) == 0 {
+		return fmt.Errorf("no images to push")
+	}
+	if len(tags) == 0 {
+		return fmt.Errorf("no tags to push")
+	}
+
+	r, err := name.NewRepository(repo)
+	if err != nil {
+		return fmt.Errorf("while parsing repository %s: %s", repo, err)
+	}
+	auth := remote.WithAuthFromKeychain(authn.DefaultKeychain)
+
+	var idx v1.ImageIndex
+	if len(imgs) > 1 {
+		// The images have Docker manifests, so use a Docker manifest list rather than an OCI index.
+		idx = mutate.IndexMediaType(empty.Index, types.DockerManifestList)
+		for _, img := range imgs {
+			platform, err := imagePlatform(img)
+			if err != nil {
+				return err
+			}
+			idx = mutate.AppendManifests(idx, mutate.IndexAddendum{
+				Add:        img,
+				Descriptor: v1.Descriptor{Platform: platform},
+			})
+		}
+	}
+
+	// Push the image under the first tag, and then add the other tags to it.
+	for i, tag := range tags {
+		t := r.Tag(tag)
+		switch {
+		case i > 0 && idx != nil:
+			err = remote.Tag(t, idx, auth)
+		case i > 0:
+			err = remote.Tag(t, imgs[0], auth)
+		case idx != nil:
+			err = remote.WriteIndex(t, idx, auth)
+		default:
+			err = remote.Write(t, imgs[0], auth)
+		}
+		if err != nil {
+			return fmt.Errorf("while pushing %s: %s", t, err)
+		}
+	}
+	return nil
+}
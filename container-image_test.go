@@ -0,0 +1,56 @@
+// SPDX-License-Identifier: BSD-3-Clause
+// Copyright (c) 2020-2021, Ctrl IQ, Inc. All rights reserved
+
+package gobuild
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/blang/semver"
+)
+
+func TestImageTags(t *testing.T) {
+	tests := []struct {
+		version string
+		want    []string
+	}{
+		{"1.2.3", []string{"1.2.3", "1.2", "1", "latest"}},
+		{"1.2.3-rc.1", []string{"1.2.3-rc.1"}},
+		{"1.2.3+dirty", []string{"1.2.3_dirty"}},
+		{"1.2.4-devel.2+dirty", []string{"1.2.4-devel.2_dirty"}},
+	}
+	for _, tt := range tests {
+		if got := ImageTags(semver.MustParse(tt.version)); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got tags %v, want %v", tt.version, got, tt.want)
+		}
+	}
+}
+
+func TestPushImageUnreleased(t *testing.T) {
+	dir := initRepo(t)
+	commitFile(t, dir, "a", "1")
+	runGit(t, dir, "tag", "v1.0.0")
+
+	chdir(t, dir)
+	if os.Getenv(VersionEnv) != "" || VersionOverride != "" {
+		t.Skip("the version is overridden")
+	}
+
+	// The tag is checked before any image is pushed, so no registry is needed.
+	if err := ioutil.WriteFile(filepath.Join(dir, "a"), []byte("2"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := PushImage("localhost/test"); !errors.Is(err, ErrUnreleasedVersion) {
+		t.Errorf("dirty working tree: got error %v, want ErrUnreleasedVersion", err)
+	}
+
+	commitFile(t, dir, "a", "2")
+	if _, err := PushImage("localhost/test"); !errors.Is(err, ErrUnreleasedVersion) {
+		t.Errorf("untagged HEAD: got error %v, want ErrUnreleasedVersion", err)
+	}
+}
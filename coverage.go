@@ -0,0 +1,140 @@
+// SPDX-License-Identifier: BSD-3-Clause
+// Copyright (c) 2020-2021, Ctrl IQ, Inc. All rights reserved
+
+package gobuild
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// coverBlock is the coverage of a block in a coverage profile.
+type coverBlock struct {
+	stmts int64 // number of statements in the block
+	count int64 // number of times the block ran, or 1 if it ran in set mode
+}
+
+// coverProfile is a coverage profile, as written by go test -coverprofile.
+type coverProfile struct {
+	mode   string
+	keys   []string               // blocks, in the form file:start,end, in the order first read
+	blocks map[string]*coverBlock // blocks by key
+}
+
+// read adds the blocks of the coverage profile at path to p. Blocks already in p, such as those
+// reported by the tests of several packages when -coverpkg is used, are merged.
+func (p *coverProfile) read(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := s.Text()
+		if strings.HasPrefix(line, "mode: ") {
+			mode := strings.TrimPrefix(line, "mode: ")
+			if p.mode != "" && p.mode != mode {
+				return fmt.Errorf("%s: cover mode %s does not match %s", path, mode, p.mode)
+			}
+			p.mode = mode
+			continue
+		}
+		if line == "" {
+			continue
+		}
+
+		// Each block is in the form file:startLine.startCol,endLine.endCol numStmts count.
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return fmt.Errorf("%s:%d: bad coverage block", path, n)
+		}
+		stmts, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("%s:%d: bad statement count: %s", path, n, err)
+		}
+		count, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return fmt.Errorf("%s:%d: bad count: %s", path, n, err)
+		}
+
+		b, ok := p.blocks[fields[0]]
+		if !ok {
+			if p.blocks == nil {
+				p.blocks = make(map[string]*coverBlock)
+			}
+			p.keys = append(p.keys, fields[0])
+			p.blocks[fields[0]] = &coverBlock{stmts: stmts, count: count}
+		} else if p.mode == "set" {
+			if count > b.count {
+				b.count = count
+			}
+		} else {
+			b.count += count
+		}
+	}
+	if err := s.Err(); err != nil {
+		return fmt.Errorf("while reading %s: %s", path, err)
+	}
+	return nil
+}
+
+// write writes p to w in the format of go test -coverprofile.
+func (p *coverProfile) write(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "mode: %s\n", p.mode)
+	for _, k := range p.keys {
+		b := p.blocks[k]
+		fmt.Fprintf(bw, "%s %d %d\n", k, b.stmts, b.count)
+	}
+	return bw.Flush()
+}
+
+// total returns the percentage of statements in p that were run.
+func (p *coverProfile) total() float64 {
+	var stmts, covered int64
+	for _, b := range p.blocks {
+		stmts += b.stmts
+		if b.count > 0 {
+			covered += b.stmts
+		}
+	}
+	if stmts == 0 {
+		return 0
+	}
+	return 100 * float64(covered) / float64(stmts)
+}
+
+// MergeCoverProfiles writes a coverage profile to w that merges the coverage profiles at paths,
+// such as those of unit and integration tests. The profiles must use the same cover mode. Blocks
+// in more than one profile are merged, by adding their counts or, in set mode, by marking them as
+// run if any profile ran them.
+func MergeCoverProfiles(w io.Writer, paths ...string) error {
+	var p coverProfile
+	for _, path := range paths {
+		if err := p.read(path); err != nil {
+			return err
+		}
+	}
+	if err := p.write(w); err != nil {
+		return fmt.Errorf("while writing coverage profile: %s", err)
+	}
+	return nil
+}
+
+// CoverProfileTotal returns the percentage of statements run in the coverage profiles at paths,
+// merged as by MergeCoverProfiles.
+func CoverProfileTotal(paths ...string) (float64, error) {
+	var p coverProfile
+	for _, path := range paths {
+		if err := p.read(path); err != nil {
+			return 0, err
+		}
+	}
+	return p.total(), nil
+}
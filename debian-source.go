@@ -0,0 +1,369 @@
+// SPDX-License-Identifier: BSD-3-Clause
+// Copyright (c) 2020-2021, Ctrl IQ, Inc. All rights reserved
+
+package gobuild
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/ulikunitz/xz"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/clearsign"
+)
+
+// DebianSourceTemplateData is the data available to Go templates in the files of the debian
+// directory passed to NewDebianSource. For example, debian/changelog.tmpl may start with
+// "{{ .Name }} ({{ .FullVersion }}) unstable; urgency=medium".
+type DebianSourceTemplateData struct {
+	Name        string // name of the source package
+	Version     string // upstream version, with the pre-release separated by ~
+	Revision    string // Debian revision
+	FullVersion string // upstream version and revision, separated by a hyphen
+	Date        string // committer date of the archived commit, in the format used by changelogs
+}
+
+// DebianSource is a Debian source package in the 3.0 (quilt) format, made of the source archive
+// of a GitArchive, as the upstream tarball, and a debian directory. It can be built with
+// dpkg-buildpackage, or uploaded to a Launchpad PPA or a repository managed by reprepro.
+type DebianSource struct {
+	// Distribution is the distribution of the changelog entry generated if the debian
+	// directory has no changelog. It defaults to unstable. Launchpad requires the name of a
+	// series, such as jammy.
+	Distribution string
+
+	// SigningKey, if set, is used to clear-sign the .dsc file, as required for uploads. Its
+	// private key must already be decrypted.
+	SigningKey *openpgp.Entity
+
+	data    DebianSourceTemplateData
+	archive *GitArchive
+	debian  []memSource // files of the debian directory, after template expansion
+}
+
+// NewDebianSource returns a DebianSource of the source package name, with the given Debian
+// revision, for the source archive created by ga. Its upstream version is that of ga. debianDir
+// must contain a control file. Files in debianDir named with the suffix .tmpl are executed as Go
+// templates with DebianSourceTemplateData, and written without the suffix; other files, such as
+// patches and rules, are written as they are. If debianDir has no changelog or source/format file,
+// they are generated.
+func NewDebianSource(name, revision, debianDir string, ga *GitArchive) (*DebianSource, error) {
+	v, err := ga.Version()
+	if err != nil {
+		return nil, fmt.Errorf("while getting version: %s", err)
+	}
+	if revision == "" {
+		revision = "1"
+	}
+
+	data := DebianSourceTemplateData{
+		Name:        name,
+		Version:     tildeVersion(v),
+		Revision:    revision,
+		FullVersion: tildeVersion(v) + "-" + revision,
+		Date:        ga.tag.commit.Committer.When.Format(time.RFC1123Z),
+	}
+
+	s := &DebianSource{data: data, archive: ga}
+	err = filepath.Walk(debianDir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil || !fi.Mode().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(debianDir, p)
+		if err != nil {
+			return err
+		}
+
+		b, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if strings.HasSuffix(name, ".tmpl") {
+			name = strings.TrimSuffix(name, ".tmpl")
+			t, err := template.New(rel).Option("missingkey=error").Parse(string(b))
+			if err != nil {
+				return fmt.Errorf("while parsing template %s: %s", rel, err)
+			}
+			var out bytes.Buffer
+			if err := t.Execute(&out, data); err != nil {
+				return fmt.Errorf("while expanding template %s: %s", rel, err)
+			}
+			b = out.Bytes()
+		}
+
+		if s.debianFile(name) != nil {
+			return fmt.Errorf("both %s and %s.tmpl exist", name, name)
+		}
+		s.debian = append(s.debian, memSource{
+			name:    name,
+			content: b,
+			mode:    normalizeMode(fi.Mode()),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("while reading debian directory %s: %s", debianDir, err)
+	}
+
+	if s.debianFile("control") == nil {
+		return nil, fmt.Errorf("debian directory %s has no control file", debianDir)
+	}
+	return s, nil
+}
+
+// debianFile returns the file at name in the debian directory, or nil if there is none.
+func (s *DebianSource) debianFile(name string) *memSource {
+	for i := range s.debian {
+		if s.debian[i].name == name {
+			return &s.debian[i]
+		}
+	}
+	return nil
+}
+
+// OrigName returns the file name of the upstream tarball.
+func (s *DebianSource) OrigName() string {
+	return fmt.Sprintf("%s_%s.orig.tar.gz", s.data.Name, s.data.Version)
+}
+
+// DebianName returns the file name of the tarball of the debian directory.
+func (s *DebianSource) DebianName() string {
+	return fmt.Sprintf("%s_%s.debian.tar.xz", s.data.Name, s.data.FullVersion)
+}
+
+// DSCName returns the file name of the .dsc file that describes the package.
+func (s *DebianSource) DSCName() string {
+	return fmt.Sprintf("%s_%s.dsc", s.data.Name, s.data.FullVersion)
+}
+
+// Create writes the upstream tarball, the tarball of the debian directory and the .dsc file to
+// dir, and returns their paths. If any cannot be written, none are left behind.
+func (s *DebianSource) Create(dir string) ([]string, error) {
+	control, err := parseDeb822(s.debianFile("control").content)
+	if err != nil {
+		return nil, fmt.Errorf("while parsing debian/control: %s", err)
+	}
+	if len(control) < 2 {
+		return nil, fmt.Errorf("debian/control must have a source paragraph and a binary paragraph")
+	}
+
+	var orig bytes.Buffer
+	if err := s.archive.Create(TgzArchive, &orig); err != nil {
+		return nil, fmt.Errorf("while creating upstream tarball: %s", err)
+	}
+
+	debian, err := s.debianTarball(control[0]["maintainer"])
+	if err != nil {
+		return nil, err
+	}
+
+	files := []memSource{
+		{name: s.OrigName(), content: orig.Bytes()},
+		{name: s.DebianName(), content: debian},
+	}
+
+	dsc := s.dsc(control)
+	var sha1s, sha256s, md5s strings.Builder
+	for _, f := range files {
+		fmt.Fprintf(&sha1s, "\n %x %d %s", sha1.Sum(f.content), len(f.content), f.name)
+		fmt.Fprintf(&sha256s, "\n %x %d %s", sha256.Sum256(f.content), len(f.content), f.name)
+		fmt.Fprintf(&md5s, "\n %x %d %s", md5.Sum(f.content), len(f.content), f.name)
+	}
+	fmt.Fprintf(dsc, "Checksums-Sha1:%s\nChecksums-Sha256:%s\nFiles:%s\n", sha1s.String(),
+		sha256s.String(), md5s.String())
+
+	dscContent := dsc.Bytes()
+	if s.SigningKey != nil {
+		if s.SigningKey.PrivateKey == nil || s.SigningKey.PrivateKey.Encrypted {
+			return nil, fmt.Errorf("private key must be decrypted for signing")
+		}
+		var signed bytes.Buffer
+		w, err := clearsign.Encode(&signed, s.SigningKey.PrivateKey, nil)
+		if err != nil {
+			return nil, fmt.Errorf("while signing %s: %s", s.DSCName(), err)
+		}
+		w.Write(dscContent)
+		if err := w.Close(); err != nil {
+			return nil, fmt.Errorf("while signing %s: %s", s.DSCName(), err)
+		}
+		dscContent = signed.Bytes()
+	}
+
+	files = append(files, memSource{name: s.DSCName(), content: dscContent})
+
+	var paths []string
+	for _, f := range files {
+		p := filepath.Join(dir, f.name)
+		if err := ioutil.WriteFile(p, f.content, 0644); err != nil {
+			for _, p := range paths {
+				os.Remove(p)
+			}
+			return nil, fmt.Errorf("while writing %s: %s", p, err)
+		}
+		paths = append(paths, p)
+	}
+	return paths, nil
+}
+
+// dsc returns the fields of the .dsc file, other than the checksums of the files, from the
+// paragraphs of debian/control.
+func (s *DebianSource) dsc(control []map[string]string) *bytes.Buffer {
+	src := control[0]
+
+	var binaries, archs []string
+	seen := make(map[string]bool)
+	for _, p := range control[1:] {
+		binaries = append(binaries, p["package"])
+		for _, a := range strings.Fields(p["architecture"]) {
+			if !seen[a] {
+				seen[a] = true
+				archs = append(archs, a)
+			}
+		}
+	}
+
+	b := &bytes.Buffer{}
+	fmt.Fprintf(b, "Format: 3.0 (quilt)\n")
+	fmt.Fprintf(b, "Source: %s\n", s.data.Name)
+	fmt.Fprintf(b, "Binary: %s\n", strings.Join(binaries, ", "))
+	fmt.Fprintf(b, "Architecture: %s\n", strings.Join(archs, " "))
+	fmt.Fprintf(b, "Version: %s\n", s.data.FullVersion)
+
+	// These fields are copied from the source paragraph, with dependencies on one line as
+	// dpkg-source writes them.
+	for _, f := range []string{"Maintainer", "Uploaders", "Homepage", "Standards-Version",
+		"Vcs-Browser", "Vcs-Git", "Testsuite", "Build-Depends", "Build-Depends-Arch",
+		"Build-Depends-Indep", "Build-Conflicts", "Build-Conflicts-Arch",
+		"Build-Conflicts-Indep"} {
+		if v := src[strings.ToLower(f)]; v != "" {
+			fmt.Fprintf(b, "%s: %s\n", f, strings.Join(strings.Fields(v), " "))
+		}
+	}
+	return b
+}
+
+// debianTarball returns the xz compressed tarball of the debian directory. A changelog entry for
+// the version by maintainer and a source/format file are added if the directory has none.
+func (s *DebianSource) debianTarball(maintainer string) ([]byte, error) {
+	mtime, err := s.archive.modTime()
+	if err != nil {
+		return nil, err
+	}
+
+	files := append([]memSource(nil), s.debian...)
+	if s.debianFile("changelog") == nil {
+		dist := s.Distribution
+		if dist == "" {
+			dist = "unstable"
+		}
+		changelog := fmt.Sprintf("%s (%s) %s; urgency=medium\n\n  * New upstream release.\n\n -- %s  %s\n",
+			s.data.Name, s.data.FullVersion, dist, maintainer, s.data.Date)
+		files = append(files, memSource{name: "changelog", content: []byte(changelog), mode: 0644})
+	}
+	if s.debianFile("source/format") == nil {
+		files = append(files, memSource{name: "source/format", content: []byte("3.0 (quilt)\n"), mode: 0644})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].name < files[j].name })
+
+	var b bytes.Buffer
+	xw, err := xz.NewWriter(&b)
+	if err != nil {
+		return nil, fmt.Errorf("while creating xz writer: %s", err)
+	}
+	tw := tar.NewWriter(xw)
+
+	dirs := map[string]bool{}
+	writeHeader := func(h *tar.Header) error {
+		h.ModTime = mtime
+		h.Uname, h.Gname = "root", "root"
+		return tw.WriteHeader(h)
+	}
+	for _, f := range files {
+		// Each directory precedes its contents.
+		var parents []string
+		for d := path.Dir(f.name); d != "."; d = path.Dir(d) {
+			parents = append([]string{d}, parents...)
+		}
+		for _, d := range append([]string{""}, parents...) {
+			if dirs[d] {
+				continue
+			}
+			dirs[d] = true
+			name := path.Join("debian", d) + "/"
+			if err := writeHeader(&tar.Header{Typeflag: tar.TypeDir, Name: name, Mode: 0755}); err != nil {
+				return nil, fmt.Errorf("while writing tar header for %s: %s", name, err)
+			}
+		}
+
+		name := path.Join("debian", f.name)
+		h := &tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: int64(f.mode.Perm()), Size: int64(len(f.content))}
+		if err := writeHeader(h); err != nil {
+			return nil, fmt.Errorf("while writing tar header for %s: %s", name, err)
+		}
+		if _, err := tw.Write(f.content); err != nil {
+			return nil, fmt.Errorf("while writing %s to tar: %s", name, err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return nil, fmt.Errorf("while finishing tar archive: %s", err)
+	}
+	if err := xw.Close(); err != nil {
+		return nil, fmt.Errorf("while finishing xz stream: %s", err)
+	}
+	return b.Bytes(), nil
+}
+
+// parseDeb822 parses the paragraphs of a control file in the deb822 format, such as debian/control.
+// Fields are keyed by their lower case names, and the lines of multi-line values are joined with
+// newlines. Comments are ignored.
+func parseDeb822(b []byte) ([]map[string]string, error) {
+	var paragraphs []map[string]string
+	var cur map[string]string
+	key := ""
+
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	for n := 1; sc.Scan(); n++ {
+		line := sc.Text()
+		switch {
+		case strings.HasPrefix(line, "#"):
+			continue
+		case strings.TrimSpace(line) == "":
+			cur, key = nil, ""
+		case line[0] == ' ' || line[0] == '\t':
+			if key == "" {
+				return nil, fmt.Errorf("line %d: continuation line without a field", n)
+			}
+			cur[key] += "\n" + strings.TrimSpace(line)
+		default:
+			i := strings.Index(line, ":")
+			if i <= 0 {
+				return nil, fmt.Errorf("line %d: expected a field", n)
+			}
+			if cur == nil {
+				cur = make(map[string]string)
+				paragraphs = append(paragraphs, cur)
+			}
+			key = strings.ToLower(line[:i])
+			cur[key] = strings.TrimSpace(line[i+1:])
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return paragraphs, nil
+}
@@ -0,0 +1,68 @@
+// SPDX-License-Identifier: BSD-3-Clause
+// Copyright (c) 2020-2021, Ctrl IQ, Inc. All rights reserved
+
+package gobuild
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNewDebianSourceTemplates(t *testing.T) {
+	dir := initRepo(t)
+	commitFile(t, dir, "README", "hello")
+	runGit(t, dir, "tag", "v1.2.3")
+	ga, err := NewGitArchiveAt(dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	debian := tempDir(t)
+	files := map[string]string{
+		"control":             "Source: tool\n",
+		"changelog.tmpl":      "{{ .Name }} ({{ .FullVersion }}) unstable; urgency=medium\n",
+		"rules":               "#!/usr/bin/make -f\n%:\n\tdh $@ --with '{{'\n",
+		"patches/fix.patch":   "+\tt := template.Must(template.New(\"\").Parse(\"{{ .X }}\"))\n",
+		"source/options.tmpl": "# {{ .Version }}\n",
+	}
+	for name, content := range files {
+		p := filepath.Join(debian, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s, err := NewDebianSource("tool", "2", debian, ga)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{
+		"control":           files["control"],
+		"changelog":         "tool (1.2.3-2) unstable; urgency=medium\n",
+		"rules":             files["rules"],
+		"patches/fix.patch": files["patches/fix.patch"],
+		"source/options":    "# 1.2.3\n",
+	} {
+		f := s.debianFile(name)
+		if f == nil {
+			t.Errorf("%s not found", name)
+		} else if string(f.content) != want {
+			t.Errorf("got %s %q, want %q", name, f.content, want)
+		}
+	}
+	if f := s.debianFile("changelog.tmpl"); f != nil {
+		t.Error("template written with its suffix")
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(debian, "changelog"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewDebianSource("tool", "2", debian, ga); err == nil {
+		t.Error("no error for both changelog and changelog.tmpl")
+	}
+}
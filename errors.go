@@ -0,0 +1,28 @@
+// SPDX-License-Identifier: BSD-3-Clause
+// Copyright (c) 2020-2021, Ctrl IQ, Inc. All rights reserved
+
+package gobuild
+
+import "errors"
+
+var (
+	// ErrNoChanges is returned when a release is made, but there are no commits since the last tag.
+	ErrNoChanges = errors.New("no commits since the last tag")
+
+	// ErrNoSemverTags is returned when no tag containing a semantic version is found.
+	ErrNoSemverTags = errors.New("no semver tags found")
+
+	// ErrTagNotHead is returned when an archive is created from HEAD, but HEAD is not tagged.
+	ErrTagNotHead = errors.New("tag must also be HEAD")
+
+	// ErrUnreleasedVersion is returned when a release is published, but HEAD is not tagged or the
+	// working tree is dirty.
+	ErrUnreleasedVersion = errors.New("version is not a release")
+
+	// ErrUnsupportedFormat is returned for an unknown package or archive format.
+	ErrUnsupportedFormat = errors.New("unsupported format")
+
+	// ErrUnsupportedArch is returned for an architecture that is unknown, or not supported by a
+	// package format.
+	ErrUnsupportedArch = errors.New("unsupported architecture")
+)
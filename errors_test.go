@@ -0,0 +1,83 @@
+// SPDX-License-Identifier: BSD-3-Clause
+// Copyright (c) 2020-2021, Ctrl IQ, Inc. All rights reserved
+
+package gobuild
+
+import (
+	"errors"
+	"io/ioutil"
+	"testing"
+)
+
+func TestSentinelErrors(t *testing.T) {
+	untagged := initRepo(t)
+	commitFile(t, untagged, "README", "hello")
+
+	dir := initRepo(t)
+	commitFile(t, dir, "README", "hello")
+	runGit(t, dir, "tag", "v1.0.0")
+	ga, err := NewGitArchiveAt(dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		fn   func() error
+		want error
+	}{
+		{
+			name: "no changes",
+			fn: func() error {
+				_, err := NextVersionAt(dir, DescribeOptions{TagPrefix: DefaultTagPrefix})
+				return err
+			},
+			want: ErrNoChanges,
+		},
+		{
+			name: "no semver tags",
+			fn: func() error {
+				_, err := NewGitArchiveAt(untagged, "")
+				return err
+			},
+			want: ErrNoSemverTags,
+		},
+		{
+			name: "tag not HEAD",
+			fn: func() error {
+				commitFile(t, dir, "README", "changed")
+				ResetGitDescribeCache()
+				_, err := NewGitArchiveAt(dir, "")
+				return err
+			},
+			want: ErrTagNotHead,
+		},
+		{
+			name: "unreleased version",
+			fn: func() error {
+				chdir(t, dir)
+				_, err := PublishGitHubRelease(nil, GitHubReleaseOptions{Owner: "ctrliq", Repo: "gobuild"})
+				return err
+			},
+			want: ErrUnreleasedVersion,
+		},
+		{
+			name: "unsupported archive format",
+			fn:   func() error { return ga.Create(ArchiveFormat(100), ioutil.Discard) },
+			want: ErrUnsupportedFormat,
+		},
+		{
+			name: "unsupported architecture",
+			fn: func() error {
+				_, err := NewTarget("linux", "sparc64")
+				return err
+			},
+			want: ErrUnsupportedArch,
+		},
+	}
+	for _, tt := range tests {
+		if err := tt.fn(); !errors.Is(err, tt.want) {
+			t.Errorf("%s: got error %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
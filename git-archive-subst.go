@@ -0,0 +1,145 @@
+// SPDX-License-Identifier: BSD-3-Clause
+// Copyright (c) 2020-2021, Ctrl IQ, Inc. All rights reserved
+
+package gobuild
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// formatRE matches the placeholders expanded in files with the export-subst attribute.
+var formatRE = regexp.MustCompile(`\$Format:([^$\n]*)\$`)
+
+// substSource is an entrySource for a file with the export-subst attribute. Its contents are those
+// of the underlying entrySource, with $Format:...$ placeholders expanded for commit.
+type substSource struct {
+	entrySource
+	commit *object.Commit
+}
+
+func (src substSource) content() ([]byte, error) {
+	r, err := src.entrySource.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return expandExportSubst(b, src.commit), nil
+}
+
+func (src substSource) Stat() (os.FileInfo, error) {
+	fi, err := src.entrySource.Stat()
+	if err != nil || !fi.Mode().IsRegular() {
+		return fi, err
+	}
+
+	b, err := src.content()
+	if err != nil {
+		return nil, err
+	}
+	return &treeEntryInfo{name: fi.Name(), size: int64(len(b)), mode: fi.Mode()}, nil
+}
+
+func (src substSource) Open() (io.ReadCloser, error) {
+	b, err := src.content()
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(b)), nil
+}
+
+// expandExportSubst replaces each $Format:...$ placeholder in b with its format expanded for c, in
+// the same way as git archive. See formatCommit for the supported format directives.
+func expandExportSubst(b []byte, c *object.Commit) []byte {
+	return formatRE.ReplaceAllFunc(b, func(m []byte) []byte {
+		return []byte(formatCommit(string(formatRE.FindSubmatch(m)[1]), c))
+	})
+}
+
+// formatCommit expands a subset of the pretty format directives supported by git log in format for
+// c: %H, %h, %T, %t, %P, %p, %an, %ae, %ad, %aD, %at, %aI, the corresponding %c directives for the
+// committer, %s, %n and %%. Other directives are left as is.
+func formatCommit(format string, c *object.Commit) string {
+	var sb strings.Builder
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' || i+1 == len(format) {
+			sb.WriteByte(format[i])
+			continue
+		}
+
+		s, n := formatDirective(format[i+1:], c)
+		if n == 0 {
+			sb.WriteByte('%')
+			continue
+		}
+		sb.WriteString(s)
+		i += n
+	}
+	return sb.String()
+}
+
+// formatDirective returns the expansion of the directive at the start of s, which follows a '%',
+// and its length. If the directive is not supported, n is zero.
+func formatDirective(s string, c *object.Commit) (string, int) {
+	switch s[0] {
+	case '%':
+		return "%", 1
+	case 'n':
+		return "\n", 1
+	case 'H':
+		return c.Hash.String(), 1
+	case 'h':
+		return c.Hash.String()[:7], 1
+	case 'T':
+		return c.TreeHash.String(), 1
+	case 't':
+		return c.TreeHash.String()[:7], 1
+	case 'P', 'p':
+		parents := make([]string, 0, len(c.ParentHashes))
+		for _, h := range c.ParentHashes {
+			if s[0] == 'p' {
+				parents = append(parents, h.String()[:7])
+			} else {
+				parents = append(parents, h.String())
+			}
+		}
+		return strings.Join(parents, " "), 1
+	case 's':
+		return strings.SplitN(strings.TrimSpace(c.Message), "\n", 2)[0], 1
+	case 'a', 'c':
+		if len(s) < 2 {
+			return "", 0
+		}
+		sig := c.Author
+		if s[0] == 'c' {
+			sig = c.Committer
+		}
+		switch s[1] {
+		case 'n':
+			return sig.Name, 2
+		case 'e':
+			return sig.Email, 2
+		case 'd':
+			return sig.When.Format("Mon Jan 2 15:04:05 2006 -0700"), 2
+		case 'D':
+			return sig.When.Format("Mon, 2 Jan 2006 15:04:05 -0700"), 2
+		case 't':
+			return strconv.FormatInt(sig.When.Unix(), 10), 2
+		case 'I':
+			return sig.When.Format("2006-01-02T15:04:05-07:00"), 2
+		}
+	}
+	return "", 0
+}
@@ -0,0 +1,140 @@
+// SPDX-License-Identifier: BSD-3-Clause
+// Copyright (c) 2020-2021, Ctrl IQ, Inc. All rights reserved
+
+package gobuild
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// ArchiveTransform returns the contents to write to an archive for a regular file with the given
+// name, relative to the root of the archive and excluding its prefix, and contents. It is called
+// by GitArchive for files from the tree, extra files and added files alike.
+type ArchiveTransform func(name string, content []byte) ([]byte, error)
+
+// placeholderRE matches placeholders of the form @KEY@ replaced by PlaceholderTransform.
+var placeholderRE = regexp.MustCompile(`@([A-Za-z_][A-Za-z0-9_]*)@`)
+
+// PlaceholderTransform returns an ArchiveTransform that replaces each placeholder of the form
+// @KEY@ with vars[KEY], in files whose names match any of patterns, in the syntax used by
+// path.Match. Patterns without a '/' are matched against base names. Placeholders of keys not in
+// vars are left as is. For example, to render the version into an RPM spec file and a PKGBUILD:
+//
+//	ga.Transforms = append(ga.Transforms,
+//		gobuild.PlaceholderTransform(map[string]string{"VERSION": v}, "*.spec", "PKGBUILD"))
+func PlaceholderTransform(vars map[string]string, patterns ...string) ArchiveTransform {
+	return func(name string, content []byte) ([]byte, error) {
+		matched, err := matchAny(name, patterns)
+		if err != nil || !matched {
+			return content, err
+		}
+
+		return placeholderRE.ReplaceAllFunc(content, func(m []byte) []byte {
+			if v, ok := vars[string(m[1:len(m)-1])]; ok {
+				return []byte(v)
+			}
+			return m
+		}), nil
+	}
+}
+
+// matchAny returns true if name matches any of patterns. Patterns without a '/' are matched
+// against the base name of name.
+func matchAny(name string, patterns []string) (bool, error) {
+	for _, pattern := range patterns {
+		s := name
+		if !strings.Contains(pattern, "/") {
+			s = path.Base(name)
+		}
+		matched, err := path.Match(pattern, s)
+		if err != nil {
+			return false, fmt.Errorf("while matching pattern %s: %s", pattern, err)
+		}
+		if matched {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// AddReader adds a regular file with the given name and permissions to archives created from ga,
+// with contents read from r, in the same way as AddFile. r is read before AddReader returns.
+func (ga *GitArchive) AddReader(name string, r io.Reader, mode os.FileMode) error {
+	if err := checkAddedName(path.Clean(filepath.ToSlash(name))); err != nil {
+		return err
+	}
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("while reading %s: %s", name, err)
+	}
+	ga.AddFile(name, b, mode)
+	return nil
+}
+
+// transformSource is an entrySource for a file written to an archive with transforms. Its contents
+// are those of the underlying entrySource, after applying each of transforms in order.
+type transformSource struct {
+	entrySource
+	name       string // name of the entry in the archive, excluding the prefix
+	transforms []ArchiveTransform
+	b          []byte // transformed contents, once read by Stat, until Open
+}
+
+func (src *transformSource) content() ([]byte, error) {
+	if src.b != nil {
+		return src.b, nil
+	}
+
+	r, err := src.entrySource.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range src.transforms {
+		if b, err = t(src.name, b); err != nil {
+			return nil, fmt.Errorf("while transforming %s: %s", src.name, err)
+		}
+	}
+	if b == nil {
+		b = []byte{}
+	}
+	src.b = b
+	return b, nil
+}
+
+func (src *transformSource) Stat() (os.FileInfo, error) {
+	fi, err := src.entrySource.Stat()
+	if err != nil || !fi.Mode().IsRegular() {
+		return fi, err
+	}
+
+	b, err := src.content()
+	if err != nil {
+		return nil, err
+	}
+	return &treeEntryInfo{name: fi.Name(), size: int64(len(b)), mode: fi.Mode()}, nil
+}
+
+func (src *transformSource) Open() (io.ReadCloser, error) {
+	b, err := src.content()
+	if err != nil {
+		return nil, err
+	}
+	// Entries are opened once, after Stat, so the contents need not be kept, and keeping them would
+	// hold the whole tree in memory until the archive is complete.
+	src.b = nil
+	return ioutil.NopCloser(bytes.NewReader(b)), nil
+}
@@ -0,0 +1,51 @@
+// SPDX-License-Identifier: BSD-3-Clause
+// Copyright (c) 2020-2021, Ctrl IQ, Inc. All rights reserved
+
+package gobuild
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+func TestTransformSourceRelease(t *testing.T) {
+	calls := 0
+	upper := func(name string, b []byte) ([]byte, error) {
+		calls++
+		return bytes.ToUpper(b), nil
+	}
+	src := &transformSource{
+		entrySource: memSource{name: "a", content: []byte("hello"), mode: 0644},
+		name:        "a",
+		transforms:  []ArchiveTransform{upper},
+	}
+
+	for i := 1; i <= 2; i++ {
+		fi, err := src.Stat()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Size() != 5 {
+			t.Errorf("got size %d, want 5", fi.Size())
+		}
+		r, err := src.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != "HELLO" {
+			t.Errorf("got contents %q, want HELLO", b)
+		}
+
+		if calls != i {
+			t.Errorf("transformed %d times after %d reads", calls, i)
+		}
+		if src.b != nil {
+			t.Error("contents kept after Open")
+		}
+	}
+}
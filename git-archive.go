@@ -6,11 +6,29 @@ package gobuild
 import (
 	"archive/tar"
 	"archive/zip"
+	"bytes"
+	"compress/flate"
 	"compress/gzip"
+	"context"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"path"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/format/gitattributes"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+	"golang.org/x/crypto/openpgp"
 )
 
 type ArchiveFormat uint8
@@ -18,83 +36,1143 @@ type ArchiveFormat uint8
 const (
 	TgzArchive ArchiveFormat = iota
 	ZipArchive
+	TxzArchive
+	ZstArchive
+	TarArchive // uncompressed tar
+
+	TzstArchive = ZstArchive // zstd compressed tar
 )
 
+// GitArchive creates archives of the tree of a git commit. Archives are always reproducible: entries
+// are sorted by name, every entry records the same modification time (see SOURCE_DATE_EPOCH and
+// the committer time of the commit), owners are root, modes are normalized as git records them,
+// and the gzip header carries the same time. Two archives of the same commit created with the
+// same options are therefore byte-identical.
 type GitArchive struct {
-	gd     *GitDescription
-	prefix string
+	// CompressionLevel is the compression level, from gzip.HuffmanOnly to gzip.BestCompression.
+	// It defaults to gzip.DefaultCompression. It applies to TgzArchive, to ZipArchive when
+	// ZipMethod is zip.Deflate, and to TxzArchive and TzstArchive, where levels 1 to 9 select
+	// the corresponding xz preset and zstd level. It is ignored for TarArchive.
+	CompressionLevel int
+
+	// ZipMethod is the compression method used for entries of a ZipArchive: zip.Deflate (the
+	// default) or zip.Store.
+	ZipMethod uint16
+
+	// Exclude is a list of patterns, in the syntax used by path.Match, of paths in the tree to
+	// leave out of the archive. Excluding a directory excludes its contents. Paths with the
+	// export-ignore attribute in .gitattributes are always excluded, and $Format:...$ placeholders
+	// in files with the export-subst attribute are expanded, as git archive does.
+	Exclude []string
+
+	// FromGitObjects causes the contents and modes of entries in the tree to be read from git
+	// objects, rather than from the working tree. This ensures the archive reflects the committed
+	// state of the tree, regardless of local modifications or the commit checked out. Extra files
+	// are always read from the file system.
+	FromGitObjects bool
+
+	// OnProgress, if non-nil, is called before each entry is written to the archive, with the
+	// name of the entry, its zero-based index, and the total number of entries.
+	OnProgress func(entry string, index, total int)
+
+	// ModeFilter, if non-nil, is called with the name and normalized mode of each entry, and
+	// returns the permission bits to record for it in the archive. The type of the entry cannot be
+	// changed.
+	ModeFilter func(path string, mode os.FileMode) os.FileMode
+
+	// Transforms are applied, in order, to the contents of each regular file written to the
+	// archive, after export-subst placeholders are expanded. See PlaceholderTransform.
+	Transforms []ArchiveTransform
+
+	// RecurseSubmodules includes the files of initialized submodules, recursively, under their
+	// paths in the tree, as git archive does with --recurse-submodules. The files are those of the
+	// commit recorded by the tree, read in the same way as other entries. Otherwise, and for
+	// submodules that are not initialized, each submodule is an empty directory.
+	RecurseSubmodules bool
+
+	// Subtree, if set, is the path of a directory in the tree to archive instead of the whole
+	// tree, for example the directory of one component of a monorepo. Entry names are relative to
+	// it. Exclude patterns and export-ignore attributes still apply to paths relative to the root.
+	Subtree string
+
+	gd        *GitDescription // description of the archived commit (nil if created for a named tag)
+	tag       *versionTag     // tag (or, for snapshots, revision) the archive is created from
+	tagPrefix string          // prefix of the semantic version in tag names
+	dir       string          // root of the working tree
+	prefix    string
+	files     []memSource // files added with AddFile
+	snapshot  bool        // if true, tree entries missing from the working tree are skipped
 }
 
+// NewGitArchive returns a GitArchive for HEAD in the git repository containing the current working
+// directory, which must be tagged with a semantic version. The names of entries in the archive are
+// prefixed with the directory prefix, which may be a Go template of ArchivePrefixData, such as
+// "{{ .Name }}-{{ .Version }}/".
 func NewGitArchive(prefix string) (*GitArchive, error) {
+	return NewGitArchiveAt(".", prefix)
+}
+
+// NewGitArchiveAt returns a GitArchive in the same way as NewGitArchive, for HEAD in the git
+// repository containing path.
+func NewGitArchiveAt(path, prefix string) (*GitArchive, error) {
+	return NewGitArchiveWithOptions(path, prefix, DescribeOptions{TagPrefix: DefaultTagPrefix})
+}
+
+// NewGitArchiveWithOptions returns a GitArchive in the same way as NewGitArchiveAt, finding the tag
+// of HEAD using opts. For example, with a TagPrefix of "component/v", HEAD must be tagged
+// component/v1.2.3.
+func NewGitArchiveWithOptions(path, prefix string, opts DescribeOptions) (*GitArchive, error) {
 	var err error
-	ga := new(GitArchive)
+	ga := &GitArchive{CompressionLevel: gzip.DefaultCompression, ZipMethod: zip.Deflate, tagPrefix: opts.TagPrefix}
 
-	ga.gd, err = GitDescribe()
+	ga.gd, err = GitDescribeWithOptions(path, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	repo, err := openRepo(path)
+	if err != nil {
+		return nil, err
+	}
+	ga.dir, err = worktreeRoot(repo)
 	if err != nil {
 		return nil, err
 	}
 
 	if ga.gd.tag == nil {
-		return nil, fmt.Errorf("no tag found to create archive from")
+		return nil, fmt.Errorf("while creating archive: %w", ErrNoSemverTags)
 	} else if ga.gd.n > 0 {
-		tagName := ga.gd.tag.Name
-		return nil, fmt.Errorf("tag %s must also be HEAD", tagName)
+		tagName := ga.gd.tag.name
+		return nil, fmt.Errorf("while using tag %s: %w", tagName, ErrTagNotHead)
+	}
+
+	ga.tag = ga.gd.tag
+	if err := ga.setPrefix(prefix); err != nil {
+		return nil, err
+	}
+	return ga, nil
+}
+
+// NewGitArchiveAuto returns a GitArchive in the same way as NewGitArchive, with a prefix of the
+// form <name>-<version>. The name is taken from the URL of the origin remote if there is one, then
+// from the module path in go.mod, and finally from the name of the repository directory. The
+// version is that of the tag, without the tag prefix.
+func NewGitArchiveAuto() (*GitArchive, error) {
+	ga, err := NewGitArchive("")
+	if err != nil {
+		return nil, err
+	}
+
+	v, err := parseTagVersion(ga.tag.name, ga.tagPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	repo, err := openRepo(ga.dir)
+	if err != nil {
+		return nil, err
+	}
+	name, err := repoName(repo)
+	if err != nil {
+		return nil, err
+	}
+
+	if ga.prefix, err = normalizeArchivePrefix(name + "-" + v.String()); err != nil {
+		return nil, err
+	}
+	return ga, nil
+}
+
+// repoName returns the name of the project in repo, derived from the URL of the origin remote, the
+// module path in go.mod, or the name of the worktree directory, in that order.
+func repoName(repo *git.Repository) (string, error) {
+	if remote, err := repo.Remote(git.DefaultRemoteName); err == nil {
+		if urls := remote.Config().URLs; len(urls) > 0 {
+			if name := urlName(urls[0]); name != "" {
+				return name, nil
+			}
+		}
+	} else if err != git.ErrRemoteNotFound {
+		return "", fmt.Errorf("while reading remote %s: %s", git.DefaultRemoteName, err)
+	}
+
+	root, err := worktreeRoot(repo)
+	if err != nil {
+		return "", err
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(root, "go.mod"))
+	if err == nil {
+		if name := modulePathName(b); name != "" {
+			return name, nil
+		}
+	} else if !os.IsNotExist(err) {
+		return "", fmt.Errorf("while reading go.mod: %s", err)
+	}
+
+	return filepath.Base(root), nil
+}
+
+// urlName returns the last path element of a remote URL, without any .git suffix. Both URLs and
+// scp-like addresses (user@host:path) are accepted.
+func urlName(url string) string {
+	url = strings.TrimRight(url, "/")
+	if i := strings.LastIndexAny(url, "/:"); i >= 0 {
+		url = url[i+1:]
 	}
+	return strings.TrimSuffix(url, ".git")
+}
+
+// modulePathName returns the last element of the module path declared in the go.mod contents b,
+// ignoring any major version suffix.
+func modulePathName(b []byte) string {
+	for _, line := range strings.Split(string(b), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != "module" {
+			continue
+		}
+
+		elems := strings.Split(strings.Trim(fields[1], "\"`"), "/")
+		name := elems[len(elems)-1]
+		if len(elems) > 1 && isMajorVersion(name) {
+			name = elems[len(elems)-2]
+		}
+		return name
+	}
+	return ""
+}
+
+// isMajorVersion returns true if s is a major version suffix of a module path, such as v2.
+func isMajorVersion(s string) bool {
+	if len(s) < 2 || s[0] != 'v' {
+		return false
+	}
+	n, err := strconv.Atoi(s[1:])
+	return err == nil && n >= 2
+}
+
+// NewGitArchiveForTag returns a GitArchive for the tree of the tag named tagName, which may be
+// either an annotated or lightweight tag. Unlike NewGitArchive, the tag need not be HEAD. If it is
+// not, the working tree does not contain the tagged files, so FromGitObjects is set. The version
+// is that of the tag name without DefaultTagPrefix; see NewGitArchiveForTagWithPrefix.
+func NewGitArchiveForTag(prefix, tagName string) (*GitArchive, error) {
+	return NewGitArchiveForTagAt(".", prefix, tagName)
+}
+
+// NewGitArchiveForTagAt returns a GitArchive in the same way as NewGitArchiveForTag, for the git
+// repository containing path.
+func NewGitArchiveForTagAt(path, prefix, tagName string) (*GitArchive, error) {
+	return NewGitArchiveForTagWithPrefix(path, prefix, tagName, DefaultTagPrefix)
+}
+
+// NewGitArchiveForTagWithPrefix returns a GitArchive in the same way as NewGitArchiveForTagAt, for
+// a tag whose name is tagPrefix followed by the semantic version, such as component/v1.2.3 with a
+// tagPrefix of "component/v".
+func NewGitArchiveForTagWithPrefix(path, prefix, tagName, tagPrefix string) (*GitArchive, error) {
+	repo, err := openRepo(path)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := worktreeRoot(repo)
+	if err != nil {
+		return nil, err
+	}
+
+	ref, err := repo.Tag(tagName)
+	if err != nil {
+		return nil, fmt.Errorf("while looking up tag %s: %s", tagName, err)
+	}
+
+	tag, err := resolveTag(repo, ref)
+	if err != nil {
+		return nil, fmt.Errorf("while resolving tag %s: %s", tagName, err)
+	} else if tag == nil {
+		return nil, fmt.Errorf("tag %s does not point to a commit", tagName)
+	}
+
+	ga := &GitArchive{
+		CompressionLevel: gzip.DefaultCompression,
+		ZipMethod:        zip.Deflate,
+		tag:              tag,
+		tagPrefix:        tagPrefix,
+		dir:              dir,
+	}
+	if err := ga.setPrefix(prefix); err != nil {
+		return nil, err
+	}
+
+	head, err := repo.Head()
+	if err != nil {
+		return nil, fmt.Errorf("while reading HEAD: %s", err)
+	}
+	ga.FromGitObjects = head.Hash() != tag.commit.Hash
 
-	ga.prefix = prefix
 	return ga, nil
 }
 
+// NewGitArchiveFrom returns a GitArchive for the tree of the revision rev (for example, a branch or
+// commit hash) in the git repository containing the current working directory. Unlike
+// NewGitArchive, the revision need not be tagged. Entries are read from git objects, so rev need
+// not be checked out. Version returns a version for the revision such as 1.2.4-alpha.4.devel.3.
+func NewGitArchiveFrom(prefix, rev string) (*GitArchive, error) {
+	return NewGitArchiveFromAt(".", prefix, rev)
+}
+
+// NewGitArchiveFromAt returns a GitArchive in the same way as NewGitArchiveFrom, for the git
+// repository containing path.
+func NewGitArchiveFromAt(path, prefix, rev string) (*GitArchive, error) {
+	gd, err := GitDescribeRefWithOptions(path, rev, DescribeOptions{TagPrefix: DefaultTagPrefix})
+	if err != nil {
+		return nil, err
+	}
+
+	ga, err := newSnapshotArchive(path, prefix, rev, gd)
+	if err != nil {
+		return nil, err
+	}
+	ga.FromGitObjects = true
+	return ga, nil
+}
+
+// NewGitArchiveSnapshot returns a GitArchive for HEAD in the git repository containing the current
+// working directory, including local modifications to tracked files. Unlike NewGitArchive, HEAD
+// need not be tagged. Tracked files deleted from the working tree are left out. Version returns a
+// version for the snapshot such as 1.2.4-alpha.4.devel.3+g1a2b3c4.dirty.
+func NewGitArchiveSnapshot(prefix string) (*GitArchive, error) {
+	return NewGitArchiveSnapshotAt(".", prefix)
+}
+
+// NewGitArchiveSnapshotAt returns a GitArchive in the same way as NewGitArchiveSnapshot, for the
+// git repository containing path.
+func NewGitArchiveSnapshotAt(path, prefix string) (*GitArchive, error) {
+	gd, err := GitDescribeWithOptions(path, DescribeOptions{TagPrefix: DefaultTagPrefix})
+	if err != nil {
+		return nil, err
+	}
+
+	ga, err := newSnapshotArchive(path, prefix, "HEAD", gd)
+	if err != nil {
+		return nil, err
+	}
+	ga.snapshot = true
+	return ga, nil
+}
+
+// newSnapshotArchive returns a GitArchive for the commit described by gd, which was resolved from
+// the revision rev, in the git repository containing path.
+func newSnapshotArchive(path, prefix, rev string, gd *GitDescription) (*GitArchive, error) {
+	repo, err := openRepo(path)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := worktreeRoot(repo)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := repo.CommitObject(gd.Ref())
+	if err != nil {
+		return nil, fmt.Errorf("while reading commit %s: %s", gd.Ref(), err)
+	}
+
+	ga := &GitArchive{
+		CompressionLevel: gzip.DefaultCompression,
+		ZipMethod:        zip.Deflate,
+		gd:               gd,
+		tag:              &versionTag{name: rev, commit: c},
+		tagPrefix:        gd.opts.TagPrefix,
+		dir:              dir,
+	}
+	if err := ga.setPrefix(prefix); err != nil {
+		return nil, err
+	}
+	return ga, nil
+}
+
+// ArchivePrefixData is the data available to Go templates in archive prefixes. For example, a
+// prefix of "{{ .Name }}-{{ .Version }}/" results in entries such as gobuild-1.2.3/README.md.
+type ArchivePrefixData struct {
+	Name    string // name of the project, as used by NewGitArchiveAuto
+	Version string // version of the archived tree, as returned by GitArchive.Version
+	Tag     string // name of the archived tag, or the revision of an untagged archive
+	Commit  string // hash of the archived commit
+}
+
+// setPrefix sets the prefix of entries in the archive to prefix, after expanding it as a Go
+// template with ArchivePrefixData and normalizing it with normalizeArchivePrefix.
+func (ga *GitArchive) setPrefix(prefix string) error {
+	if strings.Contains(prefix, "{{") {
+		t, err := template.New("prefix").Option("missingkey=error").Parse(prefix)
+		if err != nil {
+			return fmt.Errorf("while parsing archive prefix: %s", err)
+		}
+
+		data := ArchivePrefixData{Tag: ga.tag.name, Commit: ga.tag.commit.Hash.String()}
+		if data.Version, err = ga.Version(); err != nil {
+			return err
+		}
+		repo, err := openRepo(ga.dir)
+		if err != nil {
+			return err
+		}
+		if data.Name, err = repoName(repo); err != nil {
+			return err
+		}
+
+		var sb strings.Builder
+		if err := t.Execute(&sb, data); err != nil {
+			return fmt.Errorf("while expanding archive prefix: %s", err)
+		}
+		prefix = sb.String()
+	}
+
+	var err error
+	ga.prefix, err = normalizeArchivePrefix(prefix)
+	return err
+}
+
+// normalizeArchivePrefix returns prefix as a clean path separated by '/', as entry names in tar
+// and zip archives must be on all platforms, including Windows. Absolute prefixes, and those that
+// refer to a parent directory, are rejected, so that archives extract under the current directory.
+func normalizeArchivePrefix(prefix string) (string, error) {
+	p := strings.ReplaceAll(prefix, "\\", "/")
+	if strings.HasPrefix(p, "/") || filepath.VolumeName(prefix) != "" || len(p) > 1 && p[1] == ':' {
+		return "", fmt.Errorf("archive prefix %q is absolute", prefix)
+	}
+
+	p = path.Clean(p)
+	if p == "." {
+		return "", nil
+	}
+	if p == ".." || strings.HasPrefix(p, "../") {
+		return "", fmt.Errorf("archive prefix %q is outside of the archive", prefix)
+	}
+	return p, nil
+}
+
+// archiveEntryName returns the name in archives of the entry with the given name, which may use
+// the separator of the platform, and prefix, as normalized by normalizeArchivePrefix.
+func archiveEntryName(prefix, name string) string {
+	return path.Join(prefix, filepath.ToSlash(name))
+}
+
+// Version returns the semantic version of the archived tree, without the tag prefix. For archives
+// of untagged commits, it includes the number of commits since the nearest tag, as returned by
+// GitDescription.GetSemver. If no tags are found, UntaggedVersion is returned if it is set.
+func (ga *GitArchive) Version() (string, error) {
+	if ga.gd != nil {
+		return describedVersion(ga.gd)
+	}
+
+	v, err := parseTagVersion(ga.tag.name, ga.tagPrefix)
+	if err != nil {
+		return "", err
+	}
+	return v.String(), nil
+}
+
 func (ga *GitArchive) Create(format ArchiveFormat, w io.Writer, extraFiles ...string) error {
+	return ga.CreateContext(context.Background(), format, w, extraFiles...)
+}
+
+// CreateContext writes an archive in the given format to w, in the same way as Create. If ctx is
+// done before the archive is complete, writing stops and ctx.Err() is returned.
+func (ga *GitArchive) CreateContext(ctx context.Context, format ArchiveFormat, w io.Writer, extraFiles ...string) error {
 	switch format {
 	case TgzArchive:
-		return ga.createTgzArchive(w, extraFiles...)
+		return ga.createTgzArchive(ctx, w, extraFiles...)
 	case ZipArchive:
-		return ga.createZipArchive(w, extraFiles...)
+		return ga.createZipArchive(ctx, w, extraFiles...)
+	case TxzArchive:
+		return ga.createTxzArchive(ctx, w, extraFiles...)
+	case ZstArchive:
+		return ga.createZstArchive(ctx, w, extraFiles...)
+	case TarArchive:
+		return ga.createTarArchive(ctx, w, extraFiles...)
+	}
+
+	return fmt.Errorf("%w: archive format %v", ErrUnsupportedFormat, format)
+}
+
+// CreateFile writes an archive in the given format to a new file at path, in the same way as
+// Create. The file is fully written and closed before CreateFile returns. If the archive cannot be
+// written, the partial file is removed.
+func (ga *GitArchive) CreateFile(format ArchiveFormat, path string, extraFiles ...string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("while creating %s: %s", path, err)
 	}
 
+	if err := ga.Create(format, f, extraFiles...); err != nil {
+		f.Close()
+		os.Remove(path)
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		os.Remove(path)
+		return fmt.Errorf("while closing %s: %s", path, err)
+	}
+	Log.Infof("created %s", path)
+	return nil
+}
+
+// CreateSigned writes an archive in the given format to w, in the same way as Create, and writes
+// an ASCII-armored detached signature of the archive made with key to sig. The archive is signed
+// as it is written, so the signature covers exactly the bytes written to w. The private key of key
+// must already be decrypted.
+func (ga *GitArchive) CreateSigned(format ArchiveFormat, w io.Writer, sig io.Writer, key *openpgp.Entity, extraFiles ...string) error {
+	ds, err := newDetachedSigner(key)
+	if err != nil {
+		return err
+	}
+
+	if err := ga.Create(format, io.MultiWriter(w, ds), extraFiles...); err != nil {
+		return err
+	}
+	return ds.writeSignature(sig)
+}
+
+// AddFile adds a regular file with the given name, content and permissions to archives created
+// from ga. Added files are written after the entries from the tree and any extra files, in the
+// order they were added. Their metadata is normalized in the same way, except that the permission
+// bits of mode are kept as given, subject to ModeFilter. Names must be relative, and must not refer
+// to the parent directory with "..", or creating the archive fails.
+func (ga *GitArchive) AddFile(name string, content []byte, mode os.FileMode) {
+	ga.files = append(ga.files, memSource{
+		name:    path.Clean(filepath.ToSlash(name)),
+		content: content,
+		mode:    mode.Perm(),
+	})
+}
+
+// checkAddedName returns an error if name, as cleaned by AddFile, is not a relative path within
+// the archive, which could be written outside of the directory the archive is extracted to.
+func checkAddedName(name string) error {
+	if name == "." || path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+		return fmt.Errorf("invalid name %q for added file", name)
+	}
 	return nil
 }
 
-func (ga *GitArchive) createTgzArchive(w io.Writer, extraFiles ...string) error {
-	gzipWriter := gzip.NewWriter(w)
-	defer gzipWriter.Close()
+// entrySource provides the metadata and contents of an archive entry.
+type entrySource interface {
+	Stat() (os.FileInfo, error)
+	Readlink() (string, error)
+	Open() (io.ReadCloser, error)
+}
+
+// fileSource is an entrySource for a path in the file system.
+type fileSource string
+
+func (fs fileSource) Stat() (os.FileInfo, error) {
+	return os.Lstat(string(fs))
+}
+
+func (fs fileSource) Readlink() (string, error) {
+	return os.Readlink(string(fs))
+}
+
+func (fs fileSource) Open() (io.ReadCloser, error) {
+	return os.Open(string(fs))
+}
+
+// objectSource is an entrySource for an entry in a git tree.
+type objectSource struct {
+	tree *object.Tree
+	te   treeEntry
+}
+
+func (src objectSource) Stat() (os.FileInfo, error) {
+	return newTreeEntryInfo(src.tree, src.te)
+}
+
+func (src objectSource) Readlink() (string, error) {
+	r, err := src.Open()
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func (src objectSource) Open() (io.ReadCloser, error) {
+	f, err := src.tree.TreeEntryFile(&src.te.TreeEntry)
+	if err != nil {
+		return nil, err
+	}
+	return f.Reader()
+}
+
+// memSource is an entrySource for a file added with AddFile.
+type memSource struct {
+	name    string
+	content []byte
+	mode    os.FileMode
+}
+
+func (src memSource) Stat() (os.FileInfo, error) {
+	return &treeEntryInfo{name: path.Base(src.name), size: int64(len(src.content)), mode: src.mode}, nil
+}
+
+func (src memSource) Readlink() (string, error) {
+	return "", fmt.Errorf("%s is not a symlink", src.name)
+}
+
+func (src memSource) Open() (io.ReadCloser, error) {
+	return ioutil.NopCloser(bytes.NewReader(src.content)), nil
+}
+
+// treeEntryInfo implements os.FileInfo for an entry that is not in the file system, such as an
+// entry in a git tree.
+type treeEntryInfo struct {
+	name string
+	size int64
+	mode os.FileMode
+}
+
+func newTreeEntryInfo(tree *object.Tree, te treeEntry) (*treeEntryInfo, error) {
+	mode, err := te.Mode.ToOSFileMode()
+	if err != nil {
+		return nil, err
+	}
+
+	fi := &treeEntryInfo{name: te.Name, mode: mode}
+	if te.Mode.IsFile() {
+		f, err := tree.TreeEntryFile(&te.TreeEntry)
+		if err != nil {
+			return nil, err
+		}
+		fi.size = f.Size
+	}
+	return fi, nil
+}
+
+func (fi *treeEntryInfo) Name() string       { return fi.name }
+func (fi *treeEntryInfo) Size() int64        { return fi.size }
+func (fi *treeEntryInfo) Mode() os.FileMode  { return fi.mode }
+func (fi *treeEntryInfo) ModTime() time.Time { return time.Time{} }
+func (fi *treeEntryInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi *treeEntryInfo) Sys() interface{}   { return nil }
+
+// contextReader is an io.Reader that fails once its context is done.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (cr *contextReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.r.Read(p)
+}
+
+// archiveEntry is an entry to write to an archive.
+type archiveEntry struct {
+	name     string // path of the entry within the archive, excluding the prefix
+	src      entrySource
+	keepMode bool // if true, the permissions of the entry are recorded as given, not normalized
+}
+
+// entries returns the list of entries to write to the archive: the entries from the tree and
+// extraFiles, sorted by name, followed by the files added with AddFile.
+func (ga *GitArchive) entries(extraFiles ...string) ([]archiveEntry, error) {
+	tes, subst, err := ga.treeEntries()
+	if err != nil {
+		return nil, err
+	}
+
+	subtree := ""
+	if ga.Subtree != "" {
+		subtree = strings.Trim(path.Clean(filepath.ToSlash(ga.Subtree)), "/")
+		if subtree == "." {
+			subtree = ""
+		}
+	}
+	found := subtree == ""
+
+	entries := make([]archiveEntry, 0, len(tes)+len(extraFiles)+len(ga.files))
+	for _, te := range tes {
+		name := te.path
+		if subtree != "" {
+			if name == subtree && te.Mode == filemode.Dir {
+				found = true
+			}
+			if !strings.HasPrefix(name, subtree+"/") {
+				continue
+			}
+			name = strings.TrimPrefix(name, subtree+"/")
+		}
+
+		var src entrySource
+		if ga.FromGitObjects {
+			src = objectSource{te.tree, te}
+		} else {
+			fs := fileSource(filepath.Join(ga.dir, filepath.FromSlash(te.path)))
+			if ga.snapshot {
+				if _, err := fs.Stat(); os.IsNotExist(err) {
+					continue
+				}
+			}
+			src = fs
+		}
+		if subst[te.path] {
+			src = substSource{src, te.commit}
+		}
+		entries = append(entries, archiveEntry{name: name, src: src})
+	}
+	if !found {
+		return nil, fmt.Errorf("directory %s not found in tag %s", subtree, ga.tag.name)
+	}
+
+	for _, path := range extraFiles {
+		entries = append(entries, archiveEntry{name: path, src: fileSource(path)})
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].name < entries[j].name
+	})
+
+	for _, f := range ga.files {
+		if err := checkAddedName(f.name); err != nil {
+			return nil, err
+		}
+		entries = append(entries, archiveEntry{name: f.name, src: f, keepMode: true})
+	}
+
+	if len(ga.Transforms) > 0 {
+		for i, e := range entries {
+			entries[i].src = &transformSource{entrySource: e.src, name: e.name, transforms: ga.Transforms}
+		}
+	}
+	return entries, nil
+}
+
+// treeEntries returns the entries in the tree to write to the archive. Paths with the
+// export-ignore attribute or that match ga.Exclude are left out, as are directories left empty as a
+// result. The paths of files with the export-subst attribute are returned in subst.
+func (ga *GitArchive) treeEntries() (entries []treeEntry, subst map[string]bool, err error) {
+	tes, err := ga.tag.treeEntries()
+	if err != nil {
+		return nil, nil, fmt.Errorf("while listing tree entries: %s", err)
+	}
+	if ga.RecurseSubmodules {
+		if tes, err = submoduleEntries(ga.dir, tes); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	matcher, err := ga.exportAttributes(tes)
+	if err != nil {
+		return nil, nil, err
+	}
 
-	tarWriter := tar.NewWriter(gzipWriter)
-	defer tarWriter.Close()
+	var kept []treeEntry
+	var excludedDirs []string
+	nonEmptyDirs := make(map[string]bool)
+
+	for _, te := range tes {
+		if isInDir(te.path, excludedDirs) {
+			continue
+		}
 
-	for _, entry := range append(ga.gd.ListEntries(), extraFiles...) {
-		err := addEntryToTar(ga.prefix, entry, tarWriter)
+		excluded, err := ga.isExcluded(matcher, te.path)
 		if err != nil {
-			return fmt.Errorf("while adding file %s to tar archive: %s", entry, err)
+			return nil, nil, err
+		}
+		if excluded {
+			if te.Mode == filemode.Dir {
+				excludedDirs = append(excludedDirs, te.path)
+			}
+			continue
+		}
+
+		kept = append(kept, te)
+		if te.Mode != filemode.Dir {
+			for dir := path.Dir(te.path); dir != "."; dir = path.Dir(dir) {
+				nonEmptyDirs[dir] = true
+			}
 		}
 	}
 
+	entries = make([]treeEntry, 0, len(kept))
+	subst = make(map[string]bool)
+	for _, te := range kept {
+		if te.Mode == filemode.Dir && !nonEmptyDirs[te.path] {
+			continue
+		}
+		entries = append(entries, te)
+
+		if te.Mode.IsFile() {
+			results, _ := matcher.Match(strings.Split(te.path, "/"), []string{"export-subst"})
+			if attr, ok := results["export-subst"]; ok && attr.IsSet() {
+				subst[te.path] = true
+			}
+		}
+	}
+
+	return entries, subst, nil
+}
+
+// submoduleEntries returns tes, with the entries of the trees of the initialized submodules among
+// them inserted after each submodule, recursively. Submodules are read from the working tree at
+// root, and become directories. Submodules that are not initialized are left as they are.
+func submoduleEntries(root string, tes []treeEntry) ([]treeEntry, error) {
+	entries := make([]treeEntry, 0, len(tes))
+	for _, te := range tes {
+		if te.Mode != filemode.Submodule {
+			entries = append(entries, te)
+			continue
+		}
+
+		repo, err := git.PlainOpen(filepath.Join(root, filepath.FromSlash(te.path)))
+		if err == git.ErrRepositoryNotExists {
+			entries = append(entries, te)
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("while opening submodule %s: %s", te.path, err)
+		}
+
+		c, err := repo.CommitObject(te.Hash)
+		if err != nil {
+			return nil, fmt.Errorf("while reading commit %s of submodule %s: %s", te.Hash, te.path, err)
+		}
+		sub, err := (&versionTag{name: te.path, commit: c}).treeEntries()
+		if err != nil {
+			return nil, fmt.Errorf("while listing entries of submodule %s: %s", te.path, err)
+		}
+		for i := range sub {
+			sub[i].path = te.path + "/" + sub[i].path
+		}
+		if sub, err = submoduleEntries(root, sub); err != nil {
+			return nil, err
+		}
+
+		te.Mode = filemode.Dir
+		entries = append(entries, te)
+		entries = append(entries, sub...)
+	}
+	return entries, nil
+}
+
+// exportAttributes returns a matcher for the attributes in the .gitattributes files in tes.
+func (ga *GitArchive) exportAttributes(tes []treeEntry) (gitattributes.Matcher, error) {
+	// Tree entries are walked with each directory preceding its contents, so attributes are
+	// gathered in order of increasing priority, as the matcher expects.
+	var attrs []gitattributes.MatchAttribute
+	for _, te := range tes {
+		if path.Base(te.path) != ".gitattributes" || !te.Mode.IsFile() {
+			continue
+		}
+
+		f, err := te.tree.TreeEntryFile(&te.TreeEntry)
+		if err != nil {
+			return nil, fmt.Errorf("while reading %s: %s", te.path, err)
+		}
+		r, err := f.Reader()
+		if err != nil {
+			return nil, fmt.Errorf("while reading %s: %s", te.path, err)
+		}
+
+		var domain []string
+		if dir := path.Dir(te.path); dir != "." {
+			domain = strings.Split(dir, "/")
+		}
+
+		a, err := gitattributes.ReadAttributes(r, domain, te.path == ".gitattributes")
+		r.Close()
+		if err != nil {
+			return nil, fmt.Errorf("while parsing %s: %s", te.path, err)
+		}
+		attrs = append(attrs, a...)
+	}
+
+	return gitattributes.NewMatcher(attrs), nil
+}
+
+// isExcluded returns true if p has the export-ignore attribute or matches ga.Exclude.
+func (ga *GitArchive) isExcluded(matcher gitattributes.Matcher, p string) (bool, error) {
+	results, _ := matcher.Match(strings.Split(p, "/"), []string{"export-ignore"})
+	if attr, ok := results["export-ignore"]; ok && attr.IsSet() {
+		return true, nil
+	}
+
+	for _, pattern := range ga.Exclude {
+		matched, err := path.Match(pattern, p)
+		if err != nil {
+			return false, fmt.Errorf("while matching exclude pattern %s: %s", pattern, err)
+		}
+		if matched {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// isInDir returns true if p is within any of dirs.
+func isInDir(p string, dirs []string) bool {
+	for _, dir := range dirs {
+		if strings.HasPrefix(p, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// modTime returns the modification time recorded for every entry in the archive. If the
+// SOURCE_DATE_EPOCH environment variable is set, it is used. Otherwise, the committer time of the
+// tagged commit is used. Pinning the time makes archives of the same tag reproducible.
+func (ga *GitArchive) modTime() (time.Time, error) {
+	if t, ok, err := sourceDateEpoch(); ok || err != nil {
+		return t, err
+	}
+	return time.Unix(ga.tag.commit.Committer.When.Unix(), 0).UTC(), nil
+}
+
+// sourceDateEpoch returns the time in the SOURCE_DATE_EPOCH environment variable. If it is not
+// set, ok is false.
+func sourceDateEpoch() (t time.Time, ok bool, err error) {
+	s, ok := os.LookupEnv("SOURCE_DATE_EPOCH")
+	if !ok {
+		return time.Time{}, false, nil
+	}
+	sec, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return time.Time{}, true, fmt.Errorf("while parsing SOURCE_DATE_EPOCH: %s", err)
+	}
+	return time.Unix(sec, 0).UTC(), true, nil
+}
+
+// normalizeMode returns a fixed mode for an entry of the given mode, in the same way that git only
+// records whether a file is executable.
+func normalizeMode(mode os.FileMode) os.FileMode {
+	switch {
+	case mode.IsDir():
+		return os.ModeDir | 0755
+	case mode&os.ModeSymlink != 0:
+		return os.ModeSymlink | 0777
+	case mode&0111 != 0:
+		return 0755
+	default:
+		return 0644
+	}
+}
+
+// entryMode returns the mode to record for entry with the given mode, after normalization, unless
+// entry.keepMode is set, and filtering by filter, if it is non-nil.
+func entryMode(entry archiveEntry, mode os.FileMode, filter func(string, os.FileMode) os.FileMode) os.FileMode {
+	if !entry.keepMode {
+		mode = normalizeMode(mode)
+	}
+	if filter != nil {
+		mode = mode&os.ModeType | filter(entry.name, mode).Perm()
+	}
+	return mode
+}
+
+func (ga *GitArchive) createTgzArchive(ctx context.Context, w io.Writer, extraFiles ...string) error {
+	mtime, err := ga.modTime()
+	if err != nil {
+		return err
+	}
+
+	gzipWriter, err := gzip.NewWriterLevel(w, ga.CompressionLevel)
+	if err != nil {
+		return fmt.Errorf("while creating gzip writer: %s", err)
+	}
+	gzipWriter.ModTime = mtime
+
+	if err := ga.writeTarArchive(ctx, gzipWriter, mtime, extraFiles...); err != nil {
+		gzipWriter.Close()
+		return err
+	}
+
+	if err := gzipWriter.Close(); err != nil {
+		return fmt.Errorf("while finishing gzip stream: %s", err)
+	}
+	return nil
+}
+
+func (ga *GitArchive) createTxzArchive(ctx context.Context, w io.Writer, extraFiles ...string) error {
+	mtime, err := ga.modTime()
+	if err != nil {
+		return err
+	}
+
+	cfg := xz.WriterConfig{DictCap: xzDictCap(ga.CompressionLevel)}
+	if cfg.DictCap == 0 {
+		return fmt.Errorf("invalid compression level: %d", ga.CompressionLevel)
+	}
+
+	xzWriter, err := cfg.NewWriter(w)
+	if err != nil {
+		return fmt.Errorf("while creating xz writer: %s", err)
+	}
+
+	if err := ga.writeTarArchive(ctx, xzWriter, mtime, extraFiles...); err != nil {
+		xzWriter.Close()
+		return err
+	}
+
+	if err := xzWriter.Close(); err != nil {
+		return fmt.Errorf("while finishing xz stream: %s", err)
+	}
 	return nil
 }
 
-func (ga *GitArchive) createZipArchive(w io.Writer, extraFiles ...string) error {
+func (ga *GitArchive) createZstArchive(ctx context.Context, w io.Writer, extraFiles ...string) error {
+	mtime, err := ga.modTime()
+	if err != nil {
+		return err
+	}
+
+	var opts []zstd.EOption
+	if ga.CompressionLevel != gzip.DefaultCompression {
+		if ga.CompressionLevel < gzip.HuffmanOnly || ga.CompressionLevel > gzip.BestCompression {
+			return fmt.Errorf("invalid compression level: %d", ga.CompressionLevel)
+		}
+		opts = append(opts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(ga.CompressionLevel)))
+	}
+
+	zstdWriter, err := zstd.NewWriter(w, opts...)
+	if err != nil {
+		return fmt.Errorf("while creating zstd writer: %s", err)
+	}
+
+	if err := ga.writeTarArchive(ctx, zstdWriter, mtime, extraFiles...); err != nil {
+		zstdWriter.Close()
+		return err
+	}
+
+	if err := zstdWriter.Close(); err != nil {
+		return fmt.Errorf("while finishing zstd stream: %s", err)
+	}
+	return nil
+}
+
+func (ga *GitArchive) createTarArchive(ctx context.Context, w io.Writer, extraFiles ...string) error {
+	mtime, err := ga.modTime()
+	if err != nil {
+		return err
+	}
+	return ga.writeTarArchive(ctx, w, mtime, extraFiles...)
+}
+
+// xzDictCap returns the xz dictionary size for a compression level, following the presets of the
+// xz command, or zero if level is invalid. The dictionary size is what distinguishes the presets
+// for the xz encoder used here.
+func xzDictCap(level int) int {
+	presets := []int{256 << 10, 1 << 20, 2 << 20, 4 << 20, 4 << 20, 8 << 20, 8 << 20, 16 << 20, 32 << 20, 64 << 20}
+	switch {
+	case level == gzip.DefaultCompression:
+		return presets[6]
+	case level == gzip.HuffmanOnly:
+		return presets[0]
+	case level >= 0 && level < len(presets):
+		return presets[level]
+	}
+	return 0
+}
+
+// writeTarArchive writes the entries of the archive to w as a tar stream.
+func (ga *GitArchive) writeTarArchive(ctx context.Context, w io.Writer, mtime time.Time, extraFiles ...string) error {
+	tarWriter := tar.NewWriter(w)
+
+	entries, err := ga.entries(extraFiles...)
+	if err != nil {
+		return err
+	}
+
+	for i, entry := range entries {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if ga.OnProgress != nil {
+			ga.OnProgress(entry.name, i, len(entries))
+		}
+		Log.Debugf("archiving %s", archiveEntryName(ga.prefix, entry.name))
+
+		err := addEntryToTar(ctx, ga.prefix, entry, ga.ModeFilter, mtime, tarWriter)
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		} else if err != nil {
+			return fmt.Errorf("while adding file %s to tar archive: %s", entry.name, err)
+		}
+	}
+
+	if err := tarWriter.Close(); err != nil {
+		return fmt.Errorf("while finishing tar archive: %s", err)
+	}
+	return nil
+}
+
+func (ga *GitArchive) createZipArchive(ctx context.Context, w io.Writer, extraFiles ...string) error {
+	mtime, err := ga.modTime()
+	if err != nil {
+		return err
+	}
+
 	zipWriter := zip.NewWriter(w)
+	if ga.ZipMethod == zip.Deflate {
+		// Check the level now, as the compressor is not called until the first entry is written.
+		if _, err := flate.NewWriter(ioutil.Discard, ga.CompressionLevel); err != nil {
+			return fmt.Errorf("while creating deflate writer: %s", err)
+		}
+		level := ga.CompressionLevel
+		zipWriter.RegisterCompressor(zip.Deflate, func(w io.Writer) (io.WriteCloser, error) {
+			return flate.NewWriter(w, level)
+		})
+	} else if ga.ZipMethod != zip.Store {
+		return fmt.Errorf("unsupported zip method: %d", ga.ZipMethod)
+	}
 
-	for _, entry := range append(ga.gd.ListEntries(), extraFiles...) {
-		err := addEntryToZip(ga.prefix, entry, zipWriter)
-		if err != nil {
-			return fmt.Errorf("while adding file %s to zip archive: %s", entry, err)
+	entries, err := ga.entries(extraFiles...)
+	if err != nil {
+		return err
+	}
+
+	for i, entry := range entries {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if ga.OnProgress != nil {
+			ga.OnProgress(entry.name, i, len(entries))
+		}
+		Log.Debugf("archiving %s", archiveEntryName(ga.prefix, entry.name))
+
+		err := addEntryToZip(ctx, ga.prefix, entry, ga.ModeFilter, ga.ZipMethod, mtime, zipWriter)
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		} else if err != nil {
+			return fmt.Errorf("while adding file %s to zip archive: %s", entry.name, err)
 		}
 	}
 
-	return zipWriter.Close()
+	if err := zipWriter.Close(); err != nil {
+		return fmt.Errorf("while finishing zip archive: %s", err)
+	}
+	return nil
 }
 
-func addEntryToTar(prefix, path string, w *tar.Writer) error {
-	fi, err := os.Stat(path)
+func addEntryToTar(ctx context.Context, prefix string, entry archiveEntry, filter func(string, os.FileMode) os.FileMode, mtime time.Time, w *tar.Writer) error {
+	path, src := entry.name, entry.src
+	fi, err := src.Stat()
 	if err != nil {
 		return fmt.Errorf("while getting information for file %s: %s", path, err)
 	}
 
 	link := ""
 	if fi.Mode()&os.ModeSymlink != 0 {
-		link, err = os.Readlink(path)
+		link, err = src.Readlink()
 		if err != nil {
 			return fmt.Errorf("while reading symlink %s: %s", path, err)
 		}
@@ -104,24 +1182,34 @@ func addEntryToTar(prefix, path string, w *tar.Writer) error {
 	if err != nil {
 		return fmt.Errorf("while getting tar header for file %s: %s", path, err)
 	}
-	header.Name = filepath.Join(prefix, path)
+	header.Name = archiveEntryName(prefix, path)
 	if fi.IsDir() {
 		header.Name += "/"
 	}
 
+	// Normalize metadata that varies between machines, so the archive is reproducible.
+	header.Mode = int64(entryMode(entry, fi.Mode(), filter).Perm())
+	header.ModTime = mtime
+	header.AccessTime = time.Time{}
+	header.ChangeTime = time.Time{}
+	header.Uid = 0
+	header.Gid = 0
+	header.Uname = "root"
+	header.Gname = "root"
+
 	err = w.WriteHeader(header)
 	if err != nil {
 		return fmt.Errorf("while writing tar header for file %s: %s", path, err)
 	}
 
 	if fi.Mode().IsRegular() {
-		file, err := os.Open(path)
+		file, err := src.Open()
 		if err != nil {
 			return fmt.Errorf("while opening file %s: %s", path, err)
 		}
 		defer file.Close()
 
-		_, err = io.Copy(w, file)
+		_, err = io.Copy(w, &contextReader{ctx, file})
 		if err != nil {
 			return fmt.Errorf("while copying file %s to tar: %s", path, err)
 		}
@@ -130,8 +1218,9 @@ func addEntryToTar(prefix, path string, w *tar.Writer) error {
 	return nil
 }
 
-func addEntryToZip(prefix, path string, w *zip.Writer) error {
-	fi, err := os.Stat(path)
+func addEntryToZip(ctx context.Context, prefix string, entry archiveEntry, filter func(string, os.FileMode) os.FileMode, method uint16, mtime time.Time, w *zip.Writer) error {
+	path, src := entry.name, entry.src
+	fi, err := src.Stat()
 	if err != nil {
 		return fmt.Errorf("while getting information for file %s: %s", path, err)
 	}
@@ -140,8 +1229,12 @@ func addEntryToZip(prefix, path string, w *zip.Writer) error {
 	if err != nil {
 		return fmt.Errorf("while getting zip information header for file %s: %s", path, err)
 	}
-	header.Name = filepath.Join(prefix, path)
-	header.Method = zip.Deflate
+	header.Name = archiveEntryName(prefix, path)
+	header.Method = method
+
+	// Normalize metadata that varies between machines, so the archive is reproducible.
+	header.SetMode(entryMode(entry, fi.Mode(), filter))
+	header.Modified = mtime
 
 	if fi.Mode().IsDir() {
 		header.Name += "/"
@@ -153,13 +1246,13 @@ func addEntryToZip(prefix, path string, w *zip.Writer) error {
 	}
 
 	if fi.Mode().IsRegular() {
-		file, err := os.Open(path)
+		file, err := src.Open()
 		if err != nil {
 			return fmt.Errorf("while opening file %s: %s", path, err)
 		}
 		defer file.Close()
 
-		_, err = io.Copy(f, file)
+		_, err = io.Copy(f, &contextReader{ctx, file})
 		if err != nil {
 			return fmt.Errorf("while copying file %s to zip archive: %s", path, err)
 		}
@@ -167,7 +1260,7 @@ func addEntryToZip(prefix, path string, w *zip.Writer) error {
 		var data []byte
 
 		if fi.Mode()&os.ModeSymlink != 0 {
-			target, err := os.Readlink(path)
+			target, err := src.Readlink()
 			if err != nil {
 				return fmt.Errorf("while reading symlink %s: %s", path, err)
 			}
@@ -0,0 +1,666 @@
+// SPDX-License-Identifier: BSD-3-Clause
+// Copyright (c) 2020-2021, Ctrl IQ, Inc. All rights reserved
+
+package gobuild
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/openpgp"
+)
+
+// tarEntry is an entry read from a tar archive by readTgz.
+type tarEntry struct {
+	hdr     *tar.Header
+	content string
+}
+
+// readTgz returns the entries of the gzip-compressed tar archive b, in order.
+func readTgz(t testing.TB, b []byte) []tarEntry {
+	t.Helper()
+	zr, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries []tarEntry
+	tr := tar.NewReader(zr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return entries
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, tarEntry{hdr, string(content)})
+	}
+}
+
+// createTgz returns a TgzArchive created from ga.
+func createTgz(t testing.TB, ga *GitArchive) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	if err := ga.Create(TgzArchive, &b); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func TestAddFile(t *testing.T) {
+	dir := initRepo(t)
+	commitFile(t, dir, "README", "hello")
+	runGit(t, dir, "tag", "v1.0.0")
+
+	ga, err := NewGitArchiveAt(dir, "tool-1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ga.AddFile("VERSION", []byte("1.0.0\n"), 0600)
+	if err := ga.AddReader("bin/run", strings.NewReader("#!/bin/sh\n"), os.ModeSetuid|0750); err != nil {
+		t.Fatal(err)
+	}
+
+	type want struct {
+		name    string
+		mode    int64
+		content string
+	}
+	check := func(desc string, wants []want) {
+		t.Helper()
+		entries := readTgz(t, createTgz(t, ga))
+		if n := len(entries); n < len(wants) {
+			t.Fatalf("%s: got %d entries", desc, n)
+		}
+		for i, w := range wants {
+			e := entries[len(entries)-len(wants)+i]
+			if e.hdr.Name != w.name || e.hdr.Mode != w.mode || e.content != w.content {
+				t.Errorf("%s: got entry %s, mode %o, content %q, want %s, mode %o, content %q",
+					desc, e.hdr.Name, e.hdr.Mode, e.content, w.name, w.mode, w.content)
+			}
+		}
+	}
+
+	// The permission bits of added files are kept, rather than normalized.
+	check("added", []want{
+		{"tool-1.0.0/VERSION", 0600, "1.0.0\n"},
+		{"tool-1.0.0/bin/run", 0750, "#!/bin/sh\n"},
+	})
+
+	ga.ModeFilter = func(path string, mode os.FileMode) os.FileMode {
+		return mode | 0044
+	}
+	check("filtered", []want{
+		{"tool-1.0.0/VERSION", 0644, "1.0.0\n"},
+		{"tool-1.0.0/bin/run", 0754, "#!/bin/sh\n"},
+	})
+}
+
+func TestAddFileInvalidName(t *testing.T) {
+	dir := initRepo(t)
+	commitFile(t, dir, "README", "hello")
+	runGit(t, dir, "tag", "v1.0.0")
+
+	for _, name := range []string{"../x", "a/../../x", "/etc/passwd", "..", "."} {
+		ga, err := NewGitArchiveAt(dir, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ga.AddReader(name, strings.NewReader("x"), 0644); err == nil {
+			t.Errorf("AddReader(%q): no error", name)
+		}
+		ga.AddFile(name, []byte("x"), 0644)
+		if err := ga.Create(TgzArchive, ioutil.Discard); err == nil {
+			t.Errorf("Create with file %q: no error", name)
+		}
+	}
+}
+
+func TestGitArchiveTagPrefix(t *testing.T) {
+	dir := initRepo(t)
+	commitFile(t, dir, "README", "hello")
+	runGit(t, dir, "tag", "component/v1.2.3")
+
+	ga, err := NewGitArchiveWithOptions(dir, "{{ .Version }}", DescribeOptions{TagPrefix: "component/v"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := ga.Version(); err != nil || v != "1.2.3" {
+		t.Errorf("got version %q (%v), want 1.2.3", v, err)
+	}
+
+	commitFile(t, dir, "README", "changed")
+	ga, err = NewGitArchiveForTagWithPrefix(dir, "{{ .Version }}", "component/v1.2.3", "component/v")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := ga.Version(); err != nil || v != "1.2.3" {
+		t.Errorf("got version %q (%v) for tag, want 1.2.3", v, err)
+	}
+	if ga.prefix != "1.2.3" {
+		t.Errorf("got prefix %q, want 1.2.3", ga.prefix)
+	}
+	if !ga.FromGitObjects {
+		t.Error("archive of a tag behind HEAD does not read from git objects")
+	}
+}
+
+// setSourceDateEpoch sets SOURCE_DATE_EPOCH to value, or unsets it if value is empty, until the test
+// completes.
+func setSourceDateEpoch(t testing.TB, value string) {
+	t.Helper()
+	old, ok := os.LookupEnv("SOURCE_DATE_EPOCH")
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv("SOURCE_DATE_EPOCH", old)
+		} else {
+			os.Unsetenv("SOURCE_DATE_EPOCH")
+		}
+	})
+	if value == "" {
+		os.Unsetenv("SOURCE_DATE_EPOCH")
+	} else {
+		os.Setenv("SOURCE_DATE_EPOCH", value)
+	}
+}
+
+func TestCreateReproducible(t *testing.T) {
+	dir := initRepo(t)
+	commitFile(t, dir, "README", "hello")
+	commitFile(t, dir, "src/main.go", "package main\n")
+	runGit(t, dir, "tag", "v1.0.0")
+
+	formats := []struct {
+		name   string
+		format ArchiveFormat
+	}{
+		{"tgz", TgzArchive},
+		{"zip", ZipArchive},
+		{"txz", TxzArchive},
+		{"tzst", TzstArchive},
+	}
+	for _, epoch := range []string{"", "1600000000"} {
+		setSourceDateEpoch(t, epoch)
+		for _, f := range formats {
+			var archives [2][]byte
+			for i := range archives {
+				// The times and permissions of files in the working tree must not matter.
+				mtime := time.Now().Add(time.Duration(i) * time.Hour)
+				for _, name := range []string{"README", "src/main.go"} {
+					p := filepath.Join(dir, filepath.FromSlash(name))
+					if err := os.Chtimes(p, mtime, mtime); err != nil {
+						t.Fatal(err)
+					}
+					if err := os.Chmod(p, os.FileMode(0644-i*040)); err != nil {
+						t.Fatal(err)
+					}
+				}
+
+				ga, err := NewGitArchiveAt(dir, "tool-1.0.0")
+				if err != nil {
+					t.Fatal(err)
+				}
+				var b bytes.Buffer
+				if err := ga.Create(f.format, &b); err != nil {
+					t.Fatalf("%s: %s", f.name, err)
+				}
+				archives[i] = b.Bytes()
+			}
+			if !bytes.Equal(archives[0], archives[1]) {
+				t.Errorf("%s with SOURCE_DATE_EPOCH %q: archives differ", f.name, epoch)
+			}
+		}
+	}
+
+	ga, err := NewGitArchiveAt(dir, "tool-1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range readTgz(t, createTgz(t, ga)) {
+		if !e.hdr.ModTime.Equal(time.Unix(1600000000, 0)) {
+			t.Errorf("%s: got modification time %s, want SOURCE_DATE_EPOCH", e.hdr.Name, e.hdr.ModTime)
+		}
+	}
+}
+
+func TestCompressionLevel(t *testing.T) {
+	dir := initRepo(t)
+	// Text with repetition at varying distances, which better compression finds more of.
+	var b strings.Builder
+	words := []string{"archive", "commit", "tree", "tag", "version", "package", "release", "module"}
+	for i := 0; b.Len() < 256<<10; i++ {
+		b.WriteString(words[(i*i+i/7)%len(words)])
+		b.WriteByte(" \n"[i%11/10])
+	}
+	commitFile(t, dir, "words.txt", b.String())
+	runGit(t, dir, "tag", "v1.0.0")
+
+	size := func(level int) int {
+		ga, err := NewGitArchiveAt(dir, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ga.CompressionLevel = level
+		return len(createTgz(t, ga))
+	}
+	if best, speed := size(gzip.BestCompression), size(gzip.BestSpeed); best >= speed {
+		t.Errorf("got %d bytes with the best compression, not less than %d with the best speed", best, speed)
+	}
+}
+
+// tgzNames returns the names of the entries of the TgzArchive created from ga.
+func tgzNames(t testing.TB, ga *GitArchive) []string {
+	t.Helper()
+	var names []string
+	for _, e := range readTgz(t, createTgz(t, ga)) {
+		names = append(names, e.hdr.Name)
+	}
+	return names
+}
+
+func TestExclude(t *testing.T) {
+	dir := initRepo(t)
+	for name, content := range map[string]string{
+		".gitattributes": "testdata export-ignore\n*.secret export-ignore\n",
+		"README":         "hello",
+		"key.secret":     "secret",
+		"testdata/x":     "x",
+		"docs/guide.md":  "guide",
+		"build/out.o":    "object",
+		"src/main.go":    "package main\n",
+		"src/main.o":     "object",
+	} {
+		commitFile(t, dir, name, content)
+	}
+	runGit(t, dir, "tag", "v1.0.0")
+
+	ga, err := NewGitArchiveAt(dir, "p")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ga.Exclude = []string{"docs", "*/*.o"}
+
+	// The build directory is left empty by the exclusions, so it is not written.
+	want := []string{"p/.gitattributes", "p/README", "p/src/", "p/src/main.go"}
+	if got := tgzNames(t, ga); strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("got entries %v, want %v", got, want)
+	}
+}
+
+func TestOnProgress(t *testing.T) {
+	dir := initRepo(t)
+	commitFile(t, dir, "b", "b")
+	commitFile(t, dir, "a/c", "c")
+	runGit(t, dir, "tag", "v1.0.0")
+
+	for _, format := range []ArchiveFormat{TgzArchive, ZipArchive} {
+		ga, err := NewGitArchiveAt(dir, "p")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ga.AddFile("VERSION", []byte("1.0.0"), 0644)
+
+		var names []string
+		ga.OnProgress = func(entry string, index, total int) {
+			if index != len(names) || total != 4 {
+				t.Errorf("format %d: got %s as entry %d of %d, want %d of 4", format, entry, index, total, len(names))
+			}
+			names = append(names, entry)
+		}
+		if err := ga.Create(format, ioutil.Discard); err != nil {
+			t.Fatal(err)
+		}
+		if want := "a a/c b VERSION"; strings.Join(names, " ") != want {
+			t.Errorf("format %d: got entries %v, want %s", format, names, want)
+		}
+	}
+}
+
+func TestCreateFile(t *testing.T) {
+	dir := initRepo(t)
+	commitFile(t, dir, "README", "hello")
+	runGit(t, dir, "tag", "v1.0.0")
+	ga, err := NewGitArchiveAt(dir, "tool-1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := tempDir(t)
+
+	tgz := filepath.Join(out, "tool-1.0.0.tar.gz")
+	if err := ga.CreateFile(TgzArchive, tgz); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(tgz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// readTgz fails unless the gzip stream and the tar archive are complete.
+	entries := readTgz(t, b)
+	if len(entries) == 0 || entries[len(entries)-1].content != "hello" {
+		t.Errorf("got entries %v", entries)
+	}
+
+	zipPath := filepath.Join(out, "tool-1.0.0.zip")
+	if err := ga.CreateFile(ZipArchive, zipPath); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.OpenReader(zipPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr.Close()
+	found := false
+	for _, f := range zr.File {
+		if f.Name != "tool-1.0.0/README" {
+			continue
+		}
+		found = true
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content) != "hello" {
+			t.Errorf("got README %q", content)
+		}
+	}
+	if !found {
+		t.Error("README not found in zip archive")
+	}
+
+	// A file that cannot be completed is removed.
+	ga.AddFile("../outside", []byte("x"), 0644)
+	bad := filepath.Join(out, "bad.tar.gz")
+	if err := ga.CreateFile(TgzArchive, bad); err == nil {
+		t.Error("no error")
+	}
+	if _, err := os.Stat(bad); !os.IsNotExist(err) {
+		t.Errorf("%s was not removed: %v", bad, err)
+	}
+}
+
+// limitWriter fails once more than n bytes have been written to it.
+type limitWriter struct {
+	n int
+}
+
+func (w *limitWriter) Write(p []byte) (int, error) {
+	if len(p) > w.n {
+		n := w.n
+		w.n = 0
+		return n, errors.New("write limit reached")
+	}
+	w.n -= len(p)
+	return len(p), nil
+}
+
+func TestCreateFinishError(t *testing.T) {
+	dir := initRepo(t)
+	commitFile(t, dir, "README", "hello")
+	runGit(t, dir, "tag", "v1.0.0")
+	ga, err := NewGitArchiveAt(dir, "tool-1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, format := range []ArchiveFormat{TgzArchive, ZipArchive, TxzArchive, ZstArchive, TarArchive} {
+		var b bytes.Buffer
+		if err := ga.Create(format, &b); err != nil {
+			t.Fatal(err)
+		}
+		// Only the last byte, written when the archive is finished, cannot be written.
+		err := ga.Create(format, &limitWriter{n: b.Len() - 1})
+		if err == nil || !strings.Contains(err.Error(), "while finishing") {
+			t.Errorf("format %v: got error %v", format, err)
+		}
+	}
+}
+
+func TestCreateSigned(t *testing.T) {
+	dir := initRepo(t)
+	commitFile(t, dir, "README", "hello")
+	runGit(t, dir, "tag", "v1.0.0")
+	ga, err := NewGitArchiveAt(dir, "tool-1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path, _ := writeTestKey(t)
+	key, err := LoadSigningKey(SigningOptions{KeyFile: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var archive, sig bytes.Buffer
+	if err := ga.CreateSigned(TgzArchive, &archive, &sig, key); err != nil {
+		t.Fatal(err)
+	}
+	keyring := openpgp.EntityList{key}
+	if _, err := openpgp.CheckArmoredDetachedSignature(keyring, bytes.NewReader(archive.Bytes()), bytes.NewReader(sig.Bytes())); err != nil {
+		t.Errorf("while verifying signature: %s", err)
+	}
+
+	b := archive.Bytes()
+	b[len(b)-1] ^= 1
+	if _, err := openpgp.CheckArmoredDetachedSignature(keyring, bytes.NewReader(b), bytes.NewReader(sig.Bytes())); err == nil {
+		t.Error("signature of modified archive verified")
+	}
+
+	if err := ga.CreateSigned(TgzArchive, ioutil.Discard, ioutil.Discard, nil); err == nil {
+		t.Error("signed without a key")
+	}
+}
+
+func TestNewGitArchiveAuto(t *testing.T) {
+	dir := initRepo(t)
+	commitFile(t, dir, "README", "hello")
+	runGit(t, dir, "tag", "v0.1.0")
+	chdir(t, dir)
+
+	ga, err := NewGitArchiveAuto()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Base(dir) + "-0.1.0"; ga.prefix != want {
+		t.Errorf("without go.mod: got prefix %q, want %q", ga.prefix, want)
+	}
+
+	commitFile(t, dir, "go.mod", "module example.com/widget/v2\n\ngo 1.14\n")
+	runGit(t, dir, "tag", "v2.0.0")
+	ResetGitDescribeCache()
+	if ga, err = NewGitArchiveAuto(); err != nil {
+		t.Fatal(err)
+	}
+	if ga.prefix != "widget-2.0.0" {
+		t.Errorf("from go.mod: got prefix %q, want %q", ga.prefix, "widget-2.0.0")
+	}
+
+	runGit(t, dir, "remote", "add", "origin", "git@github.com:ctrliq/gadget.git")
+	if ga, err = NewGitArchiveAuto(); err != nil {
+		t.Fatal(err)
+	}
+	if ga.prefix != "gadget-2.0.0" {
+		t.Errorf("from remote: got prefix %q, want %q", ga.prefix, "gadget-2.0.0")
+	}
+}
+
+func TestURLName(t *testing.T) {
+	tests := map[string]string{
+		"https://github.com/ctrliq/gobuild.git":  "gobuild",
+		"https://github.com/ctrliq/gobuild/":     "gobuild",
+		"git@github.com:ctrliq/gobuild.git":      "gobuild",
+		"git@example.com:gobuild":                "gobuild",
+		"ssh://git@example.com:2222/gobuild.git": "gobuild",
+		"/srv/git/gobuild.git":                   "gobuild",
+	}
+	for url, want := range tests {
+		if got := urlName(url); got != want {
+			t.Errorf("%s: got %q, want %q", url, got, want)
+		}
+	}
+}
+
+func TestModeFilter(t *testing.T) {
+	dir := initRepo(t)
+	commitFile(t, dir, "README", "hello")
+	commitFile(t, dir, "bin/run", "#!/bin/sh\n")
+	if err := os.Chmod(filepath.Join(dir, "bin", "run"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	runGit(t, dir, "commit", "--quiet", "-a", "-m", "make bin/run executable")
+	runGit(t, dir, "tag", "v1.0.0")
+
+	ga, err := NewGitArchiveAt(dir, "tool-1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	ga.ModeFilter = func(path string, mode os.FileMode) os.FileMode {
+		paths = append(paths, path)
+		if mode.IsDir() {
+			return mode
+		}
+		return mode &^ 0111
+	}
+
+	var sawRun bool
+	for _, e := range readTgz(t, createTgz(t, ga)) {
+		want := int64(0644)
+		if e.hdr.Typeflag == tar.TypeDir {
+			want = 0755
+		}
+		if e.hdr.Mode != want {
+			t.Errorf("%s: got mode %o, want %o", e.hdr.Name, e.hdr.Mode, want)
+		}
+		sawRun = sawRun || e.hdr.Name == "tool-1.0.0/bin/run"
+	}
+	if !sawRun {
+		t.Error("bin/run not found in archive")
+	}
+	for _, p := range paths {
+		if strings.HasPrefix(p, "tool-1.0.0") {
+			t.Errorf("filter called with prefixed path %s", p)
+		}
+	}
+
+	// Without a filter, the executable bit is kept.
+	ga.ModeFilter = nil
+	for _, e := range readTgz(t, createTgz(t, ga)) {
+		if e.hdr.Name == "tool-1.0.0/bin/run" && e.hdr.Mode != 0755 {
+			t.Errorf("without filter: got mode %o for bin/run, want 755", e.hdr.Mode)
+		}
+	}
+}
+
+func TestZipMethod(t *testing.T) {
+	dir := initRepo(t)
+	text := strings.Repeat("hello, world\n", 100)
+	commitFile(t, dir, "README", text)
+	commitFile(t, dir, "src/main.go", "package main\n")
+	runGit(t, dir, "tag", "v1.0.0")
+	ga, err := NewGitArchiveAt(dir, "tool-1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, method := range []uint16{zip.Store, zip.Deflate} {
+		ga.ZipMethod = method
+		var b bytes.Buffer
+		if err := ga.Create(ZipArchive, &b); err != nil {
+			t.Fatal(err)
+		}
+		zr, err := zip.NewReader(bytes.NewReader(b.Bytes()), int64(b.Len()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, f := range zr.File {
+			if f.FileInfo().IsDir() {
+				continue
+			}
+			if f.Method != method {
+				t.Errorf("method %d: %s: got method %d", method, f.Name, f.Method)
+			}
+			stored := f.CompressedSize64 == f.UncompressedSize64
+			if method == zip.Store && !stored {
+				t.Errorf("stored %s: got %d compressed bytes, want %d", f.Name, f.CompressedSize64, f.UncompressedSize64)
+			}
+			if f.Name == "tool-1.0.0/README" && method == zip.Deflate && stored {
+				t.Errorf("deflated %s: got %d compressed bytes", f.Name, f.CompressedSize64)
+			}
+		}
+	}
+
+	ga.ZipMethod = 99
+	if err := ga.Create(ZipArchive, ioutil.Discard); err == nil {
+		t.Error("unsupported method: no error")
+	}
+}
+
+func TestManifest(t *testing.T) {
+	dir := initRepo(t)
+	commitFile(t, dir, "README", "hello")
+	commitFile(t, dir, "src/main.go", "package main\n")
+	if err := os.Symlink("README", filepath.Join(dir, "README.md")); err != nil {
+		t.Fatal(err)
+	}
+	runGit(t, dir, "add", "README.md")
+	runGit(t, dir, "commit", "--quiet", "-m", "add README.md")
+	commit := runGit(t, dir, "rev-parse", "HEAD")
+	runGit(t, dir, "tag", "v1.2.3")
+
+	ga, err := NewGitArchiveAt(dir, "tool-1.2.3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ga.AddFile("VERSION", []byte("1.2.3\n"), 0644)
+
+	b, err := ga.Manifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m ArchiveManifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		t.Fatal(err)
+	}
+	if m.Tag != "v1.2.3" || m.Version != "1.2.3" || m.Commit != commit {
+		t.Errorf("got tag %s, version %s and commit %s, want v1.2.3, 1.2.3 and %s", m.Tag, m.Version, m.Commit, commit)
+	}
+
+	entries := readTgz(t, createTgz(t, ga))
+	if len(m.Entries) != len(entries) {
+		t.Fatalf("got %d manifest entries for %d archive entries", len(m.Entries), len(entries))
+	}
+	types := map[byte]string{tar.TypeReg: "file", tar.TypeDir: "dir", tar.TypeSymlink: "symlink"}
+	for i, e := range entries {
+		want := ManifestEntry{
+			Name: e.hdr.Name,
+			Type: types[e.hdr.Typeflag],
+			Mode: fmt.Sprintf("%04o", e.hdr.Mode),
+		}
+		if e.hdr.Typeflag == tar.TypeReg {
+			want.Size = e.hdr.Size
+		}
+		if m.Entries[i] != want {
+			t.Errorf("entry %d: got %+v, want %+v", i, m.Entries[i], want)
+		}
+	}
+}
@@ -4,58 +4,611 @@
 package gobuild
 
 import (
-	"errors"
+	"context"
 	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
 	"sync"
 
 	"github.com/blang/semver"
+	"github.com/go-git/go-billy/v5/osfs"
+	"github.com/go-git/go-billy/v5/util"
 	"github.com/go-git/go-git/v5"
 	"github.com/go-git/go-git/v5/plumbing"
+	commitgraphfmt "github.com/go-git/go-git/v5/plumbing/format/commitgraph"
+	"github.com/go-git/go-git/v5/plumbing/format/gitignore"
 	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/object/commitgraph"
 	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+	"github.com/magefile/mage/sh"
 )
 
-var onceGitDescribe sync.Once
-var cachedGitDescription *GitDescription
-var cachedGitDescriptionError error
+// DefaultTagPrefix is the tag prefix used by GitDescribe and GitDescribeAt.
+const DefaultTagPrefix = "v"
+
+// DescribeOptions controls how a git repository is described.
+type DescribeOptions struct {
+	// TagPrefix is the prefix that precedes the semantic version in tag names (for example, "v"
+	// for v1.2.3, or "release-" for release-1.2.3). If empty, only bare semver tags match.
+	TagPrefix string
+
+	// OmitBuildMetadata disables appending the abbreviated commit hash as build metadata to
+	// versions that are not tagged directly.
+	OmitBuildMetadata bool
+
+	// IgnoreUntracked treats untracked files as clean, so that, for example, build outputs do not
+	// make the working tree dirty. Untracked files ignored by .gitignore, .git/info/exclude or the
+	// excludes file of the git configuration never make it dirty.
+	IgnoreUntracked bool
+
+	// DirtyExcludes are gitignore patterns of paths, relative to the root of the working tree,
+	// whose changes do not make the working tree dirty.
+	DirtyExcludes []string
+
+	// FetchTags fetches the complete history and tags from the origin remote, with git fetch, if
+	// the repository is a shallow clone in which no semver tag is reachable from HEAD, as is
+	// common in CI.
+	FetchTags bool
+
+	// OnProgress, if non-nil, is called as the commit log is walked to find the nearest semver
+	// tag, with the number of commits walked so far. It is not part of the key of cached
+	// descriptions.
+	OnProgress func(commits uint64)
+}
+
+// gitDescribeKey identifies a cached description.
+type gitDescribeKey struct {
+	path string
+	opts string // options, formatted by newGitDescribeKey
+}
+
+// newGitDescribeKey returns the key of the description of path with opts.
+func newGitDescribeKey(path string, opts DescribeOptions) gitDescribeKey {
+	opts.OnProgress = nil
+	return gitDescribeKey{path: path, opts: fmt.Sprintf("%#v", opts)}
+}
+
+// gitDescribeResult holds the cached result of describing a repository.
+type gitDescribeResult struct {
+	once sync.Once
+	gd   *GitDescription
+	err  error
+}
+
+var gitDescribeCacheMu sync.Mutex
+var gitDescribeCache = make(map[gitDescribeKey]*gitDescribeResult)
 
 type GitDescription struct {
-	isClean bool                // if true, the git working tree has local modifications
+	opts    DescribeOptions     // options used to describe the repository
+	isClean bool                // if true, the git working tree has no local modifications
 	ref     *plumbing.Reference // reference being described
-	tag     *object.Tag         // nearest semver tag reachable from ref (or nil if none found)
-	n       uint64              // number of commits between nearest semver tag and ref (if tag is non-nil)
+	tag     *versionTag         // nearest semver tag reachable from ref (or nil if none found)
+	n       uint64              // number of commits between nearest semver tag and ref, or reachable from ref once counted if tag is nil
+	shallow bool                // if true, the repository is a shallow clone
+
+	repo      *git.Repository // repository described, in which untagged commits are counted
+	counted   bool            // if true, n was counted when ref was described
+	countOnce sync.Once       // counts untagged commits on first use
+	countErr  error           // error counting untagged commits, if any
+}
+
+// versionTag is a semver tag, which may be either annotated or lightweight.
+type versionTag struct {
+	name      string         // name of the tag (for example, v1.2.3)
+	annotated bool           // if true, the tag is an annotated tag object
+	commit    *object.Commit // commit the tag points to
+}
+
+// Tree returns the tree of the commit the tag points to.
+func (t *versionTag) Tree() (*object.Tree, error) {
+	return t.commit.Tree()
+}
+
+// treeEntry is an entry in a git tree, along with its path relative to the root of the tree.
+type treeEntry struct {
+	path string
+	object.TreeEntry
+	tree   *object.Tree   // tree containing the entry, from which its contents are read
+	commit *object.Commit // commit of tree, which differs from that of the tag for submodules
+}
+
+// treeEntries returns all entries in the tree the tag points to, recursively, in the order they are
+// walked. Each directory precedes its contents.
+func (t *versionTag) treeEntries() ([]treeEntry, error) {
+	tree, err := t.Tree()
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]treeEntry, 0)
+
+	tw := object.NewTreeWalker(tree, true, nil)
+	defer tw.Close()
+
+	for {
+		name, entry, err := tw.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, treeEntry{path: name, TreeEntry: entry, tree: tree, commit: t.commit})
+	}
+
+	return entries, nil
+}
+
+// listEntries returns the paths of all entries in the tree the tag points to.
+func (t *versionTag) listEntries() []string {
+	tes, err := t.treeEntries()
+	if err != nil {
+		return nil
+	}
+
+	entries := make([]string, 0, len(tes))
+	for _, te := range tes {
+		entries = append(entries, te.path)
+	}
+
+	return entries
 }
 
+// GitDescribe returns a description of HEAD in the git repository containing the current working
+// directory.
 func GitDescribe() (*GitDescription, error) {
-	onceGitDescribe.Do(func() {
-		// Open git repo.
-		repo, err := git.PlainOpen(".")
-		if err != nil {
-			cachedGitDescriptionError = err
-			return
+	return GitDescribeAt(".")
+}
+
+// GitDescribeAt returns a description of HEAD in the git repository containing path. Parent
+// directories of path are searched for the repository in the same way as git.
+func GitDescribeAt(path string) (*GitDescription, error) {
+	return GitDescribeWithOptions(path, DescribeOptions{TagPrefix: DefaultTagPrefix})
+}
+
+// GitDescribeWithOptions returns a description of HEAD in the git repository containing path,
+// using opts. Successful results are cached per path and options until ResetGitDescribeCache is
+// called.
+func GitDescribeWithOptions(path string, opts DescribeOptions) (*GitDescription, error) {
+	return GitDescribeContext(context.Background(), path, opts)
+}
+
+// GitDescribeContext returns a description of HEAD in the git repository containing path, in the
+// same way as GitDescribeWithOptions. If ctx is done before the description is complete, ctx.Err()
+// is returned, as it is to concurrent calls waiting for the same description.
+func GitDescribeContext(ctx context.Context, path string, opts DescribeOptions) (*GitDescription, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	key := newGitDescribeKey(abs, opts)
+
+	gitDescribeCacheMu.Lock()
+	res, ok := gitDescribeCache[key]
+	if !ok {
+		res = new(gitDescribeResult)
+		gitDescribeCache[key] = res
+	}
+	gitDescribeCacheMu.Unlock()
+
+	res.once.Do(func() {
+		res.gd, res.err = describePath(ctx, abs, opts)
+	})
+
+	// Don't cache errors, so that a transient failure is retried on the next call.
+	if res.err != nil {
+		gitDescribeCacheMu.Lock()
+		if gitDescribeCache[key] == res {
+			delete(gitDescribeCache, key)
 		}
+		gitDescribeCacheMu.Unlock()
+	}
 
-		// Get HEAD commit.
-		head, err := repo.Head()
-		if err != nil {
-			cachedGitDescriptionError = err
-			return
+	return res.gd, res.err
+}
+
+// GitDescribeFresh returns a description of HEAD in the git repository containing path, in the
+// same way as GitDescribeWithOptions, but always re-reads the repository. On success, the cached
+// description for path and opts is replaced, so that subsequent cached calls also see it.
+func GitDescribeFresh(path string, opts DescribeOptions) (*GitDescription, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	gd, err := describePath(context.Background(), abs, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &gitDescribeResult{gd: gd}
+	res.once.Do(func() {})
+
+	gitDescribeCacheMu.Lock()
+	gitDescribeCache[newGitDescribeKey(abs, opts)] = res
+	gitDescribeCacheMu.Unlock()
+
+	return gd, nil
+}
+
+// ResetGitDescribeCache discards all cached descriptions, so that subsequent calls to GitDescribe
+// and related functions re-read the repository. It is safe to call concurrently with them.
+func ResetGitDescribeCache() {
+	gitDescribeCacheMu.Lock()
+	gitDescribeCache = make(map[gitDescribeKey]*gitDescribeResult)
+	gitDescribeCacheMu.Unlock()
+}
+
+// openRepo opens the git repository containing path.
+func openRepo(path string) (*git.Repository, error) {
+	return git.PlainOpenWithOptions(path, &git.PlainOpenOptions{DetectDotGit: true})
+}
+
+// worktreeRoot returns the root directory of the working tree of repo.
+func worktreeRoot(repo *git.Repository) (string, error) {
+	wt, err := repo.Worktree()
+	if err != nil {
+		return "", fmt.Errorf("while getting worktree: %s", err)
+	}
+	return wt.Filesystem.Root(), nil
+}
+
+// describePath opens the git repository containing path and returns a description of HEAD.
+func describePath(ctx context.Context, path string, opts DescribeOptions) (*GitDescription, error) {
+	// Open git repo.
+	repo, err := openRepo(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// Get HEAD commit.
+	head, err := repo.Head()
+	if err != nil {
+		return nil, err
+	}
+
+	w, err := repo.Worktree()
+	if err != nil {
+		return nil, fmt.Errorf("worktree: %s", err)
+	}
+
+	// go-git only reads .gitignore files, so add the other patterns git uses to ignore files.
+	if w.Excludes, err = excludePatterns(repo); err != nil {
+		return nil, err
+	}
+
+	status, err := w.Status()
+	if err != nil {
+		return nil, fmt.Errorf("worktree status: %s", err)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	gd, err := describe(ctx, repo, head, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.FetchTags && gd.shallow && gd.tag == nil {
+		if err := fetchHistory(w.Filesystem.Root()); err != nil {
+			return nil, err
+		}
+		// The storage of repo caches its packfile indexes and shallow commits, so reopen the
+		// repository to read the fetched history.
+		if repo, err = openRepo(w.Filesystem.Root()); err != nil {
+			return nil, err
+		}
+		if gd, err = describe(ctx, repo, head, opts); err != nil {
+			return nil, err
+		}
+	}
+
+	gd.isClean = worktreeClean(status, opts)
+	return gd, nil
+}
+
+// fetchHistory fetches the complete history and tags of the shallow clone at root from the origin
+// remote. The git command is used, so that its credential helpers and SSH configuration apply.
+func fetchHistory(root string) error {
+	Log.Infof("fetching history and tags of shallow clone %s", root)
+	if err := sh.Run("git", "-C", root, "fetch", "--quiet", "--unshallow", "--tags", "origin"); err != nil {
+		return fmt.Errorf("while fetching tags: %s", err)
+	}
+	return nil
+}
+
+// excludePatterns returns the patterns of files ignored by git in the working tree of repo, other
+// than those of .gitignore files: those of info/exclude in the git directory and the excludes files
+// of the system and global git configuration. The git directory is read through the storage of
+// repo, as it need not be the .git directory of the working tree, such as in a submodule.
+func excludePatterns(repo *git.Repository) ([]gitignore.Pattern, error) {
+	fs := osfs.New("/")
+	ps, err := gitignore.LoadSystemPatterns(fs)
+	if err != nil {
+		return nil, fmt.Errorf("while reading system excludes: %s", err)
+	}
+	global, err := gitignore.LoadGlobalPatterns(fs)
+	if err != nil {
+		return nil, fmt.Errorf("while reading global excludes: %s", err)
+	}
+	ps = append(ps, global...)
+
+	var b []byte
+	if st, ok := repo.Storer.(*filesystem.Storage); ok {
+		if b, err = util.ReadFile(st.Filesystem(), "info/exclude"); err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("while reading info/exclude: %s", err)
+		}
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if line != "" && !strings.HasPrefix(line, "#") {
+			ps = append(ps, gitignore.ParsePattern(line, nil))
 		}
+	}
+	return ps, nil
+}
 
-		cachedGitDescription, err = describe(repo, head)
-		cachedGitDescriptionError = err
-	})
+// worktreeClean returns true if status has no changes, other than those allowed by opts.
+func worktreeClean(status git.Status, opts DescribeOptions) bool {
+	var excludes gitignore.Matcher
+	if len(opts.DirtyExcludes) > 0 {
+		var ps []gitignore.Pattern
+		for _, p := range opts.DirtyExcludes {
+			ps = append(ps, gitignore.ParsePattern(p, nil))
+		}
+		excludes = gitignore.NewMatcher(ps)
+	}
 
-	return cachedGitDescription, cachedGitDescriptionError
+	for path, s := range status {
+		if s.Staging == git.Unmodified && s.Worktree == git.Unmodified {
+			continue
+		}
+		if s.Worktree == git.Untracked && opts.IgnoreUntracked {
+			continue
+		}
+		if excludes != nil && excludes.Match(strings.Split(path, "/"), false) {
+			continue
+		}
+		return false
+	}
+	return true
+}
+
+// GitDescribeRef returns a description of the revision name (for example, a branch, tag or commit
+// hash) in the git repository containing the current working directory, without checking it out.
+// The working tree is not examined, so the description is always considered clean. Unlike
+// GitDescribe, the result is not cached.
+func GitDescribeRef(name string) (*GitDescription, error) {
+	return GitDescribeRefWithOptions(".", name, DescribeOptions{TagPrefix: DefaultTagPrefix})
+}
+
+// GitDescribeRefWithOptions returns a description of the revision name in the git repository
+// containing path, in the same way as GitDescribeRef, using opts.
+func GitDescribeRefWithOptions(path, name string, opts DescribeOptions) (*GitDescription, error) {
+	repo, err := openRepo(path)
+	if err != nil {
+		return nil, err
+	}
+
+	h, err := repo.ResolveRevision(plumbing.Revision(name))
+	if err != nil {
+		return nil, fmt.Errorf("while resolving %s: %s", name, err)
+	}
+
+	ref := plumbing.NewHashReference(plumbing.ReferenceName(name), *h)
+	gd, err := describe(context.Background(), repo, ref, opts)
+	if err != nil {
+		return nil, err
+	}
+	gd.isClean = true
+	return gd, nil
 }
 
-// GetSemver returns a semantic version based on d.
+// TagName returns the name of the nearest semver tag reachable from the described reference. If
+// no such tag was found, ok is false.
+func (gd *GitDescription) TagName() (name string, ok bool) {
+	if gd.tag == nil {
+		return "", false
+	}
+	return gd.tag.name, true
+}
+
+// CommitsSinceTag returns the number of commits between the nearest semver tag and the described
+// reference, or zero if no tag was found.
+func (gd *GitDescription) CommitsSinceTag() uint64 {
+	if gd.tag == nil {
+		return 0
+	}
+	return gd.n
+}
+
+// Ref returns the commit hash of the described reference.
+func (gd *GitDescription) Ref() plumbing.Hash {
+	return gd.ref.Hash()
+}
+
+// TagAnnotated returns true if the nearest semver tag is an annotated tag, or false if it is a
+// lightweight tag or no tag was found.
+func (gd *GitDescription) TagAnnotated() bool {
+	return gd.tag != nil && gd.tag.annotated
+}
+
+// CommitHash returns the hexadecimal commit hash of the described reference.
+func (gd *GitDescription) CommitHash() string {
+	return gd.ref.Hash().String()
+}
+
+// Reference returns the described reference: the branch HEAD points to (or HEAD itself, if it is
+// detached), or the revision passed to GitDescribeRef.
+func (gd *GitDescription) Reference() *plumbing.Reference {
+	return gd.ref
+}
+
+// IsShallow returns true if the repository is a shallow clone. The history of a shallow clone may
+// not reach the nearest semver tag, in which case no tag is found; see DescribeOptions.FetchTags.
+func (gd *GitDescription) IsShallow() bool {
+	return gd.shallow
+}
+
+// IsClean returns true if the git working tree has no local modifications. It is always true for
+// descriptions returned by GitDescribeRef.
+func (gd *GitDescription) IsClean() bool {
+	return gd.isClean
+}
+
+// SemverOptions controls how GetSemverWithOptions derives a version for a commit that is not
+// tagged directly.
+type SemverOptions struct {
+	// PreRelease is the pre-release identifier added when the nearest tag is a release (for
+	// example, "alpha" for 0.1.3-alpha.3). If empty, no identifier is added.
+	PreRelease string
+
+	// Devel is the pre-release identifier followed by the number of commits since the tag (for
+	// example, "devel" for 0.1.3-alpha.3.devel.2). If empty, no identifier is added.
+	Devel string
+
+	// BumpPatch increments the patch version when the nearest tag is a release, so that the
+	// version sorts after the tag.
+	BumpPatch bool
+
+	// CommitMetadata appends the abbreviated commit hash as build metadata (for example,
+	// +g1a2b3c4).
+	CommitMetadata bool
+
+	// DirtyMetadata appends "dirty" to the build metadata when the working tree has local
+	// modifications. Unlike the other options, this also applies to tagged commits.
+	DirtyMetadata bool
+
+	// BranchMetadata appends the name of the branch being built as build metadata, with
+	// characters not allowed in build metadata replaced by '-' (for example, +feature-foo).
+	BranchMetadata bool
+}
+
+// DefaultSemverOptions returns the options used by GetSemver, if SemverPolicy is not set.
+func (gd *GitDescription) DefaultSemverOptions() SemverOptions {
+	return SemverOptions{
+		PreRelease:     "alpha",
+		Devel:          "devel",
+		BumpPatch:      true,
+		CommitMetadata: !gd.opts.OmitBuildMetadata,
+		DirtyMetadata:  true,
+	}
+}
+
+// SemverPolicy, if set, returns the options used by GetSemver for gd, in place of
+// DefaultSemverOptions. See BranchSemverPolicy.
+var SemverPolicy func(gd *GitDescription) SemverOptions
+
+// GetSemver returns a semantic version based on d. If the working tree has local modifications,
+// "dirty" is appended to the build metadata (for example, 0.1.2+dirty), so that the version
+// differs from that of a clean build without affecting precedence.
 func (gd *GitDescription) GetSemver() (semver.Version, error) {
+	if SemverPolicy != nil {
+		return gd.GetSemverWithOptions(SemverPolicy(gd))
+	}
+	return gd.GetSemverWithOptions(gd.DefaultSemverOptions())
+}
+
+// BranchSemverOptions are the options used by a BranchSemverPolicy for the branches whose names
+// match Pattern.
+type BranchSemverOptions struct {
+	Pattern string // path.Match pattern of branch names, such as main or release/*, or empty for any
+	Options SemverOptions
+}
+
+// DefaultBranchSemverOptions are options for a BranchSemverPolicy, by which commits after a tag on
+// release/* branches are versioned as release candidates of the next patch version (for example,
+// 1.2.4-rc.3), those on main and master as alpha and devel versions by DefaultSemverOptions, and
+// those on other branches additionally have the branch name as build metadata.
+var DefaultBranchSemverOptions = []BranchSemverOptions{
+	{
+		Pattern: "release/*",
+		Options: SemverOptions{Devel: "rc", BumpPatch: true, DirtyMetadata: true},
+	},
+	{
+		Pattern: "main",
+		Options: SemverOptions{
+			PreRelease: "alpha", Devel: "devel", BumpPatch: true,
+			CommitMetadata: true, DirtyMetadata: true,
+		},
+	},
+	{
+		Pattern: "master",
+		Options: SemverOptions{
+			PreRelease: "alpha", Devel: "devel", BumpPatch: true,
+			CommitMetadata: true, DirtyMetadata: true,
+		},
+	},
+	{
+		Options: SemverOptions{
+			PreRelease: "alpha", Devel: "devel", BumpPatch: true,
+			CommitMetadata: true, DirtyMetadata: true, BranchMetadata: true,
+		},
+	},
+}
+
+// BranchSemverPolicy returns a SemverPolicy that uses the options of the first of branches whose
+// pattern matches the branch being built, as returned by GitDescription.Branch. If no pattern
+// matches, or the branch is unknown, DefaultSemverOptions are used. In all cases, CommitMetadata
+// is disabled if the description was made with OmitBuildMetadata.
+func BranchSemverPolicy(branches ...BranchSemverOptions) func(gd *GitDescription) SemverOptions {
+	return func(gd *GitDescription) SemverOptions {
+		opts := gd.DefaultSemverOptions()
+		if name, ok := gd.Branch(); ok {
+			for _, b := range branches {
+				if ok, _ := path.Match(b.Pattern, name); ok || b.Pattern == "" {
+					opts = b.Options
+					break
+				}
+			}
+		}
+		if gd.opts.OmitBuildMetadata {
+			opts.CommitMetadata = false
+		}
+		return opts
+	}
+}
+
+// Branch returns the name of the branch being built. If HEAD is detached, as is common in CI, the
+// branch is taken from the GITHUB_HEAD_REF, GITHUB_REF or CI_COMMIT_BRANCH environment variables
+// set by GitHub Actions and GitLab CI. If the branch is unknown, ok is false.
+func (gd *GitDescription) Branch() (name string, ok bool) {
+	if gd.ref.Name().IsBranch() {
+		return gd.ref.Name().Short(), true
+	}
+	if gd.ref.Name() != plumbing.HEAD {
+		return "", false
+	}
+
+	if name := os.Getenv("GITHUB_HEAD_REF"); name != "" {
+		return name, true
+	}
+	if ref := os.Getenv("GITHUB_REF"); strings.HasPrefix(ref, "refs/heads/") {
+		return strings.TrimPrefix(ref, "refs/heads/"), true
+	}
+	if name := os.Getenv("CI_COMMIT_BRANCH"); name != "" {
+		return name, true
+	}
+	return "", false
+}
+
+// branchMetadataRE matches runs of characters not allowed in build metadata.
+var branchMetadataRE = regexp.MustCompile(`[^0-9A-Za-z-]+`)
+
+// GetSemverWithOptions returns a semantic version based on d, in the same way as GetSemver, using
+// opts.
+func (gd *GitDescription) GetSemverWithOptions(opts SemverOptions) (semver.Version, error) {
 	if gd.tag == nil {
-		return semver.Version{}, errors.New("no semver tags found")
+		return semver.Version{}, ErrNoSemverTags
 	}
 
-	v, err := semver.Parse(gd.tag.Name[1:])
+	v, err := parseTagVersion(gd.tag.name, gd.opts.TagPrefix)
 	if err != nil {
 		return semver.Version{}, err
 	}
@@ -64,49 +617,109 @@ func (gd *GitDescription) GetSemver() (semver.Version, error) {
 	if gd.n > 0 {
 		if len(v.Pre) == 0 {
 			// The tag is not a pre-release version. Bump the patch version and add a pre-release
-			// of alpha.0. Semantically, this indicates this is pre-alpha.1, which would normally
-			// be the first alpha version.
-			v.Patch++
-			v.Pre = append(v.Pre, semver.PRVersion{VersionStr: fmt.Sprintf("alpha.%d", v.Patch)})
+			// such as alpha.N, so that the version sorts after the tag but before the next
+			// release.
+			if opts.BumpPatch {
+				v.Patch++
+			}
+			if opts.PreRelease != "" {
+				pre := fmt.Sprintf("%s.%d", opts.PreRelease, v.Patch)
+				v.Pre = append(v.Pre, semver.PRVersion{VersionStr: pre})
+			}
 		}
 
 		// Append devel.N to pre-release version. For example, if the tag is 0.1.2-alpha.1, tag as
 		// 0.1.2-alpha.1.devel.3. Semantically, this indicates this version is between alpha.1 and
 		// alpha.2.
-		v.Pre = append(v.Pre, semver.PRVersion{VersionStr: fmt.Sprintf("devel.%d", gd.n)})
+		if opts.Devel != "" {
+			v.Pre = append(v.Pre, semver.PRVersion{VersionStr: fmt.Sprintf("%s.%d", opts.Devel, gd.n)})
+		}
+
+		// Append the abbreviated commit hash as build metadata, in the style of git describe. For
+		// example, 0.1.2-alpha.1.devel.3+g1a2b3c4. Build metadata does not affect precedence.
+		if opts.CommitMetadata {
+			v.Build = append(v.Build, "g"+gd.ref.Hash().String()[:7])
+		}
+
+		if name, ok := gd.Branch(); ok && opts.BranchMetadata {
+			if b := strings.Trim(branchMetadataRE.ReplaceAllString(name, "-"), "-"); b != "" {
+				v.Build = append(v.Build, b)
+			}
+		}
+	}
+
+	if opts.DirtyMetadata && !gd.isClean {
+		v.Build = append(v.Build, "dirty")
 	}
 
 	return v, nil
 }
 
-func (gd *GitDescription) ListEntries() []string {
-	if gd.tag == nil {
-		return nil
-	}
-	tree, err := gd.tag.Tree()
+// UntaggedSemver returns a version for a description in which no semver tag was found, such as
+// that of a shallow clone: base, followed by the number of commits reachable from the described
+// reference and, as for GetSemver, the abbreviated commit hash and "dirty" as build metadata. For
+// example, 0.0.0-devel.12+g1a2b3c4 for a base of 0.0.0-devel.
+func (gd *GitDescription) UntaggedSemver(base semver.Version) (semver.Version, error) {
+	n, err := gd.untaggedCommits()
 	if err != nil {
-		return nil
+		return semver.Version{}, err
 	}
 
-	entries := make([]string, 0)
-
-	tw := object.NewTreeWalker(tree, true, nil)
-	defer tw.Close()
+	v := base
+	v.Pre = append(append([]semver.PRVersion(nil), base.Pre...), semver.PRVersion{VersionNum: n, IsNum: true})
+	v.Build = append([]string(nil), base.Build...)
+	if !gd.opts.OmitBuildMetadata {
+		v.Build = append(v.Build, "g"+gd.ref.Hash().String()[:7])
+	}
+	if !gd.isClean {
+		v.Build = append(v.Build, "dirty")
+	}
+	return v, nil
+}
 
-	for {
-		name, _, err := tw.Next()
-		if err != nil {
-			break
+// untaggedCommits returns the number of commits reachable from the described reference. If the
+// repository has no version tags, describe does not walk the history, so they are counted on first
+// use.
+func (gd *GitDescription) untaggedCommits() (uint64, error) {
+	gd.countOnce.Do(func() {
+		if gd.counted {
+			return
 		}
+		_, gd.countErr = walkToTag(gd.repo, gd.ref.Hash(), nil, false, func(commitgraph.CommitNode) error {
+			gd.n++
+			return nil
+		})
+		if gd.countErr != nil {
+			gd.countErr = fmt.Errorf("while counting commits of %s: %s", gd.ref.Name().Short(), gd.countErr)
+		}
+	})
+	return gd.n, gd.countErr
+}
 
-		entries = append(entries, name)
+func (gd *GitDescription) ListEntries() []string {
+	if gd.tag == nil {
+		return nil
 	}
+	return gd.tag.listEntries()
+}
 
-	return entries
+// parseTagVersion parses the semantic version from a tag name that begins with prefix.
+func parseTagVersion(name, prefix string) (semver.Version, error) {
+	if !strings.HasPrefix(name, prefix) {
+		return semver.Version{}, fmt.Errorf("tag %s does not have prefix %q", name, prefix)
+	}
+	s := strings.TrimPrefix(name, prefix)
+	if s == "" {
+		return semver.Version{}, fmt.Errorf("tag %s does not contain a version", name)
+	}
+	return semver.Parse(s)
 }
 
-// getVersionTags returns a map of commit hashes to tags.
-func getVersionTags(r *git.Repository) (map[plumbing.Hash]*object.Tag, error) {
+// getVersionTags returns a map of commit hashes to tags whose names consist of prefix followed by
+// a semantic version. Both annotated and lightweight tags are considered. If a commit has more than
+// one tag, annotated tags are preferred, followed by the highest version, so that the result does
+// not depend on the order tags are listed in.
+func getVersionTags(r *git.Repository, prefix string) (map[plumbing.Hash]*versionTag, error) {
 	// Get a list of tags. Note that we cannot use r.TagObjects() directly, since that returns
 	// objects that are not referenced (for example, deleted tags.)
 	tagIter, err := r.Tags()
@@ -115,69 +728,198 @@ func getVersionTags(r *git.Repository) (map[plumbing.Hash]*object.Tag, error) {
 	}
 
 	// Iterate through tags, selecting tags that match regex.
-	tags := make(map[plumbing.Hash]*object.Tag)
+	tags := make(map[plumbing.Hash]*versionTag)
+	versions := make(map[plumbing.Hash]semver.Version)
 	err = tagIter.ForEach(func(ref *plumbing.Reference) error {
-		name := ref.Name().Short()
-		if len(name) == 0 {
+		v, err := parseTagVersion(ref.Name().Short(), prefix)
+		if err != nil {
+			return nil
+		}
+
+		t, err := resolveTag(r, ref)
+		if err != nil {
+			return err
+		}
+		if t == nil {
 			return nil
 		}
-		if _, err := semver.Parse(name[1:]); err == nil {
-			t, err := r.TagObject(ref.Hash())
-			if err != nil {
-				return err
+
+		Log.Debugf("version tag %s at %s", ref.Name().Short(), t.commit.Hash)
+		if prev, ok := tags[t.commit.Hash]; ok {
+			if prev.annotated != t.annotated {
+				if prev.annotated {
+					return nil
+				}
+			} else if v.LTE(versions[t.commit.Hash]) {
+				return nil
 			}
-			tags[t.Target] = t
 		}
+		tags[t.commit.Hash] = t
+		versions[t.commit.Hash] = v
 		return nil
 	})
 
 	return tags, err
 }
 
-// describe returns a gitDescription of ref.
-func describe(r *git.Repository, ref *plumbing.Reference) (*GitDescription, error) {
-	w, err := r.Worktree()
-	if err != nil {
-		return nil, fmt.Errorf("worktree: %s", err)
-	}
-
-	status, err := w.Status()
-	if err != nil {
-		return nil, fmt.Errorf("worktree status: %s", err)
+// resolveTag returns the versionTag referenced by ref. If ref refers to an annotated tag object,
+// the commit it points to is resolved. Otherwise, ref is assumed to be a lightweight tag pointing
+// directly at a commit. If the tag does not point to a commit, nil is returned.
+func resolveTag(r *git.Repository, ref *plumbing.Reference) (*versionTag, error) {
+	t, err := r.TagObject(ref.Hash())
+	switch err {
+	case nil:
+		c, err := t.Commit()
+		if err == object.ErrUnsupportedObject {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+		return &versionTag{name: ref.Name().Short(), annotated: true, commit: c}, nil
+	case plumbing.ErrObjectNotFound:
+		c, err := r.CommitObject(ref.Hash())
+		if err == plumbing.ErrObjectNotFound {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+		return &versionTag{name: ref.Name().Short(), commit: c}, nil
+	default:
+		return nil, err
 	}
+}
 
+// describe returns a GitDescription of ref. The caller is responsible for setting isClean.
+func describe(ctx context.Context, r *git.Repository, ref *plumbing.Reference, opts DescribeOptions) (*GitDescription, error) {
 	// Get version tags.
-	tags, err := getVersionTags(r)
+	tags, err := getVersionTags(r, opts.TagPrefix)
 	if err != nil {
 		return nil, fmt.Errorf("version tag: %s", err)
 	}
 
-	// Get commit log.
-	logIter, err := r.Log(&git.LogOptions{
-		Order: git.LogOrderCommitterTime,
-		From:  ref.Hash(),
-	})
+	shallow, err := r.Storer.Shallow()
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("while reading shallow commits: %s", err)
 	}
 
 	gd := &GitDescription{
-		isClean: status.IsClean(),
+		opts:    opts,
 		ref:     ref,
+		shallow: len(shallow) > 0,
+		repo:    r,
 	}
 
-	// Iterate through commit log until we find a matching tag.
-	err = logIter.ForEach(func(c *object.Commit) error {
-		if t, ok := tags[c.Hash]; ok {
-			gd.tag = t
-			return storer.ErrStop
+	Log.Debugf("describing %s (%s): %d version tags with prefix %q", ref.Name().Short(), ref.Hash(), len(tags), opts.TagPrefix)
+
+	// If there are no version tags, there is no need to walk the commit log, which may be long.
+	// The commits are counted only if UntaggedSemver needs them, unless the repository is a
+	// shallow clone, whose history is short.
+	if len(tags) == 0 && !gd.shallow {
+		Log.Debugf("no version tags with prefix %q", opts.TagPrefix)
+		return gd, nil
+	}
+
+	// If no tag is found, the whole history is walked, which counts the commits for UntaggedSemver.
+	gd.counted = true
+	gd.tag, err = walkToTag(r, ref.Hash(), tags, false, func(commitgraph.CommitNode) error {
+		if err := ctx.Err(); err != nil {
+			return err
 		}
 		gd.n++
+		if opts.OnProgress != nil {
+			opts.OnProgress(gd.n)
+		}
 		return nil
 	})
 	if err != nil {
 		return nil, err
 	}
 
+	if gd.tag != nil {
+		Log.Debugf("nearest tag of %s is %s, with %d commits since", ref.Name().Short(), gd.tag.name, gd.n)
+	} else if gd.shallow {
+		Log.Debugf("no tag found in %d commits of %s in shallow clone", gd.n, ref.Name().Short())
+	} else {
+		Log.Debugf("no tag found in %d commits of %s", gd.n, ref.Name().Short())
+	}
+
 	return gd, nil
 }
+
+// walkToTag walks the commit log from the commit h in committer time order (the same order as git
+// log), calling fn for each commit until one with a tag in tags is found, and returns that tag. If
+// skipFirst is true, a tag on h itself is ignored. If no tag is found, nil is returned. Commit
+// nodes are read from the commit-graph file where available, which avoids decoding each commit
+// object.
+func walkToTag(r *git.Repository, h plumbing.Hash, tags map[plumbing.Hash]*versionTag, skipFirst bool, fn func(commitgraph.CommitNode) error) (*versionTag, error) {
+	index, closeIndex := newCommitNodeIndex(r)
+	defer closeIndex()
+
+	head, err := index.Get(h)
+	if err != nil {
+		return nil, err
+	}
+	missing, err := shallowParents(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var tag *versionTag
+	err = commitgraph.NewCommitNodeIterCTime(head, missing, nil).ForEach(func(c commitgraph.CommitNode) error {
+		if t, ok := tags[c.ID()]; ok && !(skipFirst && c.ID() == h) {
+			tag = t
+			return storer.ErrStop
+		}
+		return fn(c)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return tag, nil
+}
+
+// shallowParents returns the parents of the commits at which the history of a shallow clone is
+// cut, which are missing from r, so that walks of the history stop there rather than fail.
+func shallowParents(r *git.Repository) (map[plumbing.Hash]bool, error) {
+	shallow, err := r.Storer.Shallow()
+	if err != nil {
+		return nil, fmt.Errorf("while reading shallow commits: %s", err)
+	}
+
+	parents := make(map[plumbing.Hash]bool)
+	for _, h := range shallow {
+		c, err := r.CommitObject(h)
+		if err != nil {
+			return nil, fmt.Errorf("while reading shallow commit %s: %s", h, err)
+		}
+		for _, p := range c.ParentHashes {
+			parents[p] = true
+		}
+	}
+	return parents, nil
+}
+
+// newCommitNodeIndex returns an index of commit nodes in r, along with a function to release it. If
+// r has a commit-graph file, it is used. Otherwise, nodes are read from commit objects.
+func newCommitNodeIndex(r *git.Repository) (commitgraph.CommitNodeIndex, func()) {
+	objectIndex := commitgraph.NewObjectCommitNodeIndex(r.Storer)
+
+	s, ok := r.Storer.(*filesystem.Storage)
+	if !ok {
+		return objectIndex, func() {}
+	}
+
+	f, err := s.Filesystem().Open(path.Join("objects", "info", "commit-graph"))
+	if err != nil {
+		return objectIndex, func() {}
+	}
+
+	graph, err := commitgraphfmt.OpenFileIndex(f)
+	if err != nil {
+		f.Close()
+		return objectIndex, func() {}
+	}
+
+	return commitgraph.NewGraphCommitNodeIndex(graph, r.Storer), func() { f.Close() }
+}
@@ -0,0 +1,504 @@
+// SPDX-License-Identifier: BSD-3-Clause
+// Copyright (c) 2020-2021, Ctrl IQ, Inc. All rights reserved
+
+package gobuild
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/blang/semver"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object/commitgraph"
+)
+
+// tempDir returns a temporary directory that is removed when the test completes.
+func tempDir(t testing.TB) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "gobuild-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+// chdir changes the working directory to dir until the test completes.
+func chdir(t testing.TB, dir string) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+}
+
+// runGit runs git with args in dir, and returns its trimmed output.
+func runGit(t testing.TB, dir string, args ...string) string {
+	t.Helper()
+	return runGitEnv(t, dir, nil, args...)
+}
+
+// runGitEnv runs git with args in dir, with env added to its environment, and returns its trimmed
+// output.
+func runGitEnv(t testing.TB, dir string, env []string, args ...string) string {
+	t.Helper()
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(),
+		"GIT_AUTHOR_NAME=Test", "GIT_AUTHOR_EMAIL=test@example.com",
+		"GIT_COMMITTER_NAME=Test", "GIT_COMMITTER_EMAIL=test@example.com",
+		"GIT_CONFIG_NOSYSTEM=1", "GIT_CONFIG_GLOBAL=/dev/null",
+	)
+	cmd.Env = append(cmd.Env, env...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s: %s: %s", strings.Join(args, " "), err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// initRepo returns the path of a new git repository on the master branch.
+func initRepo(t testing.TB) string {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	dir := tempDir(t)
+	runGit(t, dir, "init", "--quiet")
+	runGit(t, dir, "symbolic-ref", "HEAD", "refs/heads/master")
+	return dir
+}
+
+// commitFile writes content to name in the repository at dir, and commits it.
+func commitFile(t testing.TB, dir, name, content string) string {
+	t.Helper()
+	p := filepath.Join(dir, name)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	runGit(t, dir, "add", name)
+	runGit(t, dir, "commit", "--quiet", "-m", "update "+name)
+	return runGit(t, dir, "rev-parse", "HEAD")
+}
+
+func TestDescribeShallowFetchTags(t *testing.T) {
+	origin := initRepo(t)
+	commitFile(t, origin, "a", "1")
+	runGit(t, origin, "tag", "v1.0.0")
+	commitFile(t, origin, "a", "2")
+	commitFile(t, origin, "a", "3")
+
+	clone := filepath.Join(tempDir(t), "clone")
+	runGit(t, origin, "clone", "--quiet", "--depth", "1", "file://"+origin, clone)
+	// Keep fetched objects in a packfile, as a fetch of a large history would, rather than
+	// unpacking them as loose objects.
+	runGit(t, clone, "config", "fetch.unpackLimit", "1")
+
+	opts := DescribeOptions{TagPrefix: DefaultTagPrefix}
+	gd, err := GitDescribeFresh(clone, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !gd.IsShallow() {
+		t.Error("shallow clone is not reported as shallow")
+	}
+	if name, ok := gd.TagName(); ok {
+		t.Errorf("tag %s found beyond the shallow boundary", name)
+	}
+
+	opts.FetchTags = true
+	gd, err = GitDescribeFresh(clone, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name, ok := gd.TagName(); !ok || name != "v1.0.0" {
+		t.Fatalf("got tag %q (%v) after fetching, want v1.0.0", name, ok)
+	}
+	if n := gd.CommitsSinceTag(); n != 2 {
+		t.Errorf("got %d commits since tag, want 2", n)
+	}
+	if gd.IsShallow() {
+		t.Error("clone is still shallow after fetching")
+	}
+}
+
+// dateEnv returns the environment for git to author and commit at the Unix time sec.
+func dateEnv(sec int64) []string {
+	date := fmt.Sprintf("@%d +0000", sec)
+	return []string{"GIT_AUTHOR_DATE=" + date, "GIT_COMMITTER_DATE=" + date}
+}
+
+// commitAt creates an empty commit in dir with the message msg at the Unix time sec, and returns
+// its hash.
+func commitAt(t testing.TB, dir, msg string, sec int64) string {
+	t.Helper()
+	runGitEnv(t, dir, dateEnv(sec), "commit", "--quiet", "--allow-empty", "-m", msg)
+	return runGit(t, dir, "rev-parse", "HEAD")
+}
+
+// walkTags returns the name of the tag found by walkToTag from rev in the repository at dir, or
+// an empty name if there is none, and the number of commits walked.
+func walkTags(t testing.TB, dir, rev string, skipFirst bool) (name string, walked int) {
+	t.Helper()
+	r, err := openRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tags, err := getVersionTags(r, DefaultTagPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tag, err := walkToTag(r, plumbing.NewHash(rev), tags, skipFirst, func(commitgraph.CommitNode) error {
+		walked++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tag != nil {
+		name = tag.name
+	}
+	return name, walked
+}
+
+func TestWalkToTag(t *testing.T) {
+	// master: c1 (v1.0.0, v1.0.1) - c2 - c3 - merge (v2.0.0)
+	// feature:  \- f1 (v1.1.0, v1.1.1) -/
+	dir := initRepo(t)
+	commitAt(t, dir, "c1", 1000)
+	runGit(t, dir, "tag", "-a", "-m", "Release 1.0.0", "v1.0.0")
+	runGit(t, dir, "tag", "v1.0.1")
+	runGit(t, dir, "checkout", "--quiet", "-b", "feature")
+	commitAt(t, dir, "f1", 3000)
+	runGit(t, dir, "tag", "v1.1.1")
+	runGit(t, dir, "tag", "v1.1.0")
+	runGit(t, dir, "checkout", "--quiet", "master")
+	c2 := commitAt(t, dir, "c2", 2000)
+	c3 := commitAt(t, dir, "c3", 4000)
+	runGitEnv(t, dir, dateEnv(5000), "merge", "--quiet", "--no-ff", "-m", "merge", "feature")
+	merge := runGit(t, dir, "rev-parse", "HEAD")
+	runGit(t, dir, "tag", "v2.0.0")
+
+	shallow := filepath.Join(tempDir(t), "shallow")
+	runGit(t, dir, "clone", "--quiet", "--depth", "2", "file://"+dir, shallow)
+
+	tests := []struct {
+		name      string
+		dir       string
+		rev       string
+		skipFirst bool
+		want      string
+		walked    int
+	}{
+		{name: "tagged", dir: dir, rev: merge, want: "v2.0.0"},
+		// The merged branch is walked in committer time order, so f1 is reached before c2.
+		{name: "merge", dir: dir, rev: merge, skipFirst: true, want: "v1.1.1", walked: 2},
+		// Annotated tags are preferred to lightweight tags of the same commit.
+		{name: "first parent", dir: dir, rev: c3, want: "v1.0.0", walked: 2},
+		{name: "untagged", dir: dir, rev: c2, want: "v1.0.0", walked: 1},
+		{name: "shallow merge", dir: shallow, rev: merge, skipFirst: true, want: "v1.1.1", walked: 2},
+		// The parent of c3 is beyond the shallow boundary, so the walk stops without a tag.
+		{name: "shallow boundary", dir: shallow, rev: c3, walked: 1},
+	}
+	for _, tt := range tests {
+		name, walked := walkTags(t, tt.dir, tt.rev, tt.skipFirst)
+		if name != tt.want || walked != tt.walked {
+			t.Errorf("%s: got tag %q after %d commits, want %q after %d", tt.name, name, walked, tt.want, tt.walked)
+		}
+	}
+}
+
+// BenchmarkWalkToTag walks a linear history of 2000 commits to a tag on the first, reading commits
+// from objects and from a commit-graph file.
+func BenchmarkWalkToTag(b *testing.B) {
+	const n = 2000
+	dir := initRepo(b)
+
+	var stream bytes.Buffer
+	for i := 1; i <= n; i++ {
+		fmt.Fprintf(&stream, "commit refs/heads/master\nmark :%d\ncommitter Test <test@example.com> %d +0000\ndata 2\nc\n\n", i, 1000+i)
+	}
+	fmt.Fprintf(&stream, "reset refs/tags/v1.0.0\nfrom :1\n\n")
+	cmd := exec.Command("git", "fast-import", "--quiet")
+	cmd.Dir = dir
+	cmd.Stdin = &stream
+	if out, err := cmd.CombinedOutput(); err != nil {
+		b.Fatalf("git fast-import: %s: %s", err, out)
+	}
+	head := plumbing.NewHash(runGit(b, dir, "rev-parse", "HEAD"))
+
+	r, err := openRepo(dir)
+	if err != nil {
+		b.Fatal(err)
+	}
+	tags, err := getVersionTags(r, DefaultTagPrefix)
+	if err != nil {
+		b.Fatal(err)
+	}
+	walk := func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			walked := 0
+			tag, err := walkToTag(r, head, tags, false, func(commitgraph.CommitNode) error {
+				walked++
+				return nil
+			})
+			if err != nil {
+				b.Fatal(err)
+			}
+			if tag == nil || walked != n-1 {
+				b.Fatalf("walked %d commits to tag %v, want %d to v1.0.0", walked, tag, n-1)
+			}
+		}
+	}
+	b.Run("objects", walk)
+	runGit(b, dir, "commit-graph", "write", "--reachable")
+	b.Run("commit-graph", walk)
+}
+
+func TestGitDescribeAtSubdirectory(t *testing.T) {
+	dir := initRepo(t)
+	head := commitFile(t, dir, "a/b/c/file", "1")
+	runGit(t, dir, "tag", "v1.2.3")
+
+	gd, err := GitDescribeAt(filepath.Join(dir, "a", "b", "c"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name, ok := gd.TagName(); !ok || name != "v1.2.3" {
+		t.Errorf("got tag %q (%v), want v1.2.3", name, ok)
+	}
+	if gd.CommitHash() != head {
+		t.Errorf("got commit %s, want %s", gd.CommitHash(), head)
+	}
+}
+
+func TestGetSemverDirty(t *testing.T) {
+	dir := initRepo(t)
+	commitFile(t, dir, "file", "1")
+	runGit(t, dir, "tag", "v1.2.3")
+
+	opts := DescribeOptions{TagPrefix: DefaultTagPrefix}
+	versions := make([]string, 2)
+	for i, content := range []string{"1", "2"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, "file"), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		gd, err := GitDescribeFresh(dir, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if clean := content == "1"; gd.IsClean() != clean {
+			t.Errorf("got clean %v for content %s, want %v", gd.IsClean(), content, clean)
+		}
+		v, err := gd.GetSemver()
+		if err != nil {
+			t.Fatal(err)
+		}
+		versions[i] = v.String()
+	}
+
+	if versions[0] != "1.2.3" || versions[1] != "1.2.3+dirty" {
+		t.Errorf("got clean version %s and dirty version %s, want 1.2.3 and 1.2.3+dirty", versions[0], versions[1])
+	}
+}
+
+func TestResetGitDescribeCache(t *testing.T) {
+	dir := initRepo(t)
+	commitFile(t, dir, "file", "1")
+	runGit(t, dir, "tag", "v1.0.0")
+	commitFile(t, dir, "file", "2")
+
+	version := func() string {
+		gd, err := GitDescribeAt(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		v, err := gd.GetSemver()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v.String()
+	}
+	before := version()
+	if !strings.HasPrefix(before, "1.0.1-alpha.1.devel.1+g") {
+		t.Fatalf("got version %s before tagging", before)
+	}
+
+	runGit(t, dir, "tag", "v1.1.0")
+	if v := version(); v != before {
+		t.Errorf("got version %s before resetting the cache, want cached %s", v, before)
+	}
+	ResetGitDescribeCache()
+	if v := version(); v != "1.1.0" {
+		t.Errorf("got version %s after resetting the cache, want 1.1.0", v)
+	}
+}
+
+func TestGitDescriptionAccessors(t *testing.T) {
+	dir := initRepo(t)
+	commitFile(t, dir, "file", "1")
+	runGit(t, dir, "tag", "-a", "-m", "Release 1.0.0", "v1.0.0")
+	commitFile(t, dir, "file", "2")
+	head := commitFile(t, dir, "file", "3")
+
+	gd, err := GitDescribeFresh(dir, DescribeOptions{TagPrefix: DefaultTagPrefix})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// git describe --long prints the tag, the number of commits since it and the abbreviated hash.
+	want := runGit(t, dir, "describe", "--long", "--abbrev=7")
+	name, ok := gd.TagName()
+	if got := fmt.Sprintf("%s-%d-g%s", name, gd.CommitsSinceTag(), gd.CommitHash()[:7]); !ok || got != want {
+		t.Errorf("got description %s (%v), want %s", got, ok, want)
+	}
+	if !gd.TagAnnotated() {
+		t.Error("annotated tag reported as lightweight")
+	}
+	if gd.CommitHash() != head || gd.Ref().String() != head {
+		t.Errorf("got commit %s and ref %s, want %s", gd.CommitHash(), gd.Ref(), head)
+	}
+	if name := gd.Reference().Name(); name != "refs/heads/master" {
+		t.Errorf("got reference %s, want refs/heads/master", name)
+	}
+	if branch, ok := gd.Branch(); !ok || branch != "master" {
+		t.Errorf("got branch %q (%v), want master", branch, ok)
+	}
+	if gd.IsShallow() || !gd.IsClean() {
+		t.Errorf("got shallow %v and clean %v, want a clean complete repository", gd.IsShallow(), gd.IsClean())
+	}
+}
+
+func TestGitDescribeRef(t *testing.T) {
+	dir := initRepo(t)
+	commitFile(t, dir, "file", "1")
+	runGit(t, dir, "tag", "v1.0.0")
+	commitFile(t, dir, "file", "2")
+	commitFile(t, dir, "file", "3")
+	old := commitFile(t, dir, "file", "4")
+	runGit(t, dir, "branch", "old")
+	commitFile(t, dir, "file", "5")
+	runGit(t, dir, "tag", "v2.0.0")
+	// Changes to the working tree do not affect the description of a ref.
+	if err := ioutil.WriteFile(filepath.Join(dir, "file"), []byte("dirty"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	chdir(t, dir)
+
+	for _, ref := range []string{"old", "HEAD~1", "v2.0.0~1", old} {
+		gd, err := GitDescribeRef(ref)
+		if err != nil {
+			t.Fatalf("%s: %s", ref, err)
+		}
+		if name, ok := gd.TagName(); !ok || name != "v1.0.0" || gd.CommitsSinceTag() != 3 {
+			t.Errorf("%s: got tag %q (%v) and %d commits since it, want v1.0.0 and 3", ref, name, ok, gd.CommitsSinceTag())
+		}
+		if gd.CommitHash() != old {
+			t.Errorf("%s: got commit %s, want %s", ref, gd.CommitHash(), old)
+		}
+		if !gd.IsClean() {
+			t.Errorf("%s: description is not clean", ref)
+		}
+		if v, err := gd.GetSemver(); err != nil || !strings.HasPrefix(v.String(), "1.0.1-") {
+			t.Errorf("%s: got version %s (%v), want a pre-release of 1.0.1", ref, v, err)
+		}
+	}
+
+	gd, err := GitDescribeRefWithOptions(dir, "HEAD", DescribeOptions{TagPrefix: DefaultTagPrefix})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name, ok := gd.TagName(); !ok || name != "v2.0.0" || gd.CommitsSinceTag() != 0 {
+		t.Errorf("HEAD: got tag %q (%v) and %d commits since it, want v2.0.0 and 0", name, ok, gd.CommitsSinceTag())
+	}
+
+	if _, err := GitDescribeRef("absent"); err == nil {
+		t.Error("absent ref: no error")
+	}
+}
+
+func TestGitDescribeSubmodule(t *testing.T) {
+	sub := initRepo(t)
+	commitFile(t, sub, "README", "sub")
+	runGit(t, sub, "tag", "v2.0.0")
+
+	dir := initRepo(t)
+	commitFile(t, dir, "README", "parent")
+	runGit(t, dir, "-c", "protocol.file.allow=always", "submodule", "--quiet", "add", "file://"+sub, "sub")
+	runGit(t, dir, "commit", "--quiet", "-m", "add submodule")
+
+	// The .git of a submodule is a file naming its git directory in the parent repository.
+	path := filepath.Join(dir, "sub")
+	if fi, err := os.Stat(filepath.Join(path, ".git")); err != nil || fi.IsDir() {
+		t.Fatalf("submodule .git is not a file: %v", err)
+	}
+	exclude := filepath.Join(dir, ".git", "modules", "sub", "info", "exclude")
+	if err := os.MkdirAll(filepath.Dir(exclude), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(exclude, []byte("*.log\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(path, "build.log"), []byte("log"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	gd, err := GitDescribeFresh(path, DescribeOptions{TagPrefix: DefaultTagPrefix})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := gd.GetSemver(); err != nil || v.String() != "2.0.0" {
+		t.Errorf("got version %s (%v), want 2.0.0", v, err)
+	}
+	if !gd.IsClean() {
+		t.Error("file ignored by info/exclude of the submodule makes the working tree dirty")
+	}
+}
+
+func TestDescribeUntagged(t *testing.T) {
+	dir := initRepo(t)
+	commitFile(t, dir, "a", "1")
+	commitFile(t, dir, "a", "2")
+	head := commitFile(t, dir, "a", "3")
+	runGit(t, dir, "tag", "release-1")
+
+	// Without version tags, the history is not walked until the commits are counted.
+	var walked uint64
+	gd, err := GitDescribeFresh(dir, DescribeOptions{
+		TagPrefix:  DefaultTagPrefix,
+		OnProgress: func(n uint64) { walked = n },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if walked != 0 {
+		t.Errorf("walked %d commits without version tags", walked)
+	}
+	if _, ok := gd.TagName(); ok || gd.CommitsSinceTag() != 0 {
+		t.Errorf("got tag with %d commits since it, want none", gd.CommitsSinceTag())
+	}
+
+	base := semver.MustParse("0.0.0-devel")
+	for i := 0; i < 2; i++ {
+		v, err := gd.UntaggedSemver(base)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := "0.0.0-devel.3+g" + head[:7]; v.String() != want {
+			t.Errorf("got version %s, want %s", v, want)
+		}
+	}
+}
@@ -0,0 +1,274 @@
+// SPDX-License-Identifier: BSD-3-Clause
+// Copyright (c) 2020-2021, Ctrl IQ, Inc. All rights reserved
+
+package gobuild
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/blang/semver"
+)
+
+// DefaultGitHubAPIURL is the URL of the GitHub API used when GitHubReleaseOptions.APIURL is empty.
+const DefaultGitHubAPIURL = "https://api.github.com"
+
+// GitHubReleaseOptions configures releases published by PublishGitHubRelease.
+type GitHubReleaseOptions struct {
+	// Owner and Repo name the GitHub repository. If either is empty, both are taken from the URL
+	// of the origin remote.
+	Owner string
+	Repo  string
+
+	Token  string // API token; defaults to the GITHUB_TOKEN environment variable
+	APIURL string // URL of the API, for GitHub Enterprise; defaults to DefaultGitHubAPIURL
+
+	Name  string // name of the release; defaults to the tag name
+	Body  string // release notes; defaults to the Markdown changelog from GenerateChangelog
+	Draft bool   // create the release as a draft
+
+	// Force publishes a release even if HEAD is not tagged or the working tree is dirty. The
+	// release is then tagged with the name returned by releaseTagName, at the commit of HEAD.
+	Force bool
+}
+
+// githubRelease is a release returned by the GitHub API.
+type githubRelease struct {
+	ID        int64         `json:"id"`
+	HTMLURL   string        `json:"html_url"`
+	UploadURL string        `json:"upload_url"`
+	Assets    []githubAsset `json:"assets"`
+}
+
+// githubAsset is an asset of a release returned by the GitHub API.
+type githubAsset struct {
+	ID   int64  `json:"id"`
+	Name string `json:"name"`
+}
+
+// PublishGitHubRelease creates a GitHub release for the tag of HEAD in the git repository
+// containing the current working directory, uploads files to it as assets, and returns the URL of
+// the release. Files are typically archives, packages, checksums and signatures. The release is
+// marked as a prerelease if its version has a prerelease. If a release of the tag already exists,
+// files are added to it, replacing any assets of the same name.
+//
+// If HEAD is not tagged, or the working tree is dirty, an error wrapping ErrUnreleasedVersion is
+// returned, unless opts.Force is set.
+func PublishGitHubRelease(files []string, opts GitHubReleaseOptions) (string, error) {
+	gd, err := GitDescribe()
+	if err != nil {
+		return "", err
+	}
+	v, err := gd.GetSemver()
+	if err != nil {
+		return "", err
+	}
+
+	if _, ok := gd.TagName(); !opts.Force && (!ok || gd.CommitsSinceTag() != 0 || !gd.IsClean()) {
+		return "", fmt.Errorf("while publishing %s: %w", v, ErrUnreleasedVersion)
+	}
+	tag := releaseTagName(v)
+
+	if opts.Owner == "" || opts.Repo == "" {
+		if opts.Owner, opts.Repo, err = githubRemote("."); err != nil {
+			return "", err
+		}
+	}
+	if opts.Token == "" {
+		opts.Token = os.Getenv("GITHUB_TOKEN")
+	}
+	if opts.Token == "" {
+		return "", fmt.Errorf("no GitHub token set")
+	}
+	if opts.APIURL == "" {
+		opts.APIURL = DefaultGitHubAPIURL
+	}
+	if opts.Name == "" {
+		opts.Name = tag
+	}
+	if opts.Body == "" {
+		cl, err := GenerateChangelog()
+		if err != nil {
+			return "", err
+		}
+		var b bytes.Buffer
+		if err := cl.WriteMarkdown(&b); err != nil {
+			return "", err
+		}
+		opts.Body = b.String()
+	}
+
+	api := strings.TrimSuffix(opts.APIURL, "/") + "/repos/" + opts.Owner + "/" + opts.Repo + "/releases"
+
+	var rel githubRelease
+	err = githubRequest(http.MethodGet, api+"/tags/"+url.PathEscape(tag), opts.Token, nil, "", &rel)
+	if err == errGitHubNotFound {
+		req, err := json.Marshal(map[string]interface{}{
+			"tag_name":         tag,
+			"target_commitish": gd.CommitHash(),
+			"name":             opts.Name,
+			"body":             opts.Body,
+			"draft":            opts.Draft,
+			"prerelease":       len(v.Pre) > 0,
+		})
+		if err != nil {
+			return "", err
+		}
+		err = githubRequest(http.MethodPost, api, opts.Token, bytes.NewReader(req), "application/json", &rel)
+		if err != nil {
+			return "", fmt.Errorf("while creating release %s: %s", tag, err)
+		}
+	} else if err != nil {
+		return "", fmt.Errorf("while getting release %s: %s", tag, err)
+	}
+
+	// The upload URL is a URI template, such as .../assets{?name,label}.
+	upload := rel.UploadURL
+	if i := strings.Index(upload, "{"); i >= 0 {
+		upload = upload[:i]
+	}
+
+	for _, path := range files {
+		name := filepath.Base(path)
+		for _, a := range rel.Assets {
+			if a.Name == name {
+				err := githubRequest(http.MethodDelete, fmt.Sprintf("%s/assets/%d", api, a.ID), opts.Token, nil, "", nil)
+				if err != nil {
+					return "", fmt.Errorf("while deleting asset %s: %s", name, err)
+				}
+			}
+		}
+
+		if err := uploadGitHubAsset(upload, opts.Token, path); err != nil {
+			return "", fmt.Errorf("while uploading %s: %s", path, err)
+		}
+	}
+	return rel.HTMLURL, nil
+}
+
+// githubAssetURL returns the download URL of the asset named by the base name of path, of the
+// release of version published by PublishGitHubRelease, in the repository of the origin remote.
+func githubAssetURL(version, path string) (string, error) {
+	v, err := semver.Parse(strings.TrimPrefix(version, "v"))
+	if err != nil {
+		return "", fmt.Errorf("while parsing version %q: %s", version, err)
+	}
+	owner, repo, err := githubRemote(".")
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("https://github.com/%s/%s/releases/download/%s/%s",
+		owner, repo, url.PathEscape(releaseTagName(v)), url.PathEscape(filepath.Base(path))), nil
+}
+
+// uploadGitHubAsset uploads the file at path to upload, the upload URL of a release.
+func uploadGitHubAsset(upload, token, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	u := upload + "?name=" + url.QueryEscape(filepath.Base(path))
+	req, err := http.NewRequest(http.MethodPost, u, f)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = fi.Size()
+	req.Header.Set("Content-Type", "application/octet-stream")
+	return doGitHubRequest(req, token, nil)
+}
+
+// errGitHubNotFound is returned by githubRequest when the API responds with 404 Not Found.
+var errGitHubNotFound = errors.New("not found")
+
+// githubRequest sends a request to the GitHub API with body of contentType, and decodes the JSON
+// response into out, if it is not nil.
+func githubRequest(method, u, token string, body io.Reader, contentType string, out interface{}) error {
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	return doGitHubRequest(req, token, out)
+}
+
+// doGitHubRequest sends req to the GitHub API, authenticated with token, and decodes the JSON
+// response into out, if it is not nil.
+func doGitHubRequest(req *http.Request, token string, out interface{}) error {
+	req.Header.Set("Accept", "application/vnd.github.v3+json")
+	req.Header.Set("Authorization", "token "+token)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode == http.StatusNotFound {
+		return errGitHubNotFound
+	}
+	if resp.StatusCode/100 != 2 {
+		var e struct {
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(b, &e) == nil && e.Message != "" {
+			return fmt.Errorf("%s: %s", resp.Status, e.Message)
+		}
+		return fmt.Errorf("%s", resp.Status)
+	}
+
+	if out == nil {
+		return nil
+	}
+	if err := json.Unmarshal(b, out); err != nil {
+		return fmt.Errorf("while decoding response: %s", err)
+	}
+	return nil
+}
+
+// githubRemoteRE matches the owner and repository in the URL of a GitHub remote, such as
+// https://github.com/ctrliq/gobuild.git or git@github.com:ctrliq/gobuild.
+var githubRemoteRE = regexp.MustCompile(`github\.com[:/]([^/]+)/([^/]+?)(?:\.git)?/?$`)
+
+// githubRemote returns the owner and repository of the origin remote of the git repository
+// containing path.
+func githubRemote(path string) (owner, repo string, err error) {
+	r, err := openRepo(path)
+	if err != nil {
+		return "", "", fmt.Errorf("while opening repository: %s", err)
+	}
+	remote, err := r.Remote("origin")
+	if err != nil {
+		return "", "", fmt.Errorf("while getting origin remote: %s", err)
+	}
+
+	for _, u := range remote.Config().URLs {
+		if m := githubRemoteRE.FindStringSubmatch(u); m != nil {
+			return m[1], m[2], nil
+		}
+	}
+	return "", "", fmt.Errorf("origin remote is not a GitHub repository")
+}
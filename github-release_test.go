@@ -0,0 +1,40 @@
+// SPDX-License-Identifier: BSD-3-Clause
+// Copyright (c) 2020-2021, Ctrl IQ, Inc. All rights reserved
+
+package gobuild
+
+import (
+	"testing"
+)
+
+func TestGitHubAssetURL(t *testing.T) {
+	dir := initRepo(t)
+	runGit(t, dir, "remote", "add", "origin", "git@github.com:ctrliq/tool.git")
+	chdir(t, dir)
+
+	tests := []struct {
+		version string
+		want    string
+		wantErr bool
+	}{
+		{version: "1.2.3", want: "https://github.com/ctrliq/tool/releases/download/v1.2.3/tool.tar.gz"},
+		{version: "v1.2.3", want: "https://github.com/ctrliq/tool/releases/download/v1.2.3/tool.tar.gz"},
+		{version: "2.0.0-rc.1", want: "https://github.com/ctrliq/tool/releases/download/v2.0.0-rc.1/tool.tar.gz"},
+		{version: "latest", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := githubAssetURL(tt.version, "dist/tool.tar.gz")
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: no error", tt.version)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %s", tt.version, err)
+		}
+		if got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.version, got, tt.want)
+		}
+	}
+}
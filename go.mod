@@ -4,7 +4,15 @@ go 1.14
 
 require (
 	github.com/blang/semver v3.5.1+incompatible
-	github.com/go-git/go-git/v5 v5.1.0
-	github.com/goreleaser/nfpm v1.4.1
+	github.com/go-git/go-billy/v5 v5.3.1
+	github.com/go-git/go-git/v5 v5.4.2
+	github.com/google/go-containerregistry v0.5.1
+	github.com/goreleaser/chglog v0.2.2
+	github.com/goreleaser/nfpm/v2 v2.20.0
+	github.com/klauspost/compress v1.15.11
 	github.com/magefile/mage v1.10.0
+	github.com/rogpeppe/go-internal v1.6.2 // indirect
+	github.com/ulikunitz/xz v0.5.11
+	golang.org/x/crypto v0.0.0-20220411220226-7b82a4e95df4
+	gopkg.in/yaml.v2 v2.4.0
 )
@@ -0,0 +1,320 @@
+// SPDX-License-Identifier: BSD-3-Clause
+// Copyright (c) 2020-2021, Ctrl IQ, Inc. All rights reserved
+
+package gobuild
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"unicode"
+
+	"github.com/magefile/mage/sh"
+)
+
+// HomebrewFormulaOptions describes a Homebrew formula written by WriteHomebrewFormula.
+type HomebrewFormulaOptions struct {
+	Name        string // name of the formula, such as my-tool
+	Description string // short description of the formula
+	Homepage    string // URL of the home page of the project
+	License     string // SPDX identifier of the license, such as BSD-3-Clause
+
+	// Version is the semantic version of the formula. It defaults to that returned by
+	// CurrentVersion.
+	Version string
+
+	// Archives are the published archives of the formula. An archive without OS and Arch is
+	// installed on every platform, and must be the only archive.
+	Archives []HomebrewArchive
+
+	Dependencies []string // names of formulae the formula depends on
+
+	// Install is the Ruby body of the install method. It defaults to installing a binary named
+	// Name from the root of the archive, with `bin.install "<name>"`.
+	Install string
+
+	// Test, if set, is the Ruby body of the test block, such as
+	// `system "#{bin}/my-tool", "--version"`.
+	Test string
+}
+
+// HomebrewArchive is a published archive of a Homebrew formula.
+type HomebrewArchive struct {
+	Path string // path of the archive, of which the SHA-256 checksum is computed
+	OS   string // operating system of the archive, as GOOS: darwin or linux
+	Arch string // architecture of the archive, as GOARCH: amd64 or arm64
+
+	// URL is the URL the archive is published at. It defaults to the URL of the asset named by
+	// the base name of Path, of the GitHub release of the version, in the repository of the
+	// origin remote, as published by PublishGitHubRelease.
+	URL string
+}
+
+// homebrewFormulaData is the data of the Homebrew formula template.
+type homebrewFormulaData struct {
+	HomebrewFormulaOptions
+	Class     string // name of the Ruby class of the formula
+	Platforms []homebrewPlatform
+}
+
+// homebrewPlatform is the archives of a formula for an operating system.
+type homebrewPlatform struct {
+	Block    string // on_macos or on_linux, or empty for all operating systems
+	Archives []homebrewURL
+}
+
+// homebrewURL is an archive of a formula for an architecture.
+type homebrewURL struct {
+	CPU    string // arm or intel, or empty for all architectures
+	URL    string
+	SHA256 string
+}
+
+// newHomebrewFormulaData returns the template data for opts.
+func newHomebrewFormulaData(opts HomebrewFormulaOptions) (*homebrewFormulaData, error) {
+	if opts.Name == "" {
+		return nil, fmt.Errorf("no formula name set")
+	}
+	if len(opts.Archives) == 0 {
+		return nil, fmt.Errorf("no archives set for formula %s", opts.Name)
+	}
+	if opts.Version == "" {
+		v, err := CurrentVersion()
+		if err != nil {
+			return nil, err
+		}
+		opts.Version = v
+	}
+	opts.Version = strings.TrimPrefix(opts.Version, "v")
+	if opts.Install == "" {
+		opts.Install = "bin.install " + rubyQuote(opts.Name)
+	}
+
+	d := &homebrewFormulaData{HomebrewFormulaOptions: opts, Class: homebrewClass(opts.Name)}
+	for _, a := range opts.Archives {
+		if a.OS == "" && a.Arch == "" && len(opts.Archives) > 1 {
+			return nil, fmt.Errorf("archive %s without OS and Arch must be the only archive", a.Path)
+		}
+
+		var block, cpu string
+		switch a.OS {
+		case "":
+		case "darwin":
+			block = "on_macos"
+		case "linux":
+			block = "on_linux"
+		default:
+			return nil, fmt.Errorf("unsupported operating system %s for Homebrew formulae", a.OS)
+		}
+		switch a.Arch {
+		case "":
+		case "amd64":
+			cpu = "intel"
+		case "arm64":
+			cpu = "arm"
+		default:
+			return nil, fmt.Errorf("%w: %s for Homebrew formulae", ErrUnsupportedArch, a.Arch)
+		}
+
+		sum, err := fileChecksum(a.Path, SHA256)
+		if err != nil {
+			return nil, err
+		}
+		if a.URL == "" {
+			if a.URL, err = githubAssetURL(opts.Version, a.Path); err != nil {
+				return nil, err
+			}
+		}
+
+		var p *homebrewPlatform
+		for i := range d.Platforms {
+			if d.Platforms[i].Block == block {
+				p = &d.Platforms[i]
+			}
+		}
+		if p == nil {
+			d.Platforms = append(d.Platforms, homebrewPlatform{Block: block})
+			p = &d.Platforms[len(d.Platforms)-1]
+		}
+		for _, u := range p.Archives {
+			if u.CPU == "" || cpu == "" || u.CPU == cpu {
+				return nil, fmt.Errorf("more than one archive for %s/%s", a.OS, a.Arch)
+			}
+		}
+		p.Archives = append(p.Archives, homebrewURL{CPU: cpu, URL: a.URL, SHA256: sum})
+	}
+	return d, nil
+}
+
+// homebrewClass returns the name of the Ruby class of the formula name, as Homebrew derives it:
+// my-tool becomes MyTool, and tool@1.2 becomes ToolAT12.
+func homebrewClass(name string) string {
+	var b strings.Builder
+	upper := true
+	for _, r := range name {
+		switch {
+		case r == '@':
+			b.WriteString("AT")
+			upper = true
+		case r == '-' || r == '_' || r == '.' || r == '+':
+			upper = true
+		case upper:
+			b.WriteRune(unicode.ToUpper(r))
+			upper = false
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// rubyQuote returns s as a double-quoted Ruby string, in which nothing is interpolated.
+func rubyQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "#", `\#`, "\n", `\n`, "\t", `\t`).Replace(s) + `"`
+}
+
+// indent returns s with each non-empty line indented by n spaces.
+func indent(n int, s string) string {
+	lines := strings.Split(strings.TrimRight(s, "\n"), "\n")
+	for i, l := range lines {
+		if strings.TrimSpace(l) != "" {
+			lines[i] = strings.Repeat(" ", n) + l
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+var homebrewTemplate = template.Must(template.New("formula").Funcs(template.FuncMap{
+	"q":      rubyQuote,
+	"indent": indent,
+}).Parse(`class {{ .Class }} < Formula
+{{- if .Description }}
+  desc {{ q .Description }}
+{{- end }}
+{{- if .Homepage }}
+  homepage {{ q .Homepage }}
+{{- end }}
+  version {{ q .Version }}
+{{- if .License }}
+  license {{ q .License }}
+{{- end }}
+{{- range .Platforms }}
+{{ if .Block }}
+  {{ .Block }} do
+{{- range .Archives }}
+{{- if .CPU }}
+    if Hardware::CPU.{{ .CPU }}?
+      url {{ q .URL }}
+      sha256 {{ q .SHA256 }}
+    end
+{{- else }}
+    url {{ q .URL }}
+    sha256 {{ q .SHA256 }}
+{{- end }}
+{{- end }}
+  end
+{{- else }}
+{{- range .Archives }}
+{{- if .CPU }}
+  if Hardware::CPU.{{ .CPU }}?
+    url {{ q .URL }}
+    sha256 {{ q .SHA256 }}
+  end
+{{- else }}
+  url {{ q .URL }}
+  sha256 {{ q .SHA256 }}
+{{- end }}
+{{- end }}
+{{- end }}
+{{- end }}
+{{- if .Dependencies }}
+{{ range .Dependencies }}
+  depends_on {{ q . }}
+{{- end }}
+{{- end }}
+
+  def install
+{{ indent 4 .Install }}
+  end
+{{- if .Test }}
+
+  test do
+{{ indent 4 .Test }}
+  end
+{{- end }}
+end
+`))
+
+// WriteHomebrewFormula writes the Ruby source of a Homebrew formula described by opts to w. The
+// SHA-256 checksum of each archive is computed from its file.
+func WriteHomebrewFormula(w io.Writer, opts HomebrewFormulaOptions) error {
+	d, err := newHomebrewFormulaData(opts)
+	if err != nil {
+		return err
+	}
+	return homebrewTemplate.Execute(w, d)
+}
+
+// CreateHomebrewFormula writes a Homebrew formula described by opts to the file at path.
+func CreateHomebrewFormula(path string, opts HomebrewFormulaOptions) error {
+	var b bytes.Buffer
+	if err := WriteHomebrewFormula(&b, opts); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path, b.Bytes(), 0644); err != nil {
+		return err
+	}
+	Log.Infof("created %s", path)
+	return nil
+}
+
+// UpdateHomebrewTap writes a Homebrew formula described by opts to Formula/<name>.rb in the tap
+// repository cloned at dir, commits it with the message "<name> <version>", and, if remote is
+// set, pushes the current branch to it. It is typically called once the archives of a release
+// have been published. Nothing is committed if the formula is unchanged.
+func UpdateHomebrewTap(dir, remote string, opts HomebrewFormulaOptions) error {
+	d, err := newHomebrewFormulaData(opts)
+	if err != nil {
+		return err
+	}
+	var b bytes.Buffer
+	if err := homebrewTemplate.Execute(&b, d); err != nil {
+		return err
+	}
+
+	name := filepath.Join("Formula", d.Name+".rb")
+	if err := os.MkdirAll(filepath.Join(dir, "Formula"), 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, name), b.Bytes(), 0644); err != nil {
+		return err
+	}
+
+	if err := sh.Run("git", "-C", dir, "add", "--", name); err != nil {
+		return fmt.Errorf("while adding %s: %s", name, err)
+	}
+	err = sh.Run("git", "-C", dir, "diff", "--cached", "--quiet", "--", name)
+	if err == nil {
+		Log.Infof("formula %s is unchanged", d.Name)
+		return nil
+	} else if sh.ExitStatus(err) != 1 {
+		return fmt.Errorf("while comparing %s: %s", name, err)
+	}
+
+	message := d.Name + " " + d.Version
+	if err := sh.Run("git", "-C", dir, "commit", "--quiet", "-m", message, "--", name); err != nil {
+		return fmt.Errorf("while committing %s: %s", name, err)
+	}
+	Log.Infof("committed %s", message)
+	if remote != "" {
+		if err := sh.RunV("git", "-C", dir, "push", remote, "HEAD"); err != nil {
+			return fmt.Errorf("while pushing tap to %s: %s", remote, err)
+		}
+	}
+	return nil
+}
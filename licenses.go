@@ -0,0 +1,132 @@
+// SPDX-License-Identifier: BSD-3-Clause
+// Copyright (c) 2020-2021, Ctrl IQ, Inc. All rights reserved
+
+package gobuild
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/goreleaser/nfpm/v2/files"
+	"github.com/magefile/mage/mg"
+)
+
+// ModuleLicense is a license or notice file of a Go module, such as LICENSE, COPYING or NOTICE.
+type ModuleLicense struct {
+	Module  string // module path
+	Version string // module version, or empty for the main module
+	Main    bool   // the module is the main module
+	Path    string // path of the file
+}
+
+// licenseFileRE matches the names of license and notice files, such as LICENSE, LICENSE.md,
+// LICENSE-APACHE, COPYING and NOTICE.txt.
+var licenseFileRE = regexp.MustCompile(`(?i)^(licen[cs]e|copying|copyright|notice|unlicense|patents)([.-].*)?$`)
+
+// CollectLicenses returns the license and notice files in the root directories of the main module
+// containing the current working directory, and of each module providing a package that pkgs
+// depend on, as listed by go list -deps. If pkgs is empty, it is ./... . Modules in the standard
+// library are omitted, as are modules only needed by tests. Modules without license files are
+// logged, but are not an error, as a module may be covered by the license of its repository.
+//
+// The main module is first, followed by the other modules, sorted by module path.
+func CollectLicenses(pkgs ...string) ([]ModuleLicense, error) {
+	if len(pkgs) == 0 {
+		pkgs = []string{"./..."}
+	}
+	args := append([]string{"list", "-deps", "-f",
+		"{{with .Module}}{{.Path}}\t{{.Version}}\t{{.Main}}\t{{.Dir}}{{end}}"}, pkgs...)
+	out, err := exec.Command(mg.GoCmd(), args...).Output()
+	if err != nil {
+		if ee, ok := err.(*exec.ExitError); ok && len(ee.Stderr) > 0 {
+			return nil, fmt.Errorf("while listing dependencies: %s", strings.TrimSpace(string(ee.Stderr)))
+		}
+		return nil, fmt.Errorf("while listing dependencies: %s", err)
+	}
+
+	type module struct {
+		path, version, dir string
+		main               bool
+	}
+	var mods []module
+	var mainDir string
+	seen := make(map[string]bool)
+	s := bufio.NewScanner(bytes.NewReader(out))
+	for s.Scan() {
+		fields := strings.Split(s.Text(), "\t")
+		if len(fields) != 4 || seen[fields[0]] {
+			continue
+		}
+		seen[fields[0]] = true
+
+		m := module{path: fields[0], version: fields[1], main: fields[2] == "true", dir: fields[3]}
+		if m.main {
+			mainDir = m.dir
+		}
+		mods = append(mods, m)
+	}
+	sort.Slice(mods, func(i, j int) bool {
+		if mods[i].main != mods[j].main {
+			return mods[i].main
+		}
+		return mods[i].path < mods[j].path
+	})
+
+	var licenses []ModuleLicense
+	for _, m := range mods {
+		// Modules have no directory in the module cache when they are vendored.
+		dir := m.dir
+		if dir == "" && mainDir != "" {
+			dir = filepath.Join(mainDir, "vendor", filepath.FromSlash(m.path))
+		}
+
+		fis, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return nil, fmt.Errorf("while reading module %s: %s", m.path, err)
+		}
+		found := false
+		for _, fi := range fis {
+			if fi.Mode().IsRegular() && licenseFileRE.MatchString(fi.Name()) {
+				licenses = append(licenses, ModuleLicense{
+					Module:  m.path,
+					Version: m.version,
+					Main:    m.main,
+					Path:    filepath.Join(dir, fi.Name()),
+				})
+				found = true
+			}
+		}
+		if !found {
+			Log.Infof("no license file found for module %s", m.path)
+		}
+	}
+	return licenses, nil
+}
+
+// content returns the content of a package of format named name installing l. Files are
+// installed in /usr/share/doc/<name> for DEB packages, and otherwise in /usr/share/licenses/<name>,
+// marked as %license for RPM packages. Files of dependencies are in a directory named by their
+// module path.
+func (l ModuleLicense) content(name string, format Format) *files.Content {
+	dir := path.Join("/usr/share/licenses", name)
+	if format == DEB {
+		dir = path.Join("/usr/share/doc", name)
+	}
+	if !l.Main {
+		dir = path.Join(dir, l.Module)
+	}
+
+	c := generatedContent(l.Path, path.Join(dir, filepath.Base(l.Path)), 0644)
+	if format == RPM {
+		c.Type = "license"
+	}
+	return c
+}
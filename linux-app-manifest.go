@@ -0,0 +1,313 @@
+// SPDX-License-Identifier: BSD-3-Clause
+// Copyright (c) 2020-2021, Ctrl IQ, Inc. All rights reserved
+
+package gobuild
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	"github.com/blang/semver"
+	"gopkg.in/yaml.v2"
+)
+
+// DefaultFlatpakRuntimeVersion is the version of the freedesktop runtime used when
+// LinuxAppOptions.RuntimeVersion is empty.
+const DefaultFlatpakRuntimeVersion = "23.08"
+
+// LinuxAppOptions describes an application distributed as a snap or Flatpak, installed from a
+// published archive of its binaries, such as one created by CreateTar.
+type LinuxAppOptions struct {
+	Name        string // name of the snap, such as my-tool
+	AppID       string // ID of the Flatpak application, such as com.example.MyTool
+	Summary     string // one-line summary of the application
+	Description string // description of the application
+	License     string // SPDX identifier of the license, such as BSD-3-Clause
+
+	// Version is the semantic version of the application. It defaults to that returned by
+	// CurrentVersion. Snaps of pre-release versions are of devel grade.
+	Version string
+
+	Archive string // path of the archive, of which the SHA-256 checksum is computed
+	Arch    string // architecture of the binaries in the archive, as GOARCH; defaults to amd64
+
+	// ArchiveURL is the URL the archive is published at. It defaults to the URL of the asset named
+	// by the base name of Archive, of the GitHub release of the version, in the repository of the
+	// origin remote, as published by PublishGitHubRelease.
+	ArchiveURL string
+
+	// Binaries are the paths of the binaries in the archive, which are installed in bin under
+	// their base names. The first is the command of the application. It defaults to Name.
+	Binaries []string
+
+	Plugs      []string // interfaces the snap connects to, such as network or home
+	FinishArgs []string // sandbox permissions of the Flatpak, such as --share=network
+
+	// RuntimeVersion is the version of the freedesktop runtime of the Flatpak. It defaults to
+	// DefaultFlatpakRuntimeVersion.
+	RuntimeVersion string
+}
+
+// linuxAppData is the options of an application, with defaults set.
+type linuxAppData struct {
+	LinuxAppOptions
+	version semver.Version
+	sha256  string
+}
+
+// newLinuxAppData returns opts with defaults set, the parsed version, and the checksum of the
+// archive.
+func newLinuxAppData(opts LinuxAppOptions) (*linuxAppData, error) {
+	if opts.Archive == "" {
+		return nil, fmt.Errorf("no archive set")
+	}
+	if opts.Version == "" {
+		v, err := CurrentVersion()
+		if err != nil {
+			return nil, err
+		}
+		opts.Version = v
+	}
+	v, err := semver.Parse(strings.TrimPrefix(opts.Version, "v"))
+	if err != nil {
+		return nil, fmt.Errorf("while parsing version: %s", err)
+	}
+	opts.Version = v.String()
+	if opts.Arch == "" {
+		opts.Arch = "amd64"
+	}
+	if len(opts.Binaries) == 0 {
+		if opts.Name == "" {
+			return nil, fmt.Errorf("no binaries set")
+		}
+		opts.Binaries = []string{opts.Name}
+	}
+	if opts.ArchiveURL == "" {
+		if opts.ArchiveURL, err = githubAssetURL(opts.Version, opts.Archive); err != nil {
+			return nil, err
+		}
+	}
+
+	sum, err := fileChecksum(opts.Archive, SHA256)
+	if err != nil {
+		return nil, err
+	}
+	return &linuxAppData{LinuxAppOptions: opts, version: v, sha256: sum}, nil
+}
+
+// command returns the name of the command of the application.
+func (d *linuxAppData) command() string {
+	return path.Base(d.Binaries[0])
+}
+
+// snapcraft is a snapcraft.yaml file.
+type snapcraft struct {
+	Name          string                   `yaml:"name"`
+	Base          string                   `yaml:"base"`
+	Version       string                   `yaml:"version"`
+	Summary       string                   `yaml:"summary,omitempty"`
+	Description   string                   `yaml:"description,omitempty"`
+	License       string                   `yaml:"license,omitempty"`
+	Grade         string                   `yaml:"grade"`
+	Confinement   string                   `yaml:"confinement"`
+	Architectures []map[string]string      `yaml:"architectures"`
+	Parts         map[string]snapcraftPart `yaml:"parts"`
+	Apps          map[string]snapcraftApp  `yaml:"apps"`
+}
+
+// snapcraftPart is a part of a snapcraft.yaml file.
+type snapcraftPart struct {
+	Plugin         string            `yaml:"plugin"`
+	Source         string            `yaml:"source"`
+	SourceChecksum string            `yaml:"source-checksum"`
+	Organize       map[string]string `yaml:"organize"`
+}
+
+// snapcraftApp is an app of a snapcraft.yaml file.
+type snapcraftApp struct {
+	Command string   `yaml:"command"`
+	Plugs   []string `yaml:"plugs,omitempty"`
+}
+
+// WriteSnapcraft writes a snapcraft.yaml file describing a snap of the application described by
+// opts to w. The snap is strictly confined, built on core22, and installs the binaries from the
+// archive with the dump plugin. An app is declared for each binary.
+func WriteSnapcraft(w io.Writer, opts LinuxAppOptions) error {
+	if opts.Name == "" {
+		return fmt.Errorf("no snap name set")
+	}
+	d, err := newLinuxAppData(opts)
+	if err != nil {
+		return err
+	}
+	arch, ok := formatArch[d.Arch]
+	if !ok || arch[DEB] == "" || d.Arch == "all" {
+		return fmt.Errorf("%w: %s for snaps", ErrUnsupportedArch, d.Arch)
+	}
+
+	sc := snapcraft{
+		Name:          d.Name,
+		Base:          "core22",
+		Version:       d.Version,
+		Summary:       d.Summary,
+		Description:   d.Description,
+		License:       d.License,
+		Grade:         "stable",
+		Confinement:   "strict",
+		Architectures: []map[string]string{{"build-on": arch[DEB]}},
+		Parts: map[string]snapcraftPart{d.Name: {
+			Plugin:         "dump",
+			Source:         d.ArchiveURL,
+			SourceChecksum: "sha256/" + d.sha256,
+			Organize:       make(map[string]string),
+		}},
+		Apps: make(map[string]snapcraftApp),
+	}
+	if len(d.version.Pre) > 0 {
+		sc.Grade = "devel"
+	}
+	for _, b := range d.Binaries {
+		name := path.Base(b)
+		sc.Parts[d.Name].Organize[b] = "bin/" + name
+		sc.Apps[name] = snapcraftApp{Command: "bin/" + name, Plugs: d.Plugs}
+	}
+
+	b, err := yaml.Marshal(sc)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// flatpakManifest is a Flatpak manifest.
+type flatpakManifest struct {
+	AppID          string          `json:"app-id"`
+	Runtime        string          `json:"runtime"`
+	RuntimeVersion string          `json:"runtime-version"`
+	SDK            string          `json:"sdk"`
+	Command        string          `json:"command"`
+	FinishArgs     []string        `json:"finish-args,omitempty"`
+	Modules        []flatpakModule `json:"modules"`
+}
+
+// flatpakModule is a module of a Flatpak manifest.
+type flatpakModule struct {
+	Name          string          `json:"name"`
+	BuildSystem   string          `json:"buildsystem"`
+	BuildCommands []string        `json:"build-commands"`
+	Sources       []flatpakSource `json:"sources"`
+}
+
+// flatpakSource is a source of a module of a Flatpak manifest.
+type flatpakSource struct {
+	Type            string   `json:"type"`
+	URL             string   `json:"url"`
+	SHA256          string   `json:"sha256"`
+	StripComponents int      `json:"strip-components"`
+	OnlyArches      []string `json:"only-arches"`
+}
+
+// flatpakArch maps architecture names to the names of the architectures of Flatpak.
+var flatpakArch = map[string]string{
+	"amd64": "x86_64",
+	"386":   "i386",
+	"arm64": "aarch64",
+	"arm":   "arm",
+	"arm7":  "arm",
+}
+
+// WriteFlatpakManifest writes a Flatpak manifest, in JSON, of the application described by opts
+// to w, which can be built with flatpak-builder. The application uses the freedesktop runtime,
+// and installs the binaries from the archive in /app/bin.
+func WriteFlatpakManifest(w io.Writer, opts LinuxAppOptions) error {
+	if opts.AppID == "" {
+		return fmt.Errorf("no Flatpak application ID set")
+	}
+	d, err := newLinuxAppData(opts)
+	if err != nil {
+		return err
+	}
+	arch, ok := flatpakArch[d.Arch]
+	if !ok {
+		return fmt.Errorf("%w: %s for Flatpak", ErrUnsupportedArch, d.Arch)
+	}
+	if d.RuntimeVersion == "" {
+		d.RuntimeVersion = DefaultFlatpakRuntimeVersion
+	}
+
+	name := d.Name
+	if name == "" {
+		name = d.command()
+	}
+	m := flatpakManifest{
+		AppID:          d.AppID,
+		Runtime:        "org.freedesktop.Platform",
+		RuntimeVersion: d.RuntimeVersion,
+		SDK:            "org.freedesktop.Sdk",
+		Command:        d.command(),
+		FinishArgs:     d.FinishArgs,
+		Modules: []flatpakModule{{
+			Name:        name,
+			BuildSystem: "simple",
+			Sources: []flatpakSource{{
+				Type:       "archive",
+				URL:        d.ArchiveURL,
+				SHA256:     d.sha256,
+				OnlyArches: []string{arch},
+			}},
+		}},
+	}
+	for _, b := range d.Binaries {
+		m.Modules[0].BuildCommands = append(m.Modules[0].BuildCommands,
+			fmt.Sprintf("install -Dm755 %s /app/bin/%s", shellQuote(b), shellQuote(path.Base(b))))
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(m)
+}
+
+// shellQuote returns s quoted for the shell, if it contains characters other than letters,
+// digits, and -_./@+=:,.
+func shellQuote(s string) string {
+	safe := s != ""
+	for _, r := range s {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-_./@+=:,", r)) {
+			safe = false
+			break
+		}
+	}
+	if safe {
+		return s
+	}
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// CreateSnapcraft writes a snapcraft.yaml file, as written by WriteSnapcraft, to path.
+func CreateSnapcraft(path string, opts LinuxAppOptions) error {
+	return createManifest(path, opts, WriteSnapcraft)
+}
+
+// CreateFlatpakManifest writes a Flatpak manifest, as written by WriteFlatpakManifest, to path.
+func CreateFlatpakManifest(path string, opts LinuxAppOptions) error {
+	return createManifest(path, opts, WriteFlatpakManifest)
+}
+
+// createManifest writes the manifest written by write to path.
+func createManifest(path string, opts LinuxAppOptions, write func(io.Writer, LinuxAppOptions) error) error {
+	var b bytes.Buffer
+	if err := write(&b, opts); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path, b.Bytes(), 0644); err != nil {
+		return err
+	}
+	Log.Infof("created %s", path)
+	return nil
+}
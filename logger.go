@@ -0,0 +1,63 @@
+// SPDX-License-Identifier: BSD-3-Clause
+// Copyright (c) 2020-2021, Ctrl IQ, Inc. All rights reserved
+
+package gobuild
+
+import (
+	"log"
+
+	"github.com/magefile/mage/mg"
+)
+
+// Logger receives the messages of the package: informational messages, such as the commands run by
+// mage helpers and the files created, and debug messages, such as the tags considered when
+// describing a repository and the entries written to archives.
+type Logger interface {
+	Infof(format string, args ...interface{})
+	Debugf(format string, args ...interface{})
+}
+
+// Log is the Logger the package writes messages to. By default, messages are written with the log
+// package: informational messages when mage is run with -v, and debug messages when it is run with
+// -debug. It may be set to a StdLogger, or an adapter for another logging package.
+var Log Logger = mageLogger{}
+
+// mageLogger is the default Logger, which follows the verbosity of mage.
+type mageLogger struct{}
+
+func (mageLogger) Infof(format string, args ...interface{}) {
+	if mg.Verbose() || mg.Debug() {
+		log.Printf(format, args...)
+	}
+}
+
+func (mageLogger) Debugf(format string, args ...interface{}) {
+	if mg.Debug() {
+		log.Printf("DEBUG: "+format, args...)
+	}
+}
+
+// StdLogger is a Logger that writes informational messages, and debug messages if Debug is set, to
+// Logger, or the standard logger of the log package if it is nil.
+type StdLogger struct {
+	Logger *log.Logger
+	Debug  bool
+}
+
+func (l StdLogger) Infof(format string, args ...interface{}) {
+	l.printf(format, args...)
+}
+
+func (l StdLogger) Debugf(format string, args ...interface{}) {
+	if l.Debug {
+		l.printf("DEBUG: "+format, args...)
+	}
+}
+
+func (l StdLogger) printf(format string, args ...interface{}) {
+	if l.Logger != nil {
+		l.Logger.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
@@ -0,0 +1,486 @@
+// SPDX-License-Identifier: BSD-3-Clause
+// Copyright (c) 2020-2021, Ctrl IQ, Inc. All rights reserved
+
+package gobuild
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// MacPackageOptions describes a macOS installer package created by CreateMacPackage.
+type MacPackageOptions struct {
+	Identifier string // identifier of the package, such as com.example.tool
+	Version    string // version of the package; defaults to that returned by CurrentVersion
+
+	// InstallLocation is the directory the paths of Files are relative to. It defaults to /.
+	InstallLocation string
+
+	Files []MacPackageFile // files to install
+
+	// PreInstall and PostInstall, if set, are the contents of scripts run before and after the
+	// files are installed, such as "#!/bin/sh\n...".
+	PreInstall  string
+	PostInstall string
+}
+
+// MacPackageFile is a file installed by a macOS package.
+type MacPackageFile struct {
+	Source      string // path of the file to install
+	Destination string // path of the installed file, relative to the install location
+}
+
+// CreateMacPackage creates a flat macOS installer package (.pkg) described by opts at path, which
+// can be installed with installer or double-clicked, and signed with productsign. On macOS, it is
+// built with pkgbuild. Elsewhere, it is built in Go, with the bill of materials written by mkbom
+// from bomutils, which must be installed. Installed files are owned by root.
+func CreateMacPackage(path string, opts MacPackageOptions) error {
+	if opts.Identifier == "" {
+		return fmt.Errorf("no package identifier set")
+	}
+	if opts.Version == "" {
+		v, err := CurrentVersion()
+		if err != nil {
+			return err
+		}
+		opts.Version = v
+	}
+	if opts.InstallLocation == "" {
+		opts.InstallLocation = "/"
+	}
+
+	dir, err := ioutil.TempDir("", "gobuild-pkg")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	root := filepath.Join(dir, "root")
+	if err := stageMacPackageFiles(root, opts.Files); err != nil {
+		return err
+	}
+	scripts := filepath.Join(dir, "scripts")
+	if err := writeMacPackageScripts(scripts, opts); err != nil {
+		return err
+	}
+
+	if _, err := exec.LookPath("pkgbuild"); err == nil {
+		args := []string{"--quiet", "--root", root, "--identifier", opts.Identifier, "--version", opts.Version,
+			"--install-location", opts.InstallLocation, "--ownership", "recommended"}
+		if opts.PreInstall != "" || opts.PostInstall != "" {
+			args = append(args, "--scripts", scripts)
+		}
+		return runInstallerTool("pkgbuild", append(args, path)...)
+	}
+
+	bom := filepath.Join(dir, "Bom")
+	if _, err := exec.LookPath("mkbom"); err != nil {
+		return fmt.Errorf("neither pkgbuild nor mkbom is installed")
+	}
+	if err := runInstallerTool("mkbom", "-u", "0", "-g", "0", root, bom); err != nil {
+		return err
+	}
+	return writeFlatPackage(path, root, scripts, bom, opts)
+}
+
+// stageMacPackageFiles copies files to their destinations under root.
+func stageMacPackageFiles(root string, files []MacPackageFile) error {
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return err
+	}
+	for _, f := range files {
+		dst := filepath.Join(root, filepath.FromSlash(strings.TrimPrefix(path.Clean("/"+f.Destination), "/")))
+		if dst == root {
+			return fmt.Errorf("invalid destination %q of %s", f.Destination, f.Source)
+		}
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return err
+		}
+		if err := copyFile(f.Source, dst); err != nil {
+			return fmt.Errorf("while copying %s: %s", f.Source, err)
+		}
+	}
+	return nil
+}
+
+// copyFile copies the regular file src to dst, with the same permissions.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	fi, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// writeMacPackageScripts writes the scripts of opts to dir, named as pkgbuild expects.
+func writeMacPackageScripts(dir string, opts MacPackageOptions) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for name, s := range map[string]string{"preinstall": opts.PreInstall, "postinstall": opts.PostInstall} {
+		if s == "" {
+			continue
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(s), 0755); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeFlatPackage writes a flat package to path: a xar archive of the PackageInfo file, the bill
+// of materials at bom, and the Payload and Scripts archives of the root and scripts directories.
+func writeFlatPackage(path, root, scripts, bom string, opts MacPackageOptions) error {
+	mtime, ok, err := sourceDateEpoch()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		mtime = time.Unix(0, 0).UTC()
+	}
+
+	var payload bytes.Buffer
+	stats, err := writeCpioArchive(&payload, root, mtime)
+	if err != nil {
+		return fmt.Errorf("while writing payload: %s", err)
+	}
+
+	info := fmt.Sprintf(`<?xml version="1.0" encoding="utf-8"?>
+<pkg-info format-version="2" identifier="%s" version="%s" install-location="%s" auth="root" overwrite-permissions="true" relocatable="false">
+    <payload installKBytes="%d" numberOfFiles="%d"/>
+`, xmlEscape(opts.Identifier), xmlEscape(opts.Version), xmlEscape(opts.InstallLocation), (stats.size+1023)/1024, stats.files)
+
+	files := []xarFile{{name: "Payload"}, {name: "PackageInfo"}, {name: "Bom"}}
+	files[0].data = payload.Bytes()
+	if files[2].data, err = ioutil.ReadFile(bom); err != nil {
+		return err
+	}
+
+	if opts.PreInstall != "" || opts.PostInstall != "" {
+		var b bytes.Buffer
+		if _, err := writeCpioArchive(&b, scripts, mtime); err != nil {
+			return fmt.Errorf("while writing scripts: %s", err)
+		}
+		files = append(files, xarFile{name: "Scripts", data: b.Bytes()})
+
+		info += "    <scripts>\n"
+		if opts.PreInstall != "" {
+			info += `        <preinstall file="./preinstall"/>` + "\n"
+		}
+		if opts.PostInstall != "" {
+			info += `        <postinstall file="./postinstall"/>` + "\n"
+		}
+		info += "    </scripts>\n"
+	}
+	info += "</pkg-info>\n"
+	files[1].data = []byte(info)
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := writeXar(f, files, mtime); err != nil {
+		f.Close()
+		os.Remove(path)
+		return fmt.Errorf("while writing %s: %s", path, err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(path)
+		return err
+	}
+	Log.Infof("created %s", path)
+	return nil
+}
+
+// cpioStats are the number of files in a cpio archive and their total size.
+type cpioStats struct {
+	files int
+	size  int64
+}
+
+// writeCpioArchive writes a gzip-compressed cpio archive of the directory root to w, in the
+// portable (odc) format used by macOS packages. Entries are named relative to root, such as
+// ./usr/local/bin/tool, owned by root, and record mtime.
+func writeCpioArchive(w io.Writer, root string, mtime time.Time) (cpioStats, error) {
+	var stats cpioStats
+	zw := gzip.NewWriter(w)
+
+	var paths []string
+	err := filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		paths = append(paths, p)
+		return nil
+	})
+	if err != nil {
+		return stats, err
+	}
+	sort.Strings(paths)
+
+	for i, p := range paths {
+		fi, err := os.Lstat(p)
+		if err != nil {
+			return stats, err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return stats, err
+		}
+		name := "."
+		if rel != "." {
+			name = "./" + filepath.ToSlash(rel)
+		}
+
+		var data []byte
+		mode := uint32(fi.Mode().Perm())
+		switch {
+		case fi.IsDir():
+			mode |= 0040000
+		case fi.Mode()&os.ModeSymlink != 0:
+			mode |= 0120000
+			target, err := os.Readlink(p)
+			if err != nil {
+				return stats, err
+			}
+			data = []byte(target)
+		case fi.Mode().IsRegular():
+			mode |= 0100000
+			if data, err = ioutil.ReadFile(p); err != nil {
+				return stats, err
+			}
+		default:
+			return stats, fmt.Errorf("%s is not a regular file, directory or symlink", p)
+		}
+		stats.files++
+		stats.size += int64(len(data))
+
+		if err := writeCpioEntry(zw, name, mode, uint32(i+1), mtime, data); err != nil {
+			return stats, err
+		}
+	}
+	if err := writeCpioEntry(zw, "TRAILER!!!", 0, 0, time.Unix(0, 0), nil); err != nil {
+		return stats, err
+	}
+	return stats, zw.Close()
+}
+
+// writeCpioEntry writes an entry in the portable cpio format to w.
+func writeCpioEntry(w io.Writer, name string, mode, ino uint32, mtime time.Time, data []byte) error {
+	nlink := 1
+	if mode&0170000 == 0040000 {
+		nlink = 2
+	}
+	_, err := fmt.Fprintf(w, "070707%06o%06o%06o%06o%06o%06o%06o%011o%06o%011o%s\x00",
+		0, ino, mode, 0, 0, nlink, 0, mtime.Unix(), len(name)+1, len(data), name)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// xarFile is a file in a xar archive.
+type xarFile struct {
+	name string
+	data []byte
+}
+
+// writeXar writes a xar archive of files to w, stored uncompressed, with SHA-1 checksums.
+func writeXar(w io.Writer, files []xarFile, mtime time.Time) error {
+	const checksumSize = sha1.Size
+
+	var toc strings.Builder
+	fmt.Fprintf(&toc, `<?xml version="1.0" encoding="UTF-8"?>
+<xar>
+ <toc>
+  <checksum style="sha1">
+   <offset>0</offset>
+   <size>%d</size>
+  </checksum>
+  <creation-time>%s</creation-time>
+`, checksumSize, mtime.UTC().Format("2006-01-02T15:04:05"))
+
+	offset := checksumSize
+	for i, f := range files {
+		sum := sha1.Sum(f.data)
+		fmt.Fprintf(&toc, `  <file id="%d">
+   <name>%s</name>
+   <type>file</type>
+   <mode>0644</mode>
+   <uid>0</uid>
+   <user>root</user>
+   <gid>0</gid>
+   <group>wheel</group>
+   <data>
+    <length>%d</length>
+    <offset>%d</offset>
+    <size>%d</size>
+    <encoding style="application/octet-stream"/>
+    <extracted-checksum style="sha1">%s</extracted-checksum>
+    <archived-checksum style="sha1">%s</archived-checksum>
+   </data>
+  </file>
+`, i+1, xmlEscape(f.name), len(f.data), offset, len(f.data), hex.EncodeToString(sum[:]), hex.EncodeToString(sum[:]))
+		offset += len(f.data)
+	}
+	toc.WriteString(" </toc>\n</xar>\n")
+
+	var compressed bytes.Buffer
+	zw := zlib.NewWriter(&compressed)
+	if _, err := io.WriteString(zw, toc.String()); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+
+	header := struct {
+		Magic            uint32
+		HeaderSize       uint16
+		Version          uint16
+		TOCCompressed    uint64
+		TOCUncompressed  uint64
+		ChecksumAlgoritm uint32
+	}{0x78617221, 28, 1, uint64(compressed.Len()), uint64(toc.Len()), 1}
+	if err := binary.Write(w, binary.BigEndian, header); err != nil {
+		return err
+	}
+	if _, err := w.Write(compressed.Bytes()); err != nil {
+		return err
+	}
+
+	// The heap begins with the checksum of the compressed table of contents.
+	sum := sha1.Sum(compressed.Bytes())
+	if _, err := w.Write(sum[:]); err != nil {
+		return err
+	}
+	for _, f := range files {
+		if _, err := w.Write(f.data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CreateMacZip writes a zip archive of paths to the file at path, in the layout expected for
+// notarization with notarytool and by ditto: each of paths, such as a signed binary or .app
+// bundle, is stored at the top level of the archive under its base name. Symlinks within bundles
+// are stored as symlinks, so that their signatures remain valid, and permissions are preserved.
+// Entries record the time of SOURCE_DATE_EPOCH, if set, so that archives are reproducible.
+func CreateMacZip(path string, paths ...string) error {
+	mtime, ok, err := sourceDateEpoch()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		mtime = time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	zw := zip.NewWriter(f)
+	for _, p := range paths {
+		if err = addMacZipEntries(zw, p, mtime); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = zw.Close()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path)
+		return fmt.Errorf("while writing %s: %s", path, err)
+	}
+	Log.Infof("created %s", path)
+	return nil
+}
+
+// addMacZipEntries adds the file or directory tree at p to zw, named relative to its parent
+// directory.
+func addMacZipEntries(zw *zip.Writer, p string, mtime time.Time) error {
+	parent := filepath.Dir(filepath.Clean(p))
+	return filepath.Walk(p, func(file string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(parent, file)
+		if err != nil {
+			return err
+		}
+
+		header, err := zip.FileInfoHeader(fi)
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(rel)
+		header.Modified = mtime
+		if fi.IsDir() {
+			header.Name += "/"
+			header.Method = zip.Store
+			_, err := zw.CreateHeader(header)
+			return err
+		}
+		header.Method = zip.Deflate
+
+		var r io.Reader
+		if fi.Mode()&os.ModeSymlink != 0 {
+			target, err := os.Readlink(file)
+			if err != nil {
+				return err
+			}
+			header.Method = zip.Store
+			r = strings.NewReader(target)
+		} else if fi.Mode().IsRegular() {
+			in, err := os.Open(file)
+			if err != nil {
+				return err
+			}
+			defer in.Close()
+			r = in
+		} else {
+			return fmt.Errorf("%s is not a regular file, directory or symlink", file)
+		}
+
+		w, err := zw.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(w, r)
+		return err
+	})
+}
@@ -4,34 +4,798 @@
 package gobuild
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/blang/semver"
+	"github.com/go-git/go-git/v5"
 	"github.com/magefile/mage/mg"
 	"github.com/magefile/mage/sh"
 )
 
 func goCmd(args []string) error {
-	return sh.RunV(mg.GoCmd(), args...)
+	return goCmdEnv(nil, args)
 }
 
-func RunIntegration(paths ...string) error {
+// goCmdEnv runs the go command with args, adding env to the environment.
+func goCmdEnv(env map[string]string, args []string) error {
+	return sh.RunWithV(env, mg.GoCmd(), args...)
+}
+
+// goCmdContext runs the go command with args, adding env to the environment. If ctx is done
+// before the command exits, the command and any processes it started (such as test binaries) are
+// killed, and ctx.Err() is returned.
+func goCmdContext(ctx context.Context, env map[string]string, args []string) error {
+	return goCmdContextOutput(ctx, env, args, os.Stdout)
+}
+
+// goCmdContextOutput is like goCmdContext, but writes the standard output of the command to stdout.
+func goCmdContextOutput(ctx context.Context, env map[string]string, args []string, stdout io.Writer) error {
+	cmd := exec.Command(mg.GoCmd(), args...)
+	cmd.Env = os.Environ()
+	for k, v := range env {
+		cmd.Env = append(cmd.Env, k+"="+v)
+	}
+	cmd.Stdout = stdout
+	cmd.Stderr = os.Stderr
+	setProcessGroup(cmd)
+
+	Log.Infof("exec: %s %s", mg.GoCmd(), strings.Join(args, " "))
+
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf(`failed to run "go %s": %s`, strings.Join(args, " "), err)
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			killProcessGroup(cmd)
+		case <-done:
+		}
+	}()
+
+	err := cmd.Wait()
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	} else if err != nil {
+		return fmt.Errorf(`running "go %s" failed: %s`, strings.Join(args, " "), err)
+	}
+	return nil
+}
+
+func integrationArgs(paths []string) []string {
 	args := []string{"test", "-count", "1", "-cover", "-race"}
-	args = append(args, paths...)
-	return goCmd(args)
+	return append(args, paths...)
 }
 
-func RunUnitTest(paths ...string) error {
+func unitTestArgs(paths []string) []string {
 	args := []string{"test", "-short", "-count", "1", "-cover", "-race"}
-	args = append(args, paths...)
+	return append(args, paths...)
+}
+
+func RunIntegration(paths ...string) error {
+	return RunIntegrationWithEnv(nil, paths...)
+}
+
+func RunIntegrationWithEnv(env map[string]string, paths ...string) error {
+	return goCmdEnv(env, integrationArgs(paths))
+}
+
+func RunIntegrationContext(ctx context.Context, env map[string]string, paths ...string) error {
+	return goCmdContext(ctx, env, integrationArgs(paths))
+}
+
+func RunUnitTest(paths ...string) error {
+	return RunUnitTestWithEnv(nil, paths...)
+}
+
+func RunUnitTestWithEnv(env map[string]string, paths ...string) error {
+	return goCmdEnv(env, unitTestArgs(paths))
+}
+
+func RunUnitTestContext(ctx context.Context, env map[string]string, paths ...string) error {
+	return goCmdContext(ctx, env, unitTestArgs(paths))
+}
+
+// TestOptions configures RunUnitTestWithOptions and RunIntegrationWithOptions.
+type TestOptions struct {
+	Env map[string]string // variables added to the environment of the tests
+
+	CoverPackages []string // if set, the packages to measure the coverage of (go test -coverpkg)
+	CoverProfile  string   // if set, the path to write the coverage profile of all packages to
+	CoverHTML     string   // if set, the path to write an HTML coverage report to
+
+	// CoverThreshold, if nonzero, is the minimum percentage of statements that the tests must
+	// cover. If the total coverage is lower, an error is returned.
+	CoverThreshold float64
+
+	// Summary runs the tests with go test -json, and prints a line for each package, the output
+	// of failed tests, the number of tests that passed, failed and were skipped, and the Slowest
+	// tests, rather than the output of go test.
+	Summary bool
+	Slowest int // number of slowest tests printed by Summary; defaults to 10, or none if negative
+
+	// ResultsFile, if set, is the path to write a JSON array of the TestResult of each test and
+	// package to. It implies go test -json.
+	ResultsFile string
+}
+
+func RunUnitTestWithOptions(ctx context.Context, opts TestOptions, paths ...string) error {
+	return runTests(ctx, unitTestArgs(nil), opts, paths)
+}
+
+func RunIntegrationWithOptions(ctx context.Context, opts TestOptions, paths ...string) error {
+	return runTests(ctx, integrationArgs(nil), opts, paths)
+}
+
+// runTests runs go test with args, the coverage flags of opts, and paths, and then writes the
+// coverage outputs of opts.
+func runTests(ctx context.Context, args []string, opts TestOptions, paths []string) error {
+	if len(opts.CoverPackages) > 0 {
+		args = append(args, "-coverpkg", strings.Join(opts.CoverPackages, ","))
+	}
+
+	var profile string
+	if opts.CoverProfile != "" || opts.CoverHTML != "" || opts.CoverThreshold > 0 {
+		f, err := ioutil.TempFile("", "coverprofile")
+		if err != nil {
+			return err
+		}
+		f.Close()
+		profile = f.Name()
+		defer os.Remove(profile)
+
+		args = append(args, "-coverprofile", profile)
+	}
+
+	if opts.Summary || opts.ResultsFile != "" {
+		if err := runTestsJSON(ctx, args, opts, paths); err != nil {
+			return err
+		}
+	} else if err := goCmdContext(ctx, opts.Env, append(args, paths...)); err != nil {
+		return err
+	}
+	if profile == "" {
+		return nil
+	}
+
+	// Merge the blocks reported by more than one package, as happens with -coverpkg, so that the
+	// profile can be read by go tool cover.
+	var p coverProfile
+	if err := p.read(profile); err != nil {
+		return err
+	}
+	for _, path := range []string{profile, opts.CoverProfile} {
+		if path == "" {
+			continue
+		}
+		if err := writeCoverProfile(path, &p); err != nil {
+			return err
+		}
+	}
+
+	if opts.CoverHTML != "" {
+		if err := goCmdContext(ctx, nil, []string{"tool", "cover", "-html", profile, "-o", opts.CoverHTML}); err != nil {
+			return err
+		}
+	}
+
+	total := p.total()
+	Log.Infof("total coverage: %.1f%% of statements", total)
+	if total < opts.CoverThreshold {
+		return fmt.Errorf("total coverage %.1f%% is below threshold %.1f%%", total, opts.CoverThreshold)
+	}
+	return nil
+}
+
+// runTestsJSON runs go test -json with args and paths, and prints and writes its results as set by
+// opts. If Summary is not set, the events of go test are printed, as with go test -json.
+func runTestsJSON(ctx context.Context, args []string, opts TestOptions, paths []string) error {
+	args = append(append(args, "-json"), paths...)
+
+	// With Summary, results are printed as the events are parsed, rather than the events.
+	tw := newTestResultWriter(os.Stdout)
+	var stdout io.Writer = tw
+	if !opts.Summary {
+		tw.w = ioutil.Discard
+		stdout = io.MultiWriter(os.Stdout, tw)
+	}
+	err := goCmdContextOutput(ctx, opts.Env, args, stdout)
+
+	if opts.Summary {
+		slowest := opts.Slowest
+		if slowest == 0 {
+			slowest = 10
+		}
+		tw.printSummary(slowest)
+	}
+
+	if opts.ResultsFile != "" {
+		results := tw.results
+		if results == nil {
+			results = []TestResult{}
+		}
+		b, jerr := json.MarshalIndent(results, "", "  ")
+		if jerr != nil {
+			return jerr
+		}
+		if werr := ioutil.WriteFile(opts.ResultsFile, append(b, '\n'), 0644); werr != nil {
+			return fmt.Errorf("while writing %s: %s", opts.ResultsFile, werr)
+		}
+	}
+	return err
+}
+
+// writeCoverProfile writes p to the file at path.
+func writeCoverProfile(path string, p *coverProfile) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := p.write(f); err != nil {
+		f.Close()
+		return fmt.Errorf("while writing %s: %s", path, err)
+	}
+	return f.Close()
+}
+
+// defaultPaths returns paths, or ./... if paths is empty.
+func defaultPaths(paths []string) []string {
+	if len(paths) == 0 {
+		return []string{"./..."}
+	}
+	return paths
+}
+
+// LintIssue is a problem reported by RunLint or RunVet.
+type LintIssue struct {
+	Linter string // name of the linter or vet analyzer that reported the issue
+	Pos    string // position of the issue, in the form file:line:column
+	Text   string // description of the issue
+}
+
+// String returns the issue in the form <pos>: <text> (<linter>).
+func (i LintIssue) String() string {
+	return fmt.Sprintf("%s: %s (%s)", i.Pos, i.Text, i.Linter)
+}
+
+// LintError is returned by RunLint and RunVet when issues are found.
+type LintError struct {
+	Issues []LintIssue
+}
+
+func (e *LintError) Error() string {
+	if len(e.Issues) == 1 {
+		return "1 lint issue found"
+	}
+	return fmt.Sprintf("%d lint issues found", len(e.Issues))
+}
+
+// lintResult logs issues, and returns a *LintError of them if there are any.
+func lintResult(issues []LintIssue) error {
+	if len(issues) == 0 {
+		return nil
+	}
+	for _, i := range issues {
+		Log.Infof("%s", i)
+	}
+	return &LintError{Issues: issues}
+}
+
+// RunVet runs go vet on paths, or ./... if paths is empty. If vet reports issues, they are logged
+// and a *LintError is returned.
+func RunVet(paths ...string) error {
+	args := []string{"vet", "-json"}
+	args = append(args, defaultPaths(paths)...)
+
+	Log.Infof("exec: %s %s", mg.GoCmd(), strings.Join(args, " "))
+
+	// With -json, vet exits successfully whether or not it reports issues, and writes them as a
+	// JSON object for each package, following a "# <package>" line. Depending on the version of
+	// go, they are written to stdout or stderr.
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(mg.GoCmd(), args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		os.Stderr.Write(stderr.Bytes())
+		return fmt.Errorf(`running "go %s" failed: %s`, strings.Join(args, " "), err)
+	}
+
+	var b bytes.Buffer
+	for _, line := range strings.SplitAfter(stdout.String()+stderr.String(), "\n") {
+		if !strings.HasPrefix(line, "#") {
+			b.WriteString(line)
+		}
+	}
+
+	var issues []LintIssue
+	dec := json.NewDecoder(&b)
+	for {
+		var pkgs map[string]map[string][]struct {
+			Posn    string `json:"posn"`
+			Message string `json:"message"`
+		}
+		if err := dec.Decode(&pkgs); err == io.EOF {
+			break
+		} else if err != nil {
+			os.Stderr.Write(stdout.Bytes())
+			os.Stderr.Write(stderr.Bytes())
+			return fmt.Errorf("while parsing vet output: %s", err)
+		}
+
+		for _, analyzers := range pkgs {
+			for analyzer, diags := range analyzers {
+				for _, d := range diags {
+					issues = append(issues, LintIssue{Linter: analyzer, Pos: d.Posn, Text: d.Message})
+				}
+			}
+		}
+	}
+
+	sort.Slice(issues, func(i, j int) bool { return issues[i].Pos < issues[j].Pos })
+	return lintResult(issues)
+}
+
+// GolangciLintVersion is the version of golangci-lint run by RunLint if it is not installed.
+var GolangciLintVersion = "v1.64.8"
+
+// RunLint runs golangci-lint on paths, or ./... if paths is empty, using the configuration of the
+// module, if any. If golangci-lint is not in PATH, GolangciLintVersion is downloaded and run. If
+// golangci-lint reports issues, they are logged and a *LintError is returned.
+func RunLint(paths ...string) error {
+	lintArgs := []string{"run", "--out-format", "json"}
+	lintArgs = append(lintArgs, defaultPaths(paths)...)
+
+	cmd := exec.Command("golangci-lint", lintArgs...)
+	if _, err := exec.LookPath("golangci-lint"); err != nil {
+		args := []string{"run", "github.com/golangci/golangci-lint/cmd/golangci-lint@" + GolangciLintVersion}
+		cmd = exec.Command(mg.GoCmd(), append(args, lintArgs...)...)
+	}
+
+	Log.Infof("exec: %s", strings.Join(cmd.Args, " "))
+
+	// golangci-lint exits with status 1 if it reports issues, so the output is parsed even if it
+	// fails.
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = os.Stderr
+	runErr := cmd.Run()
+
+	var out struct {
+		Issues []struct {
+			FromLinter string
+			Text       string
+			Pos        struct {
+				Filename string
+				Line     int
+				Column   int
+			}
+		}
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &out); err != nil {
+		if runErr != nil {
+			return fmt.Errorf(`running "%s" failed: %s`, strings.Join(cmd.Args, " "), runErr)
+		}
+		return fmt.Errorf("while parsing golangci-lint output: %s", err)
+	}
+
+	var issues []LintIssue
+	for _, i := range out.Issues {
+		issues = append(issues, LintIssue{
+			Linter: i.FromLinter,
+			Pos:    fmt.Sprintf("%s:%d:%d", i.Pos.Filename, i.Pos.Line, i.Pos.Column),
+			Text:   i.Text,
+		})
+	}
+	if len(issues) == 0 && runErr != nil {
+		return fmt.Errorf(`running "%s" failed: %s`, strings.Join(cmd.Args, " "), runErr)
+	}
+	return lintResult(issues)
+}
+
+// StaticcheckVersion is the module version of staticcheck run by RunStaticcheck (v0.6.1 is
+// release 2025.1.1). It is pinned, so that new checks do not fail builds unexpectedly.
+var StaticcheckVersion = "v0.6.1"
+
+// RunStaticcheck runs StaticcheckVersion of staticcheck on paths, or ./... if paths is empty, with
+// go run, so that it need not be installed. It uses the configuration of the module, if any.
+func RunStaticcheck(paths ...string) error {
+	args := []string{"run", "honnef.co/go/tools/cmd/staticcheck@" + StaticcheckVersion}
+	args = append(args, defaultPaths(paths)...)
 	return goCmd(args)
 }
 
 func RunInstall(args ...string) error {
+	return RunInstallWithEnv(nil, args...)
+}
+
+func RunInstallWithEnv(env map[string]string, args ...string) error {
 	a := []string{"install"}
 	a = append(a, args...)
-	return goCmd(a)
+	return goCmdEnv(env, a)
+}
+
+func RunInstallContext(ctx context.Context, env map[string]string, args ...string) error {
+	a := []string{"install"}
+	a = append(a, args...)
+	return goCmdContext(ctx, env, a)
 }
 
 func RunBuild(args ...string) error {
+	return RunBuildWithEnv(nil, args...)
+}
+
+func RunBuildWithEnv(env map[string]string, args ...string) error {
+	a := []string{"build"}
+	a = append(a, args...)
+	return goCmdEnv(env, a)
+}
+
+func RunBuildContext(ctx context.Context, env map[string]string, args ...string) error {
 	a := []string{"build"}
 	a = append(a, args...)
+	return goCmdContext(ctx, env, a)
+}
+
+// BuildOptions configures RunBuildWithOptions and RunInstallWithOptions.
+type BuildOptions struct {
+	Env        map[string]string // variables added to the environment of the go command
+	Target     Target            // if GOOS is set, the platform to build for
+	DisableCGO bool              // build with CGO_ENABLED=0
+
+	Tags     []string // build tags (-tags)
+	TrimPath bool     // remove file system paths from the binaries (-trimpath)
+	LDFlags  string   // flags passed to the linker (-ldflags)
+
+	// VersionVars names variables to set to the VersionInfo of HEAD, using linker flags added to
+	// LDFlags. If it is empty, no variables are set.
+	VersionVars LDFlagVars
+
+	// Output is the file or directory to write the binary to (-o). It is not supported by
+	// RunInstallWithOptions.
+	Output string
+
+	Args []string // other flags passed to the go command
+}
+
+// RunBuildWithOptions runs go build for packages, configured by opts.
+func RunBuildWithOptions(ctx context.Context, opts BuildOptions, packages ...string) error {
+	env, args, err := buildArgs("build", opts, packages)
+	if err != nil {
+		return err
+	}
+	return goCmdContext(ctx, env, args)
+}
+
+// RunInstallWithOptions runs go install for packages, configured by opts.
+func RunInstallWithOptions(ctx context.Context, opts BuildOptions, packages ...string) error {
+	if opts.Output != "" {
+		return fmt.Errorf("go install does not support an output path")
+	}
+	env, args, err := buildArgs("install", opts, packages)
+	if err != nil {
+		return err
+	}
+	return goCmdContext(ctx, env, args)
+}
+
+// buildArgs returns the environment and arguments of the go command cmd for packages, configured by
+// opts.
+func buildArgs(cmd string, opts BuildOptions, packages []string) (map[string]string, []string, error) {
+	env := make(map[string]string)
+	for k, v := range opts.Env {
+		env[k] = v
+	}
+	if opts.Target.GOOS != "" {
+		env["GOOS"] = opts.Target.GOOS
+		env["GOARCH"] = opts.Target.GOARCH
+		env["GOARM"] = opts.Target.GOARM
+	}
+	if opts.DisableCGO {
+		env["CGO_ENABLED"] = "0"
+	}
+
+	ldflags := opts.LDFlags
+	if opts.VersionVars != (LDFlagVars{}) {
+		vi, err := NewVersionInfo()
+		if err != nil {
+			return nil, nil, err
+		}
+		ldflags = strings.TrimSpace(ldflags + " " + vi.BuildLDFlags(opts.VersionVars))
+	}
+
+	args := []string{cmd}
+	if len(opts.Tags) > 0 {
+		args = append(args, "-tags", strings.Join(opts.Tags, ","))
+	}
+	if opts.TrimPath {
+		args = append(args, "-trimpath")
+	}
+	if ldflags != "" {
+		args = append(args, "-ldflags", ldflags)
+	}
+	if opts.Output != "" {
+		args = append(args, "-o", opts.Output)
+	}
+	args = append(args, opts.Args...)
+	args = append(args, packages...)
+	return env, args, nil
+}
+
+// CleanOptions configures RunCleanWithOptions.
+type CleanOptions struct {
+	RemovePaths      []string // files or directories to remove
+	GoCleanCache     bool     // run "go clean -cache"
+	GoCleanTestCache bool     // run "go clean -testcache"
+}
+
+// RunClean removes each of paths. Paths that do not exist are ignored.
+func RunClean(paths ...string) error {
+	return RunCleanWithOptions(CleanOptions{RemovePaths: paths})
+}
+
+// RunCleanWithOptions removes opts.RemovePaths, and optionally cleans the go build and test
+// caches. Paths that do not exist are ignored. As a safety guard, the filesystem root and the
+// current directory are never removed.
+func RunCleanWithOptions(opts CleanOptions) error {
+	for _, p := range opts.RemovePaths {
+		if err := removePath(p); err != nil {
+			return err
+		}
+	}
+
+	if opts.GoCleanCache {
+		if err := goCmd([]string{"clean", "-cache"}); err != nil {
+			return err
+		}
+	}
+	if opts.GoCleanTestCache {
+		if err := goCmd([]string{"clean", "-testcache"}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removePath removes p and anything it contains, refusing to remove the filesystem root or the
+// current directory.
+func removePath(p string) error {
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return fmt.Errorf("while resolving %s: %s", p, err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		return fmt.Errorf("while getting working directory: %s", err)
+	}
+	if p == "" || abs == wd || abs == filepath.VolumeName(abs)+string(filepath.Separator) {
+		return fmt.Errorf("refusing to remove %q", p)
+	}
+
+	Log.Infof("rm -rf %s", p)
+	if err := os.RemoveAll(abs); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("while removing %s: %s", p, err)
+	}
+	return nil
+}
+
+// UntaggedVersion is the base of the version stamped by RunBuildVersioned when no semver tag is
+// reachable from HEAD, such as in a shallow clone. The number of commits and the abbreviated commit
+// hash are appended, as by GitDescription.UntaggedSemver (for example, 0.0.0-devel.12+g1a2b3c4).
+// If empty, RunBuildVersioned returns an error instead.
+var UntaggedVersion = "0.0.0-devel"
+
+// VersionEnv is the environment variable that, if set, overrides the version computed from the git
+// repository, as does VersionOverride.
+const VersionEnv = "GOBUILD_VERSION"
+
+// VersionOverride, if set, is used in place of the version computed from the git repository by
+// functions such as RunBuildVersioned and NewVersionInfo, which then do not read the repository. It
+// takes precedence over the VersionEnv environment variable. Either can be used to build from an
+// exported source tree, such as a tarball created by GitArchive, without a .git directory.
+var VersionOverride string
+
+// versionOverride returns the version set by VersionOverride or VersionEnv, without any leading v.
+// If neither is set, ok is false.
+func versionOverride() (v string, ok bool, err error) {
+	s := VersionOverride
+	if s == "" {
+		s = os.Getenv(VersionEnv)
+	}
+	if s == "" {
+		return "", false, nil
+	}
+
+	sv, err := semver.Parse(strings.TrimPrefix(s, "v"))
+	if err != nil {
+		return "", true, fmt.Errorf("while parsing version override %q: %s", s, err)
+	}
+	return sv.String(), true, nil
+}
+
+// CurrentVersion returns the version to build and package: that set by VersionOverride or
+// VersionEnv, if any, or otherwise the semantic version of HEAD in the git repository containing
+// the current working directory, as returned by GitDescription.GetSemver, or UntaggedVersion if no
+// tags are found. If there is no git repository and BuildInfoBinary is set, the version recorded in
+// that binary is used.
+func CurrentVersion() (string, error) {
+	return gitVersion()
+}
+
+// gitVersion returns the overridden version, if any, or the semantic version of HEAD, or
+// UntaggedVersion if no tags are found.
+func gitVersion() (string, error) {
+	if v, ok, err := versionOverride(); ok {
+		return v, err
+	}
+
+	gd, err := GitDescribe()
+	if err == git.ErrRepositoryNotExists && BuildInfoBinary != "" {
+		vi, err := BinaryVersionInfo(BuildInfoBinary)
+		if err != nil {
+			return "", err
+		}
+		return vi.Version, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return describedVersion(gd)
+}
+
+// describedVersion returns the overridden version, if any, or the semantic version of gd, or
+// UntaggedVersion if no tags were found.
+func describedVersion(gd *GitDescription) (string, error) {
+	if v, ok, err := versionOverride(); ok {
+		return v, err
+	}
+
+	v, err := gd.GetSemver()
+	if err != nil {
+		if _, ok := gd.TagName(); !ok && UntaggedVersion != "" {
+			base, err := semver.Parse(UntaggedVersion)
+			if err != nil {
+				return "", fmt.Errorf("while parsing untagged version: %s", err)
+			}
+			uv, err := gd.UntaggedSemver(base)
+			if err != nil {
+				return "", err
+			}
+			return uv.String(), nil
+		}
+		return "", err
+	}
+
+	return v.String(), nil
+}
+
+// RunBuildVersioned builds pkgPath, setting the string variable versionVar (for example,
+// main.version) to the semantic version of HEAD via -ldflags.
+func RunBuildVersioned(pkgPath, versionVar string, extraArgs ...string) error {
+	v, err := gitVersion()
+	if err != nil {
+		return err
+	}
+
+	vi := &VersionInfo{Version: v}
+	a := []string{"build", "-ldflags=" + vi.BuildLDFlags(LDFlagVars{Version: versionVar})}
+	a = append(a, extraArgs...)
+	a = append(a, pkgPath)
 	return goCmd(a)
 }
+
+// Target is a platform to build for.
+type Target struct {
+	GOOS   string
+	GOARCH string
+	GOARM  string // ARM version, if GOARCH is arm
+}
+
+// String returns the name of t, in the form <goos>_<goarch>[<goarm>] (for example, linux_arm7).
+func (t Target) String() string {
+	return t.GOOS + "_" + t.GOARCH + t.GOARM
+}
+
+// Arch returns the architecture of t, in the form used by package functions such as NewPackage
+// (for example, amd64 or arm7).
+func (t Target) Arch() string {
+	return t.GOARCH + t.GOARM
+}
+
+// NewTarget returns the Target for goos and arch, where arch is an architecture name accepted by
+// NewPackage (for example, amd64 or arm7).
+func NewTarget(goos, arch string) (Target, error) {
+	if _, ok := formatArch[arch]; !ok || arch == "all" {
+		return Target{}, fmt.Errorf("%w: %s", ErrUnsupportedArch, arch)
+	}
+
+	t := Target{GOOS: goos, GOARCH: arch}
+	if strings.HasPrefix(arch, "arm") && len(arch) == 4 {
+		t.GOARCH, t.GOARM = "arm", arch[3:]
+	}
+	return t, nil
+}
+
+// MatrixOptions configures builds run by RunBuildMatrixWithOptions.
+type MatrixOptions struct {
+	CGO         bool // enable cgo
+	Concurrency int  // maximum number of targets built at once; defaults to 1
+}
+
+// RunBuildMatrix builds pkgPath for each of targets, writing binaries named
+// <binary>_<goos>_<goarch>[<goarm>] to outputDir, in the same way as RunBuildMatrixWithOptions
+// with no options: one target at a time, with cgo disabled.
+func RunBuildMatrix(pkgPath string, targets []Target, outputDir string) error {
+	return RunBuildMatrixWithOptions(pkgPath, targets, outputDir, MatrixOptions{})
+}
+
+// RunBuildMatrixWithOptions builds pkgPath for each of targets, writing binaries named
+// <binary>_<goos>_<goarch>[<goarm>] to outputDir, with the suffix .exe for windows. Up to
+// opts.Concurrency targets are built at once. All targets are built, and the returned error names
+// each target that failed.
+func RunBuildMatrixWithOptions(pkgPath string, targets []Target, outputDir string, opts MatrixOptions) error {
+	abs, err := filepath.Abs(pkgPath)
+	if err != nil {
+		return err
+	}
+	binary := filepath.Base(abs)
+
+	cgo := "0"
+	if opts.CGO {
+		cgo = "1"
+	}
+
+	n := opts.Concurrency
+	if n < 1 {
+		n = 1
+	}
+	sem := make(chan struct{}, n)
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(targets))
+	for i, t := range targets {
+		env := map[string]string{
+			"GOOS":        t.GOOS,
+			"GOARCH":      t.GOARCH,
+			"GOARM":       t.GOARM,
+			"CGO_ENABLED": cgo,
+		}
+
+		out := filepath.Join(outputDir, binary+"_"+t.String())
+		if t.GOOS == "windows" {
+			out += ".exe"
+		}
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer func() { <-sem; wg.Done() }()
+			errs[i] = goCmdEnv(env, []string{"build", "-o", out, pkgPath})
+		}(i)
+	}
+	wg.Wait()
+
+	var failed []string
+	for i, err := range errs {
+		if err != nil {
+			failed = append(failed, targets[i].String())
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("build failed for targets: %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+// SPDX-License-Identifier: BSD-3-Clause
+// Copyright (c) 2020-2021, Ctrl IQ, Inc. All rights reserved
+
+package gobuild
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+// initMainModule returns the path of a new module named hello with a trivial main package, and
+// changes the working directory to it until the test completes.
+func initMainModule(t *testing.T) string {
+	t.Helper()
+	dir := filepath.Join(tempDir(t), "hello")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range map[string]string{
+		"go.mod":  "module example.com/hello\n\ngo 1.14\n",
+		"main.go": "package main\n\nfunc main() {}\n",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	chdir(t, dir)
+	return dir
+}
+
+func TestRunBuildMatrixWithOptions(t *testing.T) {
+	initMainModule(t)
+	out := tempDir(t)
+
+	targets := []Target{{GOOS: "linux", GOARCH: "arm", GOARM: "7"}, {GOOS: "windows", GOARCH: "amd64"}}
+	if err := RunBuildMatrixWithOptions(".", targets, out, MatrixOptions{Concurrency: 2}); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"hello_linux_arm7", "hello_windows_amd64.exe"} {
+		if _, err := os.Stat(filepath.Join(out, name)); err != nil {
+			t.Error(err)
+		}
+	}
+
+	bad := []Target{{GOOS: runtime.GOOS, GOARCH: runtime.GOARCH}, {GOOS: "plan10", GOARCH: "amd64"}}
+	err := RunBuildMatrixWithOptions(".", bad, out, MatrixOptions{Concurrency: 2})
+	if err == nil || err.Error() != "build failed for targets: plan10_amd64" {
+		t.Errorf("got error %v, want failure of plan10_amd64 only", err)
+	}
+}
+
+func TestRunBuildMatrix(t *testing.T) {
+	initMainModule(t)
+	out := tempDir(t)
+
+	target := Target{GOOS: runtime.GOOS, GOARCH: runtime.GOARCH}
+	if err := RunBuildMatrix(".", []Target{target}, out); err != nil {
+		t.Fatal(err)
+	}
+	name := "hello_" + runtime.GOOS + "_" + runtime.GOARCH
+	if runtime.GOOS == "windows" {
+		name += ".exe"
+	}
+	if err := exec.Command(filepath.Join(out, name)).Run(); err != nil {
+		t.Errorf("while running %s: %s", name, err)
+	}
+}
+
+func TestRunBuildWithEnv(t *testing.T) {
+	dir := initMainModule(t)
+	// The package only builds if the tag set in the environment reaches the go command.
+	for name, content := range map[string]string{
+		"main.go": "package main\n\nimport \"fmt\"\n\nfunc main() { fmt.Print(msg) }\n",
+		"msg.go":  "// +build fromenv\n\npackage main\n\nconst msg = \"from env\"\n",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	out := filepath.Join(tempDir(t), "hello")
+	if runtime.GOOS == "windows" {
+		out += ".exe"
+	}
+
+	if err := RunBuild("-o", out, "."); err == nil {
+		t.Error("package built without the tag")
+	}
+	if err := RunBuildWithEnv(map[string]string{"GOFLAGS": "-tags=fromenv"}, "-o", out, "."); err != nil {
+		t.Fatal(err)
+	}
+	got, err := exec.Command(out).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "from env" {
+		t.Errorf("got output %q, want %q", got, "from env")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := RunBuildContext(ctx, map[string]string{"GOFLAGS": "-tags=fromenv"}, "-o", out, "."); err != context.Canceled {
+		t.Errorf("got error %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestRunClean(t *testing.T) {
+	dir := tempDir(t)
+	chdir(t, dir)
+	if err := os.MkdirAll(filepath.Join("dist", "bin"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join("dist", "bin", "tool"), []byte("tool"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile("keep", []byte("keep"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := RunClean("dist", "absent"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat("dist"); !os.IsNotExist(err) {
+		t.Errorf("dist was not removed: %v", err)
+	}
+
+	for _, p := range []string{"", ".", "./", dir, "/"} {
+		if err := RunClean(p); err == nil {
+			t.Errorf("%q: no error", p)
+		}
+	}
+	if _, err := os.Stat("keep"); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,74 @@
+// SPDX-License-Identifier: BSD-3-Clause
+// Copyright (c) 2020-2021, Ctrl IQ, Inc. All rights reserved
+
+package gobuild
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// ArchiveManifest describes the contents of an archive created from a GitArchive.
+type ArchiveManifest struct {
+	Tag     string          `json:"tag"`               // name of the tag the archive is created from
+	Version string          `json:"version,omitempty"` // semantic version of the tag, if it has one
+	Commit  string          `json:"commit"`            // hash of the commit the tag points to
+	Entries []ManifestEntry `json:"entries"`           // entries in the order they are written
+}
+
+// ManifestEntry describes an entry in an archive.
+type ManifestEntry struct {
+	Name string `json:"name"`           // path of the entry in the archive, including the prefix
+	Type string `json:"type"`           // file, dir or symlink
+	Mode string `json:"mode"`           // permissions recorded in the archive, in octal
+	Size int64  `json:"size,omitempty"` // size of a file in bytes
+}
+
+// Manifest returns a JSON encoded ArchiveManifest of the archive that Create would write with the
+// same extraFiles.
+func (ga *GitArchive) Manifest(extraFiles ...string) ([]byte, error) {
+	m := ArchiveManifest{
+		Tag:    ga.tag.name,
+		Commit: ga.tag.commit.Hash.String(),
+	}
+
+	if v, err := ga.Version(); err == nil {
+		m.Version = v
+	} else if ga.gd != nil && !errors.Is(err, ErrNoSemverTags) {
+		return nil, err
+	}
+
+	entries, err := ga.entries(extraFiles...)
+	if err != nil {
+		return nil, err
+	}
+
+	m.Entries = make([]ManifestEntry, 0, len(entries))
+	for _, entry := range entries {
+		fi, err := entry.src.Stat()
+		if err != nil {
+			return nil, fmt.Errorf("while getting information for file %s: %s", entry.name, err)
+		}
+		mode := entryMode(entry, fi.Mode(), ga.ModeFilter)
+
+		me := ManifestEntry{
+			Name: archiveEntryName(ga.prefix, entry.name),
+			Type: "file",
+			Mode: fmt.Sprintf("%04o", mode.Perm()),
+		}
+		switch {
+		case mode.IsDir():
+			me.Type = "dir"
+			me.Name += "/"
+		case mode&os.ModeSymlink != 0:
+			me.Type = "symlink"
+		default:
+			me.Size = fi.Size()
+		}
+		m.Entries = append(m.Entries, me)
+	}
+
+	return json.MarshalIndent(m, "", "  ")
+}
@@ -0,0 +1,256 @@
+// SPDX-License-Identifier: BSD-3-Clause
+// Copyright (c) 2020-2021, Ctrl IQ, Inc. All rights reserved
+
+package gobuild
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/blang/semver"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/object/commitgraph"
+	"github.com/magefile/mage/sh"
+	"golang.org/x/crypto/openpgp"
+)
+
+// NextVersion returns the version of the next release of the git repository containing the current
+// working directory. See NextVersionAt.
+func NextVersion() (semver.Version, error) {
+	return NextVersionAt(".", DescribeOptions{TagPrefix: DefaultTagPrefix})
+}
+
+// NextVersionAt returns the version of the next release of HEAD in the git repository containing
+// path, by analyzing the conventional commit messages since the nearest semver tag:
+//
+//   - If a commit is a breaking change (marked with ! or a BREAKING CHANGE footer), the major
+//     version is incremented, or the minor version while the major version is 0.
+//   - Otherwise, if a commit is a feature (feat), the minor version is incremented.
+//   - Otherwise, the patch version is incremented.
+//
+// If the tag is a pre-release, such as 1.2.0-rc.1, and the commits do not require a larger bump,
+// the next version is the release of the tag, such as 1.2.0. If there is no tag, the next version
+// is that of the commits relative to 0.0.0. If HEAD is tagged, an error wrapping ErrNoChanges is
+// returned.
+func NextVersionAt(path string, opts DescribeOptions) (semver.Version, error) {
+	repo, err := openRepo(path)
+	if err != nil {
+		return semver.Version{}, err
+	}
+	head, err := repo.Head()
+	if err != nil {
+		return semver.Version{}, err
+	}
+	tags, err := getVersionTags(repo, opts.TagPrefix)
+	if err != nil {
+		return semver.Version{}, fmt.Errorf("version tag: %s", err)
+	}
+
+	var commits []ChangelogCommit
+	tag, err := walkToTag(repo, head.Hash(), tags, false, func(n commitgraph.CommitNode) error {
+		if n.NumParents() > 1 {
+			return nil
+		}
+		c, err := n.Commit()
+		if err != nil {
+			return fmt.Errorf("while reading commit %s: %s", n.ID(), err)
+		}
+		commits = append(commits, newChangelogCommit(c.Hash.String(), c.Author.Name, c.Message))
+		return nil
+	})
+	if err != nil {
+		return semver.Version{}, err
+	}
+
+	var v semver.Version
+	if tag != nil {
+		if v, err = parseTagVersion(tag.name, opts.TagPrefix); err != nil {
+			return semver.Version{}, err
+		}
+		if tag.commit.Hash == head.Hash() {
+			return semver.Version{}, fmt.Errorf("while versioning after %s: %w", tag.name, ErrNoChanges)
+		}
+	}
+
+	return nextVersion(v, commits), nil
+}
+
+// nextVersion returns the version following v, with the changes of commits.
+func nextVersion(v semver.Version, commits []ChangelogCommit) semver.Version {
+	const (
+		patch = iota
+		minor
+		major
+	)
+
+	bump := patch
+	for _, c := range commits {
+		if c.Breaking {
+			bump = major
+			break
+		}
+		if c.Type == "feat" {
+			bump = minor
+		}
+	}
+	if bump == major && v.Major == 0 {
+		bump = minor
+	}
+
+	next := semver.Version{Major: v.Major, Minor: v.Minor, Patch: v.Patch}
+	if len(v.Pre) > 0 {
+		// The pre-release precedes the release it names, so the release may already include the
+		// bump. For example, 1.3.0 follows 1.3.0-rc.1 for a feature, but 2.0.0 for a breaking change.
+		switch {
+		case bump == major && (v.Minor != 0 || v.Patch != 0):
+		case bump == minor && v.Patch != 0:
+		default:
+			return next
+		}
+	}
+
+	switch bump {
+	case major:
+		next.Major++
+		next.Minor, next.Patch = 0, 0
+	case minor:
+		next.Minor++
+		next.Patch = 0
+	default:
+		next.Patch++
+	}
+	return next
+}
+
+// TagNextVersion tags HEAD with the version returned by NextVersion, in the same way as
+// TagRelease with opts, and returns the version. The tag message lists the commits since the
+// previous tag.
+func TagNextVersion(opts TagOptions) (semver.Version, error) {
+	v, err := NextVersion()
+	if err != nil {
+		return semver.Version{}, err
+	}
+
+	cl, err := GenerateChangelog()
+	if err != nil {
+		return semver.Version{}, err
+	}
+	msg := "Release " + v.String() + "\n\n"
+	for _, c := range cl.Changes() {
+		msg += "- " + c + "\n"
+	}
+
+	if err := TagRelease(v, msg, opts); err != nil {
+		return semver.Version{}, err
+	}
+	return v, nil
+}
+
+// createTag creates an annotated tag name of HEAD in the git repository containing path, with the
+// given message. If key is not nil, the tag is signed with it. The tagger is read from the git
+// configuration.
+func createTag(path, name, message string, key *openpgp.Entity) error {
+	repo, err := openRepo(path)
+	if err != nil {
+		return err
+	}
+	head, err := repo.Head()
+	if err != nil {
+		return err
+	}
+
+	if err := writeTag(repo, head.Hash(), name, message, key); err != nil {
+		return fmt.Errorf("while creating tag %s: %s", name, err)
+	}
+
+	Log.Infof("tagged %s as %s", head.Hash(), name)
+
+	// Descriptions of HEAD are now out of date.
+	ResetGitDescribeCache()
+	return nil
+}
+
+// deleteTag deletes the tag name of the git repository containing path.
+func deleteTag(path, name string) error {
+	repo, err := openRepo(path)
+	if err != nil {
+		return err
+	}
+	if err := repo.DeleteTag(name); err != nil {
+		return fmt.Errorf("while deleting tag %s: %s", name, err)
+	}
+
+	Log.Infof("deleted tag %s", name)
+
+	ResetGitDescribeCache()
+	return nil
+}
+
+// writeTag writes an annotated tag name of the commit h to repo. The tag is signed here, rather
+// than by go-git, as go-git uses a different OpenPGP implementation.
+func writeTag(repo *git.Repository, h plumbing.Hash, name, message string, key *openpgp.Entity) error {
+	ref := plumbing.NewTagReferenceName(name)
+	if _, err := repo.Reference(ref, false); err == nil {
+		return git.ErrTagExists
+	}
+
+	// Validation reads the tagger from the git configuration, and canonicalizes the message.
+	opts := &git.CreateTagOptions{Message: message}
+	if err := opts.Validate(repo, h); err != nil {
+		return err
+	}
+	tag := &object.Tag{
+		Name:       name,
+		Tagger:     *opts.Tagger,
+		Message:    opts.Message,
+		TargetType: plumbing.CommitObject,
+		Target:     h,
+	}
+
+	if key != nil {
+		unsigned := &plumbing.MemoryObject{}
+		if err := tag.Encode(unsigned); err != nil {
+			return err
+		}
+		r, err := unsigned.Reader()
+		if err != nil {
+			return err
+		}
+		var sig strings.Builder
+		if err := SignDetached(&sig, r, key); err != nil {
+			return err
+		}
+		tag.PGPSignature = sig.String()
+	}
+
+	obj := repo.Storer.NewEncodedObject()
+	if err := tag.Encode(obj); err != nil {
+		return err
+	}
+	th, err := repo.Storer.SetEncodedObject(obj)
+	if err != nil {
+		return err
+	}
+	return repo.Storer.SetReference(plumbing.NewHashReference(ref, th))
+}
+
+// pushTag pushes the tag name of the git repository containing path to remote. The git command is
+// used, so that its credential helpers and SSH configuration apply.
+func pushTag(path, remote, name string) error {
+	repo, err := openRepo(path)
+	if err != nil {
+		return err
+	}
+	root, err := worktreeRoot(repo)
+	if err != nil {
+		return err
+	}
+
+	ref := "refs/tags/" + strings.TrimPrefix(name, "refs/tags/")
+	if err := sh.RunV("git", "-C", root, "push", remote, ref); err != nil {
+		return fmt.Errorf("while pushing tag %s to %s: %s", name, remote, err)
+	}
+	return nil
+}
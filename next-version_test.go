@@ -0,0 +1,38 @@
+// SPDX-License-Identifier: BSD-3-Clause
+// Copyright (c) 2020-2021, Ctrl IQ, Inc. All rights reserved
+
+package gobuild
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestTagNextVersion(t *testing.T) {
+	dir := initTagRepo(t)
+	runGit(t, dir, "tag", "v1.0.0")
+	runGit(t, dir, "commit", "--quiet", "--allow-empty", "-m", "feat: add b")
+
+	if _, err := TagNextVersion(TagOptions{Branches: []string{"release/*"}}); err == nil {
+		t.Error("tagged on a branch that is not a release branch")
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "a"), []byte("2"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := TagNextVersion(TagOptions{}); err == nil {
+		t.Error("tagged a dirty working tree")
+	}
+	runGit(t, dir, "checkout", "--quiet", "a")
+
+	v, err := TagNextVersion(TagOptions{Branches: []string{"master"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.String() != "1.1.0" {
+		t.Errorf("got version %s, want 1.1.0", v)
+	}
+	if got := runGit(t, dir, "tag", "--points-at", "HEAD"); got != "v1.1.0" {
+		t.Errorf("got tags %q of HEAD, want v1.1.0", got)
+	}
+}
@@ -0,0 +1,213 @@
+// SPDX-License-Identifier: BSD-3-Clause
+// Copyright (c) 2020-2021, Ctrl IQ, Inc. All rights reserved
+
+package gobuild
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"text/template"
+
+	"github.com/goreleaser/nfpm/v2"
+	"gopkg.in/yaml.v2"
+)
+
+// PackageTemplateData is the data available to Go templates in package configurations. For
+// example, a configuration may contain "{{ .Version }}" or "{{ .Commit }}".
+type PackageTemplateData struct {
+	Version string // version of the package
+	Arch    string // architecture of the package, as passed to NewPackage (for example, arm7)
+}
+
+// Commit returns the commit hash of HEAD in the git repository containing the current working
+// directory. If the version is overridden, as described by NewVersionInfo, it is empty.
+func (d PackageTemplateData) Commit() (string, error) {
+	if _, ok, err := versionOverride(); ok {
+		return "", err
+	}
+
+	gd, err := GitDescribe()
+	if err != nil {
+		return "", err
+	}
+	return gd.CommitHash(), nil
+}
+
+// Date returns the committer date of HEAD in the git repository containing the current working
+// directory, in RFC 3339 format. If the version is overridden, as described by NewVersionInfo, it
+// is the date of SOURCE_DATE_EPOCH, if it is set.
+func (d PackageTemplateData) Date() (string, error) {
+	if v, ok, err := versionOverride(); ok {
+		if err != nil {
+			return "", err
+		}
+		vi, err := overrideVersionInfo(v)
+		if err != nil {
+			return "", err
+		}
+		return vi.Date, nil
+	}
+
+	gd, err := GitDescribe()
+	if err != nil {
+		return "", err
+	}
+	return commitDate(".", gd)
+}
+
+// expandConfigTemplate executes the configuration b as a Go template with data. The git repository
+// is only read if the template refers to fields that require it.
+func expandConfigTemplate(b []byte, data PackageTemplateData) ([]byte, error) {
+	if !bytes.Contains(b, []byte("{{")) {
+		return b, nil
+	}
+
+	t, err := template.New("config").Option("missingkey=error").Parse(string(b))
+	if err != nil {
+		return nil, fmt.Errorf("while parsing configuration template: %s", err)
+	}
+
+	var out bytes.Buffer
+	if err := t.Execute(&out, data); err != nil {
+		return nil, fmt.Errorf("while expanding configuration template: %s", err)
+	}
+	return out.Bytes(), nil
+}
+
+// parseConfig reads an nfpm configuration from r, expanding templates in it with data.
+// Configurations written for nfpm v1, which list package contents with files, config_files,
+// symlinks and empty_folders, are converted to the contents list used by nfpm v2, so that they
+// continue to work.
+func parseConfig(r io.Reader, data PackageTemplateData) (nfpm.Config, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nfpm.Config{}, err
+	}
+
+	if b, err = expandConfigTemplate(b, data); err != nil {
+		return nfpm.Config{}, err
+	}
+
+	if b, err = upgradeLegacyConfig(b); err != nil {
+		return nfpm.Config{}, err
+	}
+
+	return nfpm.Parse(bytes.NewReader(b))
+}
+
+// upgradeLegacyConfig returns the configuration b with nfpm v1 content keys replaced by entries in
+// contents, both at the top level and in overrides. If b has no such keys, it is returned as is.
+func upgradeLegacyConfig(b []byte) ([]byte, error) {
+	var doc map[interface{}]interface{}
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return nil, err
+	}
+
+	changed := upgradeLegacyContents(doc)
+	if overrides, ok := doc["overrides"].(map[interface{}]interface{}); ok {
+		for _, o := range overrides {
+			if o, ok := o.(map[interface{}]interface{}); ok && upgradeLegacyContents(o) {
+				changed = true
+			}
+		}
+	}
+	if !changed {
+		return b, nil
+	}
+
+	out, err := yaml.Marshal(doc)
+	if err != nil {
+		return nil, fmt.Errorf("while converting legacy configuration: %s", err)
+	}
+	return out, nil
+}
+
+// upgradeLegacyContents moves nfpm v1 content keys in m to contents, and returns true if any were
+// found.
+func upgradeLegacyContents(m map[interface{}]interface{}) bool {
+	found := false
+	var added []map[string]interface{}
+	add := func(src, dst interface{}, typ string) {
+		c := map[string]interface{}{"dst": dst}
+		if src != nil {
+			c["src"] = src
+		}
+		if typ != "" {
+			c["type"] = typ
+		}
+		added = append(added, c)
+	}
+
+	// Maps of sources to destinations.
+	for key, typ := range map[string]string{"files": "", "config_files": "config"} {
+		if v, ok := m[key]; ok {
+			found = true
+			delete(m, key)
+			files, _ := v.(map[interface{}]interface{})
+			for src, dst := range files {
+				add(src, dst, typ)
+			}
+		}
+	}
+
+	// In nfpm v1, symlinks map the path of each link to its target.
+	if v, ok := m["symlinks"]; ok {
+		found = true
+		delete(m, "symlinks")
+		links, _ := v.(map[interface{}]interface{})
+		for link, target := range links {
+			add(target, link, "symlink")
+		}
+	}
+
+	if v, ok := m["empty_folders"]; ok {
+		found = true
+		delete(m, "empty_folders")
+		dirs, _ := v.([]interface{})
+		for _, dir := range dirs {
+			add(nil, dir, "dir")
+		}
+	}
+
+	if rpm, ok := m["rpm"].(map[interface{}]interface{}); ok {
+		if v, ok := rpm["config_noreplace_files"]; ok {
+			found = true
+			delete(rpm, "config_noreplace_files")
+			files, _ := v.(map[interface{}]interface{})
+			for src, dst := range files {
+				add(src, dst, "config|noreplace")
+			}
+		}
+		if v, ok := rpm["ghost_files"]; ok {
+			found = true
+			delete(rpm, "ghost_files")
+			ghosts, _ := v.([]interface{})
+			for _, dst := range ghosts {
+				add(nil, dst, "ghost")
+			}
+		}
+	}
+
+	if !found {
+		return false
+	}
+
+	// Map iteration order is random, so sort the new entries to keep the result stable.
+	sort.Slice(added, func(i, j int) bool {
+		a, b := fmt.Sprint(added[i]["dst"]), fmt.Sprint(added[j]["dst"])
+		if a != b {
+			return a < b
+		}
+		return fmt.Sprint(added[i]["type"]) < fmt.Sprint(added[j]["type"])
+	})
+
+	contents, _ := m["contents"].([]interface{})
+	for _, c := range added {
+		contents = append(contents, c)
+	}
+	m["contents"] = contents
+	return true
+}
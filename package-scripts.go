@@ -0,0 +1,172 @@
+// SPDX-License-Identifier: BSD-3-Clause
+// Copyright (c) 2020-2021, Ctrl IQ, Inc. All rights reserved
+
+package gobuild
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/goreleaser/nfpm/v2/files"
+)
+
+// scriptlets are shell snippets generated for the maintainer scripts of a package, in the order
+// they run.
+type scriptlets struct {
+	preInstall  []string
+	postInstall []string
+	preRemove   []string
+	postRemove  []string
+}
+
+// add appends the snippets of o to s, omitting any that s already contains, such as a reload of
+// systemd needed by more than one service.
+func (s *scriptlets) add(o scriptlets) {
+	s.preInstall = appendSnippets(s.preInstall, o.preInstall)
+	s.postInstall = appendSnippets(s.postInstall, o.postInstall)
+	s.preRemove = appendSnippets(s.preRemove, o.preRemove)
+	s.postRemove = appendSnippets(s.postRemove, o.postRemove)
+}
+
+// appendSnippets appends the snippets of add that are not in s to s.
+func appendSnippets(s, add []string) []string {
+	for _, a := range add {
+		found := false
+		for _, x := range s {
+			if x == a {
+				found = true
+				break
+			}
+		}
+		if !found {
+			s = append(s, a)
+		}
+	}
+	return s
+}
+
+// hasGenerated returns true if files or scripts are generated for the package when it is created.
+func (p *Package) hasGenerated() bool {
+	return len(p.opts.Services) > 0 || len(p.opts.Users) > 0 || len(p.opts.Licenses) > 0
+}
+
+// addGenerated writes the files and scripts generated for the package to dir, and adds them to
+// p.Info. Generated snippets run before the corresponding script of the configuration, if any,
+// which is run with its own interpreter. The caller is responsible for restoring p.Info.
+func (p *Package) addGenerated(dir string) error {
+	var s scriptlets
+	for _, u := range p.opts.Users {
+		s.add(u.scriptlets(p.format))
+	}
+
+	contents := cloneContents(p.Info.Contents)
+	for _, svc := range p.opts.Services {
+		c, err := svc.content(dir, p.format)
+		if err != nil {
+			return err
+		}
+		contents = append(contents, c)
+		s.add(svc.scriptlets(p.format))
+	}
+	for _, l := range p.opts.Licenses {
+		contents = append(contents, l.content(p.Info.Name, p.format))
+	}
+	p.Info.Contents = contents
+
+	scripts := &p.Info.Scripts
+	for _, script := range []struct {
+		name     string
+		path     *string
+		snippets []string
+	}{
+		{"preinstall", &scripts.PreInstall, s.preInstall},
+		{"postinstall", &scripts.PostInstall, s.postInstall},
+		{"preremove", &scripts.PreRemove, s.preRemove},
+		{"postremove", &scripts.PostRemove, s.postRemove},
+	} {
+		if len(script.snippets) == 0 {
+			continue
+		}
+		path, err := writeScript(filepath.Join(dir, script.name), *script.path, script.snippets)
+		if err != nil {
+			return err
+		}
+		*script.path = path
+	}
+	return nil
+}
+
+// writeScript writes a shell script of snippets, followed by the script at orig, if it is set, to
+// path, and returns path.
+func writeScript(path, orig string, snippets []string) (string, error) {
+	var b strings.Builder
+	b.WriteString("#!/bin/sh\n")
+	for _, s := range snippets {
+		b.WriteString(s)
+		if !strings.HasSuffix(s, "\n") {
+			b.WriteString("\n")
+		}
+	}
+	if orig != "" {
+		body, err := ioutil.ReadFile(orig)
+		if err != nil {
+			return "", err
+		}
+		text, err := scriptInvocation(string(body))
+		if err != nil {
+			return "", fmt.Errorf("while combining %s with generated scriptlets: %s", orig, err)
+		}
+		b.WriteString(text)
+	}
+	return path, ioutil.WriteFile(path, []byte(b.String()), 0755)
+}
+
+// execShells are the names of shells that scripts may be written for. They accept
+// a script with -c, followed by $0 and the arguments of the script.
+var execShells = map[string]bool{"sh": true, "bash": true, "dash": true, "ksh": true, "mksh": true, "zsh": true}
+
+// scriptInvocation returns the text of a shell script that runs the script text with its own
+// interpreter, with the arguments of the shell script. Scripts for sh without options, or without
+// an interpreter, are included as they are, and other shell scripts are run with exec. Scripts
+// for other interpreters are not supported, as package managers run scriptlets with /bin/sh.
+func scriptInvocation(text string) (string, error) {
+	if !strings.HasPrefix(text, "#!") {
+		return text, nil
+	}
+	line, body := text, ""
+	if i := strings.IndexByte(text, '\n'); i >= 0 {
+		line, body = text[:i], text[i+1:]
+	}
+
+	interp := strings.Fields(line[2:])
+	if len(interp) == 0 {
+		return body, nil
+	}
+	name, args := filepath.Base(interp[0]), interp[1:]
+	if name == "env" && len(args) > 0 {
+		name, args = filepath.Base(args[0]), args[1:]
+	}
+	if name == "sh" && len(args) == 0 {
+		return body, nil
+	}
+	if !execShells[name] {
+		return "", fmt.Errorf("unsupported interpreter %s", strings.Join(interp, " "))
+	}
+
+	for i, arg := range interp {
+		interp[i] = shellQuote(arg)
+	}
+	return fmt.Sprintf("exec %s -c %s \"$0\" \"$@\"\n", strings.Join(interp, " "), shellQuote(body)), nil
+}
+
+// generatedContent returns the content of a package installing the file at src as dst.
+func generatedContent(src, dst string, mode os.FileMode) *files.Content {
+	return &files.Content{
+		Source:      src,
+		Destination: dst,
+		FileInfo:    &files.ContentFileInfo{Mode: mode},
+	}
+}
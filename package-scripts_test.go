@@ -0,0 +1,79 @@
+// SPDX-License-Identifier: BSD-3-Clause
+// Copyright (c) 2020-2021, Ctrl IQ, Inc. All rights reserved
+
+package gobuild
+
+import (
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWriteScript(t *testing.T) {
+	tests := []struct {
+		name       string
+		orig       string
+		want       string
+		wantErr    bool
+		wantRunErr bool // the script fails
+	}{
+		{name: "none", want: "generated\n"},
+		{name: "no interpreter", orig: "echo \"orig $1 $2\"\n", want: "generated\norig configure 1.0\n"},
+		{name: "sh", orig: "#!/bin/sh\necho \"orig $1 $2\"\n", want: "generated\norig configure 1.0\n"},
+		{name: "sh -e", orig: "#!/bin/sh -e\nfalse\necho orig\n", want: "generated\n", wantRunErr: true},
+		{
+			name: "bash",
+			orig: "#!/bin/bash\nif [[ $1 == configure ]]; then echo \"bash '$1' $2\"; fi\n",
+			want: "generated\nbash 'configure' 1.0\n",
+		},
+		{
+			name: "env bash",
+			orig: "#!/usr/bin/env bash\nset -o pipefail\necho \"${BASH_VERSION:+bash} $#\"\n",
+			want: "generated\nbash 2\n",
+		},
+		{name: "python", orig: "#!/usr/bin/python3\nprint('orig')\n", wantErr: true},
+	}
+
+	dir := tempDir(t)
+	for _, tt := range tests {
+		if strings.Contains(tt.orig, "bash") {
+			if _, err := exec.LookPath("bash"); err != nil {
+				continue
+			}
+		}
+
+		orig := ""
+		if tt.orig != "" {
+			orig = filepath.Join(dir, "orig")
+			if err := ioutil.WriteFile(orig, []byte(tt.orig), 0755); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		path, err := writeScript(filepath.Join(dir, "script"), orig, []string{"echo generated"})
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: no error", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+
+		// Package managers run scriptlets with /bin/sh.
+		out, err := exec.Command("/bin/sh", path, "configure", "1.0").CombinedOutput()
+		if tt.wantRunErr {
+			if err == nil {
+				t.Errorf("%s: script succeeded", tt.name)
+			}
+		} else if err != nil {
+			t.Fatalf("%s: %s: %s", tt.name, err, out)
+		}
+		if string(out) != tt.want {
+			t.Errorf("%s: got output %q, want %q", tt.name, out, tt.want)
+		}
+	}
+}
@@ -4,12 +4,24 @@
 package gobuild
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/template"
 
-	"github.com/goreleaser/nfpm"
-	_ "github.com/goreleaser/nfpm/deb"
-	_ "github.com/goreleaser/nfpm/rpm"
+	"github.com/goreleaser/nfpm/v2"
+	_ "github.com/goreleaser/nfpm/v2/apk"
+	archlinux "github.com/goreleaser/nfpm/v2/arch"
+	_ "github.com/goreleaser/nfpm/v2/deb"
+	"github.com/goreleaser/nfpm/v2/files"
+	_ "github.com/goreleaser/nfpm/v2/rpm"
+	"golang.org/x/crypto/openpgp"
 )
 
 type Format uint8
@@ -17,56 +29,216 @@ type Format uint8
 const (
 	DEB Format = iota
 	RPM
+	APK
+	ARCHLINUX
 )
 
+// formatString maps each format to its nfpm packager name. Like formatArch, it is never modified
+// after initialization, so it is safe for concurrent use.
 var formatString = map[Format]string{
-	DEB: "deb",
-	RPM: "rpm",
+	DEB:       "deb",
+	RPM:       "rpm",
+	APK:       "apk",
+	ARCHLINUX: "archlinux",
 }
 
+// formatArch maps architecture names to the name of the architecture for each format. An empty
+// name means the architecture is not supported for that format.
 var formatArch = map[string]map[Format]string{
-	"all":     {RPM: "noarch", DEB: "noarch"},
-	"amd64":   {RPM: "x86_64", DEB: "amd64"},
-	"386":     {RPM: "i386", DEB: "i386"},
-	"arm64":   {RPM: "aarch64", DEB: "arm64"},
-	"ppc64le": {RPM: "ppc64le", DEB: "ppc64el"},
-	"s390x":   {RPM: "s390x", DEB: "s390x"},
-	"arm":     {RPM: "armhfp", DEB: "armhf"},
-	"arm5":    {RPM: "", DEB: "armel"},
-	"arm6":    {RPM: "armhfp", DEB: "armhf"},
-	"arm7":    {RPM: "armhfp", DEB: "armhf"},
-	"mipsle":  {RPM: "", DEB: "mipsel"},
+	"all":      {RPM: "noarch", DEB: "noarch", APK: "noarch", ARCHLINUX: "any"},
+	"amd64":    {RPM: "x86_64", DEB: "amd64", APK: "x86_64", ARCHLINUX: "x86_64"},
+	"386":      {RPM: "i386", DEB: "i386", APK: "x86", ARCHLINUX: "i686"},
+	"arm64":    {RPM: "aarch64", DEB: "arm64", APK: "aarch64", ARCHLINUX: "aarch64"},
+	"ppc64le":  {RPM: "ppc64le", DEB: "ppc64el", APK: "ppc64le", ARCHLINUX: "powerpc64le"},
+	"s390x":    {RPM: "s390x", DEB: "s390x", APK: "s390x", ARCHLINUX: ""},
+	"arm":      {RPM: "armhfp", DEB: "armhf", APK: "armhf", ARCHLINUX: "armv7h"},
+	"arm5":     {RPM: "", DEB: "armel", APK: "", ARCHLINUX: "arm"},
+	"arm6":     {RPM: "armhfp", DEB: "armhf", APK: "armhf", ARCHLINUX: "armv6h"},
+	"arm7":     {RPM: "armhfp", DEB: "armhf", APK: "armv7", ARCHLINUX: "armv7h"},
+	"mips":     {RPM: "", DEB: "mips", APK: "", ARCHLINUX: ""},
+	"mipsle":   {RPM: "", DEB: "mipsel", APK: "", ARCHLINUX: ""},
+	"mips64":   {RPM: "", DEB: "mips64", APK: "mips64", ARCHLINUX: ""},
+	"mips64le": {RPM: "", DEB: "mips64el", APK: "", ARCHLINUX: ""},
+	"riscv64":  {RPM: "riscv64", DEB: "riscv64", APK: "riscv64", ARCHLINUX: "riscv64"},
+	"loong64":  {RPM: "loongarch64", DEB: "loong64", APK: "loongarch64", ARCHLINUX: "loong64"},
+}
+
+// PackageOptions overrides values from the package configuration.
+type PackageOptions struct {
+	Release string // if set, overrides the release number in the configuration
+	Epoch   string // if set, overrides the epoch in the configuration
+
+	// Dist, if set, is a distribution tag (for example, el9) appended to the release of RPM
+	// packages, in the same way as %{?dist} in a spec file. It is ignored for other formats.
+	Dist string
+
+	// Changelog, if set, is the path of a changelog in the YAML format read by nfpm, which
+	// overrides the changelog in the configuration.
+	Changelog string
+
+	// ChangelogEntries, if set, are written to the changelog of RPM and DEB packages, overriding
+	// Changelog and the changelog in the configuration.
+	ChangelogEntries []ChangelogEntry
+
+	// TargetTemplate, if set, is a Go template for the file name of the package, replacing the
+	// naming convention of its format. It is executed with a PackageTargetData, for example
+	// "{{ .Name }}-{{ .Version }}-{{ .Release }}.el9.{{ .Arch }}.rpm".
+	TargetTemplate string
+
+	// Services are systemd units installed by the package, with scriptlets that manage them for
+	// RPM and DEB packages. The scriptlets run before any scripts in the configuration.
+	Services []SystemdService
+
+	// Users are system users created by the preinstall scriptlets of RPM and DEB packages, before
+	// any services are installed.
+	Users []SystemUser
+
+	// Licenses are license and notice files, such as those returned by CollectLicenses, installed
+	// in /usr/share/doc/<name> by DEB packages, and in /usr/share/licenses/<name> by other
+	// packages, where they are marked as %license by RPM packages.
+	Licenses []ModuleLicense
+}
+
+// PackageTargetData is the data available to PackageOptions.TargetTemplate.
+type PackageTargetData struct {
+	Name       string // name of the package
+	Version    string // version, without the pre-release or metadata
+	Prerelease string // pre-release of the version, if any
+	Release    string // release number
+	Epoch      string // epoch, if any
+	Arch       string // architecture, as named by the format (for example, x86_64 for RPM)
+	Format     string // name of the format (for example, rpm)
+	Default    string // file name following the naming convention of the format
+}
+
+// expandTargetTemplate returns the file name of the package described by info, from the template
+// text.
+func expandTargetTemplate(text string, info *nfpm.Info, format Format) (string, error) {
+	t, err := template.New("target").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("while parsing target template: %s", err)
+	}
+
+	var sb strings.Builder
+	err = t.Execute(&sb, PackageTargetData{
+		Name:       info.Name,
+		Version:    info.Version,
+		Prerelease: info.Prerelease,
+		Release:    info.Release,
+		Epoch:      info.Epoch,
+		Arch:       info.Arch,
+		Format:     formatString[format],
+		Default:    info.Target,
+	})
+	if err != nil {
+		return "", fmt.Errorf("while expanding target template: %s", err)
+	}
+
+	name := sb.String()
+	if name == "" || name != filepath.Base(name) {
+		return "", fmt.Errorf("invalid target file name %q", name)
+	}
+	return name, nil
+}
+
+// versionRelease returns the version of info as it appears in package file names, built in the
+// same way as the package version: the version, followed by the pre-release after preSep, the
+// metadata after a +, and the release after a -, if they are set. Without the pre-release and
+// metadata, development builds would have the same file names as the release.
+func versionRelease(info *nfpm.Info, preSep string) string {
+	v := info.Version
+	if info.Prerelease != "" {
+		v += preSep + info.Prerelease
+	}
+	if info.VersionMetadata != "" {
+		v += "+" + info.VersionMetadata
+	}
+	if info.Release != "" {
+		v += "-" + info.Release
+	}
+	return v
+}
+
+// RPMRelease returns a release number for an RPM package of the commit described by gd, for use as
+// PackageOptions.Release: 1 for a tagged commit with a clean working tree, and otherwise 0.N.devel,
+// where N is the number of commits since the tag, following the Fedora convention for snapshots.
+func RPMRelease(gd *GitDescription) string {
+	if _, ok := gd.TagName(); ok && gd.CommitsSinceTag() == 0 && gd.IsClean() {
+		return "1"
+	}
+	return fmt.Sprintf("0.%d.devel", gd.CommitsSinceTag())
 }
 
 // getPackageInfo returns the target based on suffix and c.
-func getPackageInfo(c nfpm.Config, format Format, version string) (*nfpm.Info, error) {
+func getPackageInfo(c nfpm.Config, format Format, version string, opts PackageOptions) (*nfpm.Info, error) {
+	// nfpm.Parse splits the configured version into its pre-release and metadata, which must not
+	// be carried over to version.
 	c.Version = version
+	c.Prerelease = ""
+	c.VersionMetadata = ""
 
 	info, err := c.Get(formatString[format])
 	if err != nil {
 		return nil, fmt.Errorf("package format: %s", err)
 	}
+	cloneOverridables(&info.Overridables)
 	info = nfpm.WithDefaults(info)
 
+	if opts.Release != "" {
+		info.Release = opts.Release
+	}
+	if opts.Epoch != "" {
+		info.Epoch = opts.Epoch
+	}
+	if opts.Changelog != "" {
+		info.Changelog = opts.Changelog
+	}
+	if opts.Dist != "" && format == RPM {
+		if info.Release == "" {
+			info.Release = "1"
+		}
+		info.Release += "." + strings.TrimPrefix(opts.Dist, ".")
+	}
+
 	switch format {
 	case DEB:
 		// Ref: https://www.debian.org/doc/manuals/debian-faq/ch-pkg_basics.en.html#s-pkgname
-		info.Target = fmt.Sprintf("%s_%s-%s_%s.%s",
+		info.Target = fmt.Sprintf("%s_%s_%s.%s",
 			info.Name,
-			info.Version,
-			info.Release,
+			versionRelease(info, "~"),
 			info.Arch,
 			formatString[format])
 	case RPM:
 		// Ref: http://ftp.rpm.org/max-rpm/ch-rpm-file-format.html
-		info.Target = fmt.Sprintf("%s-%s-%s.%s.%s",
+		// The epoch is not part of the file name.
+		info.Target = fmt.Sprintf("%s-%s.%s.%s",
 			info.Name,
-			info.Version,
-			info.Release,
+			versionRelease(info, "~"),
 			info.Arch,
 			formatString[format])
+	case APK:
+		// Ref: https://wiki.alpinelinux.org/wiki/Apk_spec
+		info.Target = fmt.Sprintf("%s_%s_%s.%s",
+			info.Name,
+			versionRelease(info, "_"),
+			info.Arch,
+			formatString[format])
+	case ARCHLINUX:
+		// The archlinux packager ignores the pre-release and metadata, so include them in the
+		// version, where pacman sorts them correctly.
+		info.Version = archLinuxVersion(info)
+		info.Prerelease = ""
+		info.VersionMetadata = ""
+		// Ref: https://wiki.archlinux.org/title/Arch_package_guidelines#Package_naming
+		info.Target = archlinux.Default.ConventionalFileName(info)
 	default:
-		return nil, fmt.Errorf("unknown package format: %v", format)
+		return nil, fmt.Errorf("%w: package format %v", ErrUnsupportedFormat, format)
+	}
+
+	if opts.TargetTemplate != "" {
+		if info.Target, err = expandTargetTemplate(opts.TargetTemplate, info, format); err != nil {
+			return nil, err
+		}
 	}
 
 	if err = nfpm.Validate(info); err != nil {
@@ -76,47 +248,601 @@ func getPackageInfo(c nfpm.Config, format Format, version string) (*nfpm.Info, e
 	return info, nil
 }
 
+// archLinuxVersion returns the version of info in the form used for pkgver in Arch Linux packages.
+// Hyphens are not allowed in pkgver, so they are replaced with underscores.
+func archLinuxVersion(info *nfpm.Info) string {
+	v := info.Version
+	if info.Prerelease != "" {
+		v += "_" + info.Prerelease
+	}
+	if info.VersionMetadata != "" {
+		v += "+" + info.VersionMetadata
+	}
+	return strings.ReplaceAll(v, "-", "_")
+}
+
+// cloneOverridables replaces the slices and maps in o with copies. nfpm.Config.Get copies them
+// by reference, so without this, packages created from the same configuration would share them.
+func cloneOverridables(o *nfpm.Overridables) {
+	o.Replaces = cloneStrings(o.Replaces)
+	o.Provides = cloneStrings(o.Provides)
+	o.Depends = cloneStrings(o.Depends)
+	o.Recommends = cloneStrings(o.Recommends)
+	o.Suggests = cloneStrings(o.Suggests)
+	o.Conflicts = cloneStrings(o.Conflicts)
+	o.Contents = cloneContents(o.Contents)
+	o.Deb.Breaks = cloneStrings(o.Deb.Breaks)
+	o.Deb.Fields = cloneStringMap(o.Deb.Fields)
+	o.Deb.Triggers.Interest = cloneStrings(o.Deb.Triggers.Interest)
+	o.Deb.Triggers.InterestAwait = cloneStrings(o.Deb.Triggers.InterestAwait)
+	o.Deb.Triggers.InterestNoAwait = cloneStrings(o.Deb.Triggers.InterestNoAwait)
+	o.Deb.Triggers.Activate = cloneStrings(o.Deb.Triggers.Activate)
+	o.Deb.Triggers.ActivateAwait = cloneStrings(o.Deb.Triggers.ActivateAwait)
+	o.Deb.Triggers.ActivateNoAwait = cloneStrings(o.Deb.Triggers.ActivateNoAwait)
+}
+
+func cloneStrings(s []string) []string {
+	if s == nil {
+		return nil
+	}
+	return append([]string(nil), s...)
+}
+
+// cloneContents returns a copy of c, including the contents it points to, which nfpm modifies when
+// the package is validated.
+func cloneContents(c files.Contents) files.Contents {
+	if c == nil {
+		return nil
+	}
+	cc := make(files.Contents, 0, len(c))
+	for _, content := range c {
+		content := *content
+		if content.FileInfo != nil {
+			fi := *content.FileInfo
+			content.FileInfo = &fi
+		}
+		cc = append(cc, &content)
+	}
+	return cc
+}
+
+func cloneStringMap(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	c := make(map[string]string, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
 type Package struct {
 	Packager nfpm.Packager
 	Info     *nfpm.Info
+
+	// OnProgress, if non-nil, is called as the package is written by Create, with the number of
+	// bytes written so far.
+	OnProgress func(written int64)
+
+	format    Format
+	changelog []ChangelogEntry // changelog entries to write when the package is created
+
+	// The arguments the package was created from, used by CreateAll to create other formats.
+	config  nfpm.Config
+	version string
+	arch    string
+	opts    PackageOptions
 }
 
+// NewPackage returns a Package of the given format, version and architecture from the nfpm
+// configuration read from configReader. The configuration may contain Go templates with the fields
+// of PackageTemplateData, such as {{ .Version }}, which are expanded before it is parsed.
 func NewPackage(configReader io.Reader, format Format, version string, arch string) (*Package, error) {
-	fmtStr, ok := formatString[format]
-	if !ok {
-		return nil, fmt.Errorf("unsupported format")
+	return NewPackageWithOptions(configReader, format, version, arch, PackageOptions{})
+}
+
+// NewPackageWithOptions returns a Package in the same way as NewPackage, with values from the
+// configuration overridden by opts.
+func NewPackageWithOptions(configReader io.Reader, format Format, version, arch string, opts PackageOptions) (*Package, error) {
+	if _, ok := formatString[format]; !ok {
+		return nil, fmt.Errorf("%w: package format %v", ErrUnsupportedFormat, format)
 	}
 
-	config, err := nfpm.Parse(configReader)
+	config, err := parseConfig(configReader, PackageTemplateData{Version: version, Arch: arch})
 	if err != nil {
 		return nil, fmt.Errorf("while reading configuration: %s", err)
 	}
 
-	config.Arch = ""
-	if a, ok := formatArch[arch]; ok {
-		config.Arch = a[format]
+	return newConfigPackage(config, format, version, arch, opts)
+}
+
+// NewPackageFromFile returns a Package in the same way as NewPackage, reading the configuration
+// from the file at path. As with the nfpm command, environment variables in the file, such as
+// ${MAINTAINER}, are expanded before it is parsed.
+func NewPackageFromFile(path string, format Format, version, arch string) (*Package, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("while reading configuration %s: %w", path, err)
 	}
-	if config.Arch == "" {
-		return nil, fmt.Errorf("unsupported architecture")
+
+	data := PackageTemplateData{Version: version, Arch: arch}
+	config, err := parseConfig(strings.NewReader(os.ExpandEnv(string(b))), data)
+	if err != nil {
+		return nil, fmt.Errorf("while reading configuration %s: %w", path, err)
 	}
 
-	pkg := new(Package)
+	return newConfigPackage(config, format, version, arch, PackageOptions{})
+}
+
+// NewPackageWithConfig returns a Package in the same way as NewPackage, from a configuration that
+// has already been parsed or built in code. The architecture of config is replaced by the name of
+// arch for the given format.
+func NewPackageWithConfig(config nfpm.Config, format Format, version, arch string) (*Package, error) {
+	return newConfigPackage(config, format, version, arch, PackageOptions{})
+}
 
-	pkg.Info, err = getPackageInfo(config, format, version)
+// newConfigPackage returns a Package for the given format, version and architecture from config.
+func newConfigPackage(config nfpm.Config, format Format, version string, arch string, opts PackageOptions) (*Package, error) {
+	info, err := configPackageInfo(config, format, version, arch, opts)
 	if err != nil {
-		return nil, fmt.Errorf("while getting package information: %s", err)
+		return nil, err
+	}
+	for _, svc := range opts.Services {
+		if err := svc.validate(); err != nil {
+			return nil, err
+		}
+	}
+	for _, u := range opts.Users {
+		if err := u.validate(); err != nil {
+			return nil, err
+		}
 	}
-	pkg.Packager, err = nfpm.Get(fmtStr)
+
+	pkg := &Package{
+		Info:    info,
+		format:  format,
+		config:  config,
+		version: version,
+		arch:    arch,
+		opts:    opts,
+	}
+	if len(opts.ChangelogEntries) > 0 {
+		pkg.changelog = append([]ChangelogEntry(nil), opts.ChangelogEntries...)
+	}
+
+	pkg.Packager, err = nfpm.Get(formatString[format])
 	if err != nil {
 		return nil, fmt.Errorf("while getting packager: %s", err)
 	}
 
+	Log.Debugf("%s package %s %s for %s: %s", formatString[format], info.Name, versionRelease(info, "~"), info.Arch, info.Target)
 	return pkg, nil
 }
 
+// PackageTargetName returns the file name of the package that NewPackage would create from the
+// same arguments, without creating a packager.
+func PackageTargetName(configReader io.Reader, format Format, version, arch string) (string, error) {
+	info, err := newPackageInfo(configReader, format, version, arch)
+	if err != nil {
+		return "", err
+	}
+	return info.Target, nil
+}
+
+// newPackageInfo reads the configuration from configReader and returns the package information for
+// the given format, version and architecture.
+func newPackageInfo(configReader io.Reader, format Format, version string, arch string) (*nfpm.Info, error) {
+	if _, ok := formatString[format]; !ok {
+		return nil, fmt.Errorf("%w: package format %v", ErrUnsupportedFormat, format)
+	}
+
+	config, err := parseConfig(configReader, PackageTemplateData{Version: version, Arch: arch})
+	if err != nil {
+		return nil, fmt.Errorf("while reading configuration: %s", err)
+	}
+
+	return configPackageInfo(config, format, version, arch, PackageOptions{})
+}
+
+// validationVersion is the version used to validate configurations with ValidatePackageConfig.
+const validationVersion = "0.0.0"
+
+// ValidatePackageConfig reads the configuration from configReader and checks that a package of
+// the given format and architecture could be created from it, without creating a packager.
+func ValidatePackageConfig(configReader io.Reader, format Format, arch string) error {
+	if _, ok := formatString[format]; !ok {
+		return fmt.Errorf("%w: package format %v", ErrUnsupportedFormat, format)
+	}
+
+	config, err := parseConfig(configReader, PackageTemplateData{Version: validationVersion, Arch: arch})
+	if err != nil {
+		return fmt.Errorf("while reading configuration: %s", err)
+	}
+
+	_, err = configPackageInfo(config, format, validationVersion, arch, PackageOptions{})
+	return err
+}
+
+// configPackageInfo returns the package information for the given format, version and architecture
+// from config.
+func configPackageInfo(config nfpm.Config, format Format, version string, arch string, opts PackageOptions) (*nfpm.Info, error) {
+	fmtStr, ok := formatString[format]
+	if !ok {
+		return nil, fmt.Errorf("%w: package format %v", ErrUnsupportedFormat, format)
+	}
+
+	a, ok := formatArch[arch]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedArch, arch)
+	}
+	config.Arch = a[format]
+	if config.Arch == "" {
+		return nil, fmt.Errorf("%w: %s is not supported for %s packages", ErrUnsupportedArch, arch, fmtStr)
+	}
+
+	info, err := getPackageInfo(config, format, version, opts)
+	if err != nil {
+		return nil, fmt.Errorf("while getting package information: %w", err)
+	}
+
+	return info, nil
+}
+
+// NewPackages returns a Package for each of formats, parsing config only once. If any of the
+// packages cannot be created, the returned error identifies each format that failed. The packages
+// share no mutable state, so they may be created concurrently.
+func NewPackages(config []byte, formats []Format, version, arch string) ([]*Package, error) {
+	c, err := parseConfig(bytes.NewReader(config), PackageTemplateData{Version: version, Arch: arch})
+	if err != nil {
+		return nil, fmt.Errorf("while reading configuration: %s", err)
+	}
+
+	pkgs := make([]*Package, 0, len(formats))
+	var errs []string
+
+	for _, format := range formats {
+		pkg, err := newConfigPackage(c, format, version, arch, PackageOptions{})
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", formatName(format), err))
+			continue
+		}
+		pkgs = append(pkgs, pkg)
+	}
+
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("while creating packages: %s", strings.Join(errs, "; "))
+	}
+
+	return pkgs, nil
+}
+
+// PackageSet is a set of packages created from one configuration for several formats and
+// architectures.
+type PackageSet struct {
+	Packages []*Package // packages, grouped by architecture in the order given to NewPackageSet
+}
+
+// NewPackageSet returns a PackageSet with a package for every combination of formats and arches
+// that formatArch supports; combinations that are not supported, such as s390x Arch Linux
+// packages, are skipped, but combinations with the same file name are an error. The configuration
+// is expanded for each architecture, so the sources of binaries built for each target may be given
+// with a template. For example, RunBuildMatrix writes the binaries of foo to its output directory
+// as foo_<goos>_<goarch>[<goarm>], which for an output directory of dist are matched by
+// dist/foo_linux_{{ .Arch }}.
+func NewPackageSet(config []byte, formats []Format, version string, arches []string) (*PackageSet, error) {
+	set := &PackageSet{}
+	targets := make(map[string]*Package)
+	var errs []string
+
+	for _, arch := range arches {
+		a, ok := formatArch[arch]
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", ErrUnsupportedArch, arch)
+		}
+
+		c, err := parseConfig(bytes.NewReader(config), PackageTemplateData{Version: version, Arch: arch})
+		if err != nil {
+			return nil, fmt.Errorf("while reading configuration for %s: %s", arch, err)
+		}
+
+		for _, format := range formats {
+			if _, ok := formatString[format]; ok && a[format] == "" {
+				continue
+			}
+			pkg, err := newConfigPackage(c, format, version, arch, PackageOptions{})
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%s/%s: %s", formatName(format), arch, err))
+				continue
+			}
+
+			// Some formats share a name between architectures, such as armhfp for arm6 and arm7
+			// RPMs, whose packages could not be written to the same directory.
+			if other, ok := targets[pkg.TargetName()]; ok {
+				errs = append(errs, fmt.Sprintf("%s/%s: same file name as %s", formatName(format), arch, other.arch))
+				continue
+			}
+			targets[pkg.TargetName()] = pkg
+			set.Packages = append(set.Packages, pkg)
+		}
+	}
+
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("while creating packages: %s", strings.Join(errs, "; "))
+	}
+	return set, nil
+}
+
+// Create creates every package in the set concurrently, writing each to a file named by its
+// TargetName in dir. It returns the paths of the files, in the order of Packages. If any package
+// cannot be created, the returned error identifies each one that failed.
+func (s *PackageSet) Create(dir string) ([]string, error) {
+	paths := make([]string, len(s.Packages))
+	errs := make([]error, len(s.Packages))
+
+	var wg sync.WaitGroup
+	for i, pkg := range s.Packages {
+		paths[i] = filepath.Join(dir, pkg.TargetName())
+		wg.Add(1)
+		go func(i int, pkg *Package) {
+			defer wg.Done()
+			errs[i] = pkg.createFile(paths[i])
+		}(i, pkg)
+	}
+	wg.Wait()
+
+	var failed []string
+	for i, err := range errs {
+		if err != nil {
+			pkg := s.Packages[i]
+			failed = append(failed, fmt.Sprintf("%s/%s: %s", formatName(pkg.format), pkg.arch, err))
+		}
+	}
+	if len(failed) > 0 {
+		return nil, fmt.Errorf("while creating packages: %s", strings.Join(failed, "; "))
+	}
+	return paths, nil
+}
+
+// formatName returns the name of format, for use in messages.
+func formatName(format Format) string {
+	if s, ok := formatString[format]; ok {
+		return s
+	}
+	return fmt.Sprintf("format %d", format)
+}
+
+// TargetName returns the file name of the package, following the naming convention of its format,
+// or PackageOptions.TargetTemplate if it was set.
+func (p *Package) TargetName() string {
+	return p.Info.Target
+}
+
+// SetSigningOptions configures p to be signed with the key described by opts when it is created.
+// The key is loaded immediately, so that a missing key or wrong passphrase is reported here rather
+// than during Create. Signing is supported for DEB and RPM packages, with a PGP key, and APK
+// packages, with an RSA key.
+func (p *Package) SetSigningOptions(opts SigningOptions) error {
+	var err error
+	if p.format == APK {
+		_, err = loadRSASigningKey(opts)
+	} else {
+		_, err = loadSigningKey(opts)
+	}
+	if err != nil {
+		return fmt.Errorf("while loading signing key: %s", err)
+	}
+
+	var keyID *string
+	if opts.KeyID != "" {
+		keyID = &opts.KeyID
+	}
+
+	switch p.format {
+	case DEB:
+		p.Info.Deb.Signature.KeyFile = opts.KeyFile
+		p.Info.Deb.Signature.KeyPassphrase = opts.KeyPassphrase
+		p.Info.Deb.Signature.KeyID = keyID
+	case RPM:
+		p.Info.RPM.Signature.KeyFile = opts.KeyFile
+		p.Info.RPM.Signature.KeyPassphrase = opts.KeyPassphrase
+		p.Info.RPM.Signature.KeyID = keyID
+	case APK:
+		p.Info.APK.Signature.KeyFile = opts.KeyFile
+		p.Info.APK.Signature.KeyPassphrase = opts.KeyPassphrase
+		p.Info.APK.Signature.KeyName = opts.KeyName
+	default:
+		return fmt.Errorf("signing is not supported for %s packages", formatString[p.format])
+	}
+
+	return nil
+}
+
+// SetChangelog sets the entries written to the changelog of p when it is created, overriding the
+// changelog in the configuration. Changelogs are written to RPM and DEB packages.
+func (p *Package) SetChangelog(entries ...ChangelogEntry) {
+	p.changelog = append([]ChangelogEntry(nil), entries...)
+}
+
 func (p *Package) Create(w io.Writer) error {
-	if err := p.Packager.Package(p.Info, w); err != nil {
+	return p.CreateContext(context.Background(), w)
+}
+
+// CreateContext writes the package to w, in the same way as Create. If ctx is done before the
+// package is complete, writing stops and ctx.Err() is returned.
+func (p *Package) CreateContext(ctx context.Context, w io.Writer) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if p.hasGenerated() {
+		// nfpm reads contents and scripts from files, so write the generated ones to a directory
+		// for the duration of the call.
+		dir, err := ioutil.TempDir("", "gobuild-package")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+
+		saved := *p.Info
+		defer func() { *p.Info = saved }()
+		if err := p.addGenerated(dir); err != nil {
+			return fmt.Errorf("while generating package files: %s", err)
+		}
+	}
+
+	if len(p.changelog) > 0 {
+		// nfpm reads the changelog from a file, so write the entries to one for the duration of
+		// the call.
+		path, err := writeChangelog(p.changelog, p.Info.Maintainer)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(path)
+
+		saved := p.Info.Changelog
+		p.Info.Changelog = path
+		defer func() { p.Info.Changelog = saved }()
+	}
+
+	pw := &progressWriter{ctx: ctx, w: w, onProgress: p.OnProgress}
+	if err := p.Packager.Package(p.Info, pw); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
 		return fmt.Errorf("while writing package: %s", err)
 	}
 	return nil
 }
+
+// progressWriter is an io.Writer that fails once its context is done, and reports the number of
+// bytes written to onProgress, if it is not nil.
+type progressWriter struct {
+	ctx        context.Context
+	w          io.Writer
+	onProgress func(written int64)
+	written    int64
+}
+
+func (pw *progressWriter) Write(p []byte) (int, error) {
+	if err := pw.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := pw.w.Write(p)
+	pw.written += int64(n)
+	if pw.onProgress != nil {
+		pw.onProgress(pw.written)
+	}
+	return n, err
+}
+
+// CreateSigned writes the package to w, in the same way as Create, and writes an ASCII-armored
+// detached signature of the package made with key to sig. This is independent of signing
+// configured with SetSigningOptions, which embeds the signature in the package. The private key of
+// key must already be decrypted.
+func (p *Package) CreateSigned(w io.Writer, sig io.Writer, key *openpgp.Entity) error {
+	ds, err := newDetachedSigner(key)
+	if err != nil {
+		return err
+	}
+
+	if err := p.Create(io.MultiWriter(w, ds)); err != nil {
+		return err
+	}
+	return ds.writeSignature(sig)
+}
+
+// CreateAll creates a package of each of formats from the same configuration, version and
+// architecture as p, concurrently, and writes each to a file named by its TargetName in dir. It
+// returns the paths of the files, in the order of formats. If formats is empty, only p is created.
+// The package of p's own format is p itself; packages of other formats share its changelog, but not
+// signing configured with SetSigningOptions. If any package cannot be created, the returned error
+// identifies each format that failed, and no files are left behind for them.
+func (p *Package) CreateAll(dir string, formats ...Format) ([]string, error) {
+	if len(formats) == 0 {
+		formats = []Format{p.format}
+	}
+
+	pkgs := make([]*Package, len(formats))
+	byFormat := map[Format]*Package{p.format: p}
+	var errs []string
+	for i, format := range formats {
+		if pkg, ok := byFormat[format]; ok {
+			pkgs[i] = pkg
+			continue
+		}
+		pkg, err := newConfigPackage(p.config, format, p.version, p.arch, p.opts)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", formatName(format), err))
+			continue
+		}
+		pkg.changelog = p.changelog
+		pkgs[i] = pkg
+		byFormat[format] = pkg
+	}
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("while creating packages: %s", strings.Join(errs, "; "))
+	}
+
+	paths := make([]string, len(pkgs))
+	createErrs := make([]error, len(pkgs))
+	var wg sync.WaitGroup
+	for i, pkg := range pkgs {
+		paths[i] = filepath.Join(dir, pkg.TargetName())
+
+		// A format listed more than once is only created once.
+		if containsPackage(pkgs[:i], pkg) {
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int, pkg *Package) {
+			defer wg.Done()
+			createErrs[i] = pkg.createFile(paths[i])
+		}(i, pkg)
+	}
+	wg.Wait()
+
+	for i, err := range createErrs {
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", formatName(formats[i]), err))
+		}
+	}
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("while creating packages: %s", strings.Join(errs, "; "))
+	}
+
+	return paths, nil
+}
+
+// containsPackage returns true if pkgs contains pkg.
+func containsPackage(pkgs []*Package, pkg *Package) bool {
+	for _, p := range pkgs {
+		if p == pkg {
+			return true
+		}
+	}
+	return false
+}
+
+// createFile writes the package to a new file at path. If the package cannot be written, the file
+// is removed.
+func (p *Package) createFile(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("while creating %s: %s", path, err)
+	}
+
+	if err := p.Create(f); err != nil {
+		f.Close()
+		os.Remove(path)
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		os.Remove(path)
+		return fmt.Errorf("while closing %s: %s", path, err)
+	}
+	Log.Infof("created %s", path)
+	return nil
+}
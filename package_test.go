@@ -0,0 +1,430 @@
+// SPDX-License-Identifier: BSD-3-Clause
+// Copyright (c) 2020-2021, Ctrl IQ, Inc. All rights reserved
+
+package gobuild
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/goreleaser/nfpm/v2"
+	"golang.org/x/crypto/openpgp"
+)
+
+// testPackageConfig returns an nfpm configuration of a package named tool, which installs a
+// script as /usr/bin/tool.
+func testPackageConfig(t testing.TB) []byte {
+	t.Helper()
+	bin := filepath.Join(tempDir(t), "tool")
+	if err := ioutil.WriteFile(bin, []byte("#!/bin/sh\necho tool\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return []byte(fmt.Sprintf(`name: tool
+arch: "{{ .Arch }}"
+version: "{{ .Version }}"
+maintainer: Test <test@example.com>
+description: A test package.
+license: BSD-3-Clause
+depends:
+  - base
+deb:
+  fields:
+    Bugs: https://example.com/bugs
+contents:
+  - src: %s
+    dst: /usr/bin/tool
+`, bin))
+}
+
+func TestPackagesConcurrent(t *testing.T) {
+	config, err := parseConfig(bytes.NewReader(testPackageConfig(t)), PackageTemplateData{Version: "1.2.3", Arch: "amd64"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	targets := map[Format]string{
+		DEB:       "tool_1.2.3_amd64.deb",
+		RPM:       "tool-1.2.3.x86_64.rpm",
+		APK:       "tool_1.2.3_x86_64.apk",
+		ARCHLINUX: "tool-1.2.3-1-x86_64.pkg.tar.zst",
+	}
+
+	const n = 16
+	pkgs := make([]*Package, n)
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// Each package starts from the same configuration, and changes its own.
+			pkg, err := NewPackageWithConfig(config, Format(i%len(targets)), "1.2.3", "amd64")
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			pkg.Info.Depends[0] = fmt.Sprintf("dep%d", i)
+			pkg.Info.Deb.Fields["X-Package"] = fmt.Sprint(i)
+			errs[i] = pkg.Create(ioutil.Discard)
+			pkgs[i] = pkg
+		}(i)
+	}
+	wg.Wait()
+
+	for i, pkg := range pkgs {
+		if errs[i] != nil {
+			t.Fatalf("package %d: %s", i, errs[i])
+		}
+		format := Format(i % len(targets))
+		if name := pkg.TargetName(); name != targets[format] {
+			t.Errorf("package %d: got target %s, want %s", i, name, targets[format])
+		}
+		if deps := pkg.Info.Depends; len(deps) != 1 || deps[0] != fmt.Sprintf("dep%d", i) {
+			t.Errorf("package %d: got dependencies %v", i, deps)
+		}
+		if f := pkg.Info.Deb.Fields; len(f) != 2 || f["X-Package"] != fmt.Sprint(i) {
+			t.Errorf("package %d: got fields %v", i, f)
+		}
+	}
+	if len(config.Depends) != 1 || config.Depends[0] != "base" || len(config.Deb.Fields) != 1 {
+		t.Errorf("configuration changed to dependencies %v and fields %v", config.Depends, config.Deb.Fields)
+	}
+}
+
+func TestAPKPackage(t *testing.T) {
+	config := testPackageConfig(t)
+	for arch, want := range map[string]string{
+		"amd64": "tool_1.2.3_x86_64.apk",
+		"arm7":  "tool_1.2.3_armv7.apk",
+	} {
+		pkg, err := NewPackage(bytes.NewReader(config), APK, "1.2.3", arch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name := pkg.TargetName(); name != want {
+			t.Errorf("%s: got target %s, want %s", arch, name, want)
+		}
+
+		var b bytes.Buffer
+		if err := pkg.Create(&b); err != nil {
+			t.Fatal(err)
+		}
+		if b.Len() == 0 {
+			t.Errorf("%s: package is empty", arch)
+		}
+	}
+}
+
+// arMembers returns the contents of the members of the ar archive b, by name.
+func arMembers(t testing.TB, b []byte) map[string][]byte {
+	t.Helper()
+	if !bytes.HasPrefix(b, []byte("!<arch>\n")) {
+		t.Fatal("not an ar archive")
+	}
+	members := make(map[string][]byte)
+	for b = b[8:]; len(b) >= 60; {
+		name := strings.TrimRight(string(b[:16]), " /")
+		size, err := strconv.Atoi(strings.TrimSpace(string(b[48:58])))
+		if err != nil || 60+size > len(b) {
+			t.Fatalf("invalid ar header for %s", name)
+		}
+		members[name] = b[60 : 60+size]
+		b = b[60+size+size%2:]
+	}
+	return members
+}
+
+func TestSignedPackages(t *testing.T) {
+	keyFile, key := writeTestKey(t)
+	config := testPackageConfig(t)
+
+	for _, format := range []Format{DEB, RPM} {
+		pkg, err := NewPackage(bytes.NewReader(config), format, "1.2.3", "amd64")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var unsigned bytes.Buffer
+		if err := pkg.Create(&unsigned); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := pkg.SetSigningOptions(SigningOptions{KeyFile: keyFile, KeyID: "0000000000000000"}); err == nil {
+			t.Errorf("%s: no error for the wrong key ID", formatString[format])
+		}
+		if err := pkg.SetSigningOptions(SigningOptions{KeyFile: keyFile}); err != nil {
+			t.Fatal(err)
+		}
+		var signed bytes.Buffer
+		if err := pkg.Create(&signed); err != nil {
+			t.Fatal(err)
+		}
+
+		if format == RPM {
+			// The signature header of an RPM package grows to hold the signatures.
+			if signed.Len() <= unsigned.Len() {
+				t.Errorf("rpm: signed package of %d bytes is not larger than unsigned package of %d", signed.Len(), unsigned.Len())
+			}
+			continue
+		}
+
+		// The origin signature of a DEB package signs its other members, in order.
+		m := arMembers(t, signed.Bytes())
+		sig, ok := m["_gpgorigin"]
+		if !ok {
+			t.Fatal("deb: no _gpgorigin signature")
+		}
+		var data []byte
+		for _, name := range []string{"debian-binary", "control.tar.gz", "data.tar.gz"} {
+			data = append(data, m[name]...)
+		}
+		keyring := openpgp.EntityList{key}
+		if _, err := openpgp.CheckArmoredDetachedSignature(keyring, bytes.NewReader(data), bytes.NewReader(sig)); err != nil {
+			t.Errorf("deb: %s", err)
+		}
+	}
+}
+
+func TestPackageArch(t *testing.T) {
+	// The architecture names of DEB, RPM, APK and Arch Linux packages, or "" if not supported.
+	tests := []struct {
+		arch                     string
+		deb, rpm, apk, archlinux string
+	}{
+		{"all", "noarch", "noarch", "noarch", "any"},
+		{"amd64", "amd64", "x86_64", "x86_64", "x86_64"},
+		{"386", "i386", "i386", "x86", "i686"},
+		{"arm64", "arm64", "aarch64", "aarch64", "aarch64"},
+		{"ppc64le", "ppc64el", "ppc64le", "ppc64le", "powerpc64le"},
+		{"s390x", "s390x", "s390x", "s390x", ""},
+		{"arm", "armhf", "armhfp", "armhf", "armv7h"},
+		{"arm5", "armel", "", "", "arm"},
+		{"arm6", "armhf", "armhfp", "armhf", "armv6h"},
+		{"arm7", "armhf", "armhfp", "armv7", "armv7h"},
+		{"mips", "mips", "", "", ""},
+		{"mipsle", "mipsel", "", "", ""},
+		{"mips64", "mips64", "", "mips64", ""},
+		{"mips64le", "mips64el", "", "", ""},
+		{"riscv64", "riscv64", "riscv64", "riscv64", "riscv64"},
+		{"loong64", "loong64", "loongarch64", "loongarch64", "loong64"},
+	}
+	if len(tests) != len(formatArch) {
+		t.Errorf("%d architectures tested, of %d", len(tests), len(formatArch))
+	}
+
+	config := testPackageConfig(t)
+	for _, tt := range tests {
+		for format, want := range map[Format]string{DEB: tt.deb, RPM: tt.rpm, APK: tt.apk, ARCHLINUX: tt.archlinux} {
+			pkg, err := NewPackage(bytes.NewReader(config), format, "1.2.3", tt.arch)
+			if want == "" {
+				wantErr := fmt.Sprintf("%s is not supported for %s packages", tt.arch, formatString[format])
+				if !errors.Is(err, ErrUnsupportedArch) || !strings.Contains(err.Error(), wantErr) {
+					t.Errorf("%s %s: got error %v, want %s", tt.arch, formatString[format], err, wantErr)
+				}
+				continue
+			}
+			if err != nil {
+				t.Errorf("%s %s: %s", tt.arch, formatString[format], err)
+				continue
+			}
+			if got := pkg.Info.Arch; got != want {
+				t.Errorf("%s %s: got architecture %s, want %s", tt.arch, formatString[format], got, want)
+			}
+		}
+	}
+
+	if _, err := NewPackage(bytes.NewReader(config), DEB, "1.2.3", "sparc64"); !errors.Is(err, ErrUnsupportedArch) {
+		t.Errorf("sparc64: got error %v, want ErrUnsupportedArch", err)
+	}
+}
+
+func TestPackageTargetName(t *testing.T) {
+	config := testPackageConfig(t)
+	const devel = "1.2.4-alpha.4.devel.3+g1a2b3c4"
+	tests := []struct {
+		format  Format
+		version string
+		arch    string
+		want    string
+	}{
+		{DEB, "1.2.3", "amd64", "tool_1.2.3_amd64.deb"},
+		{DEB, "1.2.3", "arm7", "tool_1.2.3_armhf.deb"},
+		{RPM, "1.2.3", "amd64", "tool-1.2.3.x86_64.rpm"},
+		{RPM, "1.2.3", "arm64", "tool-1.2.3.aarch64.rpm"},
+		// Development builds must not have the file names of the release.
+		{DEB, devel, "amd64", "tool_1.2.4~alpha.4.devel.3+g1a2b3c4_amd64.deb"},
+		{RPM, devel, "amd64", "tool-1.2.4~alpha.4.devel.3+g1a2b3c4.x86_64.rpm"},
+		{APK, devel, "amd64", "tool_1.2.4_alpha.4.devel.3+g1a2b3c4_x86_64.apk"},
+		{ARCHLINUX, devel, "amd64", "tool-1.2.4_alpha.4.devel.3+g1a2b3c4-1-x86_64.pkg.tar.zst"},
+	}
+	for _, tt := range tests {
+		name, err := PackageTargetName(bytes.NewReader(config), tt.format, tt.version, tt.arch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pkg, err := NewPackage(bytes.NewReader(config), tt.format, tt.version, tt.arch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name != tt.want || pkg.TargetName() != tt.want {
+			t.Errorf("%s %s %s: got target %s and package target %s, want %s",
+				formatString[tt.format], tt.version, tt.arch, name, pkg.TargetName(), tt.want)
+		}
+	}
+}
+
+// debFile returns the content of the file named name in the member of the DEB package b with the
+// given name, such as control.tar.gz.
+func debFile(t testing.TB, b []byte, member, name string) string {
+	t.Helper()
+	m, ok := arMembers(t, b)[member]
+	if !ok {
+		t.Fatalf("no member %s", member)
+	}
+	for _, e := range readTgz(t, m) {
+		if e.hdr.Name == name {
+			return e.content
+		}
+	}
+	t.Fatalf("no file %s in %s", name, member)
+	return ""
+}
+
+func TestNewPackageWithConfig(t *testing.T) {
+	config := nfpm.Config{Info: nfpm.Info{
+		Name:        "tool",
+		Maintainer:  "Test <test@example.com>",
+		Description: "A test package.",
+		Overridables: nfpm.Overridables{
+			Depends: []string{"base", "extra (>= 2.0)"},
+		},
+	}}
+	pkg, err := NewPackageWithConfig(config, DEB, "1.2.3", "arm64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := pkg.TargetName(); name != "tool_1.2.3_arm64.deb" {
+		t.Errorf("got target %s, want tool_1.2.3_arm64.deb", name)
+	}
+
+	var b bytes.Buffer
+	if err := pkg.Create(&b); err != nil {
+		t.Fatal(err)
+	}
+	control := debFile(t, b.Bytes(), "control.tar.gz", "./control")
+	for _, want := range []string{"Package: tool\n", "Version: 1.2.3\n", "Architecture: arm64\n", "Depends: base, extra (>= 2.0)\n"} {
+		if !strings.Contains(control, want) {
+			t.Errorf("control file does not contain %q:\n%s", want, control)
+		}
+	}
+}
+
+func TestNewPackageFromFile(t *testing.T) {
+	os.Setenv("GOBUILD_TEST_MAINTAINER", "Env Test <env@example.com>")
+	t.Cleanup(func() { os.Unsetenv("GOBUILD_TEST_MAINTAINER") })
+
+	config := strings.Replace(string(testPackageConfig(t)), "Test <test@example.com>", "${GOBUILD_TEST_MAINTAINER}", 1)
+	config = strings.Replace(config, "- base", "- $GOBUILD_TEST_UNSET base", 1)
+	path := filepath.Join(tempDir(t), "nfpm.yaml")
+	if err := ioutil.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	pkg, err := NewPackageFromFile(path, DEB, "1.2.3", "amd64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := pkg.Info.Maintainer; m != "Env Test <env@example.com>" {
+		t.Errorf("got maintainer %q", m)
+	}
+	// Unset variables expand to nothing, as with the nfpm command.
+	if deps := pkg.Info.Depends; len(deps) != 1 || deps[0] != "base" {
+		t.Errorf("got dependencies %q", deps)
+	}
+
+	if _, err := NewPackageFromFile(filepath.Join(tempDir(t), "absent.yaml"), DEB, "1.2.3", "amd64"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("absent file: got error %v", err)
+	}
+}
+
+func TestValidatePackageConfig(t *testing.T) {
+	config := string(testPackageConfig(t))
+	if err := ValidatePackageConfig(strings.NewReader(config), RPM, "amd64"); err != nil {
+		t.Errorf("valid configuration: %s", err)
+	}
+
+	tests := []struct {
+		name   string
+		config string
+		format Format
+		arch   string
+	}{
+		{"no name", strings.Replace(config, "name: tool\n", "", 1), DEB, "amd64"},
+		{"absent source", strings.Replace(config, "src: /", "src: /absent/", 1), DEB, "amd64"},
+		{"unsupported architecture", config, ARCHLINUX, "s390x"},
+		{"unknown architecture", config, DEB, "sparc64"},
+		{"unsupported format", config, Format(100), "amd64"},
+	}
+	for _, tt := range tests {
+		if err := ValidatePackageConfig(strings.NewReader(tt.config), tt.format, tt.arch); err == nil {
+			t.Errorf("%s: no error", tt.name)
+		}
+	}
+}
+
+func TestPackageChangelog(t *testing.T) {
+	config := testPackageConfig(t)
+	opts := PackageOptions{ChangelogEntries: []ChangelogEntry{{
+		Version: "1.2.3",
+		Date:    time.Date(2021, 3, 4, 12, 0, 0, 0, time.UTC),
+		Changes: []string{"Fixed the frobnicator."},
+	}}}
+
+	// The changelog is in the uncompressed header of an RPM package.
+	pkg, err := NewPackageWithOptions(bytes.NewReader(config), RPM, "1.2.3", "amd64", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	if err := pkg.Create(&b); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"Fixed the frobnicator.", "Test <test@example.com> - 1.2.3"} {
+		if !bytes.Contains(b.Bytes(), []byte(want)) {
+			t.Errorf("RPM package does not contain %q", want)
+		}
+	}
+
+	pkg, err = NewPackageWithOptions(bytes.NewReader(config), DEB, "1.2.3", "amd64", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Reset()
+	if err := pkg.Create(&b); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := gzip.NewReader(strings.NewReader(debFile(t, b.Bytes(), "data.tar.gz", "./usr/share/doc/tool/changelog.gz")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	changelog, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"tool (1.2.3) stable; urgency=low\n", "  * Fixed the frobnicator.\n", " -- Test <test@example.com>  Thu, 04 Mar 2021 12:00:00 +0000\n"} {
+		if !strings.Contains(string(changelog), want) {
+			t.Errorf("DEB changelog does not contain %q:\n%s", want, changelog)
+		}
+	}
+	if pkg.Info.Changelog != "" {
+		t.Errorf("temporary changelog %s left in package information", pkg.Info.Changelog)
+	}
+}
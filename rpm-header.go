@@ -0,0 +1,319 @@
+// SPDX-License-Identifier: BSD-3-Clause
+// Copyright (c) 2020-2021, Ctrl IQ, Inc. All rights reserved
+
+package gobuild
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// rpmHeader is an RPM header structure, used for both the signature and the main header.
+type rpmHeader struct {
+	entries []rpmHeaderEntry
+}
+
+// rpmHeaderEntry is an entry in an RPM header.
+type rpmHeaderEntry struct {
+	tag   int32
+	typ   int32
+	count int32
+	data  []byte
+}
+
+func (h *rpmHeader) add(tag, typ int32, count int, data []byte) {
+	h.entries = append(h.entries, rpmHeaderEntry{tag, typ, int32(count), data})
+}
+
+func (h *rpmHeader) addString(tag int32, s string) {
+	h.add(tag, rpmTypeString, 1, append([]byte(s), 0))
+}
+
+func (h *rpmHeader) addStrings(tag int32, s ...string) {
+	var b []byte
+	for _, v := range s {
+		b = append(append(b, v...), 0)
+	}
+	h.add(tag, rpmTypeStringArray, len(s), b)
+}
+
+func (h *rpmHeader) addBinary(tag int32, b []byte) {
+	h.add(tag, rpmTypeBinary, len(b), b)
+}
+
+func (h *rpmHeader) addInt32(tag int32, v ...int32) {
+	b := make([]byte, 4*len(v))
+	for i, n := range v {
+		binary.BigEndian.PutUint32(b[4*i:], uint32(n))
+	}
+	h.add(tag, rpmTypeInt32, len(v), b)
+}
+
+func (h *rpmHeader) addUint16(tag int32, v ...uint16) {
+	b := make([]byte, 2*len(v))
+	for i, n := range v {
+		binary.BigEndian.PutUint16(b[2*i:], n)
+	}
+	h.add(tag, rpmTypeInt16, len(v), b)
+}
+
+// bytes returns the encoded header. Its entries are sorted by tag and preceded by the region tag
+// region, which rpm requires to mark the entries covered by digests and signatures.
+func (h *rpmHeader) bytes(region int32) []byte {
+	entries := append([]rpmHeaderEntry(nil), h.entries...)
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].tag < entries[j].tag })
+
+	var data bytes.Buffer
+	offsets := make([]int, len(entries))
+	for i, e := range entries {
+		// Integers must be aligned to their size.
+		align := map[int32]int{rpmTypeInt16: 2, rpmTypeInt32: 4}[e.typ]
+		if align > 0 {
+			data.Write(make([]byte, (align-data.Len()%align)%align))
+		}
+		offsets[i] = data.Len()
+		data.Write(e.data)
+	}
+
+	// The region trailer is an index entry for the region tag, whose offset is the negated size
+	// of the index.
+	n := len(entries) + 1
+	trailer := data.Len()
+	binary.Write(&data, binary.BigEndian, []int32{region, rpmTypeBinary, int32(-16 * n), 16})
+
+	var b bytes.Buffer
+	b.Write([]byte{0x8e, 0xad, 0xe8, 0x01, 0, 0, 0, 0})
+	binary.Write(&b, binary.BigEndian, []int32{int32(n), int32(data.Len())})
+	binary.Write(&b, binary.BigEndian, []int32{region, rpmTypeBinary, int32(trailer), 16})
+	for i, e := range entries {
+		binary.Write(&b, binary.BigEndian, []int32{e.tag, e.typ, int32(offsets[i]), e.count})
+	}
+	b.Write(data.Bytes())
+	return b.Bytes()
+}
+
+// readRPMHeader reads a header structure from r, and returns its entries, keyed by tag, and its
+// size in bytes.
+func readRPMHeader(r io.Reader) (map[int32]rpmHeaderEntry, int, error) {
+	var intro struct {
+		Magic   [8]byte
+		Entries int32
+		Size    int32
+	}
+	if err := binary.Read(r, binary.BigEndian, &intro); err != nil {
+		return nil, 0, err
+	}
+	if !bytes.Equal(intro.Magic[:4], []byte{0x8e, 0xad, 0xe8, 0x01}) {
+		return nil, 0, fmt.Errorf("bad header magic")
+	}
+	if intro.Entries < 0 || intro.Entries > 0x10000 || intro.Size < 0 || intro.Size > 256<<20 {
+		return nil, 0, fmt.Errorf("bad header size")
+	}
+
+	index := make([]struct{ Tag, Type, Offset, Count int32 }, intro.Entries)
+	if err := binary.Read(r, binary.BigEndian, index); err != nil {
+		return nil, 0, err
+	}
+	data := make([]byte, intro.Size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, 0, err
+	}
+
+	entries := make(map[int32]rpmHeaderEntry, len(index))
+	for i, e := range index {
+		if e.Offset < 0 || e.Offset > intro.Size {
+			return nil, 0, fmt.Errorf("bad offset of tag %d", e.Tag)
+		}
+		// An entry extends to the next one, or the end of the data, less any padding, which
+		// readers of the entry ignore.
+		end := intro.Size
+		if i+1 < len(index) && index[i+1].Offset >= e.Offset {
+			end = index[i+1].Offset
+		}
+		entries[e.Tag] = rpmHeaderEntry{e.Tag, e.Type, e.Count, data[e.Offset:end]}
+	}
+	return entries, 16 + 16*len(index) + len(data), nil
+}
+
+// readRPMHeaders reads the lead, signature header and main header of an RPM from r, leaving r at
+// the start of the payload. It returns the offsets of the start and end of the main header.
+func readRPMHeaders(r io.Reader) (sig, h map[int32]rpmHeaderEntry, start, end int, err error) {
+	lead := make([]byte, 96)
+	if _, err := io.ReadFull(r, lead); err != nil {
+		return nil, nil, 0, 0, err
+	}
+	if !bytes.Equal(lead[:4], []byte{0xed, 0xab, 0xee, 0xdb}) {
+		return nil, nil, 0, 0, fmt.Errorf("not an RPM")
+	}
+
+	sig, n, err := readRPMHeader(r)
+	if err != nil {
+		return nil, nil, 0, 0, fmt.Errorf("while reading signature header: %s", err)
+	}
+	// The signature header is padded to a multiple of 8 bytes.
+	pad := (8 - n%8) % 8
+	if _, err := io.ReadFull(r, make([]byte, pad)); err != nil {
+		return nil, nil, 0, 0, err
+	}
+
+	start = len(lead) + n + pad
+	h, n, err = readRPMHeader(r)
+	if err != nil {
+		return nil, nil, 0, 0, fmt.Errorf("while reading header: %s", err)
+	}
+	return sig, h, start, start + n, nil
+}
+
+// strings returns the values of a string entry.
+func (e rpmHeaderEntry) strings() []string {
+	switch e.typ {
+	case rpmTypeString, rpmTypeStringArray, rpmTypeI18NString:
+	default:
+		return nil
+	}
+	var s []string
+	data := e.data
+	for i := int32(0); i < e.count; i++ {
+		j := bytes.IndexByte(data, 0)
+		if j < 0 {
+			break
+		}
+		s = append(s, string(data[:j]))
+		data = data[j+1:]
+	}
+	return s
+}
+
+// ints returns the values of an integer entry.
+func (e rpmHeaderEntry) ints() []int64 {
+	size := map[int32]int{rpmTypeInt8: 1, rpmTypeInt16: 2, rpmTypeInt32: 4, rpmTypeInt64: 8}[e.typ]
+	if size == 0 || len(e.data) < size*int(e.count) {
+		return nil
+	}
+	v := make([]int64, e.count)
+	for i := range v {
+		b := e.data[size*i:]
+		switch size {
+		case 1:
+			v[i] = int64(b[0])
+		case 2:
+			v[i] = int64(binary.BigEndian.Uint16(b))
+		case 4:
+			v[i] = int64(binary.BigEndian.Uint32(b))
+		case 8:
+			v[i] = int64(binary.BigEndian.Uint64(b))
+		}
+	}
+	return v
+}
+
+// RPM header types, tags and flags.
+const (
+	rpmTypeInt8        = 2
+	rpmTypeInt16       = 3
+	rpmTypeInt32       = 4
+	rpmTypeInt64       = 5
+	rpmTypeString      = 6
+	rpmTypeBinary      = 7
+	rpmTypeStringArray = 8
+	rpmTypeI18NString  = 9
+
+	rpmTagHeaderSignatures = 62
+	rpmTagHeaderImmutable  = 63
+	rpmTagHeaderI18NTable  = 100
+
+	rpmSigSHA1        = 269
+	rpmSigSHA256      = 273
+	rpmSigSize        = 1000
+	rpmSigMD5         = 1004
+	rpmSigPayloadSize = 1007
+
+	rpmTagName              = 1000
+	rpmTagVersion           = 1001
+	rpmTagRelease           = 1002
+	rpmTagEpoch             = 1003
+	rpmTagSummary           = 1004
+	rpmTagDescription       = 1005
+	rpmTagBuildTime         = 1006
+	rpmTagBuildHost         = 1007
+	rpmTagSize              = 1009
+	rpmTagVendor            = 1011
+	rpmTagLicense           = 1014
+	rpmTagPackager          = 1015
+	rpmTagGroup             = 1016
+	rpmTagURL               = 1020
+	rpmTagOS                = 1021
+	rpmTagArch              = 1022
+	rpmTagOldFileNames      = 1027
+	rpmTagFileSizes         = 1028
+	rpmTagFileModes         = 1030
+	rpmTagFileRDevs         = 1033
+	rpmTagFileMTimes        = 1034
+	rpmTagFileDigests       = 1035
+	rpmTagFileLinkTos       = 1036
+	rpmTagFileFlags         = 1037
+	rpmTagFileUserName      = 1039
+	rpmTagFileGroupName     = 1040
+	rpmTagSourceRPM         = 1044
+	rpmTagFileVerifyFlags   = 1045
+	rpmTagProvideName       = 1047
+	rpmTagRequireFlags      = 1048
+	rpmTagRequireName       = 1049
+	rpmTagRequireVersion    = 1050
+	rpmTagConflictFlags     = 1053
+	rpmTagConflictName      = 1054
+	rpmTagConflictVersion   = 1055
+	rpmTagChangelogTime     = 1080
+	rpmTagChangelogName     = 1081
+	rpmTagChangelogText     = 1082
+	rpmTagObsoleteName      = 1090
+	rpmTagFileDevices       = 1095
+	rpmTagFileINodes        = 1096
+	rpmTagFileLangs         = 1097
+	rpmTagSourcePackage     = 1106
+	rpmTagProvideFlags      = 1112
+	rpmTagProvideVersion    = 1113
+	rpmTagObsoleteFlags     = 1114
+	rpmTagObsoleteVersion   = 1115
+	rpmTagDirIndexes        = 1116
+	rpmTagBaseNames         = 1117
+	rpmTagDirNames          = 1118
+	rpmTagPayloadFormat     = 1124
+	rpmTagPayloadCompressor = 1125
+	rpmTagPayloadFlags      = 1126
+	rpmTagLongSize          = 5009
+	rpmTagFileDigestAlgo    = 5011
+	rpmTagRecommendName     = 5046
+	rpmTagRecommendVersion  = 5047
+	rpmTagRecommendFlags    = 5048
+	rpmTagSuggestName       = 5049
+	rpmTagSuggestVersion    = 5050
+	rpmTagSuggestFlags      = 5051
+	rpmTagSupplementName    = 5052
+	rpmTagSupplementVersion = 5053
+	rpmTagSupplementFlags   = 5054
+	rpmTagEnhanceName       = 5055
+	rpmTagEnhanceVersion    = 5056
+	rpmTagEnhanceFlags      = 5057
+	rpmTagPayloadDigest     = 5092
+	rpmTagPayloadDigestAlgo = 5093
+
+	rpmDigestSHA256 = 8
+	rpmFileGhost    = 1 << 6
+	rpmFileSpecFile = 1 << 5
+	rpmModeDir      = 040000
+	rpmModeRegular  = 0100000
+
+	rpmSenseLess    = 1 << 1
+	rpmSenseGreater = 1 << 2
+	rpmSenseEqual   = 1 << 3
+	rpmSensePrereq  = 1 << 6
+	rpmSensePre     = 1 << 9
+	rpmSensePost    = 1 << 10
+	rpmSensePreun   = 1 << 11
+	rpmSensePostun  = 1 << 12
+	rpmSenseRPMLib  = 1 << 24
+)
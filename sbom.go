@@ -0,0 +1,274 @@
+// SPDX-License-Identifier: BSD-3-Clause
+// Copyright (c) 2020-2021, Ctrl IQ, Inc. All rights reserved
+
+package gobuild
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/magefile/mage/mg"
+)
+
+// SBOMFormat is the format of a software bill of materials.
+type SBOMFormat uint8
+
+const (
+	SPDXJSON      SBOMFormat = iota // SPDX 2.3, JSON encoded
+	CycloneDXJSON                   // CycloneDX 1.4, JSON encoded
+)
+
+// SBOMModule is a Go module built into a binary.
+type SBOMModule struct {
+	Path    string // module path
+	Version string // module version, or (devel) for an unversioned main module
+	Sum     string // checksum from go.sum, if known
+}
+
+// purl returns the package URL of m.
+func (m SBOMModule) purl() string {
+	if m.Version == "" || m.Version == "(devel)" {
+		return "pkg:golang/" + m.Path
+	}
+	return "pkg:golang/" + m.Path + "@" + m.Version
+}
+
+// ReadBinaryModules returns the main module of the Go binary at path, and the modules it depends
+// on, as recorded by the go command when the binary was built.
+func ReadBinaryModules(path string) (main SBOMModule, deps []SBOMModule, err error) {
+	out, err := exec.Command(mg.GoCmd(), "version", "-m", path).Output()
+	if err != nil {
+		return SBOMModule{}, nil, fmt.Errorf("while reading module information from %s: %s", path, err)
+	}
+
+	s := bufio.NewScanner(bytes.NewReader(out))
+	for s.Scan() {
+		fields := strings.Split(strings.TrimPrefix(s.Text(), "\t"), "\t")
+		if len(fields) < 3 {
+			continue
+		}
+
+		m := SBOMModule{Path: fields[1], Version: fields[2]}
+		if len(fields) > 3 {
+			m.Sum = fields[3]
+		}
+
+		switch fields[0] {
+		case "mod":
+			main = m
+		case "dep":
+			deps = append(deps, m)
+		case "=>":
+			// The previous dependency is replaced. A replacement in the local file system has no
+			// meaningful path, so only the version of the original module is changed.
+			if len(deps) > 0 {
+				if strings.HasPrefix(m.Path, ".") || filepath.IsAbs(m.Path) {
+					m.Path = deps[len(deps)-1].Path
+				}
+				deps[len(deps)-1] = m
+			}
+		}
+	}
+
+	if main.Path == "" {
+		return SBOMModule{}, nil, fmt.Errorf("no module information found in %s", path)
+	}
+	return main, deps, nil
+}
+
+// WriteSBOM writes a software bill of materials in the given format for the Go binary at path to
+// w, listing its main module and dependencies. If the SOURCE_DATE_EPOCH environment variable is
+// set, it is used as the creation time, so that the output is reproducible.
+func WriteSBOM(w io.Writer, format SBOMFormat, path string) error {
+	main, deps, err := ReadBinaryModules(path)
+	if err != nil {
+		return err
+	}
+
+	created, ok, err := sourceDateEpoch()
+	if err != nil {
+		return err
+	} else if !ok {
+		created = time.Now().UTC()
+	}
+
+	var doc interface{}
+	switch format {
+	case SPDXJSON:
+		doc = spdxDocument(main, deps, created)
+	case CycloneDXJSON:
+		doc = cycloneDXDocument(main, deps, created)
+	default:
+		return fmt.Errorf("%w: SBOM format %v", ErrUnsupportedFormat, format)
+	}
+
+	b, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return fmt.Errorf("while encoding SBOM: %s", err)
+	}
+	if _, err := w.Write(append(b, '\n')); err != nil {
+		return fmt.Errorf("while writing SBOM: %s", err)
+	}
+	return nil
+}
+
+// sbomTool identifies this package as the creator of an SBOM.
+const sbomTool = "github.com/ctrliq/gobuild"
+
+type spdxExternalRef struct {
+	ReferenceCategory string `json:"referenceCategory"`
+	ReferenceType     string `json:"referenceType"`
+	ReferenceLocator  string `json:"referenceLocator"`
+}
+
+type spdxPackage struct {
+	Name             string            `json:"name"`
+	SPDXID           string            `json:"SPDXID"`
+	VersionInfo      string            `json:"versionInfo,omitempty"`
+	DownloadLocation string            `json:"downloadLocation"`
+	FilesAnalyzed    bool              `json:"filesAnalyzed"`
+	LicenseConcluded string            `json:"licenseConcluded"`
+	LicenseDeclared  string            `json:"licenseDeclared"`
+	CopyrightText    string            `json:"copyrightText"`
+	ExternalRefs     []spdxExternalRef `json:"externalRefs"`
+}
+
+type spdxRelationship struct {
+	SPDXElementID      string `json:"spdxElementId"`
+	RelationshipType   string `json:"relationshipType"`
+	RelatedSPDXElement string `json:"relatedSpdxElement"`
+}
+
+type spdxCreationInfo struct {
+	Created  string   `json:"created"`
+	Creators []string `json:"creators"`
+}
+
+type spdxDoc struct {
+	SPDXVersion       string             `json:"spdxVersion"`
+	DataLicense       string             `json:"dataLicense"`
+	SPDXID            string             `json:"SPDXID"`
+	Name              string             `json:"name"`
+	DocumentNamespace string             `json:"documentNamespace"`
+	CreationInfo      spdxCreationInfo   `json:"creationInfo"`
+	Packages          []spdxPackage      `json:"packages"`
+	Relationships     []spdxRelationship `json:"relationships"`
+}
+
+// spdxDocument returns an SPDX document describing main and its dependencies.
+func spdxDocument(main SBOMModule, deps []SBOMModule, created time.Time) *spdxDoc {
+	// The namespace must be unique to the document, so derive it from the modules described.
+	h := sha256.New()
+	for _, m := range append([]SBOMModule{main}, deps...) {
+		fmt.Fprintf(h, "%s %s %s\n", m.Path, m.Version, m.Sum)
+	}
+
+	doc := &spdxDoc{
+		SPDXVersion:       "SPDX-2.3",
+		DataLicense:       "CC0-1.0",
+		SPDXID:            "SPDXRef-DOCUMENT",
+		Name:              main.Path,
+		DocumentNamespace: "https://spdx.org/spdxdocs/" + main.Path + "-" + hex.EncodeToString(h.Sum(nil)),
+		CreationInfo: spdxCreationInfo{
+			Created:  created.Format(time.RFC3339),
+			Creators: []string{"Tool: " + sbomTool},
+		},
+	}
+
+	for i, m := range append([]SBOMModule{main}, deps...) {
+		id := fmt.Sprintf("SPDXRef-Package-%d", i)
+		doc.Packages = append(doc.Packages, spdxPackage{
+			Name:             m.Path,
+			SPDXID:           id,
+			VersionInfo:      m.Version,
+			DownloadLocation: "NOASSERTION",
+			LicenseConcluded: "NOASSERTION",
+			LicenseDeclared:  "NOASSERTION",
+			CopyrightText:    "NOASSERTION",
+			ExternalRefs: []spdxExternalRef{{
+				ReferenceCategory: "PACKAGE-MANAGER",
+				ReferenceType:     "purl",
+				ReferenceLocator:  m.purl(),
+			}},
+		})
+
+		// The document describes the main module, which depends on each of the others.
+		rel := spdxRelationship{SPDXElementID: "SPDXRef-DOCUMENT", RelationshipType: "DESCRIBES"}
+		if i > 0 {
+			rel = spdxRelationship{SPDXElementID: "SPDXRef-Package-0", RelationshipType: "DEPENDS_ON"}
+		}
+		rel.RelatedSPDXElement = id
+		doc.Relationships = append(doc.Relationships, rel)
+	}
+
+	return doc
+}
+
+type cdxComponent struct {
+	Type    string `json:"type"`
+	BOMRef  string `json:"bom-ref"`
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+	PURL    string `json:"purl"`
+}
+
+type cdxTool struct {
+	Name string `json:"name"`
+}
+
+type cdxMetadata struct {
+	Timestamp string       `json:"timestamp"`
+	Tools     []cdxTool    `json:"tools"`
+	Component cdxComponent `json:"component"`
+}
+
+type cdxDependency struct {
+	Ref       string   `json:"ref"`
+	DependsOn []string `json:"dependsOn,omitempty"`
+}
+
+type cdxDoc struct {
+	BOMFormat    string          `json:"bomFormat"`
+	SpecVersion  string          `json:"specVersion"`
+	Version      int             `json:"version"`
+	Metadata     cdxMetadata     `json:"metadata"`
+	Components   []cdxComponent  `json:"components"`
+	Dependencies []cdxDependency `json:"dependencies"`
+}
+
+// cycloneDXDocument returns a CycloneDX document describing main and its dependencies.
+func cycloneDXDocument(main SBOMModule, deps []SBOMModule, created time.Time) *cdxDoc {
+	component := func(typ string, m SBOMModule) cdxComponent {
+		return cdxComponent{Type: typ, BOMRef: m.purl(), Name: m.Path, Version: m.Version, PURL: m.purl()}
+	}
+
+	doc := &cdxDoc{
+		BOMFormat:   "CycloneDX",
+		SpecVersion: "1.4",
+		Version:     1,
+		Metadata: cdxMetadata{
+			Timestamp: created.Format(time.RFC3339),
+			Tools:     []cdxTool{{Name: sbomTool}},
+			Component: component("application", main),
+		},
+		Components: []cdxComponent{},
+	}
+
+	root := cdxDependency{Ref: main.purl()}
+	for _, m := range deps {
+		doc.Components = append(doc.Components, component("library", m))
+		root.DependsOn = append(root.DependsOn, m.purl())
+	}
+	doc.Dependencies = []cdxDependency{root}
+
+	return doc
+}
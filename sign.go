@@ -0,0 +1,193 @@
+// SPDX-License-Identifier: BSD-3-Clause
+// Copyright (c) 2020-2021, Ctrl IQ, Inc. All rights reserved
+
+package gobuild
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"strings"
+	"unicode"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+// SigningOptions describes the key used to sign packages. DEB and RPM packages are signed with a
+// PGP key, and APK packages with an RSA key in PEM format.
+type SigningOptions struct {
+	KeyFile       string // path to the secret key, which may be ASCII-armored
+	KeyPassphrase string // passphrase of the secret key, if it is encrypted
+	KeyID         string // if set, the hexadecimal ID the key is expected to have (PGP keys only)
+
+	// KeyName is the name of the public key installed in /etc/apk/keys, recorded in APK
+	// packages. If empty, it defaults to <maintainer email>.rsa.pub.
+	KeyName string
+}
+
+// LoadSigningKey reads and decrypts the secret key described by opts, for use with CreateSigned and
+// SignDetached. The key file must contain exactly one secret key capable of signing.
+func LoadSigningKey(opts SigningOptions) (*openpgp.Entity, error) {
+	return loadSigningKey(opts)
+}
+
+// loadSigningKey reads and decrypts the secret key described by opts. The key file must contain
+// exactly one secret key capable of signing.
+func loadSigningKey(opts SigningOptions) (*openpgp.Entity, error) {
+	b, err := ioutil.ReadFile(opts.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("while reading key file %s: %s", opts.KeyFile, err)
+	}
+
+	var entities openpgp.EntityList
+	if isASCII(b) {
+		entities, err = openpgp.ReadArmoredKeyRing(bytes.NewReader(b))
+	} else {
+		entities, err = openpgp.ReadKeyRing(bytes.NewReader(b))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("while decoding key file %s: %s", opts.KeyFile, err)
+	}
+
+	var key *openpgp.Entity
+	for _, e := range entities {
+		if e.PrivateKey == nil || !e.PrivateKey.CanSign() {
+			continue
+		}
+		if key != nil {
+			return nil, fmt.Errorf("key file %s contains more than one signing key", opts.KeyFile)
+		}
+		key = e
+	}
+	if key == nil {
+		return nil, fmt.Errorf("key file %s contains no signing key", opts.KeyFile)
+	}
+
+	if opts.KeyID != "" {
+		id := fmt.Sprintf("%016X", key.PrivateKey.KeyId)
+		want := strings.ToUpper(strings.TrimPrefix(opts.KeyID, "0x"))
+		if want == "" || !strings.HasSuffix(id, want) {
+			return nil, fmt.Errorf("key in %s has ID %s, expected %s", opts.KeyFile, id, opts.KeyID)
+		}
+	}
+
+	if key.PrivateKey.Encrypted {
+		if opts.KeyPassphrase == "" {
+			return nil, fmt.Errorf("key in %s is encrypted, but no passphrase was provided", opts.KeyFile)
+		}
+		if err := key.PrivateKey.Decrypt([]byte(opts.KeyPassphrase)); err != nil {
+			return nil, fmt.Errorf("while decrypting key in %s (wrong passphrase?): %s", opts.KeyFile, err)
+		}
+	}
+
+	return key, nil
+}
+
+// SignDetached writes an ASCII-armored detached signature of the contents of r, made with key, to
+// sig. The private key of key must already be decrypted.
+func SignDetached(sig io.Writer, r io.Reader, key *openpgp.Entity) error {
+	ds, err := newDetachedSigner(key)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(ds, r); err != nil {
+		return fmt.Errorf("while reading data to sign: %s", err)
+	}
+	return ds.writeSignature(sig)
+}
+
+// detachedSigner computes a detached signature of the data written to it.
+type detachedSigner struct {
+	hash.Hash
+	key    *openpgp.Entity
+	sig    *packet.Signature
+	config packet.Config
+}
+
+// newDetachedSigner returns a detachedSigner that signs with key.
+func newDetachedSigner(key *openpgp.Entity) (*detachedSigner, error) {
+	if key == nil || key.PrivateKey == nil {
+		return nil, fmt.Errorf("no private key provided for signing")
+	} else if key.PrivateKey.Encrypted {
+		return nil, fmt.Errorf("private key must be decrypted for signing")
+	}
+
+	ds := &detachedSigner{key: key}
+	ds.sig = &packet.Signature{
+		SigType:      packet.SigTypeBinary,
+		PubKeyAlgo:   key.PrivateKey.PubKeyAlgo,
+		Hash:         ds.config.Hash(),
+		CreationTime: ds.config.Now(),
+		IssuerKeyId:  &key.PrivateKey.KeyId,
+	}
+	ds.Hash = ds.sig.Hash.New()
+	return ds, nil
+}
+
+// writeSignature writes the ASCII-armored signature of the data written to ds to w.
+func (ds *detachedSigner) writeSignature(w io.Writer) error {
+	if err := ds.sig.Sign(ds.Hash, ds.key.PrivateKey, &ds.config); err != nil {
+		return fmt.Errorf("while signing: %s", err)
+	}
+
+	aw, err := armor.Encode(w, openpgp.SignatureType, nil)
+	if err != nil {
+		return fmt.Errorf("while writing signature: %s", err)
+	}
+	if err := ds.sig.Serialize(aw); err != nil {
+		aw.Close()
+		return fmt.Errorf("while writing signature: %s", err)
+	}
+	if err := aw.Close(); err != nil {
+		return fmt.Errorf("while writing signature: %s", err)
+	}
+	return nil
+}
+
+// isASCII returns true if b contains only ASCII characters.
+func isASCII(b []byte) bool {
+	for _, c := range b {
+		if c > unicode.MaxASCII {
+			return false
+		}
+	}
+	return true
+}
+
+// loadRSASigningKey reads and decrypts the RSA secret key described by opts, which must be in PEM
+// format, as used to sign APK packages.
+func loadRSASigningKey(opts SigningOptions) (*rsa.PrivateKey, error) {
+	b, err := ioutil.ReadFile(opts.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("while reading key file %s: %s", opts.KeyFile, err)
+	}
+
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("key file %s contains no PEM block", opts.KeyFile)
+	}
+
+	der := block.Bytes
+	// nfpm decrypts keys in the legacy encrypted PEM format, so accept the same keys here.
+	if x509.IsEncryptedPEMBlock(block) {
+		if opts.KeyPassphrase == "" {
+			return nil, fmt.Errorf("key in %s is encrypted, but no passphrase was provided", opts.KeyFile)
+		}
+		if der, err = x509.DecryptPEMBlock(block, []byte(opts.KeyPassphrase)); err != nil {
+			return nil, fmt.Errorf("while decrypting key in %s (wrong passphrase?): %s", opts.KeyFile, err)
+		}
+	}
+
+	key, err := x509.ParsePKCS1PrivateKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("while decoding key file %s: %s", opts.KeyFile, err)
+	}
+	return key, nil
+}
@@ -0,0 +1,443 @@
+// SPDX-License-Identifier: BSD-3-Clause
+// Copyright (c) 2020-2021, Ctrl IQ, Inc. All rights reserved
+
+package gobuild
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// SourceRPMTemplateData is the data available to Go templates in spec files passed to
+// NewSourceRPM. For example, a spec file may contain "Version: {{ .Version }}" and
+// "%autosetup -n {{ .Prefix }}".
+type SourceRPMTemplateData struct {
+	Name    string // name of the package
+	Version string // version, with the pre-release separated by ~ so that it sorts first
+	Release string // release number
+	Source  string // file name of the source archive, for Source0
+	Prefix  string // directory the source archive extracts to
+}
+
+// SourceRPM is a source RPM, made of a spec file and the source archive of a GitArchive, from which
+// binary packages can be rebuilt with rpmbuild, mock or koji.
+type SourceRPM struct {
+	data    SourceRPMTemplateData
+	spec    []byte
+	archive *GitArchive
+	sources []memSource // sources added with AddSource
+}
+
+// NewSourceRPM returns a SourceRPM of the package name, with the given release, for the source
+// archive created by ga. Its version is that of ga. The spec file read from specReader is executed
+// as a Go template with SourceRPMTemplateData, so that the name, version, release and source
+// archive recorded in the package agree with those in the spec file.
+//
+// The prefix of ga must be name-version, with the version as in the archive or in the package,
+// so that the archive extracts to a single directory. If ga has no prefix, it is set to
+// name-version.
+func NewSourceRPM(specReader io.Reader, name, release string, ga *GitArchive) (*SourceRPM, error) {
+	v, err := ga.Version()
+	if err != nil {
+		return nil, fmt.Errorf("while getting version: %s", err)
+	}
+	if release == "" {
+		release = "1"
+	}
+
+	data := SourceRPMTemplateData{
+		Name:    name,
+		Version: tildeVersion(v),
+		Release: release,
+	}
+
+	// The archive must extract to the single directory named by Prefix, for %autosetup -n.
+	switch ga.prefix {
+	case "":
+		ga.prefix = name + "-" + data.Version
+	case name + "-" + data.Version, name + "-" + v:
+	default:
+		return nil, fmt.Errorf("archive prefix %s is not %s-%s", ga.prefix, name, data.Version)
+	}
+	data.Prefix = ga.prefix
+	data.Source = data.Prefix + ".tar.gz"
+
+	b, err := ioutil.ReadAll(specReader)
+	if err != nil {
+		return nil, fmt.Errorf("while reading spec file: %s", err)
+	}
+	t, err := template.New("spec").Option("missingkey=error").Parse(string(b))
+	if err != nil {
+		return nil, fmt.Errorf("while parsing spec file template: %s", err)
+	}
+	var spec bytes.Buffer
+	if err := t.Execute(&spec, data); err != nil {
+		return nil, fmt.Errorf("while expanding spec file template: %s", err)
+	}
+
+	return &SourceRPM{data: data, spec: spec.Bytes(), archive: ga}, nil
+}
+
+// tildeVersion returns the semantic version v in the form used for RPM and Debian versions, in the
+// same way as nfpm: hyphens separate the release, so the pre-release is separated by ~, which sorts
+// before the release.
+func tildeVersion(v string) string {
+	meta := ""
+	if i := strings.Index(v, "+"); i >= 0 {
+		v, meta = v[:i], v[i:]
+	}
+	if i := strings.Index(v, "-"); i >= 0 {
+		v = v[:i] + "~" + strings.ReplaceAll(v[i+1:], "-", "_")
+	}
+	return v + strings.ReplaceAll(meta, "-", "_")
+}
+
+// AddSource adds a file, such as a patch, with the given name and content to the package,
+// alongside the spec file and source archive.
+func (s *SourceRPM) AddSource(name string, content []byte) {
+	s.sources = append(s.sources, memSource{name: name, content: content, mode: 0644})
+}
+
+// TargetName returns the file name of the package, in the form name-version-release.src.rpm.
+func (s *SourceRPM) TargetName() string {
+	return fmt.Sprintf("%s-%s-%s.src.rpm", s.data.Name, s.data.Version, s.data.Release)
+}
+
+// rpmFile is a file in the payload of an RPM.
+type rpmFile struct {
+	name    string
+	content []byte
+	flags   int32
+}
+
+// Create writes the package to w.
+func (s *SourceRPM) Create(w io.Writer) error {
+	mtime, err := s.archive.modTime()
+	if err != nil {
+		return err
+	}
+
+	var archive bytes.Buffer
+	if err := s.archive.Create(TgzArchive, &archive); err != nil {
+		return fmt.Errorf("while creating source archive: %s", err)
+	}
+
+	files := []rpmFile{
+		{name: s.data.Name + ".spec", content: s.spec, flags: rpmFileSpecFile},
+		{name: s.data.Source, content: archive.Bytes()},
+	}
+	for _, src := range s.sources {
+		files = append(files, rpmFile{name: src.name, content: src.content})
+	}
+
+	// rpm looks files up by name, so they must be sorted.
+	sort.Slice(files, func(i, j int) bool { return files[i].name < files[j].name })
+	for i := 1; i < len(files); i++ {
+		if files[i].name == files[i-1].name {
+			return fmt.Errorf("duplicate source file %s", files[i].name)
+		}
+	}
+
+	payload, payloadSize, err := rpmPayload(files, mtime)
+	if err != nil {
+		return err
+	}
+
+	h, err := s.header(files, payload, mtime)
+	if err != nil {
+		return err
+	}
+	hb := h.bytes(rpmTagHeaderImmutable)
+
+	md5sum := md5.New()
+	md5sum.Write(hb)
+	md5sum.Write(payload)
+
+	var sig rpmHeader
+	sig.addString(rpmSigSHA1, fmt.Sprintf("%x", sha1.Sum(hb)))
+	sig.addString(rpmSigSHA256, fmt.Sprintf("%x", sha256.Sum256(hb)))
+	sig.addInt32(rpmSigSize, int32(len(hb)+len(payload)))
+	sig.addBinary(rpmSigMD5, md5sum.Sum(nil))
+	sig.addInt32(rpmSigPayloadSize, int32(payloadSize))
+	sb := sig.bytes(rpmTagHeaderSignatures)
+
+	lead := rpmLead(fmt.Sprintf("%s-%s-%s", s.data.Name, s.data.Version, s.data.Release))
+	for _, b := range [][]byte{lead, sb, make([]byte, (8-len(sb)%8)%8), hb, payload} {
+		if _, err := w.Write(b); err != nil {
+			return fmt.Errorf("while writing package: %s", err)
+		}
+	}
+	return nil
+}
+
+// header returns the main header of the package.
+func (s *SourceRPM) header(files []rpmFile, payload []byte, mtime time.Time) (*rpmHeader, error) {
+	preamble, description, err := parseSpecPreamble(s.spec)
+	if err != nil {
+		return nil, err
+	}
+
+	host, _ := os.Hostname()
+
+	var h rpmHeader
+	h.addStrings(rpmTagHeaderI18NTable, "C")
+	h.addString(rpmTagName, s.data.Name)
+	h.addString(rpmTagVersion, s.data.Version)
+	h.addString(rpmTagRelease, s.data.Release)
+	h.addString(rpmTagSummary, preamble["summary"])
+	h.addString(rpmTagDescription, description)
+	h.addInt32(rpmTagBuildTime, int32(mtime.Unix()))
+	h.addString(rpmTagBuildHost, host)
+	h.addString(rpmTagLicense, preamble["license"])
+	if url := preamble["url"]; url != "" {
+		h.addString(rpmTagURL, url)
+	}
+	h.addString(rpmTagOS, "linux")
+	h.addString(rpmTagArch, "noarch")
+	h.addInt32(rpmTagSourcePackage, 1)
+	h.addString(rpmTagPayloadFormat, "cpio")
+	h.addString(rpmTagPayloadCompressor, "gzip")
+	h.addString(rpmTagPayloadFlags, "9")
+	h.addStrings(rpmTagPayloadDigest, fmt.Sprintf("%x", sha256.Sum256(payload)))
+	h.addInt32(rpmTagPayloadDigestAlgo, rpmDigestSHA256)
+	h.addInt32(rpmTagFileDigestAlgo, rpmDigestSHA256)
+
+	// Build dependencies are recorded as the requirements of a source package, for tools such as
+	// dnf builddep. rpmbuild also adds the rpmlib features the package relies on.
+	reqs, err := parseDependencies(preamble["buildrequires"])
+	if err != nil {
+		return nil, err
+	}
+	reqs = append(reqs,
+		rpmDependency{"rpmlib(CompressedFileNames)", rpmSenseRPMLib | rpmSenseLess | rpmSenseEqual, "3.0.4-1"},
+		rpmDependency{"rpmlib(FileDigests)", rpmSenseRPMLib | rpmSenseLess | rpmSenseEqual, "4.6.0-1"},
+	)
+	names := make([]string, len(reqs))
+	flags := make([]int32, len(reqs))
+	versions := make([]string, len(reqs))
+	for i, r := range reqs {
+		names[i], flags[i], versions[i] = r.name, r.flags, r.version
+	}
+	h.addStrings(rpmTagRequireName, names...)
+	h.addInt32(rpmTagRequireFlags, flags...)
+	h.addStrings(rpmTagRequireVersion, versions...)
+
+	n := len(files)
+	var (
+		size      int32
+		sizes     = make([]int32, n)
+		modes     = make([]uint16, n)
+		rdevs     = make([]uint16, n)
+		mtimes    = make([]int32, n)
+		digests   = make([]string, n)
+		linktos   = make([]string, n)
+		fflags    = make([]int32, n)
+		owners    = make([]string, n)
+		verify    = make([]int32, n)
+		devices   = make([]int32, n)
+		inodes    = make([]int32, n)
+		langs     = make([]string, n)
+		dirIndex  = make([]int32, n)
+		basenames = make([]string, n)
+	)
+	for i, f := range files {
+		size += int32(len(f.content))
+		sizes[i] = int32(len(f.content))
+		modes[i] = rpmModeRegular | 0644
+		mtimes[i] = int32(mtime.Unix())
+		digests[i] = fmt.Sprintf("%x", sha256.Sum256(f.content))
+		fflags[i] = f.flags
+		owners[i] = "root"
+		verify[i] = -1
+		devices[i] = 1
+		inodes[i] = int32(i + 1)
+		basenames[i] = f.name
+	}
+	h.addInt32(rpmTagSize, size)
+	h.addInt32(rpmTagFileSizes, sizes...)
+	h.addUint16(rpmTagFileModes, modes...)
+	h.addUint16(rpmTagFileRDevs, rdevs...)
+	h.addInt32(rpmTagFileMTimes, mtimes...)
+	h.addStrings(rpmTagFileDigests, digests...)
+	h.addStrings(rpmTagFileLinkTos, linktos...)
+	h.addInt32(rpmTagFileFlags, fflags...)
+	h.addStrings(rpmTagFileUserName, owners...)
+	h.addStrings(rpmTagFileGroupName, owners...)
+	h.addInt32(rpmTagFileVerifyFlags, verify...)
+	h.addInt32(rpmTagFileDevices, devices...)
+	h.addInt32(rpmTagFileINodes, inodes...)
+	h.addStrings(rpmTagFileLangs, langs...)
+
+	// The files of a source package have no directory.
+	h.addInt32(rpmTagDirIndexes, dirIndex...)
+	h.addStrings(rpmTagBaseNames, basenames...)
+	h.addStrings(rpmTagDirNames, "")
+
+	return &h, nil
+}
+
+// parseSpecPreamble returns the tags in the preamble of spec, keyed by their lower case names, and
+// the text of its %description section. The values of tags that appear more than once, such as
+// BuildRequires, are joined with commas. Macros are not expanded.
+func parseSpecPreamble(spec []byte) (map[string]string, string, error) {
+	preamble := make(map[string]string)
+	var description []string
+	section := ""
+
+	sc := bufio.NewScanner(bytes.NewReader(spec))
+	for sc.Scan() {
+		line := sc.Text()
+		trimmed := strings.TrimSpace(line)
+
+		if strings.HasPrefix(trimmed, "%") {
+			word := strings.Fields(trimmed)[0]
+			if isSpecSection(word) {
+				// Only the description of the main package is recorded.
+				section = word
+				if section == "%description" && len(strings.Fields(trimmed)) > 1 {
+					section = "%description-sub"
+				}
+				continue
+			}
+		}
+
+		switch section {
+		case "":
+			if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+				continue
+			}
+			i := strings.Index(trimmed, ":")
+			if i < 0 {
+				continue
+			}
+			tag := strings.ToLower(strings.TrimSpace(trimmed[:i]))
+			value := strings.TrimSpace(trimmed[i+1:])
+			if prev, ok := preamble[tag]; ok {
+				value = prev + ", " + value
+			}
+			preamble[tag] = value
+		case "%description":
+			description = append(description, line)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, "", fmt.Errorf("while reading spec file: %s", err)
+	}
+
+	return preamble, strings.TrimSpace(strings.Join(description, "\n")), nil
+}
+
+// isSpecSection returns true if word starts a section of a spec file.
+func isSpecSection(word string) bool {
+	switch word {
+	case "%package", "%description", "%prep", "%generate_buildrequires", "%conf", "%build",
+		"%install", "%check", "%clean", "%files", "%changelog", "%pre", "%post", "%preun",
+		"%postun", "%pretrans", "%posttrans", "%verifyscript", "%triggerin", "%triggerun",
+		"%triggerpostun", "%filetriggerin", "%filetriggerun", "%transfiletriggerin",
+		"%transfiletriggerun":
+		return true
+	}
+	return false
+}
+
+// rpmDependency is a dependency of an RPM, such as a requirement.
+type rpmDependency struct {
+	name    string
+	flags   int32
+	version string
+}
+
+// parseDependencies parses a list of dependencies, separated by commas or white space, each of
+// which may be followed by a comparison with a version, such as "golang >= 1.14, make".
+func parseDependencies(s string) ([]rpmDependency, error) {
+	fields := strings.Fields(strings.ReplaceAll(s, ",", " "))
+
+	var deps []rpmDependency
+	for i := 0; i < len(fields); i++ {
+		d := rpmDependency{name: fields[i]}
+		if i+1 < len(fields) {
+			if flags, ok := rpmSense[fields[i+1]]; ok {
+				if i+2 == len(fields) {
+					return nil, fmt.Errorf("missing version in dependency %s %s", fields[i], fields[i+1])
+				}
+				d.flags, d.version = flags, fields[i+2]
+				i += 2
+			}
+		}
+		deps = append(deps, d)
+	}
+	return deps, nil
+}
+
+// rpmSense maps comparison operators to the flags of a dependency.
+var rpmSense = map[string]int32{
+	"<":  rpmSenseLess,
+	"<=": rpmSenseLess | rpmSenseEqual,
+	"=":  rpmSenseEqual,
+	"==": rpmSenseEqual,
+	">=": rpmSenseGreater | rpmSenseEqual,
+	">":  rpmSenseGreater,
+}
+
+// rpmPayload returns the gzip compressed cpio archive of files, and its uncompressed size.
+func rpmPayload(files []rpmFile, mtime time.Time) ([]byte, int, error) {
+	var archive bytes.Buffer
+	for i, f := range files {
+		writeCPIOEntry(&archive, i+1, f.name, rpmModeRegular|0644, mtime, f.content)
+	}
+	writeCPIOEntry(&archive, 0, "TRAILER!!!", 0, time.Unix(0, 0), nil)
+
+	var payload bytes.Buffer
+	gz, err := gzip.NewWriterLevel(&payload, gzip.BestCompression)
+	if err != nil {
+		return nil, 0, fmt.Errorf("while creating gzip writer: %s", err)
+	}
+	gz.ModTime = mtime
+	if _, err := gz.Write(archive.Bytes()); err != nil {
+		return nil, 0, fmt.Errorf("while compressing payload: %s", err)
+	}
+	if err := gz.Close(); err != nil {
+		return nil, 0, fmt.Errorf("while compressing payload: %s", err)
+	}
+	return payload.Bytes(), archive.Len(), nil
+}
+
+// writeCPIOEntry writes an entry in the SVR4 (newc) cpio format used for RPM payloads to w.
+func writeCPIOEntry(w *bytes.Buffer, ino int, name string, mode int, mtime time.Time, content []byte) {
+	nlink := 1
+	fmt.Fprintf(w, "070701%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x",
+		ino, mode, 0, 0, nlink, mtime.Unix(), len(content), 0, 0, 0, 0, len(name)+1, 0)
+	w.WriteString(name)
+	w.WriteByte(0)
+	w.Write(make([]byte, (4-w.Len()%4)%4))
+	w.Write(content)
+	w.Write(make([]byte, (4-w.Len()%4)%4))
+}
+
+// rpmLead returns the lead of a source package named name.
+func rpmLead(name string) []byte {
+	lead := make([]byte, 96)
+	copy(lead, []byte{0xed, 0xab, 0xee, 0xdb, 3, 0})
+	binary.BigEndian.PutUint16(lead[6:], 1) // source package
+	binary.BigEndian.PutUint16(lead[8:], 0) // architecture, which rpm ignores
+	if len(name) > 65 {
+		name = name[:65]
+	}
+	copy(lead[10:76], name)
+	binary.BigEndian.PutUint16(lead[76:], 1) // Linux
+	binary.BigEndian.PutUint16(lead[78:], 5) // signature in a header
+	return lead
+}
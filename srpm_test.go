@@ -0,0 +1,61 @@
+// SPDX-License-Identifier: BSD-3-Clause
+// Copyright (c) 2020-2021, Ctrl IQ, Inc. All rights reserved
+
+package gobuild
+
+import (
+	"strings"
+	"testing"
+)
+
+const testSpec = `Name: {{ .Name }}
+Version: {{ .Version }}
+Release: {{ .Release }}
+Source0: {{ .Source }}
+
+%prep
+%autosetup -n {{ .Prefix }}
+`
+
+func TestNewSourceRPMPrefix(t *testing.T) {
+	dir := initRepo(t)
+	commitFile(t, dir, "README", "hello")
+	runGit(t, dir, "tag", "v1.2.3")
+
+	tests := []struct {
+		prefix  string
+		source  string
+		wantErr bool
+	}{
+		{prefix: "", source: "tool-1.2.3.tar.gz"},
+		{prefix: "tool-1.2.3", source: "tool-1.2.3.tar.gz"},
+		{prefix: "{{ .Name }}-{{ .Version }}", wantErr: true},
+		{prefix: "a/tool-1.2.3", wantErr: true},
+	}
+	for _, tt := range tests {
+		ga, err := NewGitArchiveAt(dir, tt.prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		s, err := NewSourceRPM(strings.NewReader(testSpec), "tool", "1", ga)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("prefix %q: no error", tt.prefix)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("prefix %q: %s", tt.prefix, err)
+		}
+		if s.data.Source != tt.source {
+			t.Errorf("prefix %q: got source %s, want %s", tt.prefix, s.data.Source, tt.source)
+		}
+		if !strings.Contains(string(s.spec), "%autosetup -n tool-1.2.3\n") {
+			t.Errorf("prefix %q: got spec file:\n%s", tt.prefix, s.spec)
+		}
+		if ga.prefix != "tool-1.2.3" {
+			t.Errorf("prefix %q: got archive prefix %q", tt.prefix, ga.prefix)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+// SPDX-License-Identifier: BSD-3-Clause
+// Copyright (c) 2020-2021, Ctrl IQ, Inc. All rights reserved
+
+package gobuild
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// SystemUser is a system user, and its primary group, created by the preinstall scriptlet of a
+// package, such as the user a service runs as. The user and group are only created if they do not
+// already exist, and are not removed with the package, so that files they own remain owned by
+// them. Scriptlets are generated for RPM and DEB packages.
+type SystemUser struct {
+	Name    string // name of the user
+	Group   string // name of the primary group of the user; defaults to Name
+	Home    string // home directory of the user; defaults to /
+	Shell   string // login shell of the user; defaults to /usr/sbin/nologin
+	Comment string // description of the user, such as "My Tool daemon"
+
+	CreateHome bool // create the home directory, owned by the user, if it does not exist
+}
+
+// systemUserRE matches the names of users and groups that are valid on all distributions.
+var systemUserRE = regexp.MustCompile(`^[a-z_][a-z0-9_-]{0,31}$`)
+
+// validate returns an error if u cannot be created by a scriptlet.
+func (u SystemUser) validate() error {
+	if !systemUserRE.MatchString(u.Name) {
+		return fmt.Errorf("invalid user name %q", u.Name)
+	}
+	if u.Group != "" && !systemUserRE.MatchString(u.Group) {
+		return fmt.Errorf("invalid group name %q of user %s", u.Group, u.Name)
+	}
+	if u.Home != "" && !strings.HasPrefix(u.Home, "/") {
+		return fmt.Errorf("home directory %q of user %s is not absolute", u.Home, u.Name)
+	}
+	return nil
+}
+
+// scriptlets returns the snippets of the maintainer scripts of a package of format that create
+// u. Only RPM and DEB packages have scriptlets. The snippets run on both installation and
+// upgrade, so that a user removed since installation is created again.
+func (u SystemUser) scriptlets(format Format) scriptlets {
+	if format != RPM && format != DEB {
+		return scriptlets{}
+	}
+
+	group := u.Group
+	if group == "" {
+		group = u.Name
+	}
+	home := u.Home
+	if home == "" {
+		home = "/"
+	}
+	shell := u.Shell
+	if shell == "" {
+		shell = "/usr/sbin/nologin"
+	}
+
+	args := []string{"-r", "-g", shellQuote(group), "-d", shellQuote(home), "-s", shellQuote(shell)}
+	if u.Comment != "" {
+		args = append(args, "-c", shellQuote(u.Comment))
+	}
+	if u.CreateHome {
+		args = append(args, "-m")
+	} else {
+		args = append(args, "-M")
+	}
+	args = append(args, shellQuote(u.Name))
+
+	var s scriptlets
+	s.preInstall = append(s.preInstall,
+		fmt.Sprintf("if ! getent group %s >/dev/null; then\n\tgroupadd -r %s\nfi", shellQuote(group), shellQuote(group)),
+		fmt.Sprintf("if ! getent passwd %s >/dev/null; then\n\tuseradd %s\nfi", shellQuote(u.Name), strings.Join(args, " ")))
+	return s
+}
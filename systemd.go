@@ -0,0 +1,148 @@
+// SPDX-License-Identifier: BSD-3-Clause
+// Copyright (c) 2020-2021, Ctrl IQ, Inc. All rights reserved
+
+package gobuild
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/goreleaser/nfpm/v2/files"
+)
+
+// SystemdService is a systemd unit installed by a package. For RPM and DEB packages, scriptlets
+// are generated to reload systemd when the unit is installed or removed, to stop it when the
+// package is removed, and to enable, start, and restart it as configured.
+type SystemdService struct {
+	// Name is the name of the unit, such as my-tool.service. If it has no unit type, .service is
+	// appended.
+	Name string
+
+	Unit   string // contents of the unit file
+	Source string // path of the unit file, if Unit is empty
+
+	Enable           bool // enable the unit when the package is installed, and disable it when removed
+	Start            bool // start the unit when the package is installed
+	RestartOnUpgrade bool // restart the unit, if it is running, when the package is upgraded
+}
+
+// systemdUnitTypes are the suffixes of the names of systemd units.
+var systemdUnitTypes = []string{
+	".service", ".socket", ".timer", ".path", ".mount", ".automount", ".target", ".slice",
+}
+
+// unitName returns the name of the unit of svc.
+func (svc SystemdService) unitName() string {
+	for _, t := range systemdUnitTypes {
+		if strings.HasSuffix(svc.Name, t) {
+			return svc.Name
+		}
+	}
+	return svc.Name + ".service"
+}
+
+// validate returns an error if svc cannot be packaged.
+func (svc SystemdService) validate() error {
+	if svc.Name == "" || strings.ContainsAny(svc.Name, "/ ") {
+		return fmt.Errorf("invalid systemd unit name %q", svc.Name)
+	}
+	if svc.Unit == "" && svc.Source == "" {
+		return fmt.Errorf("no unit file set for %s", svc.unitName())
+	}
+	return nil
+}
+
+// content returns the content of a package of format installing the unit file of svc, which is
+// written to dir if it is set by Unit.
+func (svc SystemdService) content(dir string, format Format) (*files.Content, error) {
+	name := svc.unitName()
+
+	// Debian installs units in /lib, which is the same directory as /usr/lib on merged-/usr
+	// systems.
+	dst := path.Join("/usr/lib/systemd/system", name)
+	if format == DEB {
+		dst = path.Join("/lib/systemd/system", name)
+	}
+
+	src := svc.Source
+	if svc.Unit != "" {
+		src = filepath.Join(dir, name)
+		if err := ioutil.WriteFile(src, []byte(svc.Unit), 0644); err != nil {
+			return nil, fmt.Errorf("while writing unit %s: %s", name, err)
+		}
+	}
+	return generatedContent(src, dst, 0644), nil
+}
+
+// systemdRunning is a shell condition that is true if systemd is the running init system, so
+// that units can be started and stopped, and not, for example, in a container or chroot.
+const systemdRunning = "[ -d /run/systemd/system ]"
+
+// systemdReload is a snippet that reloads the units of systemd.
+const systemdReload = `if ` + systemdRunning + `; then
+	systemctl daemon-reload >/dev/null 2>&1 || :
+fi`
+
+// scriptlets returns the snippets of the maintainer scripts of a package of format that manage
+// svc. Only RPM and DEB packages have scriptlets.
+//
+// The arguments of the scripts differ by format. RPM passes the number of installed instances
+// of the package once the script completes, so %post is passed 1 on installation, %preun 0 on
+// removal, and %postun at least 1 on upgrade, after the new files are installed. Debian passes
+// postinst "configure" and the previously configured version, if any, and prerm "remove" on
+// removal.
+func (svc SystemdService) scriptlets(format Format) scriptlets {
+	var installed, upgraded, removed string
+	switch format {
+	case RPM:
+		installed, upgraded, removed = `[ "$1" -eq 1 ]`, `[ "$1" -ge 1 ]`, `[ "$1" -eq 0 ]`
+	case DEB:
+		installed = `[ "$1" = configure ] && [ -z "$2" ]`
+		upgraded = `[ "$1" = configure ] && [ -n "$2" ]`
+		removed = `[ "$1" = remove ]`
+	default:
+		return scriptlets{}
+	}
+	unit := shellQuote(svc.unitName())
+
+	var s scriptlets
+	s.postInstall = append(s.postInstall, systemdReload)
+	if svc.Enable || svc.Start {
+		var b strings.Builder
+		fmt.Fprintf(&b, "if %s; then\n", installed)
+		if svc.Enable {
+			fmt.Fprintf(&b, "\tsystemctl enable %s >/dev/null 2>&1 || :\n", unit)
+		}
+		if svc.Start {
+			fmt.Fprintf(&b, "\tif %s; then\n\t\tsystemctl start %s >/dev/null 2>&1 || :\n\tfi\n", systemdRunning, unit)
+		}
+		b.WriteString("fi")
+		s.postInstall = append(s.postInstall, b.String())
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "if %s; then\n", removed)
+	if svc.Enable {
+		fmt.Fprintf(&b, "\tsystemctl --no-reload disable %s >/dev/null 2>&1 || :\n", unit)
+	}
+	fmt.Fprintf(&b, "\tif %s; then\n\t\tsystemctl stop %s >/dev/null 2>&1 || :\n\tfi\nfi", systemdRunning, unit)
+	s.preRemove = append(s.preRemove, b.String())
+
+	s.postRemove = append(s.postRemove, systemdReload)
+
+	if svc.RestartOnUpgrade {
+		restart := fmt.Sprintf("if %s && %s; then\n\tsystemctl try-restart %s >/dev/null 2>&1 || :\nfi",
+			upgraded, systemdRunning, unit)
+		// RPM restarts the unit once the files of the old package are removed, and Debian once
+		// the new package is configured.
+		if format == RPM {
+			s.postRemove = append(s.postRemove, restart)
+		} else {
+			s.postInstall = append(s.postInstall, restart)
+		}
+	}
+	return s
+}
@@ -0,0 +1,90 @@
+// SPDX-License-Identifier: BSD-3-Clause
+// Copyright (c) 2020-2021, Ctrl IQ, Inc. All rights reserved
+
+package gobuild
+
+import (
+	"fmt"
+	"path"
+
+	"github.com/blang/semver"
+	"golang.org/x/crypto/openpgp"
+)
+
+// TagOptions configures tags created by TagRelease. The zero value creates an unsigned tag on any
+// branch, and does not push it.
+type TagOptions struct {
+	// Remote is the remote the tag is pushed to, such as "origin". If empty, the tag is not pushed.
+	Remote string
+
+	// SigningKey, if set, is the key the tag is signed with. Its private key must already be
+	// decrypted; see LoadSigningKey.
+	SigningKey *openpgp.Entity
+
+	// Branches are the path.Match patterns of the branches releases may be tagged on, such as
+	// "main" and "release/*". If empty, releases may be tagged on any branch.
+	Branches []string
+}
+
+// TagRelease creates an annotated tag of HEAD in the git repository containing the current working
+// directory, named with version by releaseTagName, signs it and pushes it as configured by opts.
+// If message is empty, it is "Release <version>".
+//
+// An error is returned, and no tag is created, if the working tree is dirty, the tag already
+// exists, or the branch of HEAD, as returned by GitDescription.Branch, does not match
+// opts.Branches. If the tag cannot be pushed, it is deleted, so that the release can be tagged
+// again.
+func TagRelease(version semver.Version, message string, opts TagOptions) error {
+	// Describe the repository afresh, so that changes since it was described are seen.
+	gd, err := GitDescribeFresh(".", DescribeOptions{TagPrefix: DefaultTagPrefix})
+	if err != nil {
+		return err
+	}
+	name := releaseTagName(version)
+
+	if !gd.IsClean() {
+		return fmt.Errorf("while tagging %s: working tree is dirty", name)
+	}
+	if len(opts.Branches) > 0 {
+		branch, ok := gd.Branch()
+		if !ok {
+			return fmt.Errorf("while tagging %s: branch of HEAD is unknown", name)
+		}
+		if !matchBranch(branch, opts.Branches) {
+			return fmt.Errorf("while tagging %s: branch %s is not a release branch", name, branch)
+		}
+	}
+
+	if message == "" {
+		message = "Release " + version.String()
+	}
+	if err := createTag(".", name, message, opts.SigningKey); err != nil {
+		return err
+	}
+	if opts.Remote == "" {
+		return nil
+	}
+	if err := pushTag(".", opts.Remote, name); err != nil {
+		if derr := deleteTag(".", name); derr != nil {
+			return fmt.Errorf("%s, and %s", err, derr)
+		}
+		return err
+	}
+	return nil
+}
+
+// releaseTagName returns the name of the tag of the release of version: DefaultTagPrefix followed
+// by the version. Releases are tagged, published and downloaded by this name.
+func releaseTagName(version semver.Version) string {
+	return DefaultTagPrefix + version.String()
+}
+
+// matchBranch returns true if branch matches any of patterns.
+func matchBranch(branch string, patterns []string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, branch); ok {
+			return true
+		}
+	}
+	return false
+}
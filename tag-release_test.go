@@ -0,0 +1,79 @@
+// SPDX-License-Identifier: BSD-3-Clause
+// Copyright (c) 2020-2021, Ctrl IQ, Inc. All rights reserved
+
+package gobuild
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/blang/semver"
+)
+
+// initTagRepo returns the path of a new git repository with one commit, configured with a tagger,
+// and changes the working directory to it until the test completes.
+func initTagRepo(t *testing.T) string {
+	t.Helper()
+	dir := initRepo(t)
+	runGit(t, dir, "config", "user.name", "Test")
+	runGit(t, dir, "config", "user.email", "test@example.com")
+	commitFile(t, dir, "a", "1")
+	chdir(t, dir)
+	return dir
+}
+
+func TestTagRelease(t *testing.T) {
+	dir := initTagRepo(t)
+	remote := tempDir(t)
+	runGit(t, remote, "init", "--quiet", "--bare")
+
+	v := semver.MustParse("1.0.0")
+	if err := TagRelease(v, "", TagOptions{Remote: remote, Branches: []string{"main"}}); err == nil {
+		t.Error("tagged on a branch that is not a release branch")
+	}
+	if err := TagRelease(v, "", TagOptions{Remote: remote, Branches: []string{"master"}}); err != nil {
+		t.Fatal(err)
+	}
+	if got := runGit(t, remote, "tag", "--list"); got != "v1.0.0" {
+		t.Errorf("got tags %q in remote, want v1.0.0", got)
+	}
+	if got := runGit(t, dir, "tag", "--list", "--format=%(contents:subject)"); got != "Release 1.0.0" {
+		t.Errorf("got tag message %q", got)
+	}
+	if err := TagRelease(v, "", TagOptions{}); err == nil {
+		t.Error("tagged an existing tag")
+	}
+}
+
+func TestTagReleaseDirty(t *testing.T) {
+	dir := initTagRepo(t)
+
+	// A cached description of the clean working tree must not be used.
+	if _, err := GitDescribe(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "a"), []byte("2"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err := TagRelease(semver.MustParse("1.0.0"), "", TagOptions{})
+	if err == nil || !strings.Contains(err.Error(), "dirty") {
+		t.Errorf("got error %v, want dirty working tree", err)
+	}
+	if got := runGit(t, dir, "tag", "--list"); got != "" {
+		t.Errorf("got tags %q", got)
+	}
+}
+
+func TestTagReleasePushFails(t *testing.T) {
+	dir := initTagRepo(t)
+
+	remote := filepath.Join(tempDir(t), "missing")
+	if err := TagRelease(semver.MustParse("1.0.0"), "", TagOptions{Remote: remote}); err == nil {
+		t.Fatal("pushed to a missing remote")
+	}
+	if got := runGit(t, dir, "tag", "--list"); got != "" {
+		t.Errorf("got tags %q after failed push, want none", got)
+	}
+}
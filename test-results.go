@@ -0,0 +1,163 @@
+// SPDX-License-Identifier: BSD-3-Clause
+// Copyright (c) 2020-2021, Ctrl IQ, Inc. All rights reserved
+
+package gobuild
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// TestResult is the result of a test, or of the tests of a package, run by RunUnitTestWithOptions
+// or RunIntegrationWithOptions.
+type TestResult struct {
+	Package string
+	Test    string  `json:",omitempty"` // name of the test, or empty for the result of a package
+	Action  string  // pass, fail or skip
+	Elapsed float64 // time taken, in seconds
+	Output  string  `json:",omitempty"` // output of a failed test or package
+}
+
+// testEvent is an event written by go test -json, as described by go doc test2json.
+type testEvent struct {
+	Action  string
+	Package string
+	Test    string
+	Elapsed float64
+	Output  string
+}
+
+// testResultWriter parses the events written to it by go test -json, and prints a line for the
+// result of each package, including the output of failed tests.
+type testResultWriter struct {
+	w       io.Writer                   // writer results are printed to
+	buf     []byte                      // incomplete line
+	output  map[string]*strings.Builder // output of running tests and packages, by key
+	results []TestResult
+}
+
+func newTestResultWriter(w io.Writer) *testResultWriter {
+	return &testResultWriter{w: w, output: make(map[string]*strings.Builder)}
+}
+
+func (tw *testResultWriter) Write(p []byte) (int, error) {
+	tw.buf = append(tw.buf, p...)
+	for {
+		i := bytes.IndexByte(tw.buf, '\n')
+		if i < 0 {
+			break
+		}
+		tw.line(tw.buf[:i+1])
+		tw.buf = tw.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+// line handles a line written by go test -json. Lines that are not events, such as build errors,
+// are printed as is.
+func (tw *testResultWriter) line(b []byte) {
+	var e testEvent
+	if !bytes.HasPrefix(b, []byte("{")) || json.Unmarshal(b, &e) != nil {
+		tw.w.Write(b)
+		return
+	}
+
+	key := e.Package + " " + e.Test
+	switch e.Action {
+	case "output":
+		out, ok := tw.output[key]
+		if !ok {
+			out = &strings.Builder{}
+			tw.output[key] = out
+		}
+		out.WriteString(e.Output)
+		return
+	case "pass", "fail", "skip":
+	default:
+		return
+	}
+
+	r := TestResult{Package: e.Package, Test: e.Test, Action: e.Action, Elapsed: e.Elapsed}
+	var output string
+	if out, ok := tw.output[key]; ok {
+		output = out.String()
+		delete(tw.output, key)
+	}
+	if e.Action == "fail" {
+		r.Output = output
+	}
+	tw.results = append(tw.results, r)
+
+	if e.Test != "" {
+		if e.Action != "fail" {
+			return
+		}
+		// Print the output of the test, other than the lines marking when tests ran, which are
+		// out of order as subtests end before their parents.
+		for _, line := range strings.SplitAfter(output, "\n") {
+			if !strings.HasPrefix(line, "=== ") {
+				fmt.Fprint(tw.w, line)
+			}
+		}
+		return
+	}
+
+	switch e.Action {
+	case "pass":
+		fmt.Fprintf(tw.w, "ok  \t%s\t%.3fs%s\n", e.Package, e.Elapsed, coverageSuffix(output))
+	case "skip":
+		fmt.Fprintf(tw.w, "?   \t%s\t[no test files]\n", e.Package)
+	case "fail":
+		// Print output of the package outside of its tests, such as a panic.
+		for _, line := range strings.SplitAfter(output, "\n") {
+			if line != "" && !strings.HasPrefix(line, "FAIL") && !strings.HasPrefix(line, "coverage:") {
+				fmt.Fprint(tw.w, line)
+			}
+		}
+		fmt.Fprintf(tw.w, "FAIL\t%s\t%.3fs\n", e.Package, e.Elapsed)
+	}
+}
+
+// coverageSuffix returns the coverage reported in the output of a package, if any, in the form
+// printed by go test.
+func coverageSuffix(output string) string {
+	for _, line := range strings.Split(output, "\n") {
+		if strings.HasPrefix(line, "coverage:") {
+			return "\t" + line
+		}
+	}
+	return ""
+}
+
+// printSummary prints the number of tests that passed, failed and were skipped, and the slowest
+// top-level tests, up to slowest of them.
+func (tw *testResultWriter) printSummary(slowest int) {
+	var tests []TestResult
+	counts := make(map[string]int)
+	for _, r := range tw.results {
+		if r.Test == "" {
+			continue
+		}
+		counts[r.Action]++
+		if !strings.Contains(r.Test, "/") && r.Elapsed > 0 {
+			tests = append(tests, r)
+		}
+	}
+	fmt.Fprintf(tw.w, "\n%d passed, %d failed, %d skipped\n", counts["pass"], counts["fail"], counts["skip"])
+
+	if slowest <= 0 || len(tests) == 0 {
+		return
+	}
+	sort.SliceStable(tests, func(i, j int) bool { return tests[i].Elapsed > tests[j].Elapsed })
+	if len(tests) > slowest {
+		tests = tests[:slowest]
+	}
+	fmt.Fprintf(tw.w, "\nslowest tests:\n")
+	for _, r := range tests {
+		fmt.Fprintf(tw.w, "%9.3fs  %s %s\n", r.Elapsed, r.Package, r.Test)
+	}
+}
@@ -0,0 +1,273 @@
+// SPDX-License-Identifier: BSD-3-Clause
+// Copyright (c) 2020-2021, Ctrl IQ, Inc. All rights reserved
+
+package gobuild
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Uploader uploads artifacts to a remote location, such as a mirror or release bucket.
+type Uploader interface {
+	// Upload uploads size bytes read from r as name, which may contain '/'.
+	Upload(name string, r io.Reader, size int64) error
+}
+
+// UploadFiles uploads each of files with u, named by its base name. It can be used to upload the
+// files returned by functions such as CreateAll.
+func UploadFiles(u Uploader, files ...string) error {
+	for _, p := range files {
+		if err := uploadFile(u, p); err != nil {
+			return fmt.Errorf("while uploading %s: %s", p, err)
+		}
+	}
+	return nil
+}
+
+// uploadFile uploads the file at p with u.
+func uploadFile(u Uploader, p string) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	return u.Upload(filepath.Base(p), f, fi.Size())
+}
+
+// HTTPUploader is an Uploader that uploads each artifact with an HTTP PUT request to the URL of its
+// name, relative to URL. It can be used with WebDAV servers and artifact repositories.
+type HTTPUploader struct {
+	URL      string       // base URL, such as https://example.com/releases
+	Username string       // if set, the username for basic authentication
+	Password string       // password for basic authentication
+	Header   http.Header  // additional headers of each request
+	Client   *http.Client // client used for requests; defaults to http.DefaultClient
+}
+
+// Upload uploads size bytes read from r to the URL of name.
+func (u *HTTPUploader) Upload(name string, r io.Reader, size int64) error {
+	req, err := newUploadRequest(strings.TrimSuffix(u.URL, "/")+"/"+escapePath(name), r, size)
+	if err != nil {
+		return err
+	}
+	for k, v := range u.Header {
+		req.Header[k] = v
+	}
+	if u.Username != "" {
+		req.SetBasicAuth(u.Username, u.Password)
+	}
+	return doUploadRequest(u.Client, req)
+}
+
+// S3Uploader is an Uploader for Amazon S3 and S3-compatible object storage, such as MinIO. Requests
+// are signed with AWS Signature Version 4 and address the bucket in the path of the URL.
+type S3Uploader struct {
+	// Endpoint is the URL of the storage service. It defaults to the S3 endpoint of Region.
+	Endpoint string
+
+	Bucket string // name of the bucket
+	Prefix string // if set, the prefix of object names, such as releases/1.2.3/
+	Region string // defaults to the AWS_REGION or AWS_DEFAULT_REGION environment variable, or us-east-1
+
+	// Credentials default to the AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN
+	// environment variables.
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+
+	Client *http.Client // client used for requests; defaults to http.DefaultClient
+}
+
+// Upload uploads size bytes read from r as the object Prefix + name.
+func (u *S3Uploader) Upload(name string, r io.Reader, size int64) error {
+	region := firstNonEmpty(u.Region, os.Getenv("AWS_REGION"), os.Getenv("AWS_DEFAULT_REGION"), "us-east-1")
+	endpoint := firstNonEmpty(u.Endpoint, "https://s3."+region+".amazonaws.com")
+	id := firstNonEmpty(u.AccessKeyID, os.Getenv("AWS_ACCESS_KEY_ID"))
+	secret := firstNonEmpty(u.SecretAccessKey, os.Getenv("AWS_SECRET_ACCESS_KEY"))
+	token := firstNonEmpty(u.SessionToken, os.Getenv("AWS_SESSION_TOKEN"))
+	if id == "" || secret == "" {
+		return fmt.Errorf("no S3 credentials set")
+	}
+
+	key := escapePath(u.Bucket + "/" + u.Prefix + name)
+	req, err := newUploadRequest(strings.TrimSuffix(endpoint, "/")+"/"+key, r, size)
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		req.Header.Set("X-Amz-Security-Token", token)
+	}
+
+	// The payload is not signed, so that it does not need to be read twice.
+	signS3Request(req, "UNSIGNED-PAYLOAD", region, id, secret, time.Now())
+	return doUploadRequest(u.Client, req)
+}
+
+// signS3Request signs req with AWS Signature Version 4 for the S3 service in region, at time t. All
+// headers of req are signed, along with the host. payloadHash is the hex-encoded SHA-256 hash of
+// the payload, or UNSIGNED-PAYLOAD.
+func signS3Request(req *http.Request, payloadHash, region, id, secret string, t time.Time) {
+	t = t.UTC()
+	amzDate := t.Format("20060102T150405Z")
+	scope := t.Format("20060102") + "/" + region + "/s3/aws4_request"
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.Query().Encode(),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := []byte("AWS4" + secret)
+	for _, s := range strings.Split(scope, "/") {
+		key = hmacSHA256(key, s)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		id, scope, signedHeaders, signature))
+}
+
+// hmacSHA256 returns the HMAC-SHA256 of s with key.
+func hmacSHA256(key []byte, s string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(s))
+	return h.Sum(nil)
+}
+
+// GCSUploader is an Uploader for Google Cloud Storage, using its XML API.
+type GCSUploader struct {
+	Bucket string // name of the bucket
+	Prefix string // if set, the prefix of object names, such as releases/1.2.3/
+
+	// Token is an OAuth 2.0 access token, such as one printed by gcloud auth print-access-token. It
+	// defaults to the GOOGLE_OAUTH_ACCESS_TOKEN environment variable.
+	Token string
+
+	Endpoint string       // URL of the API; defaults to https://storage.googleapis.com
+	Client   *http.Client // client used for requests; defaults to http.DefaultClient
+}
+
+// Upload uploads size bytes read from r as the object Prefix + name.
+func (u *GCSUploader) Upload(name string, r io.Reader, size int64) error {
+	token := firstNonEmpty(u.Token, os.Getenv("GOOGLE_OAUTH_ACCESS_TOKEN"))
+	if token == "" {
+		return fmt.Errorf("no GCS access token set")
+	}
+	endpoint := firstNonEmpty(u.Endpoint, "https://storage.googleapis.com")
+
+	key := escapePath(u.Bucket + "/" + u.Prefix + name)
+	req, err := newUploadRequest(strings.TrimSuffix(endpoint, "/")+"/"+key, r, size)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return doUploadRequest(u.Client, req)
+}
+
+// newUploadRequest returns a PUT request of size bytes read from r to u, with the content type of
+// its extension.
+func newUploadRequest(u string, r io.Reader, size int64) (*http.Request, error) {
+	req, err := http.NewRequest(http.MethodPut, u, ioutil.NopCloser(r))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = size
+
+	typ := mime.TypeByExtension(path.Ext(req.URL.Path))
+	if typ == "" {
+		typ = "application/octet-stream"
+	}
+	req.Header.Set("Content-Type", typ)
+	return req, nil
+}
+
+// doUploadRequest sends req with client, or http.DefaultClient if it is nil, and returns an error
+// if the response is not successful.
+func doUploadRequest(client *http.Client, req *http.Request) error {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		if msg := strings.TrimSpace(string(b)); msg != "" {
+			return fmt.Errorf("%s %s: %s: %s", req.Method, req.URL, resp.Status, msg)
+		}
+		return fmt.Errorf("%s %s: %s", req.Method, req.URL, resp.Status)
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	return nil
+}
+
+// escapePath escapes each byte of p other than '/' and those unreserved in URIs, as required for
+// object names by S3.
+func escapePath(p string) string {
+	var sb strings.Builder
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-._~/", c) >= 0 {
+			sb.WriteByte(c)
+		} else {
+			fmt.Fprintf(&sb, "%%%02X", c)
+		}
+	}
+	return sb.String()
+}
+
+// firstNonEmpty returns the first of s that is not empty.
+func firstNonEmpty(s ...string) string {
+	for _, v := range s {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
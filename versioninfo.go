@@ -0,0 +1,211 @@
+// SPDX-License-Identifier: BSD-3-Clause
+// Copyright (c) 2020-2021, Ctrl IQ, Inc. All rights reserved
+
+package gobuild
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"go/format"
+	"go/token"
+	"io/ioutil"
+	"os/user"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+)
+
+// VersionInfo describes the build of a binary, for stamping into it with -ldflags.
+type VersionInfo struct {
+	Version   string `json:"version"`   // semantic version of HEAD, UntaggedVersion or VersionOverride
+	Commit    string `json:"commit"`    // commit hash of HEAD
+	Date      string `json:"date"`      // committer date of HEAD, in RFC 3339 format
+	Builder   string `json:"builder"`   // name of the user running the build
+	TreeState string `json:"treeState"` // "clean" or "dirty"
+}
+
+// LDFlagVars names the string variables (for example, main.version) that BuildLDFlags sets to
+// each field of a VersionInfo. Variables with empty names are not set.
+type LDFlagVars struct {
+	Version   string
+	Commit    string
+	Date      string
+	Builder   string
+	TreeState string
+}
+
+// NewVersionInfo returns a VersionInfo for HEAD in the git repository containing the current
+// working directory. The date is that of the commit rather than the build, so that it is
+// reproducible.
+//
+// If the version is overridden by VersionOverride or VersionEnv, the repository is not read: the
+// commit and tree state are empty, and the date is that of SOURCE_DATE_EPOCH, if it is set. If
+// there is no git repository and BuildInfoBinary is set, the VersionInfo recorded in that binary
+// is returned, as by BinaryVersionInfo.
+func NewVersionInfo() (*VersionInfo, error) {
+	if v, ok, err := versionOverride(); ok {
+		if err != nil {
+			return nil, err
+		}
+		return overrideVersionInfo(v)
+	}
+
+	gd, err := GitDescribe()
+	if err == git.ErrRepositoryNotExists && BuildInfoBinary != "" {
+		return BinaryVersionInfo(BuildInfoBinary)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	v, err := gitVersion()
+	if err != nil {
+		return nil, err
+	}
+
+	date, err := commitDate(".", gd)
+	if err != nil {
+		return nil, err
+	}
+
+	vi := &VersionInfo{
+		Version:   v,
+		Commit:    gd.CommitHash(),
+		Date:      date,
+		TreeState: "clean",
+	}
+	if !gd.IsClean() {
+		vi.TreeState = "dirty"
+	}
+	if u, err := user.Current(); err == nil {
+		vi.Builder = u.Username
+	}
+	return vi, nil
+}
+
+// overrideVersionInfo returns a VersionInfo of version v, without reading the git repository.
+func overrideVersionInfo(v string) (*VersionInfo, error) {
+	vi := &VersionInfo{Version: v}
+	t, ok, err := sourceDateEpoch()
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		vi.Date = t.Format(time.RFC3339)
+	}
+	if u, err := user.Current(); err == nil {
+		vi.Builder = u.Username
+	}
+	return vi, nil
+}
+
+// BuildLDFlags returns linker flags that set the variables named by vars to the fields of vi, for
+// use as the value of -ldflags.
+func (vi *VersionInfo) BuildLDFlags(vars LDFlagVars) string {
+	var flags []string
+	for _, d := range []struct{ name, value string }{
+		{vars.Version, vi.Version},
+		{vars.Commit, vi.Commit},
+		{vars.Date, vi.Date},
+		{vars.Builder, vi.Builder},
+		{vars.TreeState, vi.TreeState},
+	} {
+		if d.name == "" {
+			continue
+		}
+		// The -ldflags value is split by the go command, not a shell, so quote each definition
+		// in case it contains spaces.
+		flags = append(flags, fmt.Sprintf("-X '%s=%s'", d.name, d.value))
+	}
+	return strings.Join(flags, " ")
+}
+
+// RunBuildWithVersionInfo runs go build with args, setting the variables named by vars to the
+// VersionInfo of HEAD.
+func RunBuildWithVersionInfo(vars LDFlagVars, args ...string) error {
+	vi, err := NewVersionInfo()
+	if err != nil {
+		return err
+	}
+	return RunBuild(append([]string{"-ldflags=" + vi.BuildLDFlags(vars)}, args...)...)
+}
+
+// RunInstallWithVersionInfo runs go install with args, setting the variables named by vars to the
+// VersionInfo of HEAD.
+func RunInstallWithVersionInfo(vars LDFlagVars, args ...string) error {
+	vi, err := NewVersionInfo()
+	if err != nil {
+		return err
+	}
+	return RunInstall(append([]string{"-ldflags=" + vi.BuildLDFlags(vars)}, args...)...)
+}
+
+// WriteVersionFile writes the version of vi, followed by a newline, to the file at path, such as
+// VERSION.
+func (vi *VersionInfo) WriteVersionFile(path string) error {
+	if err := ioutil.WriteFile(path, []byte(vi.Version+"\n"), 0644); err != nil {
+		return fmt.Errorf("while writing %s: %s", path, err)
+	}
+	return nil
+}
+
+// WriteGoFile writes a Go source file to path, such as version.go, in the package named pkg. It
+// declares the constants Version, Commit, Date and TreeState with the fields of vi. The builder is
+// omitted, so that the file does not change between users.
+func (vi *VersionInfo) WriteGoFile(path, pkg string) error {
+	if !token.IsIdentifier(pkg) {
+		return fmt.Errorf("invalid package name %q", pkg)
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "// Code generated by gobuild; DO NOT EDIT.\n\npackage %s\n\n", pkg)
+	fmt.Fprintf(&b, "const (")
+	for _, c := range []struct{ name, doc, value string }{
+		{"Version", "semantic version of the build", vi.Version},
+		{"Commit", "commit hash of the build", vi.Commit},
+		{"Date", "committer date of the commit, in RFC 3339 format", vi.Date},
+		{"TreeState", `state of the working tree of the build, "clean" or "dirty"`, vi.TreeState},
+	} {
+		fmt.Fprintf(&b, "\n\t// %s is the %s.\n\t%s = %s\n", c.name, c.doc, c.name, strconv.Quote(c.value))
+	}
+	fmt.Fprintf(&b, ")\n")
+
+	src, err := format.Source(b.Bytes())
+	if err != nil {
+		return fmt.Errorf("while formatting %s: %s", path, err)
+	}
+	if err := ioutil.WriteFile(path, src, 0644); err != nil {
+		return fmt.Errorf("while writing %s: %s", path, err)
+	}
+	return nil
+}
+
+// WriteJSONFile writes vi to the file at path as a JSON object, with the keys version, commit,
+// date, builder and treeState.
+func (vi *VersionInfo) WriteJSONFile(path string) error {
+	b, err := json.MarshalIndent(vi, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path, append(b, '\n'), 0644); err != nil {
+		return fmt.Errorf("while writing %s: %s", path, err)
+	}
+	return nil
+}
+
+// commitDate returns the committer date of the commit described by gd, in the git repository
+// containing path, in RFC 3339 format.
+func commitDate(path string, gd *GitDescription) (string, error) {
+	repo, err := openRepo(path)
+	if err != nil {
+		return "", err
+	}
+	c, err := repo.CommitObject(gd.Ref())
+	if err != nil {
+		return "", fmt.Errorf("while reading commit %s: %s", gd.Ref(), err)
+	}
+	return c.Committer.When.UTC().Format(time.RFC3339), nil
+}
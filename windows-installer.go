@@ -0,0 +1,363 @@
+// SPDX-License-Identifier: BSD-3-Clause
+// Copyright (c) 2020-2021, Ctrl IQ, Inc. All rights reserved
+
+package gobuild
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/blang/semver"
+)
+
+// WindowsInstallerOptions describes a Windows installer created by CreateMSI or CreateNSIS.
+type WindowsInstallerOptions struct {
+	Name         string // name of the product, which is also the name of the installation directory
+	Manufacturer string // name of the publisher
+	Description  string // short description of the product
+
+	// Version is the semantic version of the product. It defaults to that returned by
+	// CurrentVersion. Windows versions are numeric, so the pre-release and build metadata are
+	// not part of the version fields of installers. As an MSI of a pre-release would therefore
+	// have the same version as the release, and not be upgraded by it, CreateMSI and
+	// WriteWiXSource reject pre-release versions.
+	Version string
+
+	Arch string // architecture of the files, as GOARCH: 386, amd64 (the default) or arm64
+
+	// UpgradeCode is a GUID that identifies the product across versions, so that installing an
+	// MSI of a new version replaces the old one. It is required by CreateMSI, and must never
+	// change once installers have been published.
+	UpgradeCode string
+
+	Files   []string // paths of the files to install, such as built .exe files, named by base name
+	License string   // if set, path of the license shown by the installer; it must be RTF for MSI
+
+	// AddToPath adds the installation directory to the system PATH, and removes it on
+	// uninstallation. It is only supported by CreateMSI.
+	AddToPath bool
+}
+
+// windowsInstallerData is the data of the WiX and NSIS templates.
+type windowsInstallerData struct {
+	WindowsInstallerOptions
+	MSIVersion  string // version in the form major.minor.build used by MSI
+	FileVersion string // version in the form major.minor.build.revision used by version resources
+	Platform    string // WiX platform: x86, x64 or arm64
+	Is64Bit     bool
+	Files       []windowsInstallerFile
+	PathGUID    string // GUID of the component that adds the installation directory to PATH
+	OutFile     string // absolute path of the installer, for NSIS
+
+	version semver.Version
+}
+
+// windowsInstallerFile is a file installed by a Windows installer.
+type windowsInstallerFile struct {
+	ID   string // identifier of the file and its component in WiX sources
+	GUID string // GUID of the component of the file
+	Name string // base name of the file in the installation directory
+	Path string // absolute path of the file
+}
+
+// newWindowsInstallerData returns the template data for opts.
+func newWindowsInstallerData(opts WindowsInstallerOptions) (*windowsInstallerData, error) {
+	if opts.Name == "" {
+		return nil, fmt.Errorf("no product name set")
+	}
+	if opts.Version == "" {
+		v, err := CurrentVersion()
+		if err != nil {
+			return nil, err
+		}
+		opts.Version = v
+	}
+	v, err := semver.Parse(strings.TrimPrefix(opts.Version, "v"))
+	if err != nil {
+		return nil, fmt.Errorf("while parsing version: %s", err)
+	}
+	if v.Major > 255 || v.Minor > 255 || v.Patch > 65535 {
+		return nil, fmt.Errorf("version %s is too large for Windows installers", v)
+	}
+
+	d := &windowsInstallerData{
+		WindowsInstallerOptions: opts,
+		MSIVersion:              fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch),
+		FileVersion:             fmt.Sprintf("%d.%d.%d.0", v.Major, v.Minor, v.Patch),
+		version:                 v,
+	}
+	switch opts.Arch {
+	case "386":
+		d.Platform = "x86"
+	case "", "amd64":
+		d.Platform, d.Is64Bit = "x64", true
+	case "arm64":
+		d.Platform, d.Is64Bit = "arm64", true
+	default:
+		return nil, fmt.Errorf("%w: %s for Windows installers", ErrUnsupportedArch, opts.Arch)
+	}
+
+	if d.License != "" {
+		if d.License, err = filepath.Abs(d.License); err != nil {
+			return nil, err
+		}
+	}
+	seen := make(map[string]bool)
+	for i, p := range opts.Files {
+		abs, err := filepath.Abs(p)
+		if err != nil {
+			return nil, err
+		}
+		name := filepath.Base(p)
+		if seen[strings.ToLower(name)] {
+			return nil, fmt.Errorf("more than one file is named %s", name)
+		}
+		seen[strings.ToLower(name)] = true
+
+		d.Files = append(d.Files, windowsInstallerFile{
+			ID:   fmt.Sprintf("File%d", i),
+			GUID: nameGUID(opts.UpgradeCode, "file:"+strings.ToLower(name)),
+			Name: name,
+			Path: abs,
+		})
+	}
+	d.PathGUID = nameGUID(opts.UpgradeCode, "path")
+	return d, nil
+}
+
+// nameGUID returns a GUID derived from the SHA-1 hash of namespace and name, in the manner of a
+// version 5 UUID, so that the GUIDs of components are stable across builds of a product.
+func nameGUID(namespace, name string) string {
+	h := sha1.Sum([]byte(strings.ToUpper(namespace) + "\x00" + name))
+	h[6] = h[6]&0x0f | 0x50
+	h[8] = h[8]&0x3f | 0x80
+	return strings.ToUpper(fmt.Sprintf("%x-%x-%x-%x-%x", h[0:4], h[4:6], h[6:8], h[8:10], h[10:16]))
+}
+
+// xmlEscape returns s escaped for use in XML text and attribute values.
+func xmlEscape(s string) string {
+	var b bytes.Buffer
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// nsisEscape returns s escaped for use in a quoted NSIS string, in which variables are not
+// expanded.
+func nsisEscape(s string) string {
+	return strings.NewReplacer("$", "$$", `"`, `$\"`, "\r", `$\r`, "\n", `$\n`, "\t", `$\t`).Replace(s)
+}
+
+// nsisQuote returns s as a quoted NSIS string, in which variables are not expanded.
+func nsisQuote(s string) string {
+	return `"` + nsisEscape(s) + `"`
+}
+
+var wixTemplate = template.Must(template.New("wxs").Funcs(template.FuncMap{"xml": xmlEscape}).Parse(
+	`<?xml version="1.0" encoding="UTF-8"?>
+<Wix xmlns="http://schemas.microsoft.com/wix/2006/wi">
+  <Product Id="*" Name="{{ xml .Name }}" Version="{{ .MSIVersion }}" Manufacturer="{{ xml .Manufacturer }}" Language="1033" UpgradeCode="{{ .UpgradeCode }}">
+    <Package InstallerVersion="500" Compressed="yes" InstallScope="perMachine" Platform="{{ .Platform }}" Description="{{ xml .Description }}" Manufacturer="{{ xml .Manufacturer }}"/>
+    <MajorUpgrade DowngradeErrorMessage="A newer version of {{ xml .Name }} is already installed."/>
+    <MediaTemplate EmbedCab="yes"/>
+    <Directory Id="TARGETDIR" Name="SourceDir">
+      <Directory Id="{{ if .Is64Bit }}ProgramFiles64Folder{{ else }}ProgramFilesFolder{{ end }}">
+        <Directory Id="INSTALLDIR" Name="{{ xml .Name }}">
+{{- range .Files }}
+          <Component Id="{{ .ID }}" Guid="{{ .GUID }}">
+            <File Id="{{ .ID }}" Name="{{ xml .Name }}" Source="{{ xml .Path }}" KeyPath="yes"/>
+          </Component>
+{{- end }}
+{{- if .AddToPath }}
+          <Component Id="Path" Guid="{{ .PathGUID }}">
+            <CreateFolder/>
+            <Environment Id="Path" Name="PATH" Value="[INSTALLDIR]" Action="set" Part="last" System="yes" Permanent="no"/>
+          </Component>
+{{- end }}
+        </Directory>
+      </Directory>
+    </Directory>
+    <Feature Id="Complete" Level="1">
+{{- range .Files }}
+      <ComponentRef Id="{{ .ID }}"/>
+{{- end }}
+{{- if .AddToPath }}
+      <ComponentRef Id="Path"/>
+{{- end }}
+    </Feature>
+{{- if .License }}
+    <WixVariable Id="WixUILicenseRtf" Value="{{ xml .License }}"/>
+    <UIRef Id="WixUI_Minimal"/>
+{{- end }}
+  </Product>
+</Wix>
+`))
+
+var nsisTemplate = template.Must(template.New("nsi").Funcs(template.FuncMap{"q": nsisQuote, "e": nsisEscape}).Parse(
+	`Unicode true
+Name {{ q .Name }}
+OutFile {{ q .OutFile }}
+InstallDir "{{ if .Is64Bit }}$PROGRAMFILES64{{ else }}$PROGRAMFILES{{ end }}\{{ e .Name }}"
+RequestExecutionLevel admin
+SetCompressor /SOLID lzma
+
+VIProductVersion {{ q .FileVersion }}
+VIAddVersionKey "ProductName" {{ q .Name }}
+VIAddVersionKey "CompanyName" {{ q .Manufacturer }}
+VIAddVersionKey "FileDescription" {{ q .Description }}
+VIAddVersionKey "FileVersion" {{ q .Version }}
+VIAddVersionKey "ProductVersion" {{ q .Version }}
+{{ if .License }}
+LicenseData {{ q .License }}
+Page license
+{{- end }}
+Page directory
+Page instfiles
+UninstPage uninstConfirm
+UninstPage instfiles
+
+!define UNINSTALL_KEY {{ q (print "Software\\Microsoft\\Windows\\CurrentVersion\\Uninstall\\" .Name) }}
+{{ if .Is64Bit }}
+Function .onInit
+  SetRegView 64
+FunctionEnd
+
+Function un.onInit
+  SetRegView 64
+FunctionEnd
+{{ end }}
+Section
+  SetOutPath "$INSTDIR"
+{{- range .Files }}
+  File {{ q (print "/oname=" .Name) }} {{ q .Path }}
+{{- end }}
+  WriteUninstaller "$INSTDIR\uninstall.exe"
+  WriteRegStr HKLM "${UNINSTALL_KEY}" "DisplayName" {{ q .Name }}
+  WriteRegStr HKLM "${UNINSTALL_KEY}" "DisplayVersion" {{ q .Version }}
+  WriteRegStr HKLM "${UNINSTALL_KEY}" "Publisher" {{ q .Manufacturer }}
+  WriteRegStr HKLM "${UNINSTALL_KEY}" "UninstallString" '"$INSTDIR\uninstall.exe"'
+  WriteRegDWORD HKLM "${UNINSTALL_KEY}" "NoModify" 1
+  WriteRegDWORD HKLM "${UNINSTALL_KEY}" "NoRepair" 1
+SectionEnd
+
+Section "Uninstall"
+{{- range .Files }}
+  Delete "$INSTDIR\{{ e .Name }}"
+{{- end }}
+  Delete "$INSTDIR\uninstall.exe"
+  RMDir "$INSTDIR"
+  DeleteRegKey HKLM "${UNINSTALL_KEY}"
+SectionEnd
+`))
+
+// WriteWiXSource writes the WiX source of an MSI installer described by opts to w, for building
+// with the WiX toolset (candle and light) or wixl from msitools.
+func WriteWiXSource(w io.Writer, opts WindowsInstallerOptions) error {
+	d, err := newWindowsInstallerData(opts)
+	if err != nil {
+		return err
+	}
+	if d.UpgradeCode == "" {
+		return fmt.Errorf("no upgrade code set")
+	}
+	if len(d.version.Pre) > 0 {
+		return fmt.Errorf("pre-release version %s cannot be used for MSI installers", d.version)
+	}
+	return wixTemplate.Execute(w, d)
+}
+
+// WriteNSISScript writes an NSIS script of an installer described by opts, which writes the
+// installer to outFile, to w.
+func WriteNSISScript(w io.Writer, outFile string, opts WindowsInstallerOptions) error {
+	if opts.AddToPath {
+		return fmt.Errorf("adding to PATH is not supported by NSIS installers")
+	}
+	d, err := newWindowsInstallerData(opts)
+	if err != nil {
+		return err
+	}
+	if d.OutFile, err = filepath.Abs(outFile); err != nil {
+		return err
+	}
+	return nsisTemplate.Execute(w, d)
+}
+
+// CreateMSI creates an MSI installer described by opts at path. It is built with wixl from
+// msitools if it is installed, which runs on Linux, or otherwise with candle and light from the
+// WiX toolset. A license requires the WiX toolset, as wixl does not support its user interface.
+func CreateMSI(path string, opts WindowsInstallerOptions) error {
+	dir, err := ioutil.TempDir("", "gobuild-msi")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	d, err := newWindowsInstallerData(opts)
+	if err != nil {
+		return err
+	}
+	var b bytes.Buffer
+	if err := WriteWiXSource(&b, opts); err != nil {
+		return err
+	}
+	src := filepath.Join(dir, "product.wxs")
+	if err := ioutil.WriteFile(src, b.Bytes(), 0644); err != nil {
+		return err
+	}
+
+	if _, err := exec.LookPath("wixl"); err == nil && opts.License == "" {
+		return runInstallerTool("wixl", "--arch", d.Platform, "-o", path, src)
+	}
+	if _, err := exec.LookPath("candle"); err != nil {
+		return fmt.Errorf("neither wixl nor the WiX toolset is installed")
+	}
+	obj := filepath.Join(dir, "product.wixobj")
+	if err := runInstallerTool("candle", "-nologo", "-arch", d.Platform, "-out", obj, src); err != nil {
+		return err
+	}
+	args := []string{"-nologo", "-out", path}
+	if opts.License != "" {
+		args = append(args, "-ext", "WixUIExtension")
+	}
+	return runInstallerTool("light", append(args, obj)...)
+}
+
+// CreateNSIS creates an NSIS installer described by opts at path, with makensis.
+func CreateNSIS(path string, opts WindowsInstallerOptions) error {
+	f, err := ioutil.TempFile("", "gobuild-*.nsi")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	err = WriteNSISScript(f, path, opts)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return runInstallerTool("makensis", "-V2", f.Name())
+}
+
+// runInstallerTool runs the installer tool name with args, and returns an error including its
+// output if it fails.
+func runInstallerTool(name string, args ...string) error {
+	Log.Infof("exec: %s %s", name, strings.Join(args, " "))
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		if msg := strings.TrimSpace(string(out)); msg != "" {
+			return fmt.Errorf("%s: %s: %s", name, err, msg)
+		}
+		return fmt.Errorf("%s: %s", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+// SPDX-License-Identifier: BSD-3-Clause
+// Copyright (c) 2020-2021, Ctrl IQ, Inc. All rights reserved
+
+package gobuild
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestWriteWiXSourceVersion(t *testing.T) {
+	tests := []struct {
+		version string
+		want    string
+		wantErr bool
+	}{
+		{version: "1.2.3", want: `Version="1.2.3"`},
+		{version: "v1.2.3+dirty", want: `Version="1.2.3"`},
+		{version: "1.2.4-devel.3", wantErr: true},
+		{version: "1.2.3-rc.1", wantErr: true},
+	}
+	for _, tt := range tests {
+		opts := WindowsInstallerOptions{
+			Name:        "tool",
+			Version:     tt.version,
+			UpgradeCode: "2b7c1e64-8f0d-4b9e-9c37-6f1d8c2a0e51",
+		}
+		// NSIS installers have no upgrade semantics, so pre-releases are accepted.
+		if err := WriteNSISScript(ioutil.Discard, "tool.exe", opts); err != nil {
+			t.Errorf("%s: %s", tt.version, err)
+		}
+
+		var b strings.Builder
+		err := WriteWiXSource(&b, opts)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: no error", tt.version)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %s", tt.version, err)
+		}
+		if !strings.Contains(b.String(), tt.want) {
+			t.Errorf("%s: %s not found in:\n%s", tt.version, tt.want, b.String())
+		}
+	}
+}
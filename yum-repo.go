@@ -0,0 +1,503 @@
+// SPDX-License-Identifier: BSD-3-Clause
+// Copyright (c) 2020-2021, Ctrl IQ, Inc. All rights reserved
+
+package gobuild
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CreateYumRepo writes the metadata of a YUM/DNF repository of the RPM packages in dir and its
+// subdirectories to dir/repodata, replacing any metadata already there. The metadata is compatible
+// with that written by createrepo_c, so dir can be published as a repository without other tools.
+// If the SOURCE_DATE_EPOCH environment variable is set, it is used as the time of the metadata.
+func CreateYumRepo(dir string) error {
+	now, ok, err := sourceDateEpoch()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		now = time.Now()
+	}
+
+	var pkgs []*yumPackage
+	err = filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() && p != dir && (fi.Name() == "repodata" || strings.HasPrefix(fi.Name(), ".repodata")) {
+			return filepath.SkipDir
+		}
+		if !fi.Mode().IsRegular() || !strings.HasSuffix(p, ".rpm") {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		pkg, err := readYumPackage(p, filepath.ToSlash(rel), fi)
+		if err != nil {
+			return fmt.Errorf("while reading %s: %s", p, err)
+		}
+		pkgs = append(pkgs, pkg)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Slice(pkgs, func(i, j int) bool { return pkgs[i].Location.Href < pkgs[j].Location.Href })
+
+	// Write the metadata to a new directory, and then replace the old one with it, so that the
+	// repository is never left with partial metadata.
+	tmp := filepath.Join(dir, ".repodata")
+	if err := os.RemoveAll(tmp); err != nil {
+		return err
+	}
+	if err := os.Mkdir(tmp, 0755); err != nil {
+		return fmt.Errorf("while creating %s: %s", tmp, err)
+	}
+	defer os.RemoveAll(tmp)
+
+	repomd := yumRepomd{
+		Xmlns:    "http://linux.duke.edu/metadata/repo",
+		XmlnsRPM: "http://linux.duke.edu/metadata/rpm",
+		Revision: now.Unix(),
+	}
+	for _, md := range []struct {
+		typ string
+		v   interface{}
+	}{
+		{"primary", newYumPrimary(pkgs)},
+		{"filelists", newYumFilelists(pkgs)},
+		{"other", newYumOther(pkgs)},
+	} {
+		data, err := writeYumMetadata(tmp, md.typ, md.v)
+		if err != nil {
+			return err
+		}
+		data.Timestamp = now.Unix()
+		repomd.Data = append(repomd.Data, data)
+	}
+
+	b, err := xml.MarshalIndent(repomd, "", "  ")
+	if err != nil {
+		return fmt.Errorf("while encoding repomd.xml: %s", err)
+	}
+	b = append([]byte(xml.Header), append(b, '\n')...)
+	if err := ioutil.WriteFile(filepath.Join(tmp, "repomd.xml"), b, 0644); err != nil {
+		return fmt.Errorf("while writing repomd.xml: %s", err)
+	}
+
+	repodata := filepath.Join(dir, "repodata")
+	if err := os.RemoveAll(repodata); err != nil {
+		return fmt.Errorf("while removing %s: %s", repodata, err)
+	}
+	if err := os.Rename(tmp, repodata); err != nil {
+		return fmt.Errorf("while renaming %s: %s", tmp, err)
+	}
+	return nil
+}
+
+// writeYumMetadata writes v as the gzip compressed metadata of type typ to dir, in a file named by
+// its checksum as createrepo_c does, and returns its entry in repomd.xml.
+func writeYumMetadata(dir, typ string, v interface{}) (yumRepomdData, error) {
+	b, err := xml.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return yumRepomdData{}, fmt.Errorf("while encoding %s metadata: %s", typ, err)
+	}
+	b = append([]byte(xml.Header), append(b, '\n')...)
+
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write(b)
+	if err := w.Close(); err != nil {
+		return yumRepomdData{}, fmt.Errorf("while compressing %s metadata: %s", typ, err)
+	}
+
+	sum := fmt.Sprintf("%x", sha256.Sum256(gz.Bytes()))
+	name := sum + "-" + typ + ".xml.gz"
+	if err := ioutil.WriteFile(filepath.Join(dir, name), gz.Bytes(), 0644); err != nil {
+		return yumRepomdData{}, fmt.Errorf("while writing %s: %s", name, err)
+	}
+
+	return yumRepomdData{
+		Type:         typ,
+		Checksum:     yumChecksum{Type: "sha256", Value: sum},
+		OpenChecksum: yumChecksum{Type: "sha256", Value: fmt.Sprintf("%x", sha256.Sum256(b))},
+		Location:     yumLocation{Href: "repodata/" + name},
+		Size:         gz.Len(),
+		OpenSize:     len(b),
+	}, nil
+}
+
+// yumPackage is the metadata of a package in a YUM repository.
+type yumPackage struct {
+	Type        string      `xml:"type,attr"`
+	Name        string      `xml:"name"`
+	Arch        string      `xml:"arch"`
+	Version     yumVersion  `xml:"version"`
+	Checksum    yumChecksum `xml:"checksum"`
+	Summary     string      `xml:"summary"`
+	Description string      `xml:"description"`
+	Packager    string      `xml:"packager"`
+	URL         string      `xml:"url"`
+	Time        struct {
+		File  int64 `xml:"file,attr"`
+		Build int64 `xml:"build,attr"`
+	} `xml:"time"`
+	Size struct {
+		Package   int64 `xml:"package,attr"`
+		Installed int64 `xml:"installed,attr"`
+		Archive   int64 `xml:"archive,attr"`
+	} `xml:"size"`
+	Location yumLocation `xml:"location"`
+	Format   struct {
+		License     string `xml:"rpm:license"`
+		Vendor      string `xml:"rpm:vendor"`
+		Group       string `xml:"rpm:group"`
+		BuildHost   string `xml:"rpm:buildhost"`
+		SourceRPM   string `xml:"rpm:sourcerpm"`
+		HeaderRange struct {
+			Start int `xml:"start,attr"`
+			End   int `xml:"end,attr"`
+		} `xml:"rpm:header-range"`
+		Provides    *yumEntries `xml:"rpm:provides,omitempty"`
+		Requires    *yumEntries `xml:"rpm:requires,omitempty"`
+		Conflicts   *yumEntries `xml:"rpm:conflicts,omitempty"`
+		Obsoletes   *yumEntries `xml:"rpm:obsoletes,omitempty"`
+		Suggests    *yumEntries `xml:"rpm:suggests,omitempty"`
+		Enhances    *yumEntries `xml:"rpm:enhances,omitempty"`
+		Recommends  *yumEntries `xml:"rpm:recommends,omitempty"`
+		Supplements *yumEntries `xml:"rpm:supplements,omitempty"`
+		Files       []yumFile   `xml:"file"` // files listed in primary.xml
+	} `xml:"format"`
+
+	files      []yumFile      // all files, listed in filelists.xml
+	changelogs []yumChangelog // listed in other.xml
+}
+
+type yumVersion struct {
+	Epoch string `xml:"epoch,attr"`
+	Ver   string `xml:"ver,attr"`
+	Rel   string `xml:"rel,attr"`
+}
+
+type yumChecksum struct {
+	Type  string `xml:"type,attr"`
+	PkgID string `xml:"pkgid,attr,omitempty"`
+	Value string `xml:",chardata"`
+}
+
+type yumLocation struct {
+	Href string `xml:"href,attr"`
+}
+
+type yumEntries struct {
+	Entries []yumEntry `xml:"rpm:entry"`
+}
+
+type yumEntry struct {
+	Name  string `xml:"name,attr"`
+	Flags string `xml:"flags,attr,omitempty"`
+	Epoch string `xml:"epoch,attr,omitempty"`
+	Ver   string `xml:"ver,attr,omitempty"`
+	Rel   string `xml:"rel,attr,omitempty"`
+	Pre   string `xml:"pre,attr,omitempty"`
+}
+
+type yumFile struct {
+	Type string `xml:"type,attr,omitempty"`
+	Path string `xml:",chardata"`
+}
+
+type yumChangelog struct {
+	Author string `xml:"author,attr"`
+	Date   int64  `xml:"date,attr"`
+	Text   string `xml:",chardata"`
+}
+
+// readYumPackage returns the metadata of the RPM at path, whose location in the repository is href.
+func readYumPackage(path, href string, fi os.FileInfo) (*yumPackage, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	r := bufio.NewReader(io.TeeReader(f, hash))
+	sig, h, start, end, err := readRPMHeaders(r)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(ioutil.Discard, r); err != nil {
+		return nil, err
+	}
+
+	str := func(tag int32) string {
+		if s := h[tag].strings(); len(s) > 0 {
+			return s[0]
+		}
+		return ""
+	}
+	num := func(h map[int32]rpmHeaderEntry, tag int32) int64 {
+		if v := h[tag].ints(); len(v) > 0 {
+			return v[0]
+		}
+		return 0
+	}
+
+	sum := fmt.Sprintf("%x", hash.Sum(nil))
+	pkg := &yumPackage{
+		Type: "rpm",
+		Name: str(rpmTagName),
+		Arch: str(rpmTagArch),
+		Version: yumVersion{
+			Epoch: strconv.FormatInt(num(h, rpmTagEpoch), 10),
+			Ver:   str(rpmTagVersion),
+			Rel:   str(rpmTagRelease),
+		},
+		Checksum:    yumChecksum{Type: "sha256", PkgID: "YES", Value: sum},
+		Summary:     str(rpmTagSummary),
+		Description: str(rpmTagDescription),
+		Packager:    str(rpmTagPackager),
+		URL:         str(rpmTagURL),
+		Location:    yumLocation{Href: href},
+	}
+	if _, ok := h[rpmTagSourcePackage]; ok || str(rpmTagSourceRPM) == "" {
+		pkg.Arch = "src"
+	}
+
+	pkg.Time.File = fi.ModTime().Unix()
+	pkg.Time.Build = num(h, rpmTagBuildTime)
+	pkg.Size.Package = fi.Size()
+	pkg.Size.Installed = num(h, rpmTagSize)
+	if pkg.Size.Installed == 0 {
+		pkg.Size.Installed = num(h, rpmTagLongSize)
+	}
+	pkg.Size.Archive = num(sig, rpmSigPayloadSize)
+
+	pkg.Format.License = str(rpmTagLicense)
+	pkg.Format.Vendor = str(rpmTagVendor)
+	pkg.Format.Group = str(rpmTagGroup)
+	pkg.Format.BuildHost = str(rpmTagBuildHost)
+	pkg.Format.SourceRPM = str(rpmTagSourceRPM)
+	pkg.Format.HeaderRange.Start = start
+	pkg.Format.HeaderRange.End = end
+
+	pkg.Format.Provides = yumDependencies(h, rpmTagProvideName, rpmTagProvideFlags, rpmTagProvideVersion)
+	pkg.Format.Requires = yumDependencies(h, rpmTagRequireName, rpmTagRequireFlags, rpmTagRequireVersion)
+	pkg.Format.Conflicts = yumDependencies(h, rpmTagConflictName, rpmTagConflictFlags, rpmTagConflictVersion)
+	pkg.Format.Obsoletes = yumDependencies(h, rpmTagObsoleteName, rpmTagObsoleteFlags, rpmTagObsoleteVersion)
+	pkg.Format.Suggests = yumDependencies(h, rpmTagSuggestName, rpmTagSuggestFlags, rpmTagSuggestVersion)
+	pkg.Format.Enhances = yumDependencies(h, rpmTagEnhanceName, rpmTagEnhanceFlags, rpmTagEnhanceVersion)
+	pkg.Format.Recommends = yumDependencies(h, rpmTagRecommendName, rpmTagRecommendFlags, rpmTagRecommendVersion)
+	pkg.Format.Supplements = yumDependencies(h, rpmTagSupplementName, rpmTagSupplementFlags, rpmTagSupplementVersion)
+
+	pkg.files = yumFiles(h)
+	for _, f := range pkg.files {
+		// Like createrepo_c, list files that are commonly required by path in primary.xml.
+		if strings.Contains(f.Path, "bin/") || strings.HasPrefix(f.Path, "/etc/") || f.Path == "/usr/lib/sendmail" {
+			pkg.Format.Files = append(pkg.Format.Files, f)
+		}
+	}
+
+	times := h[rpmTagChangelogTime].ints()
+	names := h[rpmTagChangelogName].strings()
+	texts := h[rpmTagChangelogText].strings()
+	for i := range times {
+		if i < len(names) && i < len(texts) {
+			pkg.changelogs = append(pkg.changelogs, yumChangelog{names[i], times[i], texts[i]})
+		}
+	}
+
+	return pkg, nil
+}
+
+// yumDependencies returns the dependencies in the given tags of h, or nil if there are none.
+// Dependencies on rpmlib features are left out, as createrepo_c does.
+func yumDependencies(h map[int32]rpmHeaderEntry, nameTag, flagsTag, versionTag int32) *yumEntries {
+	names := h[nameTag].strings()
+	flags := h[flagsTag].ints()
+	versions := h[versionTag].strings()
+
+	var deps yumEntries
+	seen := make(map[yumEntry]bool)
+	for i, name := range names {
+		if strings.HasPrefix(name, "rpmlib(") {
+			continue
+		}
+
+		e := yumEntry{Name: name}
+		var f int64
+		if i < len(flags) {
+			f = flags[i]
+		}
+		if i < len(versions) && versions[i] != "" {
+			e.Flags = map[int64]string{
+				rpmSenseLess:                    "LT",
+				rpmSenseGreater:                 "GT",
+				rpmSenseEqual:                   "EQ",
+				rpmSenseLess | rpmSenseEqual:    "LE",
+				rpmSenseGreater | rpmSenseEqual: "GE",
+			}[f&(rpmSenseLess|rpmSenseGreater|rpmSenseEqual)]
+			e.Epoch, e.Ver, e.Rel = splitEVR(versions[i])
+		}
+		if nameTag == rpmTagRequireName && f&(rpmSensePrereq|rpmSensePre|rpmSensePost|rpmSensePreun|rpmSensePostun) != 0 {
+			e.Pre = "1"
+		}
+
+		if !seen[e] {
+			seen[e] = true
+			deps.Entries = append(deps.Entries, e)
+		}
+	}
+
+	if len(deps.Entries) == 0 {
+		return nil
+	}
+	return &deps
+}
+
+// splitEVR splits a version of the form [epoch:]version[-release]. The epoch defaults to 0.
+func splitEVR(evr string) (epoch, version, release string) {
+	epoch = "0"
+	if i := strings.Index(evr, ":"); i >= 0 {
+		epoch, evr = evr[:i], evr[i+1:]
+	}
+	if i := strings.LastIndex(evr, "-"); i >= 0 {
+		return epoch, evr[:i], evr[i+1:]
+	}
+	return epoch, evr, ""
+}
+
+// yumFiles returns the files in the header h.
+func yumFiles(h map[int32]rpmHeaderEntry) []yumFile {
+	names := h[rpmTagOldFileNames].strings()
+	if base := h[rpmTagBaseNames].strings(); len(base) > 0 {
+		dirs := h[rpmTagDirNames].strings()
+		indexes := h[rpmTagDirIndexes].ints()
+		names = make([]string, len(base))
+		for i, b := range base {
+			if i < len(indexes) && int(indexes[i]) < len(dirs) {
+				names[i] = dirs[indexes[i]] + b
+			}
+		}
+	}
+
+	modes := h[rpmTagFileModes].ints()
+	flags := h[rpmTagFileFlags].ints()
+	files := make([]yumFile, 0, len(names))
+	for i, name := range names {
+		f := yumFile{Path: name}
+		switch {
+		case i < len(flags) && flags[i]&rpmFileGhost != 0:
+			f.Type = "ghost"
+		case i < len(modes) && modes[i]&0170000 == rpmModeDir:
+			f.Type = "dir"
+		}
+		files = append(files, f)
+	}
+	return files
+}
+
+type yumPrimary struct {
+	XMLName  xml.Name      `xml:"metadata"`
+	Xmlns    string        `xml:"xmlns,attr"`
+	XmlnsRPM string        `xml:"xmlns:rpm,attr"`
+	Packages int           `xml:"packages,attr"`
+	Package  []*yumPackage `xml:"package"`
+}
+
+func newYumPrimary(pkgs []*yumPackage) yumPrimary {
+	return yumPrimary{
+		Xmlns:    "http://linux.duke.edu/metadata/common",
+		XmlnsRPM: "http://linux.duke.edu/metadata/rpm",
+		Packages: len(pkgs),
+		Package:  pkgs,
+	}
+}
+
+// yumPackageRef identifies a package in filelists.xml and other.xml.
+type yumPackageRef struct {
+	PkgID   string     `xml:"pkgid,attr"`
+	Name    string     `xml:"name,attr"`
+	Arch    string     `xml:"arch,attr"`
+	Version yumVersion `xml:"version"`
+}
+
+func newYumPackageRef(pkg *yumPackage) yumPackageRef {
+	return yumPackageRef{PkgID: pkg.Checksum.Value, Name: pkg.Name, Arch: pkg.Arch, Version: pkg.Version}
+}
+
+type yumFilelists struct {
+	XMLName  xml.Name              `xml:"filelists"`
+	Xmlns    string                `xml:"xmlns,attr"`
+	Packages int                   `xml:"packages,attr"`
+	Package  []yumFilelistsPackage `xml:"package"`
+}
+
+type yumFilelistsPackage struct {
+	yumPackageRef
+	Files []yumFile `xml:"file"`
+}
+
+func newYumFilelists(pkgs []*yumPackage) yumFilelists {
+	fl := yumFilelists{Xmlns: "http://linux.duke.edu/metadata/filelists", Packages: len(pkgs)}
+	for _, pkg := range pkgs {
+		fl.Package = append(fl.Package, yumFilelistsPackage{newYumPackageRef(pkg), pkg.files})
+	}
+	return fl
+}
+
+type yumOther struct {
+	XMLName  xml.Name          `xml:"otherdata"`
+	Xmlns    string            `xml:"xmlns,attr"`
+	Packages int               `xml:"packages,attr"`
+	Package  []yumOtherPackage `xml:"package"`
+}
+
+type yumOtherPackage struct {
+	yumPackageRef
+	Changelogs []yumChangelog `xml:"changelog"`
+}
+
+func newYumOther(pkgs []*yumPackage) yumOther {
+	o := yumOther{Xmlns: "http://linux.duke.edu/metadata/other", Packages: len(pkgs)}
+	for _, pkg := range pkgs {
+		o.Package = append(o.Package, yumOtherPackage{newYumPackageRef(pkg), pkg.changelogs})
+	}
+	return o
+}
+
+type yumRepomd struct {
+	XMLName  xml.Name        `xml:"repomd"`
+	Xmlns    string          `xml:"xmlns,attr"`
+	XmlnsRPM string          `xml:"xmlns:rpm,attr"`
+	Revision int64           `xml:"revision"`
+	Data     []yumRepomdData `xml:"data"`
+}
+
+type yumRepomdData struct {
+	Type         string      `xml:"type,attr"`
+	Checksum     yumChecksum `xml:"checksum"`
+	OpenChecksum yumChecksum `xml:"open-checksum"`
+	Location     yumLocation `xml:"location"`
+	Timestamp    int64       `xml:"timestamp"`
+	Size         int         `xml:"size"`
+	OpenSize     int         `xml:"open-size"`
+}